@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"pageer/myfinemu/internal/asm"
+)
+
+func runAsm(args []string) error {
+	flags := flag.NewFlagSet("asm", flag.ExitOnError)
+	output := flags.String("o", "a.bin", "File to write the assembled bytes to")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: asm [-o FILE] <source-file>")
+	}
+
+	source, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	program, err := asm.AssembleVariant(string(source), cpu_variant)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(*output, program.Bytes, 0644)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"pageer/myfinemu/internal/bench"
+)
+
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	frames := flags.Int("frames", 600, "Frames to run each program for")
+	workload := flags.String("workload", "", "Only run this built-in workload (default: all of them)")
+	save := flags.String("save", "", "Save the results as JSON, for use as a baseline")
+	baseline := flags.String("baseline", "", "Compare against results saved with -save, failing on regressions")
+	tolerance := flags.Float64("tolerance", bench.DEFAULT_TOLERANCE, "Percentage slowdown allowed against the baseline")
+	flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		return errors.New("Usage: bench [-frames N] [-workload NAME] [-save FILE] [-baseline FILE] [-tolerance PERCENT] [rom-or-source-file]")
+	}
+
+	var results []bench.Result
+	if flags.NArg() == 1 {
+		c, _, err := loadProgram(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		result, err := bench.RunFrames(c, filepath.Base(flags.Arg(0)), *frames)
+		fmt.Println(result)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	} else {
+		workloads := bench.WORKLOADS
+		if *workload != "" {
+			w, ok := bench.FindWorkload(*workload)
+			if !ok {
+				return fmt.Errorf("Unknown workload %q", *workload)
+			}
+			workloads = []bench.Workload{w}
+		}
+		for _, w := range workloads {
+			c, err := w.Load(region)
+			if err != nil {
+				return err
+			}
+			c.CPU.SetLogger(logger)
+			c.CPU.SetIllegalOpcodePolicy(illegal_policy)
+			c.CPU.SetCoreMode(core_mode)
+			result, err := bench.RunFrames(c, w.Name, *frames)
+			if err != nil {
+				return fmt.Errorf("%s: %w", w.Name, err)
+			}
+			fmt.Println(result)
+			results = append(results, result)
+		}
+	}
+
+	if *save != "" {
+		err := bench.SaveResults(*save, results)
+		if err != nil {
+			return err
+		}
+	}
+	if *baseline != "" {
+		base, err := bench.LoadResults(*baseline)
+		if err != nil {
+			return err
+		}
+		regressions := bench.Compare(base, results, *tolerance)
+		for _, r := range regressions {
+			fmt.Println("Regression:", r)
+		}
+		if len(regressions) > 0 {
+			return fmt.Errorf("%d benchmark(s) slower than the baseline", len(regressions))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"pageer/myfinemu/internal/testrom"
+)
+
+func runBlargg(args []string) error {
+	flags := flag.NewFlagSet("blargg", flag.ExitOnError)
+	max_cycles := flags.Int("max-cycles", testrom.DEFAULT_MAX_CYCLES, "Give up after this many CPU cycles")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blargg [-max-cycles N] <rom-file-or-directory>")
+	}
+
+	runner := testrom.NewBlarggRunner()
+	runner.MaxCycles = *max_cycles
+	runner.Region = region
+
+	path := flags.Arg(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var results []testrom.Result
+	if info.IsDir() {
+		results, err = runner.RunDirectory(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		result := runner.RunFile(path)
+		fmt.Println(result.Message)
+		results = []testrom.Result{result}
+	}
+
+	testrom.WriteMatrix(os.Stdout, results)
+
+	for _, result := range results {
+		if !result.Passed() {
+			return errors.New("One or more tests failed")
+		}
+	}
+	return nil
+}
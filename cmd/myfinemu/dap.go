@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"pageer/myfinemu/internal/dap"
+)
+
+// Editors start the adapter as a subprocess and talk to it over stdio.
+func runDap(args []string) error {
+	flags := flag.NewFlagSet("dap", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("Usage: dap")
+	}
+	return dap.Serve(os.Stdin, os.Stdout)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"pageer/myfinemu/internal/debugger"
+	"pageer/myfinemu/internal/gdbstub"
+)
+
+func runDebug(args []string) error {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	gdb_address := flags.String("gdb", "", "Listen for a GDB remote client on this address, e.g. localhost:1234")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: debug [-gdb ADDRESS] <rom-or-source-file>")
+	}
+
+	c, symbols, err := loadProgram(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	d := debugger.New(c.CPU)
+	d.Symbols = symbols
+	d.Cheats = cheats
+
+	if *gdb_address != "" {
+		fmt.Fprintf(os.Stderr, "Waiting for GDB connection on %s\n", *gdb_address)
+		return gdbstub.ListenAndServe(*gdb_address, d)
+	}
+
+	d.Repl(os.Stdin, os.Stdout)
+	return nil
+}
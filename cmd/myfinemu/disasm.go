@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"pageer/myfinemu/internal/cartridge"
+	"pageer/myfinemu/internal/core"
+)
+
+func runDisasm(args []string) error {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	start := flags.String("start", "", "First address to disassemble (default: reset vector)")
+	end := flags.String("end", "ffff", "Last address to disassemble")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: disasm [-start ADDR] [-end ADDR] <rom-file>")
+	}
+
+	cart, err := cartridge.Load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	c := core.NewCPU()
+	err = c.LoadPRG(cart.PRG)
+	if err != nil {
+		return err
+	}
+
+	start_address := uint16(c.ReadMemory(core.PC_RESET_ADDRESS+1))<<8 | uint16(c.ReadMemory(core.PC_RESET_ADDRESS))
+	if *start != "" {
+		start_address, err = parseAddress(*start)
+		if err != nil {
+			return err
+		}
+	}
+	end_address, err := parseAddress(*end)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range core.DisassembleRange(c, start_address, end_address, nil) {
+		fmt.Println(d)
+	}
+	return nil
+}
+
+// Parse a hex address, with or without a leading "$" or "0x".
+func parseAddress(value string) (uint16, error) {
+	if len(value) > 0 && value[0] == '$' {
+		value = value[1:]
+	} else if len(value) > 1 && value[0] == '0' && (value[1] == 'x' || value[1] == 'X') {
+		value = value[2:]
+	}
+	address, err := strconv.ParseUint(value, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid address %q", value)
+	}
+	return uint16(address), nil
+}
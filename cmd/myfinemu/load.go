@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/cartridge"
+	"pageer/myfinemu/internal/cheat"
+	"pageer/myfinemu/internal/console"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/patch"
+)
+
+// The loaded cartridge's .sav file, or nil if it has no battery or saves
+// aren't kept
+var save_file *cartridge.SaveFile
+
+// Whether loadProgram reads and writes .sav files.  Only trace sets it,
+// so benchmarking or debugging a game can't change its saves.
+var keep_saves bool
+
+// Cheats on the loaded program, from -cheats
+var cheats *cheat.Engine
+
+// Load a program onto a console for running or debugging.  iNES images
+// are loaded as cartridges, with their save RAM from a .sav file alongside
+// if they have a battery and keep_saves is set.  Assembly source
+// (.s/.asm) is assembled with its symbols, and anything else is treated as
+// a raw binary loaded at $8000.  ROMs and binaries get any IPS, UPS or BPS
+// patch with the same name applied.
+func loadProgram(path string) (*console.Console, core.Symbols, error) {
+	c := core.NewCPUVariant(cpu_variant)
+	c.SetLogger(logger)
+	c.SetIllegalOpcodePolicy(illegal_policy)
+	c.SetCoreMode(core_mode)
+	c.SetPowerOnRAM(ram_pattern, ram_seed)
+	cheats = cheat.New()
+	if cheats_path != "" {
+		err := cheats.LoadFile(cheats_path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	cheats.Attach(c)
+	con := console.NewWithCPU(region, c)
+	var symbols core.Symbols
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".nes":
+		data, err := loadPatchedROM(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		cart, err := cartridge.Parse(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = con.LoadCartridge(cart)
+		if err != nil {
+			return nil, nil, err
+		}
+		if keep_saves && con.SaveRAM != nil {
+			save_file, err = cartridge.OpenSaveFile(cartridge.SavePath(path), con.SaveRAM)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+	case ".s", ".asm":
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		program, err := asm.AssembleVariant(string(source), cpu_variant)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = c.LoadAndReset(program.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		symbols = program.Symbols()
+
+	default:
+		data, err := loadPatchedROM(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = c.LoadAndReset(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return con, symbols, nil
+}
+
+func loadPatchedROM(path string) ([]byte, error) {
+	data, patch_path, err := patch.LoadROM(path)
+	if err != nil {
+		return nil, err
+	}
+	if patch_path != "" {
+		fmt.Fprintf(os.Stderr, "Applied patch %s\n", patch_path)
+	}
+	return data, nil
+}
+
+// Write the save RAM out every so often while running.
+func pollSaveFile() error {
+	if save_file == nil {
+		return nil
+	}
+	return save_file.FlushIfDue(time.Now())
+}
+
+// Write the save RAM out on the way out.
+func closeSaveFile() error {
+	if save_file == nil {
+		return nil
+	}
+	return save_file.Flush()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"pageer/myfinemu/internal/console"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/logging"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands = []command{
+	{"asm", "Assemble 6502 source into a binary", runAsm},
+	{"blargg", "Run Blargg test ROMs and report pass/fail", runBlargg},
+	{"disasm", "Disassemble a ROM image", runDisasm},
+	{"debug", "Interactive debugger", runDebug},
+	{"dap", "Debug Adapter Protocol server on stdin/stdout", runDap},
+	{"trace", "Run a program, logging each instruction", runTrace},
+	{"bench", "Measure emulation speed on a ROM or built-in workloads", runBench},
+}
+
+// Shared by every command, or nil when logging is off
+var logger *logging.Logger
+
+// How loaded programs treat undocumented opcodes
+var illegal_policy core.IllegalOpcodePolicy
+
+// Which CPU core loaded programs run on
+var core_mode core.CoreMode
+
+// Which 6502 family member loaded programs run on
+var cpu_variant core.Variant
+
+// What RAM holds when a cartridge powers on
+var ram_pattern core.RAMPattern
+var ram_seed int64
+
+// A cheat list to apply to loaded programs
+var cheats_path string
+
+// Which console's timing loaded programs run with
+var region console.Region
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-log LEVEL] [-log-categories LIST] [-illegal POLICY] [-core CORE] [-cpu VARIANT] [-ram PATTERN] [-ram-seed SEED] [-cheats FILE] [-region REGION] <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func setupLogging(level_name string, category_names string) error {
+	level, err := logging.ParseLevel(level_name)
+	if err != nil {
+		return err
+	}
+	if level == logging.LevelOff {
+		return nil
+	}
+	categories, err := logging.ParseCategories(category_names)
+	if err != nil {
+		return err
+	}
+	logger = logging.New(logging.NewWriterSink(os.Stderr), level)
+	logger.SetCategories(categories)
+	return nil
+}
+
+func main() {
+	log_level := flag.String("log", "off", "Log messages at this level and above: trace, debug, info, warn, error or off")
+	log_categories := flag.String("log-categories", "all", "Comma separated categories to log: cpu, ppu, apu, mapper, bus or all")
+	illegal := flag.String("illegal", "emulate", "Undocumented opcodes: emulate, nop, error or jam")
+	cpu_core := flag.String("core", "instruction", "CPU core: instruction, or cycle for per-cycle bus accesses")
+	variant := flag.String("cpu", "nes", "CPU variant: nes, 6502 for decimal mode, or 65c02")
+	ram := flag.String("ram", "zero", "RAM contents at power-on: zero, ff or random")
+	flag.Int64Var(&ram_seed, "ram-seed", 0, "Seed for -ram random")
+	flag.StringVar(&cheats_path, "cheats", "", "Apply the Game Genie or ADDR:VALUE codes in this file, one per line")
+	region_name := flag.String("region", "auto", "Console timing: auto to follow the cartridge, ntsc, pal or dendy")
+	flag.Usage = usage
+	flag.Parse()
+	if err := setupLogging(*log_level, *log_categories); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var err error
+	illegal_policy, err = core.ParseIllegalOpcodePolicy(*illegal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	core_mode, err = core.ParseCoreMode(*cpu_core)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cpu_variant, err = core.ParseVariant(*variant)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ram_pattern, err = core.ParseRAMPattern(*ram)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	region, err = console.ParseRegion(*region_name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err := cmd.run(flag.Args()[1:])
+			if save_err := closeSaveFile(); save_err != nil {
+				fmt.Fprintln(os.Stderr, save_err)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"pageer/myfinemu/internal/console"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/trace"
+)
+
+// CPU cycles between checks for a signal to stop, and on whether the save
+// file is due a flush
+const SAVE_POLL_CYCLES = 30000
+
+func runTrace(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	format_name := flags.String("format", "nintendulator", "Trace format: nintendulator, fceux, mesen or json")
+	output := flags.String("o", "", "Write the trace to this file (default: stdout)")
+	start := flags.String("start", "", "Start tracing when this fires, e.g. pc=$C000, frame=10 or cycle=1000")
+	stop := flags.String("stop", "", "Stop tracing when this fires")
+	ranges := flags.String("range", "", "Only trace these comma separated address ranges, e.g. $8000-$8FFF")
+	mnemonics := flags.String("op", "", "Only trace these comma separated mnemonics, e.g. JSR,RTS")
+	pc := flags.String("pc", "", "Start executing here instead of at the reset vector")
+	steps := flags.Int("steps", 0, "Stop after this many instructions (default: run until BRK)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: trace [-format NAME] [-o FILE] [-start TRIGGER] [-stop TRIGGER] [-range RANGES] [-op MNEMONICS] [-pc ADDR] [-steps N] <rom-or-source-file>")
+	}
+
+	var options trace.Options
+	var err error
+	options.Format, err = trace.ParseFormat(*format_name)
+	if err != nil {
+		return err
+	}
+	options.Start, err = trace.ParseTrigger(*start)
+	if err != nil {
+		return err
+	}
+	options.Stop, err = trace.ParseTrigger(*stop)
+	if err != nil {
+		return err
+	}
+	for _, text := range splitList(*ranges) {
+		r, err := trace.ParseRange(text)
+		if err != nil {
+			return err
+		}
+		options.Ranges = append(options.Ranges, r)
+	}
+	options.Mnemonics = splitList(*mnemonics)
+
+	keep_saves = true
+	c, _, err := loadProgram(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *pc != "" {
+		address, err := parseAddress(*pc)
+		if err != nil {
+			return err
+		}
+		registers := c.CPU.Registers()
+		registers.PC = address
+		c.CPU.SetRegisters(registers)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	// Stop cleanly on Ctrl-C or kill, so the save file gets its final
+	// flush.  Checked between instructions rather than flushed from the
+	// handler, which would race with the game writing its RAM.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	tracer := trace.New(out, options)
+	executed := 0
+	c.CPU.SetInstructionHook(func(cpu *core.CPU) {
+		tracer.SetFrame(int(c.Frame()))
+		tracer.Trace(cpu)
+		executed++
+	})
+	var stop_err error
+	err = c.RunUntil(func(c *console.Console) bool {
+		if *steps != 0 && executed >= *steps {
+			return true
+		}
+		if c.Cycles()%SAVE_POLL_CYCLES != 0 {
+			return false
+		}
+		select {
+		case received := <-signals:
+			stop_err = fmt.Errorf("Stopped by %v", received)
+			return true
+		default:
+		}
+		stop_err = pollSaveFile()
+		return stop_err != nil
+	})
+	if err == nil {
+		err = stop_err
+	}
+	if errors.Is(err, console.ErrHalted) {
+		err = nil
+	}
+	if err != nil {
+		tracer.Flush()
+		return err
+	}
+	return tracer.Flush()
+}
+
+func splitList(text string) []string {
+	var items []string
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,484 @@
+package asm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"pageer/myfinemu/internal/core"
+)
+
+// Code is assembled at the start of the ROM segment unless there's a .org
+const DEFAULT_ORIGIN = core.ROM_SEGMENT_START
+
+type Program struct {
+	// Address of the first byte in Bytes
+	Origin uint16
+	Bytes  []uint8
+	// Labels and constants by name
+	Labels map[string]uint16
+	// Address of the code or data on each source line, 1-based
+	Lines map[int]uint16
+}
+
+// Labels keyed by address, for use with the disassembler.
+func (p *Program) Symbols() core.Symbols {
+	symbols := core.Symbols{}
+	for name, address := range p.Labels {
+		// Prefer the alphabetically first name when there's more than one
+		if existing, ok := symbols[address]; !ok || name < existing {
+			symbols[address] = name
+		}
+	}
+	return symbols
+}
+
+// Find the source line whose code or data starts at an address.
+func (p *Program) LineForAddress(address uint16) (int, bool) {
+	for line, start := range p.Lines {
+		if start == address {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// One line of source, with the choices made on the first pass.
+type statement struct {
+	line     int
+	mnemonic string
+	operand  string
+
+	address     uint16
+	size        int
+	instruction core.Instruction
+	// The operand with the addressing mode syntax stripped off
+	expression string
+}
+
+var (
+	labelPattern     = regexp.MustCompile(`^\s*([A-Za-z_.][A-Za-z0-9_.]*):`)
+	constantPattern  = regexp.MustCompile(`^\s*([A-Za-z_.][A-Za-z0-9_.]*)\s*=\s*(.+)$`)
+	indexedPattern   = regexp.MustCompile(`(?i)^(.+),\s*([XY])$`)
+	indirectXPattern = regexp.MustCompile(`(?i)^\((.+),\s*X\s*\)$`)
+	indirectYPattern = regexp.MustCompile(`(?i)^(\(.+\))\s*,\s*Y$`)
+)
+
+type assembler struct {
+	variant    core.Variant
+	labels     map[string]uint16
+	statements []*statement
+	pc         uint16
+	origin     uint16
+}
+
+// Assemble source into a byte image and symbol table.  Returns an *Error
+// identifying the line number on failure.
+func Assemble(source string) (*Program, error) {
+	return AssembleVariant(source, core.VariantNES)
+}
+
+// Assemble for another CPU variant's instruction set, e.g. the 65C02's.
+func AssembleVariant(source string, variant core.Variant) (*Program, error) {
+	a := &assembler{
+		variant: variant,
+		labels:  map[string]uint16{},
+		pc:      DEFAULT_ORIGIN,
+		origin:  DEFAULT_ORIGIN,
+	}
+
+	for i, line := range strings.Split(source, "\n") {
+		err := a.firstPass(i+1, line)
+		if err != nil {
+			return nil, &Error{Line: i + 1, Message: err.Error()}
+		}
+	}
+
+	program := &Program{Origin: a.origin, Labels: a.labels, Lines: map[int]uint16{}}
+	for _, stmt := range a.statements {
+		bytes, err := a.encode(stmt)
+		if err != nil {
+			return nil, &Error{Line: stmt.line, Message: err.Error()}
+		}
+		if len(bytes) == 0 {
+			continue
+		}
+		program.Lines[stmt.line] = stmt.address
+		offset := int(stmt.address) - int(program.Origin)
+		for len(program.Bytes) < offset {
+			program.Bytes = append(program.Bytes, 0)
+		}
+		program.Bytes = append(program.Bytes, bytes...)
+	}
+
+	return program, nil
+}
+
+// Resolve symbols against what's been defined so far.
+func (a *assembler) resolve(name string) (int, bool) {
+	if name == "*" {
+		return int(a.pc), true
+	}
+	value, ok := a.labels[name]
+	return int(value), ok
+}
+
+// Define labels and work out where everything goes.
+func (a *assembler) firstPass(line_number int, line string) error {
+	line = stripComment(line)
+
+	if match := labelPattern.FindStringSubmatch(line); match != nil {
+		err := a.define(match[1], a.pc)
+		if err != nil {
+			return err
+		}
+		line = line[len(match[0]):]
+	}
+
+	if match := constantPattern.FindStringSubmatch(line); match != nil {
+		value, known, err := evaluate(match[2], a.resolve)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("Constant %s must be defined after the symbols it uses", match[1])
+		}
+		return a.define(match[1], uint16(value))
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	stmt := &statement{
+		line:     line_number,
+		mnemonic: strings.ToUpper(fields[0]),
+		operand:  strings.TrimSpace(strings.TrimSpace(line)[len(fields[0]):]),
+		address:  a.pc,
+	}
+
+	switch stmt.mnemonic {
+	case ".ORG":
+		value, known, err := evaluate(stmt.operand, a.resolve)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf(".org address must not use forward references")
+		}
+		if value < 0 || value > 0xffff {
+			return fmt.Errorf(".org address $%X out of range", value)
+		}
+		if len(a.statements) == 0 {
+			a.origin = uint16(value)
+		} else if uint16(value) < a.pc {
+			return fmt.Errorf(".org $%04X is before current address $%04X", value, a.pc)
+		}
+		a.pc = uint16(value)
+		return nil
+
+	case ".BYTE":
+		args, err := splitArguments(stmt.operand)
+		if err != nil {
+			return err
+		}
+		for _, arg := range args {
+			if isString(arg) {
+				stmt.size += len(arg) - 2
+			} else {
+				stmt.size++
+			}
+		}
+
+	case ".WORD":
+		args, err := splitArguments(stmt.operand)
+		if err != nil {
+			return err
+		}
+		stmt.size = 2 * len(args)
+
+	default:
+		err := a.selectInstruction(stmt)
+		if err != nil {
+			return err
+		}
+		stmt.size = int(stmt.instruction.Size())
+	}
+
+	if int(a.pc)+stmt.size > 0x10000 {
+		return fmt.Errorf("Code runs past $FFFF")
+	}
+	a.statements = append(a.statements, stmt)
+	a.pc += uint16(stmt.size)
+	return nil
+}
+
+func (a *assembler) define(name string, value uint16) error {
+	if _, exists := a.labels[name]; exists {
+		return fmt.Errorf("Symbol %s already defined", name)
+	}
+	a.labels[name] = value
+	return nil
+}
+
+// Pick the opcode based on the operand syntax.  Zero-page modes are used
+// when the address is known on the first pass and fits in a byte.
+func (a *assembler) selectInstruction(stmt *statement) error {
+	variants := a.variant.LookupMnemonic(stmt.mnemonic)
+	if len(variants) == 0 {
+		return fmt.Errorf("Unknown instruction %s", stmt.mnemonic)
+	}
+
+	operand := stmt.operand
+	upper := strings.ToUpper(operand)
+	var found bool
+
+	switch {
+	case operand == "" || upper == "A":
+		stmt.instruction, found = findVariant(variants, AnyMode, 1)
+
+	case variants[0].IsBranch():
+		stmt.instruction, found = variants[0], true
+		stmt.expression = operand
+
+	case strings.HasPrefix(operand, "#"):
+		stmt.instruction, found = findVariant(variants, core.AddrImmediate, 2)
+		stmt.expression = operand[1:]
+
+	case indirectXPattern.MatchString(operand):
+		stmt.instruction, found = findVariant(variants, core.AddrIndirectX, 0)
+		stmt.expression = indirectXPattern.FindStringSubmatch(operand)[1]
+
+	case indirectYPattern.MatchString(operand) && isWrapped(indirectYPattern.FindStringSubmatch(operand)[1]):
+		stmt.instruction, found = findVariant(variants, core.AddrIndirectY, 0)
+		inner := indirectYPattern.FindStringSubmatch(operand)[1]
+		stmt.expression = inner[1 : len(inner)-1]
+
+	case isWrapped(operand) && hasMode(variants, core.AddrZeroPageIndirect):
+		stmt.instruction, found = findVariant(variants, core.AddrZeroPageIndirect, 0)
+		stmt.expression = operand[1 : len(operand)-1]
+
+	case isWrapped(operand) && hasMode(variants, core.AddrIndirect):
+		stmt.instruction, found = findVariant(variants, core.AddrIndirect, 0)
+		stmt.expression = operand[1 : len(operand)-1]
+
+	default:
+		zero_page, absolute := core.AddrZeroPage, core.AddrAbsolute
+		stmt.expression = operand
+		if match := indexedPattern.FindStringSubmatch(operand); match != nil {
+			stmt.expression = match[1]
+			if strings.ToUpper(match[2]) == "X" {
+				zero_page, absolute = core.AddrZeroPageX, core.AddrAbsoluteX
+			} else {
+				zero_page, absolute = core.AddrZeroPageY, core.AddrAbsoluteY
+			}
+		}
+
+		value, known, err := evaluate(stmt.expression, a.resolve)
+		if err != nil {
+			return err
+		}
+		fits_zero_page := known && value >= 0 && value <= 0xff
+		if fits_zero_page || !hasMode(variants, absolute) {
+			stmt.instruction, found = findVariant(variants, zero_page, 0)
+		}
+		if !found {
+			stmt.instruction, found = findVariant(variants, absolute, 0)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("Addressing mode not supported for %s %s", stmt.mnemonic, operand)
+	}
+	return nil
+}
+
+// Produce the bytes for a statement now that every label is known.
+func (a *assembler) encode(stmt *statement) ([]uint8, error) {
+	a.pc = stmt.address
+
+	switch stmt.mnemonic {
+	case ".BYTE":
+		var bytes []uint8
+		args, _ := splitArguments(stmt.operand)
+		for _, arg := range args {
+			if isString(arg) {
+				bytes = append(bytes, arg[1:len(arg)-1]...)
+				continue
+			}
+			value, err := a.evaluateFinal(arg)
+			if err != nil {
+				return nil, err
+			}
+			if value < -0x80 || value > 0xff {
+				return nil, fmt.Errorf("Value %d doesn't fit in a byte", value)
+			}
+			bytes = append(bytes, uint8(value))
+		}
+		return bytes, nil
+
+	case ".WORD":
+		var bytes []uint8
+		args, _ := splitArguments(stmt.operand)
+		for _, arg := range args {
+			value, err := a.evaluateFinal(arg)
+			if err != nil {
+				return nil, err
+			}
+			if value < -0x8000 || value > 0xffff {
+				return nil, fmt.Errorf("Value %d doesn't fit in a word", value)
+			}
+			bytes = append(bytes, uint8(value), uint8(value>>8))
+		}
+		return bytes, nil
+	}
+
+	bytes := []uint8{stmt.instruction.Opcode()}
+	if stmt.size == 1 {
+		return bytes, nil
+	}
+
+	value, err := a.evaluateFinal(stmt.expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if stmt.instruction.IsBranch() {
+		offset := value - (int(stmt.address) + 2)
+		if offset < -128 || offset > 127 {
+			return nil, fmt.Errorf("Branch target $%04X out of range", value)
+		}
+		return append(bytes, uint8(offset)), nil
+	}
+
+	if stmt.size == 2 {
+		if stmt.instruction.Mode() == core.AddrImmediate && value < 0 && value >= -0x80 {
+			value &= 0xff
+		}
+		if value < 0 || value > 0xff {
+			return nil, fmt.Errorf("Value $%X doesn't fit in a byte", value)
+		}
+		return append(bytes, uint8(value)), nil
+	}
+
+	if value < 0 || value > 0xffff {
+		return nil, fmt.Errorf("Address $%X out of range", value)
+	}
+	return append(bytes, uint8(value), uint8(value>>8)), nil
+}
+
+func (a *assembler) evaluateFinal(text string) (int, error) {
+	value, known, err := evaluate(text, a.resolve)
+	if err != nil {
+		return 0, err
+	}
+	if !known {
+		return 0, fmt.Errorf("Undefined symbol in %q", text)
+	}
+	return value, nil
+}
+
+// Matches any addressing mode in findVariant
+const AnyMode core.AddressMode = -1
+
+// Find the variant with the given mode and size.  Zero means any.
+func findVariant(variants []core.Instruction, mode core.AddressMode, size uint) (core.Instruction, bool) {
+	for _, variant := range variants {
+		if (mode == AnyMode || variant.Mode() == mode) && (size == 0 || variant.Size() == size) {
+			return variant, true
+		}
+	}
+	return core.Instruction{}, false
+}
+
+func hasMode(variants []core.Instruction, mode core.AddressMode) bool {
+	_, found := findVariant(variants, mode, 0)
+	return found
+}
+
+// True if the whole of text is inside one pair of parentheses.
+func isWrapped(text string) bool {
+	if !strings.HasPrefix(text, "(") || !strings.HasSuffix(text, ")") {
+		return false
+	}
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i < len(text)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isString(arg string) bool {
+	return len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"'
+}
+
+// Remove a ; comment, ignoring semicolons in quotes.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Split directive arguments on commas that aren't in quotes or parentheses.
+func splitArguments(operand string) ([]string, error) {
+	var args []string
+	quote := byte(0)
+	depth := 0
+	start := 0
+	for i := 0; i < len(operand); i++ {
+		char := operand[i]
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '(':
+			depth++
+		case char == ')':
+			depth--
+		case char == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(operand[start:i]))
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated string in %q", operand)
+	}
+	args = append(args, strings.TrimSpace(operand[start:]))
+
+	for _, arg := range args {
+		if arg == "" {
+			return nil, fmt.Errorf("Empty argument in %q", operand)
+		}
+	}
+	return args, nil
+}
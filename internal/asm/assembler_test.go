@@ -0,0 +1,256 @@
+package asm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/core"
+)
+
+func TestAssemble_AddressModes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected []uint8
+	}{
+		{"Implied", "INX", []uint8{0xe8}},
+		{"Implied immediate-mode flag", "CLC", []uint8{0x18}},
+		{"Accumulator", "LSR A", []uint8{0x4a}},
+		{"Accumulator without operand", "LSR", []uint8{0x4a}},
+		{"Accumulator on implied ASL", "ASL A", []uint8{0x0a}},
+		{"Immediate hex", "LDA #$c0", []uint8{0xa9, 0xc0}},
+		{"Immediate decimal", "LDA #192", []uint8{0xa9, 0xc0}},
+		{"Immediate binary", "LDA #%11000000", []uint8{0xa9, 0xc0}},
+		{"Immediate character", "LDA #'A'", []uint8{0xa9, 0x41}},
+		{"Immediate negative", "LDA #-1", []uint8{0xa9, 0xff}},
+		{"Zero-page", "LDA $10", []uint8{0xa5, 0x10}},
+		{"Zero-page X", "LDA $10,X", []uint8{0xb5, 0x10}},
+		{"Zero-page Y", "LDX $10, y", []uint8{0xb6, 0x10}},
+		{"Absolute", "LDA $1234", []uint8{0xad, 0x34, 0x12}},
+		{"Absolute with zero-page value", "LDA $0010", []uint8{0xa5, 0x10}},
+		{"Absolute X", "LDA $1234,X", []uint8{0xbd, 0x34, 0x12}},
+		{"Absolute Y", "LDA $1234,Y", []uint8{0xb9, 0x34, 0x12}},
+		{"Zero-page Y without zero-page mode", "LDA $10,Y", []uint8{0xb9, 0x10, 0x00}},
+		{"Indirect X", "LDA ($10,X)", []uint8{0xa1, 0x10}},
+		{"Indirect Y", "LDA ($10),Y", []uint8{0xb1, 0x10}},
+		{"Indirect", "JMP ($1234)", []uint8{0x6c, 0x34, 0x12}},
+		{"Parenthesised expression", "JMP ($1200)+$34", []uint8{0x4c, 0x34, 0x12}},
+		{"Lower case mnemonic", "lda #1", []uint8{0xa9, 0x01}},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			program, err := Assemble(test.source)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, program.Bytes)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestAssembleVariant_65C02(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected []uint8
+	}{
+		{"Zero-page indirect", "LDA ($10)", []uint8{0xb2, 0x10}},
+		{"Indirect Y still works", "LDA ($10),Y", []uint8{0xb1, 0x10}},
+		{"JMP indirect", "JMP ($1234)", []uint8{0x6c, 0x34, 0x12}},
+		{"BIT immediate", "BIT #$80", []uint8{0x89, 0x80}},
+		{"INC A", "INC A", []uint8{0x1a}},
+		{"STZ", "STZ $1234,X", []uint8{0x9e, 0x34, 0x12}},
+		{"BRA", "loop: BRA loop", []uint8{0x80, 0xfe}},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			program, err := AssembleVariant(test.source, core.Variant65C02)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, program.Bytes)
+		}
+		t.Run(test.name, callback)
+	}
+
+	_, err := Assemble("STZ $10")
+	assert.NotNil(t, err)
+}
+
+func TestAssemble_RoundTripsThroughDisassembler(t *testing.T) {
+	for _, cpu_variant := range []core.Variant{core.VariantNES, core.Variant65C02} {
+		for hex := 0; hex <= 0xff; hex++ {
+			instruction, ok := cpu_variant.LookupOpcode(uint8(hex))
+			if !ok || instruction.IsBranch() || !isCanonical(cpu_variant, instruction) {
+				continue
+			}
+			rom := []uint8{uint8(hex), 0x34, 0x12}
+			c := core.NewCPUVariant(cpu_variant)
+			c.LoadAndReset(rom)
+			text := c.Disassemble(core.ROM_SEGMENT_START).Text()
+
+			program, err := AssembleVariant(text, cpu_variant)
+
+			assert.Nil(t, err, text)
+			assert.Equal(t, rom[:instruction.Size()], program.Bytes, text)
+		}
+	}
+}
+
+// Undocumented duplicates, such as the extra NOPs, assemble to the first
+// opcode with the same mnemonic and mode.
+func isCanonical(cpu_variant core.Variant, instruction core.Instruction) bool {
+	for _, variant := range cpu_variant.LookupMnemonic(instruction.Name()) {
+		if variant.Mode() == instruction.Mode() {
+			return variant.Opcode() == instruction.Opcode()
+		}
+	}
+	return false
+}
+
+func TestAssemble_LabelsAndBranches(t *testing.T) {
+	source := `
+		; Count down from 3
+		counter = $10
+	start:	LDA #3
+	loop:	DEC counter
+		BEQ done
+		JMP loop
+	done:	BRK
+	`
+
+	program, err := Assemble(source)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{
+		0xa9, 0x03,
+		0xc6, 0x10,
+		0xf0, 0x03,
+		0x4c, 0x02, 0x80,
+		0x00,
+	}, program.Bytes)
+	assert.Equal(t, uint16(0x8000), program.Labels["start"])
+	assert.Equal(t, uint16(0x8002), program.Labels["loop"])
+	assert.Equal(t, uint16(0x8009), program.Labels["done"])
+	assert.Equal(t, uint16(0x0010), program.Labels["counter"])
+	assert.Equal(t, "loop", program.Symbols()[0x8002])
+	assert.Equal(t, map[int]uint16{4: 0x8000, 5: 0x8002, 6: 0x8004, 7: 0x8006, 8: 0x8009}, program.Lines)
+	line, ok := program.LineForAddress(0x8006)
+	assert.True(t, ok)
+	assert.Equal(t, 7, line)
+}
+
+func TestAssemble_BackwardBranch(t *testing.T) {
+	program, err := Assemble("loop: DEX\n BNE loop")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{0xca, 0xd0, 0xfd}, program.Bytes)
+}
+
+func TestAssemble_ForwardReferenceUsesAbsolute(t *testing.T) {
+	program, err := Assemble("LDA value\nBRK\nvalue = $10")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{0xad, 0x10, 0x00, 0x00}, program.Bytes)
+
+	program, err = Assemble("LDA value\nBRK\nvalue: .byte 7")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{0xad, 0x04, 0x80, 0x00, 0x07}, program.Bytes)
+}
+
+func TestAssemble_Directives(t *testing.T) {
+	source := `
+		.org $c000
+	table:	.byte 1, $02, "Hi", <vector, >vector
+	vector:	.word table, $1234
+		.org $c010
+		.byte * & $ff
+	`
+
+	program, err := Assemble(source)
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0xc000), program.Origin)
+	expected := make([]uint8, 0x11)
+	copy(expected, []uint8{0x01, 0x02, 'H', 'i', 0x06, 0xc0, 0x00, 0xc0, 0x34, 0x12})
+	expected[0x10] = 0x10
+	assert.Equal(t, expected, program.Bytes)
+}
+
+func TestAssemble_Expressions(t *testing.T) {
+	testCases := []struct {
+		expression string
+		expected   uint8
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"$f0 | $0f", 0xff},
+		{"$ff & ~$0f", 0xf0},
+		{"1 << 4", 0x10},
+		{"$100 >> 4", 0x10},
+		{"$ff ^ $0f", 0xf0},
+		{">$1234", 0x12},
+		{"<$1234", 0x34},
+		{"10 / 3 - 1", 2},
+	}
+
+	for _, test := range testCases {
+		program, err := Assemble(".byte " + test.expression)
+
+		assert.Nil(t, err, test.expression)
+		assert.Equal(t, []uint8{test.expected}, program.Bytes, test.expression)
+	}
+}
+
+func TestAssemble_Errors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source string
+		line   int
+	}{
+		{"Unknown mnemonic", "NOP\nFOO #1", 2},
+		{"Unsupported mode", "INX #1", 1},
+		{"Undefined symbol", "JMP nowhere", 1},
+		{"Duplicate label", "a: NOP\na: NOP", 2},
+		{"Immediate too large", "LDA #$100", 1},
+		{"Branch out of range", "BNE far\n.org $8100\nfar: NOP", 1},
+		{"Backward .org", "NOP\n.org $7000", 2},
+		{"Unterminated string", `.byte "abc`, 1},
+		{"Bad expression", "LDA #(1", 1},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			_, err := Assemble(test.source)
+
+			var asm_err *Error
+			assert.True(t, errors.As(err, &asm_err), "Expected *Error, got %v", err)
+			if asm_err != nil {
+				assert.Equal(t, test.line, asm_err.Line)
+			}
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestAssemble_RunsOnCPU(t *testing.T) {
+	program, err := Assemble(`
+		LDX #3
+	loop:	INC $0200
+		DEX
+		BNE loop
+		BRK
+	`)
+	assert.Nil(t, err)
+
+	c := core.NewCPU()
+	c.LoadAndReset(program.Bytes)
+	err = c.Run()
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(3), c.ReadMemory(0x0200))
+}
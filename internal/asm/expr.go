@@ -0,0 +1,224 @@
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Looks up the value of a symbol.  Returns false if it isn't defined (yet).
+type resolver func(name string) (int, bool)
+
+// Recursive descent evaluator for operand expressions.  Supports
+// $hex, %binary, decimal and 'c' literals, symbols, "*" for the current
+// address, the binary operators | ^ & << >> + - * / and the unary
+// operators - ~ < (low byte) and > (high byte).
+type exprParser struct {
+	text    string
+	pos     int
+	resolve resolver
+	// Set if any symbol couldn't be resolved
+	unknown bool
+}
+
+// Evaluate an expression.  The second return value is false if the
+// expression refers to a symbol that hasn't been defined yet.
+func evaluate(text string, resolve resolver) (int, bool, error) {
+	p := &exprParser{text: text, resolve: resolve}
+	value, err := p.parseBinary(0)
+	if err != nil {
+		return 0, false, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return 0, false, fmt.Errorf("Unexpected %q in expression %q", p.text[p.pos:], text)
+	}
+	return value, !p.unknown, nil
+}
+
+var binaryOperators = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+func (p *exprParser) parseBinary(level int) (int, error) {
+	if level == len(binaryOperators) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		p.skipSpace()
+		operator := ""
+		for _, candidate := range binaryOperators[level] {
+			if strings.HasPrefix(p.text[p.pos:], candidate) {
+				operator = candidate
+				break
+			}
+		}
+		if operator == "" {
+			return left, nil
+		}
+		p.pos += len(operator)
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+
+		switch operator {
+		case "|":
+			left |= right
+		case "^":
+			left ^= right
+		case "&":
+			left &= right
+		case "<<":
+			left <<= uint(right)
+		case ">>":
+			left >>= uint(right)
+		case "+":
+			left += right
+		case "-":
+			left -= right
+		case "*":
+			left *= right
+		case "/":
+			if right == 0 {
+				if p.unknown {
+					// Forward reference, value doesn't matter yet
+					left = 0
+					continue
+				}
+				return 0, fmt.Errorf("Division by zero in expression %q", p.text)
+			}
+			left /= right
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (int, error) {
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return 0, fmt.Errorf("Unexpected end of expression %q", p.text)
+	}
+
+	operator := p.text[p.pos]
+	switch operator {
+	case '-', '~', '<', '>':
+		p.pos++
+		value, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch operator {
+		case '-':
+			return -value, nil
+		case '~':
+			return ^value, nil
+		case '<':
+			return value & 0xff, nil
+		default:
+			return (value >> 8) & 0xff, nil
+		}
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (int, error) {
+	p.skipSpace()
+	start := p.pos
+	char := p.text[p.pos]
+
+	switch {
+	case char == '(':
+		p.pos++
+		value, err := p.parseBinary(0)
+		if err != nil {
+			return 0, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.text) || p.text[p.pos] != ')' {
+			return 0, fmt.Errorf("Missing ) in expression %q", p.text)
+		}
+		p.pos++
+		return value, nil
+
+	case char == '*':
+		p.pos++
+		return p.lookup("*")
+
+	case char == '$':
+		p.pos++
+		return p.parseNumber(start, 16)
+
+	case char == '%':
+		p.pos++
+		return p.parseNumber(start, 2)
+
+	case char == '\'':
+		if p.pos+2 >= len(p.text) || p.text[p.pos+2] != '\'' {
+			return 0, fmt.Errorf("Bad character literal in expression %q", p.text)
+		}
+		p.pos += 3
+		return int(p.text[start+1]), nil
+
+	case isDigit(char):
+		return p.parseNumber(start, 10)
+
+	case isSymbolStart(char):
+		for p.pos < len(p.text) && isSymbolChar(p.text[p.pos]) {
+			p.pos++
+		}
+		return p.lookup(p.text[start:p.pos])
+	}
+
+	return 0, fmt.Errorf("Unexpected %q in expression %q", p.text[p.pos:], p.text)
+}
+
+func (p *exprParser) parseNumber(start int, base int) (int, error) {
+	digits_start := p.pos
+	for p.pos < len(p.text) && isSymbolChar(p.text[p.pos]) {
+		p.pos++
+	}
+	value, err := strconv.ParseInt(p.text[digits_start:p.pos], base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number %q", p.text[start:p.pos])
+	}
+	return int(value), nil
+}
+
+func (p *exprParser) lookup(name string) (int, error) {
+	value, ok := p.resolve(name)
+	if !ok {
+		p.unknown = true
+		return 0, nil
+	}
+	return value, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isSymbolStart(char byte) bool {
+	return char == '_' || char == '.' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+func isSymbolChar(char byte) bool {
+	return isSymbolStart(char) || isDigit(char)
+}
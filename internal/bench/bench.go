@@ -0,0 +1,216 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/console"
+	"pageer/myfinemu/internal/core"
+)
+
+// Percentage slowdown against a baseline before it counts as a regression
+const DEFAULT_TOLERANCE = 10.0
+
+// A built-in program representative of some kind of game code.
+type Workload struct {
+	Name        string
+	Description string
+	Source      string
+}
+
+// Full frame emulation joins these once there's a PPU to draw frames.
+var WORKLOADS = []Workload{
+	{"alu", "Tight loop of arithmetic and logic on registers", `
+start:	LDX #0
+loop:	LDA #$35
+	ADC #$17
+	EOR #$5A
+	AND #$F0
+	ORA #$0C
+	ASL A
+	LSR A
+	ROL A
+	INX
+	BNE loop
+	JMP start
+`},
+	// Read-modify-writes stand in for stores, which keeps results
+	// comparable with baselines from before there was STA
+	{"memory", "Reads and read-modify-writes across pages of RAM", `
+start:	LDX #0
+	LDY #0
+loop:	LDA $0200,X
+	ADC ($20),Y
+	INC $0300,X
+	ASL $0400,X
+	DEC $10
+	LDA $0500,Y
+	EOR $11
+	INY
+	INX
+	BNE loop
+	JMP start
+`},
+	{"branch", "Nested countdowns and compares, heavy on taken branches", `
+start:	LDY #16
+outer:	LDX #16
+inner:	CPX #8
+	BEQ equal
+	BCC skip
+	CLC
+	BCC skip
+equal:	CLV
+	BVC skip
+skip:	DEX
+	BNE inner
+	DEY
+	BNE outer
+	JMP start
+`},
+}
+
+func FindWorkload(name string) (Workload, bool) {
+	for _, w := range WORKLOADS {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return Workload{}, false
+}
+
+// Assemble the workload into a fresh console.  RegionAuto runs as NTSC.
+func (w Workload) Load(region console.Region) (*console.Console, error) {
+	program, err := asm.Assemble(w.Source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", w.Name, err)
+	}
+	c := console.New(region)
+	err = c.CPU.LoadAndReset(program.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type Result struct {
+	Name         string        `json:"name"`
+	Frames       int           `json:"frames"`
+	Instructions uint64        `json:"instructions"`
+	Cycles       uint64        `json:"cycles"`
+	Elapsed      time.Duration `json:"elapsed_ns"`
+}
+
+// Emulated CPU clock speed.  The real NES runs at about 1.79MHz.
+func (r Result) MHz() float64 {
+	return float64(r.Cycles) / r.Elapsed.Seconds() / 1e6
+}
+
+func (r Result) InstructionsPerSecond() float64 {
+	return float64(r.Instructions) / r.Elapsed.Seconds()
+}
+
+func (r Result) FramesPerSecond() float64 {
+	return float64(r.Frames) / r.Elapsed.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%-10s %6d frames  %8.2f MHz  %12.0f instructions/s  %8.1f frames/s",
+		r.Name, r.Frames, r.MHz(), r.InstructionsPerSecond(), r.FramesPerSecond())
+}
+
+// Run the console for a number of frames, timing it.  Stops early with
+// console.ErrHalted if the program hits BRK, or with the CPU's error.
+// This takes over the CPU's instruction hook, to count instructions.
+func RunFrames(c *console.Console, name string, frames int) (Result, error) {
+	result := Result{Name: name}
+	c.CPU.SetInstructionHook(func(*core.CPU) { result.Instructions++ })
+	defer c.CPU.SetInstructionHook(nil)
+	start_cycles := c.Cycles()
+	start := time.Now()
+
+	var err error
+	for result.Frames < frames {
+		err = c.RunFrame()
+		if err != nil {
+			break
+		}
+		result.Frames++
+	}
+
+	result.Elapsed = time.Since(start)
+	result.Cycles = c.Cycles() - start_cycles
+	return result, err
+}
+
+// A workload that got slower than its baseline.
+type Regression struct {
+	Name     string
+	Baseline float64
+	Current  float64
+}
+
+// How much slower, as a percentage of the baseline
+func (r Regression) Slowdown() float64 {
+	return (r.Baseline - r.Current) / r.Baseline * 100
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s: %.2f MHz, down %.1f%% from %.2f MHz", r.Name, r.Current, r.Slowdown(), r.Baseline)
+}
+
+// Find results more than tolerance percent slower than the baseline
+// result of the same name.  Results missing from the baseline are
+// ignored.
+func Compare(baseline []Result, current []Result, tolerance float64) []Regression {
+	var regressions []Regression
+	for _, result := range current {
+		for _, base := range baseline {
+			if base.Name != result.Name {
+				continue
+			}
+			r := Regression{result.Name, base.MHz(), result.MHz()}
+			if r.Slowdown() > tolerance {
+				regressions = append(regressions, r)
+			}
+		}
+	}
+	return regressions
+}
+
+func WriteResults(w io.Writer, results []Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
+
+func ReadResults(r io.Reader) ([]Result, error) {
+	var results []Result
+	err := json.NewDecoder(r).Decode(&results)
+	return results, err
+}
+
+func LoadResults(path string) ([]Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadResults(file)
+}
+
+func SaveResults(path string, results []Result) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = WriteResults(file, results)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,119 @@
+package bench
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/console"
+)
+
+func TestWorkloads_RunWithoutHalting(t *testing.T) {
+	for _, w := range WORKLOADS {
+		callback := func(t *testing.T) {
+			c, err := w.Load(console.RegionNTSC)
+			assert.Nil(t, err)
+
+			result, err := RunFrames(c, w.Name, 3)
+
+			assert.Nil(t, err)
+			assert.Equal(t, 3, result.Frames)
+			// 341 * 262 / 3 cycles per NTSC frame
+			assert.InDelta(t, 3*29781, result.Cycles, 2)
+			assert.Greater(t, result.Instructions, uint64(3*29781/7))
+		}
+		t.Run(w.Name, callback)
+	}
+}
+
+func TestRunFrames_Region(t *testing.T) {
+	testCases := []struct {
+		name   string
+		region console.Region
+		cycles float64
+	}{
+		// 341 dots * scanlines / PPU dots per CPU cycle
+		{"auto", console.RegionAuto, 341 * 262 / 3.0},
+		{"ntsc", console.RegionNTSC, 341 * 262 / 3.0},
+		{"pal", console.RegionPAL, 341 * 312 / 3.2},
+		{"dendy", console.RegionDendy, 341 * 312 / 3.0},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c, err := WORKLOADS[0].Load(test.region)
+			assert.Nil(t, err)
+
+			result, err := RunFrames(c, WORKLOADS[0].Name, 3)
+
+			assert.Nil(t, err)
+			assert.InDelta(t, 3*test.cycles, result.Cycles, 2)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestRunFrames_Halted(t *testing.T) {
+	c := console.New(console.RegionNTSC)
+	// INX, BRK
+	c.CPU.LoadAndReset([]uint8{0xe8, 0x00})
+
+	result, err := RunFrames(c, "halt", 1)
+
+	assert.Equal(t, console.ErrHalted, err)
+	assert.Equal(t, 0, result.Frames)
+	assert.Equal(t, uint64(2), result.Instructions)
+}
+
+func TestCompare(t *testing.T) {
+	second := time.Second
+	baseline := []Result{
+		{Name: "alu", Cycles: 100e6, Elapsed: second},
+		{Name: "memory", Cycles: 50e6, Elapsed: second},
+	}
+	current := []Result{
+		{Name: "alu", Cycles: 95e6, Elapsed: second},
+		{Name: "memory", Cycles: 40e6, Elapsed: second},
+		{Name: "branch", Cycles: 1e6, Elapsed: second},
+	}
+
+	regressions := Compare(baseline, current, DEFAULT_TOLERANCE)
+
+	assert.Equal(t, []Regression{{"memory", 50, 40}}, regressions)
+	assert.InDelta(t, 20.0, regressions[0].Slowdown(), 0.001)
+}
+
+func TestResults_RoundTrip(t *testing.T) {
+	results := []Result{{Name: "alu", Frames: 2, Instructions: 1000, Cycles: 59562, Elapsed: time.Millisecond}}
+	var buffer bytes.Buffer
+
+	assert.Nil(t, WriteResults(&buffer, results))
+	read, err := ReadResults(&buffer)
+
+	assert.Nil(t, err)
+	assert.Equal(t, results, read)
+}
+
+// One op is one frame of the workload.
+func BenchmarkWorkloads(b *testing.B) {
+	for _, w := range WORKLOADS {
+		b.Run(w.Name, func(b *testing.B) {
+			c, err := w.Load(console.RegionNTSC)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			result, err := RunFrames(c, w.Name, b.N)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportMetric(result.MHz(), "emulated-MHz")
+			b.ReportMetric(result.InstructionsPerSecond(), "instructions/s")
+		})
+	}
+}
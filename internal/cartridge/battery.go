@@ -0,0 +1,159 @@
+package cartridge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Where cartridges put PRG-RAM, battery-backed or not
+	PRG_RAM_START uint16 = 0x6000
+	PRG_RAM_END   uint16 = 0x7fff
+	PRG_RAM_SIZE         = 0x2000
+
+	SAVE_EXTENSION = ".sav"
+	// How often FlushIfDue writes a changed save
+	SAVE_FLUSH_INTERVAL = 5 * time.Second
+)
+
+// PRG-RAM at $6000-$7FFF.  With a battery, it keeps the game's saves
+// while the console is off.
+type SaveRAM struct {
+	data [PRG_RAM_SIZE]uint8
+	// Written since the last flush
+	dirty bool
+}
+
+func (s *SaveRAM) ReadRegister(address uint16) uint8 {
+	return s.data[address-PRG_RAM_START]
+}
+
+func (s *SaveRAM) WriteRegister(address uint16, value uint8) {
+	offset := address - PRG_RAM_START
+	if s.data[offset] != value {
+		s.data[offset] = value
+		s.dirty = true
+	}
+}
+
+// A copy of the whole RAM, e.g. to check what a game saved.
+func (s *SaveRAM) Bytes() []uint8 {
+	data := make([]uint8, PRG_RAM_SIZE)
+	copy(data, s.data[:])
+	return data
+}
+
+// Replace the whole RAM, e.g. with a save from disk.
+func (s *SaveRAM) SetBytes(data []uint8) error {
+	if len(data) != PRG_RAM_SIZE {
+		return fmt.Errorf("Save RAM is %d bytes, expected %d", len(data), PRG_RAM_SIZE)
+	}
+	copy(s.data[:], data)
+	s.dirty = true
+	return nil
+}
+
+// Whether the RAM has changed since it was last flushed.
+func (s *SaveRAM) Dirty() bool {
+	return s.dirty
+}
+
+func (s *SaveRAM) StateID() string {
+	return "SRAM"
+}
+
+func (s *SaveRAM) SaveState() ([]byte, error) {
+	return s.Bytes(), nil
+}
+
+func (s *SaveRAM) LoadState(data []byte) error {
+	return s.SetBytes(data)
+}
+
+// Where the save for a ROM lives: next to it, with a .sav extension.
+func SavePath(rom_path string) string {
+	return strings.TrimSuffix(rom_path, filepath.Ext(rom_path)) + SAVE_EXTENSION
+}
+
+// Keeps save RAM in sync with a file on disk.
+type SaveFile struct {
+	RAM        *SaveRAM
+	path       string
+	last_flush time.Time
+}
+
+// Load a save into the RAM.  A missing file isn't an error, since games
+// start without one, and the RAM is left as it was.
+func OpenSaveFile(path string, ram *SaveRAM) (*SaveFile, error) {
+	f := &SaveFile{RAM: ram, path: path, last_flush: time.Now()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = ram.SetBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	ram.dirty = false
+	return f, nil
+}
+
+func (f *SaveFile) Path() string {
+	return f.path
+}
+
+// Write the RAM out if it's changed.  It goes to a temporary file that
+// replaces the save once it's complete, so a crash part way through
+// can't leave a truncated save behind.
+func (f *SaveFile) Flush() error {
+	return f.flush(time.Now())
+}
+
+// Flush if SAVE_FLUSH_INTERVAL has passed since the last flush, so a
+// crash loses at most that much play.  Cheap enough to call every frame.
+func (f *SaveFile) FlushIfDue(now time.Time) error {
+	if now.Sub(f.last_flush) < SAVE_FLUSH_INTERVAL {
+		return nil
+	}
+	return f.flush(now)
+}
+
+func (f *SaveFile) flush(now time.Time) error {
+	if !f.RAM.dirty {
+		f.last_flush = now
+		return nil
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(f.RAM.data[:])
+	if err == nil {
+		err = temp.Sync()
+	}
+	close_err := temp.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	// Only now, so a failed write is retried on the next poll
+	f.last_flush = now
+	f.RAM.dirty = false
+	return nil
+}
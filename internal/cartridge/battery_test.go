@@ -0,0 +1,102 @@
+package cartridge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveRAM(t *testing.T) {
+	ram := &SaveRAM{}
+	assert.False(t, ram.Dirty())
+
+	ram.WriteRegister(0x6000, 0x00)
+	assert.False(t, ram.Dirty(), "Writing the same value isn't a change")
+
+	ram.WriteRegister(0x7fff, 0x42)
+	assert.True(t, ram.Dirty())
+	assert.Equal(t, uint8(0x42), ram.ReadRegister(0x7fff))
+	assert.Equal(t, uint8(0x42), ram.Bytes()[PRG_RAM_SIZE-1])
+
+	assert.NotNil(t, ram.SetBytes(make([]uint8, 100)))
+}
+
+func TestSavePath(t *testing.T) {
+	assert.Equal(t, "roms/zelda.sav", SavePath("roms/zelda.nes"))
+	assert.Equal(t, "zelda.sav", SavePath("zelda"))
+}
+
+func TestSaveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.sav")
+
+	ram := &SaveRAM{}
+	file, err := OpenSaveFile(path, ram)
+	assert.Nil(t, err)
+	assert.NoFileExists(t, path)
+
+	// Nothing to write yet
+	assert.Nil(t, file.Flush())
+	assert.NoFileExists(t, path)
+
+	ram.WriteRegister(0x6010, 0x99)
+	assert.Nil(t, file.Flush())
+	assert.False(t, ram.Dirty())
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, ram.Bytes(), data)
+
+	// Only the save is left, without temporary files
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	reloaded := &SaveRAM{}
+	_, err = OpenSaveFile(path, reloaded)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(0x99), reloaded.ReadRegister(0x6010))
+	assert.False(t, reloaded.Dirty())
+}
+
+func TestSaveFile_FlushIfDue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.sav")
+	ram := &SaveRAM{}
+	file, _ := OpenSaveFile(path, ram)
+	ram.WriteRegister(0x6000, 0x01)
+	now := time.Now()
+
+	assert.Nil(t, file.FlushIfDue(now))
+	assert.NoFileExists(t, path)
+
+	assert.Nil(t, file.FlushIfDue(now.Add(SAVE_FLUSH_INTERVAL)))
+	assert.FileExists(t, path)
+}
+
+func TestSaveFile_FlushIfDueRetries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "saves")
+	path := filepath.Join(dir, "game.sav")
+	ram := &SaveRAM{}
+	file, _ := OpenSaveFile(path, ram)
+	ram.WriteRegister(0x6000, 0x01)
+	due := time.Now().Add(SAVE_FLUSH_INTERVAL)
+
+	// The directory doesn't exist yet
+	assert.NotNil(t, file.FlushIfDue(due))
+	assert.True(t, ram.Dirty())
+
+	os.Mkdir(dir, 0755)
+	assert.Nil(t, file.FlushIfDue(due.Add(time.Second)))
+	assert.FileExists(t, path)
+	assert.False(t, ram.Dirty())
+}
+
+func TestOpenSaveFile_WrongSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.sav")
+	os.WriteFile(path, make([]uint8, 100), 0644)
+
+	_, err := OpenSaveFile(path, &SaveRAM{})
+
+	assert.NotNil(t, err)
+}
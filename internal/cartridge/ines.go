@@ -0,0 +1,120 @@
+package cartridge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	HEADER_SIZE   = 16
+	TRAINER_SIZE  = 512
+	PRG_BANK_SIZE = 0x4000
+	CHR_BANK_SIZE = 0x2000
+
+	// Flags 6
+	FLAG_VERTICAL_MIRRORING uint8 = 0b00000001
+	FLAG_BATTERY            uint8 = 0b00000010
+	FLAG_TRAINER            uint8 = 0b00000100
+	FLAG_FOUR_SCREEN        uint8 = 0b00001000
+
+	// Flags 7 bits 2-3 are 10 in NES 2.0 headers
+	FLAG_NES2_MASK uint8 = 0b00001100
+	FLAG_NES2      uint8 = 0b00001000
+
+	// NES 2.0 byte 12, bits 0-1
+	TIMING_OFFSET       = 12
+	TIMING_MASK   uint8 = 0b00000011
+)
+
+var INES_MAGIC = []byte{'N', 'E', 'S', 0x1a}
+
+type Mirroring int
+
+const (
+	MirrorHorizontal Mirroring = iota
+	MirrorVertical
+	MirrorFourScreen
+)
+
+// The console a game was made for, from the NES 2.0 header.
+type TimingMode int
+
+const (
+	TimingNTSC TimingMode = iota
+	TimingPAL
+	// Runs on either
+	TimingMultiRegion
+	TimingDendy
+)
+
+type Cartridge struct {
+	PRG       []uint8
+	CHR       []uint8
+	Trainer   []uint8
+	Mapper    uint8
+	Mirroring Mirroring
+	Battery   bool
+	NES2      bool
+	// Always NTSC for plain iNES images, which don't say
+	Timing TimingMode
+}
+
+// Read an iNES image from disk.
+func Load(path string) (*Cartridge, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse an in-memory iNES image.
+func Parse(data []uint8) (*Cartridge, error) {
+	if len(data) < HEADER_SIZE || !bytes.Equal(data[0:4], INES_MAGIC) {
+		return nil, errors.New("Not an iNES image")
+	}
+
+	prg_size := int(data[4]) * PRG_BANK_SIZE
+	chr_size := int(data[5]) * CHR_BANK_SIZE
+	flags6 := data[6]
+	flags7 := data[7]
+
+	cart := &Cartridge{
+		Mapper:  (flags7 & 0xf0) | (flags6 >> 4),
+		Battery: flags6&FLAG_BATTERY > 0,
+		NES2:    flags7&FLAG_NES2_MASK == FLAG_NES2,
+	}
+	if cart.NES2 {
+		cart.Timing = TimingMode(data[TIMING_OFFSET] & TIMING_MASK)
+	}
+
+	switch {
+	case flags6&FLAG_FOUR_SCREEN > 0:
+		cart.Mirroring = MirrorFourScreen
+	case flags6&FLAG_VERTICAL_MIRRORING > 0:
+		cart.Mirroring = MirrorVertical
+	default:
+		cart.Mirroring = MirrorHorizontal
+	}
+
+	position := HEADER_SIZE
+	if flags6&FLAG_TRAINER > 0 {
+		if len(data) < position+TRAINER_SIZE {
+			return nil, errors.New("iNES image truncated in trainer")
+		}
+		cart.Trainer = data[position : position+TRAINER_SIZE]
+		position += TRAINER_SIZE
+	}
+
+	if len(data) < position+prg_size+chr_size {
+		return nil, fmt.Errorf("iNES image truncated: expected %d bytes of PRG/CHR, have %d", prg_size+chr_size, len(data)-position)
+	}
+
+	cart.PRG = data[position : position+prg_size]
+	position += prg_size
+	cart.CHR = data[position : position+chr_size]
+
+	return cart, nil
+}
@@ -0,0 +1,164 @@
+package cartridge
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// An iNES image with the given header bytes 4-7 and byte 12, filled with
+// PRG, CHR and trainer bytes that say which section they're from.
+func makeImage(prg_banks uint8, chr_banks uint8, flags6 uint8, flags7 uint8, byte12 uint8) []uint8 {
+	header := make([]uint8, HEADER_SIZE)
+	copy(header, INES_MAGIC)
+	header[4] = prg_banks
+	header[5] = chr_banks
+	header[6] = flags6
+	header[7] = flags7
+	header[TIMING_OFFSET] = byte12
+
+	image := header
+	if flags6&FLAG_TRAINER > 0 {
+		image = append(image, bytes.Repeat([]uint8{'T'}, TRAINER_SIZE)...)
+	}
+	image = append(image, bytes.Repeat([]uint8{'P'}, int(prg_banks)*PRG_BANK_SIZE)...)
+	return append(image, bytes.Repeat([]uint8{'C'}, int(chr_banks)*CHR_BANK_SIZE)...)
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		image    []uint8
+		expected Cartridge
+	}{
+		{
+			"Horizontal mirroring",
+			makeImage(1, 1, 0x00, 0x00, 0),
+			Cartridge{Mirroring: MirrorHorizontal},
+		},
+		{
+			"Vertical mirroring",
+			makeImage(1, 1, FLAG_VERTICAL_MIRRORING, 0x00, 0),
+			Cartridge{Mirroring: MirrorVertical},
+		},
+		{
+			"Four screen beats vertical",
+			makeImage(1, 1, FLAG_FOUR_SCREEN|FLAG_VERTICAL_MIRRORING, 0x00, 0),
+			Cartridge{Mirroring: MirrorFourScreen},
+		},
+		{
+			"Battery",
+			makeImage(1, 1, FLAG_BATTERY, 0x00, 0),
+			Cartridge{Battery: true},
+		},
+		{
+			"Mapper from both nibbles",
+			makeImage(1, 1, 0x10, 0x40, 0),
+			Cartridge{Mapper: 0x41},
+		},
+		{
+			"NES 2.0",
+			makeImage(1, 1, 0x00, FLAG_NES2, uint8(TimingPAL)),
+			Cartridge{NES2: true, Timing: TimingPAL},
+		},
+		{
+			"Timing is ignored without NES 2.0",
+			makeImage(1, 1, 0x00, 0x00, uint8(TimingDendy)),
+			Cartridge{},
+		},
+		{
+			// Bits 2-3 of 01 are the archaic iNES format, not NES 2.0
+			"Not NES 2.0",
+			makeImage(1, 1, 0x00, 0x04, uint8(TimingPAL)),
+			Cartridge{},
+		},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			cart, err := Parse(test.image)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected.Mapper, cart.Mapper)
+			assert.Equal(t, test.expected.Mirroring, cart.Mirroring)
+			assert.Equal(t, test.expected.Battery, cart.Battery)
+			assert.Equal(t, test.expected.NES2, cart.NES2)
+			assert.Equal(t, test.expected.Timing, cart.Timing)
+			assert.Nil(t, cart.Trainer)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestParse_Sections(t *testing.T) {
+	testCases := []struct {
+		name      string
+		image     []uint8
+		prg_banks int
+		chr_banks int
+		trainer   bool
+	}{
+		{"No CHR", makeImage(2, 0, 0x00, 0x00, 0), 2, 0, false},
+		{"PRG and CHR", makeImage(1, 2, 0x00, 0x00, 0), 1, 2, false},
+		{"Trainer is skipped", makeImage(1, 1, FLAG_TRAINER, 0x00, 0), 1, 1, true},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			cart, err := Parse(test.image)
+
+			assert.Nil(t, err)
+			assert.Equal(t, bytes.Repeat([]uint8{'P'}, test.prg_banks*PRG_BANK_SIZE), cart.PRG)
+			assert.Equal(t, bytes.Repeat([]uint8{'C'}, test.chr_banks*CHR_BANK_SIZE), cart.CHR)
+			if test.trainer {
+				assert.Equal(t, bytes.Repeat([]uint8{'T'}, TRAINER_SIZE), cart.Trainer)
+			} else {
+				assert.Nil(t, cart.Trainer)
+			}
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	image := makeImage(1, 1, 0x00, 0x00, 0)
+	with_trainer := makeImage(1, 1, FLAG_TRAINER, 0x00, 0)
+
+	testCases := []struct {
+		name     string
+		image    []uint8
+		expected string
+	}{
+		{"Empty", nil, "Not an iNES image"},
+		{"Bad magic", append([]uint8{'N', 'E', 'Z', 0x1a}, image[4:]...), "Not an iNES image"},
+		{"Short header", image[:HEADER_SIZE-1], "Not an iNES image"},
+		{"Truncated in trainer", with_trainer[:HEADER_SIZE+TRAINER_SIZE-1], "iNES image truncated in trainer"},
+		{
+			"Truncated PRG",
+			image[:HEADER_SIZE+PRG_BANK_SIZE-1],
+			"iNES image truncated: expected 24576 bytes of PRG/CHR, have 16383",
+		},
+		{
+			"Truncated CHR",
+			image[:len(image)-1],
+			"iNES image truncated: expected 24576 bytes of PRG/CHR, have 24575",
+		},
+		{
+			// The trainer's bytes don't count towards PRG/CHR
+			"Truncated after trainer",
+			with_trainer[:len(with_trainer)-1],
+			"iNES image truncated: expected 24576 bytes of PRG/CHR, have 24575",
+		},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			cart, err := Parse(test.image)
+
+			assert.Nil(t, cart)
+			assert.EqualError(t, err, test.expected)
+		}
+		t.Run(test.name, callback)
+	}
+}
@@ -0,0 +1,229 @@
+// Package cheat decodes Game Genie and raw cheat codes and applies them
+// as overrides on CPU reads.
+package cheat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"pageer/myfinemu/internal/core"
+)
+
+// Each letter of a Game Genie code stands for four bits.
+const GAME_GENIE_LETTERS = "APZLGITYEOXUKSVN"
+
+// Makes a read of Address return Value.  With a compare value, only
+// reads that would have returned Compare are replaced, which is how
+// Game Genie codes pick out one bank of a bank-switched ROM.
+type Cheat struct {
+	// The code as it was entered
+	Code       string
+	Name       string
+	Address    uint16
+	Value      uint8
+	Compare    uint8
+	HasCompare bool
+	Enabled    bool
+}
+
+func (c Cheat) String() string {
+	text := fmt.Sprintf("%s: $%04X = $%02X", c.Code, c.Address, c.Value)
+	if c.HasCompare {
+		text += fmt.Sprintf(" if $%02X", c.Compare)
+	}
+	if c.Name != "" {
+		text += " " + c.Name
+	}
+	if !c.Enabled {
+		text += " (disabled)"
+	}
+	return text
+}
+
+// Decode a cheat code, either a 6 or 8 letter Game Genie code, or a raw
+// one in hex: ADDR:VALUE or ADDR:VALUE:COMPARE.
+func Parse(code string) (Cheat, error) {
+	if strings.Contains(code, ":") {
+		return ParseRaw(code)
+	}
+	return DecodeGameGenie(code)
+}
+
+// Decode a 6 or 8 letter Game Genie code.  The address bits are
+// scrambled across the letters, and always land in $8000-$FFFF.
+func DecodeGameGenie(code string) (Cheat, error) {
+	if len(code) != 6 && len(code) != 8 {
+		return Cheat{}, fmt.Errorf("Game Genie code %q should have 6 or 8 letters", code)
+	}
+	var n [8]uint16
+	for i, letter := range strings.ToUpper(code) {
+		value := strings.IndexRune(GAME_GENIE_LETTERS, letter)
+		if value < 0 {
+			return Cheat{}, fmt.Errorf("Game Genie code %q has an invalid letter %q", code, letter)
+		}
+		n[i] = uint16(value)
+	}
+
+	cheat := Cheat{
+		Code: strings.ToUpper(code),
+		Address: 0x8000 | (n[3]&7)<<12 | (n[5]&7)<<8 | (n[4]&8)<<8 |
+			(n[2]&7)<<4 | (n[1]&8)<<4 | n[4]&7 | n[3]&8,
+		Value:   uint8((n[1]&7)<<4 | (n[0]&8)<<4 | n[0]&7 | n[5]&8),
+		Enabled: true,
+	}
+	if len(code) == 8 {
+		// The last letter takes over the value's high bit
+		cheat.Value = cheat.Value&^8 | uint8(n[7]&8)
+		cheat.Compare = uint8((n[7]&7)<<4 | (n[6]&8)<<4 | n[6]&7 | n[5]&8)
+		cheat.HasCompare = true
+	}
+	return cheat, nil
+}
+
+// Decode a raw code, ADDR:VALUE or ADDR:VALUE:COMPARE in hex, e.g.
+// 0075:09 for nine lives.  Unlike Game Genie codes, these can patch RAM.
+func ParseRaw(code string) (Cheat, error) {
+	parts := strings.Split(code, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Cheat{}, fmt.Errorf("Raw code %q should be ADDR:VALUE or ADDR:VALUE:COMPARE", code)
+	}
+	var numbers [3]uint64
+	for i, part := range parts {
+		bits := 8
+		if i == 0 {
+			bits = 16
+		}
+		number, err := strconv.ParseUint(strings.TrimPrefix(part, "$"), 16, bits)
+		if err != nil {
+			return Cheat{}, fmt.Errorf("Raw code %q has a bad number %q", code, part)
+		}
+		numbers[i] = number
+	}
+
+	return Cheat{
+		Code:       strings.ToUpper(code),
+		Address:    uint16(numbers[0]),
+		Value:      uint8(numbers[1]),
+		Compare:    uint8(numbers[2]),
+		HasCompare: len(parts) == 3,
+		Enabled:    true,
+	}, nil
+}
+
+// A list of cheats, applied to a CPU's reads while they're enabled.
+type Engine struct {
+	cheats []Cheat
+	cpu    *core.CPU
+}
+
+func New() *Engine {
+	return &Engine{}
+}
+
+// Apply the cheats to a CPU, and keep it up to date as they change.
+func (e *Engine) Attach(c *core.CPU) {
+	e.cpu = c
+	e.apply()
+}
+
+// Decode and add an enabled cheat.  Returns its index.
+func (e *Engine) Add(code string, name string) (int, error) {
+	cheat, err := Parse(code)
+	if err != nil {
+		return 0, err
+	}
+	cheat.Name = name
+	e.cheats = append(e.cheats, cheat)
+	e.apply()
+	return len(e.cheats) - 1, nil
+}
+
+func (e *Engine) Remove(index int) error {
+	if index < 0 || index >= len(e.cheats) {
+		return fmt.Errorf("No cheat %d", index)
+	}
+	e.cheats = append(e.cheats[:index], e.cheats[index+1:]...)
+	e.apply()
+	return nil
+}
+
+// Turn a cheat on or off.  This takes effect from the next read.
+func (e *Engine) SetEnabled(index int, enabled bool) error {
+	if index < 0 || index >= len(e.cheats) {
+		return fmt.Errorf("No cheat %d", index)
+	}
+	e.cheats[index].Enabled = enabled
+	e.apply()
+	return nil
+}
+
+func (e *Engine) Clear() {
+	e.cheats = nil
+	e.apply()
+}
+
+// A copy of the cheats, in the order they were added.
+func (e *Engine) Cheats() []Cheat {
+	return append([]Cheat(nil), e.cheats...)
+}
+
+// Read a cheat list: one code per line, optionally followed by a name.
+// Blank lines and lines starting with # are skipped, and a code
+// starting with - is added disabled.
+func (e *Engine) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		code := fields[0]
+		disabled := strings.HasPrefix(code, "-")
+		index, err := e.Add(strings.TrimPrefix(code, "-"), strings.Join(fields[1:], " "))
+		if err != nil {
+			return fmt.Errorf("Line %d: %w", line_number, err)
+		}
+		if disabled {
+			e.SetEnabled(index, false)
+		}
+	}
+	return scanner.Err()
+}
+
+func (e *Engine) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return e.Load(file)
+}
+
+// Point the CPU's read override at the enabled cheats.
+func (e *Engine) apply() {
+	if e.cpu == nil {
+		return
+	}
+	var addresses []uint16
+	for _, cheat := range e.cheats {
+		if cheat.Enabled {
+			addresses = append(addresses, cheat.Address)
+		}
+	}
+	e.cpu.SetReadOverride(addresses, e.override)
+}
+
+// The first enabled cheat that matches wins.
+func (e *Engine) override(address uint16, value uint8) uint8 {
+	for _, cheat := range e.cheats {
+		if cheat.Enabled && cheat.Address == address && (!cheat.HasCompare || cheat.Compare == value) {
+			return cheat.Value
+		}
+	}
+	return value
+}
@@ -0,0 +1,139 @@
+package cheat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/core"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		code     string
+		expected Cheat
+	}{
+		// Super Mario Bros. infinite lives
+		{"6 letters", "SXIOPO", Cheat{Code: "SXIOPO", Address: 0x91d9, Value: 0xad, Enabled: true}},
+		{"Lower case", "sxiopo", Cheat{Code: "SXIOPO", Address: 0x91d9, Value: 0xad, Enabled: true}},
+		{"8 letters", "SXIOPOAE", Cheat{Code: "SXIOPOAE", Address: 0x91d9, Value: 0xad, Compare: 0x08, HasCompare: true, Enabled: true}},
+		{"Raw", "0075:09", Cheat{Code: "0075:09", Address: 0x0075, Value: 0x09, Enabled: true}},
+		{"Raw with compare", "$c010:ea:a9", Cheat{Code: "$C010:EA:A9", Address: 0xc010, Value: 0xea, Compare: 0xa9, HasCompare: true, Enabled: true}},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			cheat, err := Parse(test.code)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, cheat)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, code := range []string{"SXIOP", "SXIOPB", "SXIOPOAEE", "0075", "10000:00", "0075:100", "0075:09:xx", "1:2:3:4"} {
+		_, err := Parse(code)
+		assert.NotNil(t, err, code)
+	}
+}
+
+// LDA $C000, LDA $0075, then BRK.
+func newCheatCPU() *core.CPU {
+	c := core.NewCPU()
+	c.LoadAndReset([]uint8{0xad, 0x00, 0xc0, 0xa5, 0x75, 0x00})
+	c.WriteMemory(0xc000, 0x11)
+	c.WriteMemory(0x0075, 0x03)
+	return c
+}
+
+func TestEngine(t *testing.T) {
+	testCases := []struct {
+		name     string
+		codes    []string
+		expected uint8
+	}{
+		{"No cheats", nil, 0x03},
+		{"RAM", []string{"0075:09"}, 0x09},
+		{"Compare matches", []string{"0075:09:03"}, 0x09},
+		{"Compare doesn't match", []string{"0075:09:04"}, 0x03},
+		{"First match wins", []string{"0075:09:04", "0075:07", "0075:05"}, 0x07},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := newCheatCPU()
+			engine := New()
+			engine.Attach(c)
+			for _, code := range test.codes {
+				_, err := engine.Add(code, "")
+				assert.Nil(t, err)
+			}
+
+			c.Step()
+			c.Step()
+
+			assert.Equal(t, test.expected, c.Registers().A)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestEngine_PatchesCode(t *testing.T) {
+	for _, mode := range []core.CoreMode{core.CoreInstruction, core.CoreCycle} {
+		callback := func(t *testing.T) {
+			c := newCheatCPU()
+			c.SetCoreMode(mode)
+			engine := New()
+			engine.Attach(c)
+			// LDA $C000 becomes LDA #$00, the address's low byte
+			engine.Add("8000:a9", "")
+
+			c.Step()
+
+			assert.Equal(t, uint8(0x00), c.Registers().A)
+			assert.Equal(t, uint16(0x8002), c.Registers().PC)
+		}
+		t.Run(mode.String(), callback)
+	}
+}
+
+func TestEngine_Toggle(t *testing.T) {
+	c := newCheatCPU()
+	engine := New()
+	engine.Attach(c)
+	index, _ := engine.Add("C000:22", "")
+
+	c.Step()
+	assert.Equal(t, uint8(0x22), c.Registers().A)
+
+	assert.Nil(t, engine.SetEnabled(index, false))
+	c.SetRegisters(core.Registers{PC: 0x8000})
+	c.Step()
+	assert.Equal(t, uint8(0x11), c.Registers().A)
+
+	assert.NotNil(t, engine.SetEnabled(1, true))
+	assert.Nil(t, engine.Remove(index))
+	assert.Empty(t, engine.Cheats())
+}
+
+func TestEngine_Load(t *testing.T) {
+	engine := New()
+	err := engine.Load(strings.NewReader(`# Super Mario Bros.
+SXIOPO  Infinite lives
+
+-0075:09 Nine lives
+`))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Cheat{
+		{Code: "SXIOPO", Name: "Infinite lives", Address: 0x91d9, Value: 0xad, Enabled: true},
+		{Code: "0075:09", Name: "Nine lives", Address: 0x0075, Value: 0x09},
+	}, engine.Cheats())
+
+	err = engine.Load(strings.NewReader("SXIOPO\nBOGUS!\n"))
+	assert.EqualError(t, err, `Line 2: Game Genie code "BOGUS!" has an invalid letter 'B'`)
+}
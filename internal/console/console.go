@@ -0,0 +1,332 @@
+// Package console ties the CPU and the rest of the hardware together on a
+// shared master clock.
+package console
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"pageer/myfinemu/internal/cartridge"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/input"
+	"pageer/myfinemu/internal/savestate"
+)
+
+const (
+	DOTS_PER_SCANLINE = 341
+
+	// Bump this when the layout of clockState changes
+	CLOCK_STATE_VERSION uint16 = 2
+)
+
+var ErrHalted = errors.New("CPU halted")
+
+// Hardware the master clock drives alongside the CPU, such as the PPU or
+// APU.
+type Component interface {
+	// Advance one tick of the component's own clock
+	Tick()
+}
+
+// A component that drives the CPU's IRQ line, e.g. the APU frame counter.
+type IRQSource interface {
+	IRQ() bool
+}
+
+// A component that drives the CPU's NMI line, i.e. the PPU at vblank.
+// The CPU takes an NMI when the line goes high.
+type NMISource interface {
+	NMI() bool
+}
+
+// The whole machine.  There's no PPU or APU emulation yet, so those stay
+// nil unless the caller attaches something, and the console keeps track
+// of the beam position itself to count frames.
+type Console struct {
+	CPU       *core.CPU
+	PPU       Component
+	APU       Component
+	Cartridge *cartridge.Cartridge
+	Ports     *input.Ports
+	// Battery-backed PRG-RAM, or nil if the cartridge has no battery
+	SaveRAM *cartridge.SaveRAM
+	// As asked for, which may be RegionAuto
+	region Region
+	timing Timing
+	// Master clock ticks at which the CPU and PPU next tick
+	next_cpu uint64
+	next_ppu uint64
+	cycles   uint64
+	dot      int
+	scanline int
+	frame    uint64
+	nmi_line bool
+	// Until the PPU first reaches the pre-render scanline
+	warming_up bool
+}
+
+// A console with nothing plugged in, and the controllers mapped.
+// RegionAuto runs as NTSC until a cartridge says otherwise.
+func New(region Region) *Console {
+	return NewWithCPU(region, core.NewCPU())
+}
+
+// A console around a CPU that's already set up, e.g. another variant or
+// core for running plain 6502 programs.
+func NewWithCPU(region Region, cpu *core.CPU) *Console {
+	c := &Console{
+		CPU:    cpu,
+		Ports:  &input.Ports{},
+		region: region,
+		timing: RegionTiming(region),
+	}
+	c.CPU.MapDevice(input.PORT1_ADDRESS, input.PORT2_ADDRESS, c.Ports)
+	return c
+}
+
+// Insert a cartridge and power on.  On RegionAuto, this switches to the
+// region in the cartridge header.  A battery-backed cartridge gets fresh
+// save RAM, for the caller to fill from a save file.
+func (c *Console) LoadCartridge(cart *cartridge.Cartridge) error {
+	err := c.CPU.LoadPRG(cart.PRG)
+	if err != nil {
+		return err
+	}
+	c.Cartridge = cart
+	if cart.Battery {
+		c.SaveRAM = &cartridge.SaveRAM{}
+		c.CPU.MapDevice(cartridge.PRG_RAM_START, cartridge.PRG_RAM_END, c.SaveRAM)
+	}
+	if c.region == RegionAuto {
+		c.setTiming(RegionTiming(CartridgeRegion(cart)))
+	}
+	c.PowerOn()
+	return nil
+}
+
+// Override the region, or go back to following the cartridge with
+// RegionAuto.
+func (c *Console) SetRegion(region Region) {
+	c.region = region
+	if region == RegionAuto && c.Cartridge != nil {
+		region = CartridgeRegion(c.Cartridge)
+	}
+	c.setTiming(RegionTiming(region))
+}
+
+// The region being emulated, never RegionAuto.
+func (c *Console) Region() Region {
+	return c.timing.Region
+}
+
+func (c *Console) Timing() Timing {
+	return c.timing
+}
+
+// Keeps the clocks where they are, since they only ever count up, but
+// restarts the frame if the new one is shorter.
+func (c *Console) setTiming(timing Timing) {
+	c.timing = timing
+	if c.scanline >= timing.Scanlines {
+		c.dot = 0
+		c.scanline = 0
+	}
+}
+
+// Master clock ticks since power-on.
+func (c *Console) Clock() uint64 {
+	return c.next_cpu
+}
+
+// CPU cycles since power-on.  The instruction core runs each instruction
+// on its first cycle, so the CPU's own count can be a few cycles ahead.
+func (c *Console) Cycles() uint64 {
+	return c.cycles
+}
+
+// Frames completed since power-on.
+func (c *Console) Frame() uint64 {
+	return c.frame
+}
+
+// The dot and scanline the PPU is on.
+func (c *Console) BeamPosition() (int, int) {
+	return c.dot, c.scanline
+}
+
+func (c *Console) InVBlank() bool {
+	return c.scanline >= c.timing.VBlankStart && c.scanline < c.timing.VBlankStart+c.timing.VBlankScanlines
+}
+
+// Read memory as the CPU sees it, including the cartridge's save RAM,
+// without side effects.
+func (c *Console) ReadMemory(address uint16) uint8 {
+	if c.SaveRAM != nil && address >= cartridge.PRG_RAM_START && address <= cartridge.PRG_RAM_END {
+		return c.SaveRAM.ReadRegister(address)
+	}
+	return c.CPU.ReadMemory(address)
+}
+
+// Run for a number of CPU cycles.
+func (c *Console) RunCycles(cycles uint64) error {
+	for i := uint64(0); i < cycles; i++ {
+		err := c.step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run to the end of the current frame.
+func (c *Console) RunFrame() error {
+	frame := c.frame
+	return c.RunUntil(func(c *Console) bool {
+		return c.frame != frame
+	})
+}
+
+// Run until the predicate returns true.  It's checked after every CPU
+// cycle.
+func (c *Console) RunUntil(predicate func(c *Console) bool) error {
+	for !predicate(c) {
+		err := c.step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run a CPU cycle, after the PPU dots due by then.
+func (c *Console) step() error {
+	for c.next_ppu <= c.next_cpu {
+		c.tickPPU()
+		c.next_ppu += c.timing.PPUDivider
+	}
+	running, err := c.CPU.StepCycle()
+	if c.APU != nil {
+		c.APU.Tick()
+	}
+	c.next_cpu += c.timing.CPUDivider
+	c.cycles++
+	c.routeInterrupts()
+
+	if err != nil {
+		return err
+	}
+	if !running {
+		return ErrHalted
+	}
+	return nil
+}
+
+func (c *Console) tickPPU() {
+	if c.PPU != nil {
+		c.PPU.Tick()
+	}
+	c.dot++
+	if c.dot == DOTS_PER_SCANLINE {
+		c.dot = 0
+		c.scanline++
+		if c.scanline == c.timing.Scanlines-1 {
+			// The pre-render scanline, where the end of vblank clears the
+			// PPU's reset flag
+			c.warming_up = false
+		}
+		if c.scanline == c.timing.Scanlines {
+			c.scanline = 0
+			c.frame++
+		}
+	}
+}
+
+// IRQ is shared, so any source holds it.  NMI fires on a rising edge.
+func (c *Console) routeInterrupts() {
+	irq := false
+	for _, component := range [...]Component{c.PPU, c.APU} {
+		if source, ok := component.(IRQSource); ok && source.IRQ() {
+			irq = true
+		}
+	}
+	c.CPU.SetIRQ(irq)
+
+	if source, ok := c.PPU.(NMISource); ok {
+		nmi := source.NMI()
+		if nmi && !c.nmi_line {
+			c.CPU.TriggerNMI()
+		}
+		c.nmi_line = nmi
+	}
+}
+
+// Everything that goes in a save state of the console.
+func (c *Console) StateComponents() []savestate.Component {
+	components := []savestate.Component{c.CPU, c.Ports, c}
+	if c.SaveRAM != nil {
+		components = append(components, c.SaveRAM)
+	}
+	return components
+}
+
+type clockState struct {
+	Version  uint16
+	NextCPU  uint64
+	NextPPU  uint64
+	Cycles   uint64
+	Dot      uint16
+	Scanline uint16
+	Frame    uint64
+	NMILine  bool
+	Warmup   bool
+}
+
+func (c *Console) StateID() string {
+	return "CLK "
+}
+
+func (c *Console) SaveState() ([]byte, error) {
+	state := clockState{
+		Version:  CLOCK_STATE_VERSION,
+		NextCPU:  c.next_cpu,
+		NextPPU:  c.next_ppu,
+		Cycles:   c.cycles,
+		Dot:      uint16(c.dot),
+		Scanline: uint16(c.scanline),
+		Frame:    c.frame,
+		NMILine:  c.nmi_line,
+		Warmup:   c.warming_up,
+	}
+	var buffer bytes.Buffer
+	err := binary.Write(&buffer, binary.LittleEndian, &state)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (c *Console) LoadState(data []byte) error {
+	var state clockState
+	if len(data) != binary.Size(&state) {
+		return fmt.Errorf("Clock state is %d bytes, expected %d", len(data), binary.Size(&state))
+	}
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &state)
+	if err != nil {
+		return err
+	}
+	if state.Version != CLOCK_STATE_VERSION {
+		return fmt.Errorf("Unsupported clock state version %d", state.Version)
+	}
+
+	c.next_cpu = state.NextCPU
+	c.next_ppu = state.NextPPU
+	c.cycles = state.Cycles
+	c.dot = int(state.Dot)
+	c.scanline = int(state.Scanline)
+	c.frame = state.Frame
+	c.nmi_line = state.NMILine
+	c.warming_up = state.Warmup
+	return nil
+}
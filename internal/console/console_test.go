@@ -0,0 +1,355 @@
+package console
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/cartridge"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/savestate"
+)
+
+// JMP $8000, forever
+var spinProgram = []uint8{0x4c, 0x00, 0x80}
+
+type fakeComponent struct {
+	ticks int
+	irq   bool
+	nmi   bool
+}
+
+func (f *fakeComponent) Tick() {
+	f.ticks++
+}
+
+func (f *fakeComponent) IRQ() bool {
+	return f.irq
+}
+
+func (f *fakeComponent) NMI() bool {
+	return f.nmi
+}
+
+func newSpinningConsole(region Region) *Console {
+	c := New(region)
+	c.CPU.LoadAndReset(spinProgram)
+	return c
+}
+
+func TestRunCycles_ClockRatio(t *testing.T) {
+	testCases := []struct {
+		name     string
+		region   Region
+		expected int
+	}{
+		// 3 or 3.2 per CPU cycle, less the ones due after the last
+		// cycle starts
+		{"NTSC", RegionNTSC, 2998},
+		{"PAL", RegionPAL, 3197},
+		{"Dendy", RegionDendy, 2998},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := newSpinningConsole(test.region)
+			ppu := &fakeComponent{}
+			apu := &fakeComponent{}
+			c.PPU = ppu
+			c.APU = apu
+
+			err := c.RunCycles(1000)
+
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(1000), c.Cycles())
+			assert.Equal(t, 1000, apu.ticks)
+			assert.Equal(t, test.expected, ppu.ticks)
+			assert.Equal(t, 1000*c.Timing().CPUDivider, c.Clock())
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestRunFrame(t *testing.T) {
+	testCases := []struct {
+		name   string
+		region Region
+		cycles float64
+	}{
+		{"NTSC", RegionNTSC, 262 * 341 / 3.0},
+		{"PAL", RegionPAL, 312 * 341 / 3.2},
+		{"Dendy", RegionDendy, 312 * 341 / 3.0},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := newSpinningConsole(test.region)
+
+			err := c.RunFrame()
+			assert.Nil(t, err)
+			start := c.Cycles()
+			err = c.RunFrame()
+
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(2), c.Frame())
+			assert.InDelta(t, test.cycles, float64(c.Cycles()-start), 1)
+			dot, scanline := c.BeamPosition()
+			assert.Equal(t, 0, scanline)
+			assert.Less(t, dot, 4)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	testCases := []struct {
+		name       string
+		timing     Timing
+		frame_rate float64
+		cpu_hz     float64
+	}{
+		{"NTSC", NTSC_TIMING, 60.10, 1789773},
+		{"PAL", PAL_TIMING, 50.01, 1662607},
+		{"Dendy", DENDY_TIMING, 50.01, 1773448},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			assert.InDelta(t, test.frame_rate, test.timing.FrameRate(), 0.01)
+			assert.InDelta(t, test.cpu_hz, test.timing.CPUHz(), 1)
+			// Vblank runs up to the pre-render line
+			assert.Equal(t, test.timing.Scanlines-1, test.timing.VBlankStart+test.timing.VBlankScanlines)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestInVBlank(t *testing.T) {
+	testCases := []struct {
+		name     string
+		region   Region
+		vblank   int
+		expected bool
+	}{
+		{"NTSC", RegionNTSC, 241, true},
+		{"PAL long vblank", RegionPAL, 300, true},
+		{"Dendy idle lines", RegionDendy, 260, false},
+		{"Dendy", RegionDendy, 291, true},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := newSpinningConsole(test.region)
+
+			err := c.RunUntil(func(c *Console) bool {
+				_, scanline := c.BeamPosition()
+				return scanline == test.vblank
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, c.InVBlank())
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+// A 16K NROM image with an NES 2.0 header giving the timing mode.
+func nes2Image(timing uint8) []uint8 {
+	image := make([]uint8, cartridge.HEADER_SIZE+cartridge.PRG_BANK_SIZE)
+	copy(image, cartridge.INES_MAGIC)
+	image[4] = 1
+	image[7] = cartridge.FLAG_NES2
+	image[cartridge.TIMING_OFFSET] = timing
+	return image
+}
+
+func TestLoadCartridge_Region(t *testing.T) {
+	testCases := []struct {
+		name     string
+		setting  Region
+		timing   uint8
+		expected Region
+	}{
+		{"NTSC header", RegionAuto, 0, RegionNTSC},
+		{"PAL header", RegionAuto, 1, RegionPAL},
+		{"Multi-region header", RegionAuto, 2, RegionNTSC},
+		{"Dendy header", RegionAuto, 3, RegionDendy},
+		{"Override", RegionNTSC, 1, RegionNTSC},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			cart, err := cartridge.Parse(nes2Image(test.timing))
+			assert.Nil(t, err)
+			c := New(test.setting)
+
+			err = c.LoadCartridge(cart)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, c.Region())
+			assert.Equal(t, test.expected, c.Timing().Region)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestSetRegion(t *testing.T) {
+	cart, _ := cartridge.Parse(nes2Image(1))
+	c := New(RegionDendy)
+	c.LoadCartridge(cart)
+	assert.Equal(t, RegionDendy, c.Region())
+
+	c.SetRegion(RegionAuto)
+	assert.Equal(t, RegionPAL, c.Region())
+
+	c.SetRegion(RegionNTSC)
+	assert.Equal(t, RegionNTSC, c.Region())
+}
+
+func TestParseRegion(t *testing.T) {
+	region, err := ParseRegion("PAL")
+	assert.Nil(t, err)
+	assert.Equal(t, RegionPAL, region)
+
+	_, err = ParseRegion("secam")
+	assert.NotNil(t, err)
+}
+
+func TestRunUntil(t *testing.T) {
+	c := newSpinningConsole(RegionNTSC)
+
+	err := c.RunUntil(func(c *Console) bool {
+		return c.Cycles() >= 100
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), c.Cycles())
+}
+
+func TestRunCycles_Halted(t *testing.T) {
+	c := New(RegionNTSC)
+	c.CPU.LoadAndReset([]uint8{0xea, 0x00})
+
+	err := c.RunCycles(100)
+
+	assert.Equal(t, ErrHalted, err)
+}
+
+func TestInterruptRouting(t *testing.T) {
+	testCases := []struct {
+		name     string
+		irq      bool
+		nmi      bool
+		expected uint16
+	}{
+		{"No interrupt", false, false, 0x8000},
+		{"IRQ", true, false, 0x9000},
+		{"NMI", false, true, 0xa000},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			// The handlers spin too
+			c := newSpinningConsole(RegionNTSC)
+			c.CPU.WriteMemory(core.IRQ_VECTOR, 0x00)
+			c.CPU.WriteMemory(core.IRQ_VECTOR+1, 0x90)
+			c.CPU.WriteMemory(core.NMI_VECTOR, 0x00)
+			c.CPU.WriteMemory(core.NMI_VECTOR+1, 0xa0)
+			copy_program := func(address uint16) {
+				c.CPU.WriteMemory(address, 0x4c)
+				c.CPU.WriteMemory(address+1, uint8(address))
+				c.CPU.WriteMemory(address+2, uint8(address>>8))
+			}
+			copy_program(0x9000)
+			copy_program(0xa000)
+			c.PPU = &fakeComponent{nmi: test.nmi}
+			c.APU = &fakeComponent{irq: test.irq}
+			c.CPU.SetRegisters(core.Registers{PC: 0x8000, SP: 0xfd, Status: 0x00})
+			if test.nmi {
+				// Held high, but it only fires on the edge
+				c.CPU.SetRegisters(core.Registers{PC: 0x8000, SP: 0xfd, Status: core.I_BIT_STATUS})
+			}
+
+			err := c.RunCycles(100)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, c.CPU.Registers().PC)
+			if test.expected != 0x8000 {
+				// One interrupt pushes three bytes
+				assert.Equal(t, uint8(0xfa), c.CPU.Registers().SP)
+			}
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestLoadCartridge(t *testing.T) {
+	prg := make([]uint8, cartridge.PRG_BANK_SIZE)
+	// Reset vector at $FFFC, mirrored from $BFFC
+	prg[0x3ffc] = 0x34
+	prg[0x3ffd] = 0xc2
+	cart := &cartridge.Cartridge{PRG: prg}
+	c := New(RegionNTSC)
+
+	err := c.LoadCartridge(cart)
+
+	assert.Nil(t, err)
+	assert.Equal(t, cart, c.Cartridge)
+	assert.Equal(t, uint16(0xc234), c.CPU.Registers().PC)
+}
+
+func TestLoadCartridge_Battery(t *testing.T) {
+	image := nes2Image(0)
+	image[6] |= cartridge.FLAG_BATTERY
+	cart, err := cartridge.Parse(image)
+	assert.Nil(t, err)
+	c := New(RegionNTSC)
+
+	err = c.LoadCartridge(cart)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, c.SaveRAM)
+	saved := make([]uint8, cartridge.PRG_RAM_SIZE)
+	saved[0x10] = 0x77
+	assert.Nil(t, c.SaveRAM.SetBytes(saved))
+	assert.Equal(t, uint8(0x77), c.ReadMemory(0x6010))
+	// LDA $6010
+	c.CPU.WriteMemory(0x0300, 0xad)
+	c.CPU.WriteMemory(0x0301, 0x10)
+	c.CPU.WriteMemory(0x0302, 0x60)
+	c.CPU.SetRegisters(core.Registers{PC: 0x0300})
+	c.CPU.Step()
+	assert.Equal(t, uint8(0x77), c.CPU.Registers().A)
+	assert.Len(t, c.StateComponents(), 4)
+}
+
+func TestSaveState(t *testing.T) {
+	for _, mode := range []core.CoreMode{core.CoreInstruction, core.CoreCycle} {
+		callback := func(t *testing.T) {
+			c := newSpinningConsole(RegionPAL)
+			c.CPU.SetCoreMode(mode)
+			// Part way through a JMP
+			c.RunCycles(12346)
+			var buffer bytes.Buffer
+			err := savestate.Save(&buffer, c.StateComponents()...)
+			assert.Nil(t, err)
+			c.RunCycles(1000)
+			expected_clock := c.Clock()
+			expected_beam_dot, expected_beam_scanline := c.BeamPosition()
+
+			restored := New(RegionPAL)
+			err = savestate.Load(&buffer, restored.StateComponents()...)
+			assert.Nil(t, err)
+			restored.RunCycles(1000)
+
+			assert.Equal(t, expected_clock, restored.Clock())
+			dot, scanline := restored.BeamPosition()
+			assert.Equal(t, expected_beam_dot, dot)
+			assert.Equal(t, expected_beam_scanline, scanline)
+			assert.Equal(t, c.CPU.Registers(), restored.CPU.Registers())
+			assert.Equal(t, c.CPU.Cycles(), restored.CPU.Cycles())
+		}
+		t.Run(mode.String(), callback)
+	}
+}
@@ -0,0 +1,86 @@
+package console
+
+import (
+	"pageer/myfinemu/internal/core"
+)
+
+const (
+	// Where the PPU's registers are mirrored, every 8 bytes
+	PPU_REGISTERS_START uint16 = 0x2000
+	PPU_REGISTERS_END   uint16 = 0x3fff
+)
+
+// A component with state of its own to set up at power-on, which the
+// reset button may only partly clear.  The PPU, for one, keeps its VRAM
+// and OAM over a reset, and the APU silences its channels.
+type PowerCycler interface {
+	PowerOn()
+	Reset()
+}
+
+// Switch the console on.  The CPU powers up and runs its reset sequence,
+// attached components power up, the clocks start again from zero, and
+// the PPU warms up.
+func (c *Console) PowerOn() {
+	c.CPU.PowerOn()
+	for _, component := range [...]Component{c.PPU, c.APU} {
+		if cycler, ok := component.(PowerCycler); ok {
+			cycler.PowerOn()
+		}
+	}
+	c.next_cpu = 0
+	c.next_ppu = 0
+	c.cycles = 0
+	c.dot = 0
+	c.scanline = 0
+	c.frame = 0
+	c.nmi_line = false
+	c.warming_up = true
+}
+
+// Press the reset button.  The clocks keep running, so the beam carries
+// on from where it was, but the PPU ignores writes again until it
+// reaches the pre-render scanline.
+func (c *Console) Reset() {
+	c.CPU.Reset()
+	for _, component := range [...]Component{c.PPU, c.APU} {
+		if cycler, ok := component.(PowerCycler); ok {
+			cycler.Reset()
+		}
+	}
+	c.warming_up = true
+}
+
+// Whether the PPU is still ignoring writes to PPUCTRL, PPUMASK,
+// PPUSCROLL and PPUADDR after power-on or reset.  That lasts until the
+// end of the first vblank, which is about 29658 CPU cycles on NTSC.
+func (c *Console) PPUWarmingUp() bool {
+	return c.warming_up
+}
+
+// Map the PPU's registers into the CPU's address space, behind the
+// warm-up period.
+func (c *Console) MapPPU(registers core.Device) {
+	c.CPU.MapDevice(PPU_REGISTERS_START, PPU_REGISTERS_END, &warmupGate{console: c, device: registers})
+}
+
+// Drops the writes a warming up PPU ignores.  Everything else goes
+// straight through, so PPUSTATUS, OAM and PPUDATA work from the start.
+type warmupGate struct {
+	console *Console
+	device  core.Device
+}
+
+func (g *warmupGate) ReadRegister(address uint16) uint8 {
+	return g.device.ReadRegister(address)
+}
+
+func (g *warmupGate) WriteRegister(address uint16, value uint8) {
+	if g.console.warming_up {
+		switch address & 0x07 {
+		case 0, 1, 5, 6:
+			return
+		}
+	}
+	g.device.WriteRegister(address, value)
+}
@@ -0,0 +1,101 @@
+package console
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/core"
+)
+
+type fakePPU struct {
+	fakeComponent
+	writes   []uint16
+	power_on int
+	resets   int
+}
+
+func (f *fakePPU) ReadRegister(address uint16) uint8 {
+	return 0
+}
+
+func (f *fakePPU) WriteRegister(address uint16, value uint8) {
+	f.writes = append(f.writes, address)
+}
+
+func (f *fakePPU) PowerOn() {
+	f.power_on++
+}
+
+func (f *fakePPU) Reset() {
+	f.resets++
+}
+
+// Writes to every PPU register, then spins.  There's no STA yet, so
+// SAX stands in.
+var ppuWriteProgram = []uint8{
+	0x8f, 0x00, 0x20, // SAX $2000
+	0x8f, 0x01, 0x20, // SAX $2001
+	0x8f, 0x03, 0x20, // SAX $2003
+	0x8f, 0x05, 0x20, // SAX $2005
+	0x8f, 0x0e, 0x20, // SAX $200E, a mirror of $2006
+	0x8f, 0x07, 0x20, // SAX $2007
+	0x4c, 0x12, 0x80, // JMP $8012
+}
+
+func newPPUConsole() (*Console, *fakePPU) {
+	c := New(RegionNTSC)
+	ppu := &fakePPU{}
+	c.PPU = ppu
+	c.MapPPU(ppu)
+	c.CPU.LoadROM(ppuWriteProgram)
+	return c, ppu
+}
+
+func TestPowerOn(t *testing.T) {
+	c, ppu := newPPUConsole()
+	c.RunCycles(1000)
+
+	c.PowerOn()
+
+	assert.Equal(t, 1, ppu.power_on)
+	assert.Equal(t, uint64(0), c.Cycles())
+	assert.Equal(t, uint64(0), c.Clock())
+	assert.Equal(t, uint8(0xfd), c.CPU.Registers().SP)
+	assert.True(t, c.PPUWarmingUp())
+}
+
+func TestPowerOn_PPUWarmup(t *testing.T) {
+	c, ppu := newPPUConsole()
+	c.PowerOn()
+
+	c.RunCycles(100)
+	// Only OAMADDR and PPUDATA get through
+	assert.Equal(t, []uint16{0x2003, 0x2007}, ppu.writes)
+
+	err := c.RunUntil(func(c *Console) bool { return !c.PPUWarmingUp() })
+	assert.Nil(t, err)
+	_, scanline := c.BeamPosition()
+	assert.Equal(t, 261, scanline)
+	assert.InDelta(t, 29658, c.Cycles(), 20)
+
+	ppu.writes = nil
+	c.CPU.SetRegisters(core.Registers{PC: 0x8000})
+	c.RunCycles(100)
+	assert.Equal(t, []uint16{0x2000, 0x2001, 0x2003, 0x2005, 0x200e, 0x2007}, ppu.writes)
+}
+
+func TestReset(t *testing.T) {
+	c, ppu := newPPUConsole()
+	c.PowerOn()
+	c.RunFrame()
+	clock := c.Clock()
+
+	c.Reset()
+
+	assert.Equal(t, 1, ppu.resets)
+	assert.Equal(t, clock, c.Clock())
+	assert.Equal(t, uint16(0x8000), c.CPU.Registers().PC)
+	assert.Equal(t, uint8(0xfa), c.CPU.Registers().SP)
+	assert.True(t, c.PPUWarmingUp())
+}
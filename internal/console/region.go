@@ -0,0 +1,124 @@
+package console
+
+import (
+	"fmt"
+	"strings"
+
+	"pageer/myfinemu/internal/cartridge"
+)
+
+// Which console's timing to emulate.
+type Region int
+
+const (
+	// Follow the cartridge header, or NTSC if it doesn't say
+	RegionAuto Region = iota
+	RegionNTSC
+	RegionPAL
+	// The common Famicom clone, with PAL clocks but NTSC-like timing
+	RegionDendy
+)
+
+var REGION_NAMES = [...]string{"auto", "ntsc", "pal", "dendy"}
+
+func (r Region) String() string {
+	if r < 0 || int(r) >= len(REGION_NAMES) {
+		return fmt.Sprintf("region(%d)", int(r))
+	}
+	return REGION_NAMES[r]
+}
+
+func ParseRegion(name string) (Region, error) {
+	for i, region_name := range REGION_NAMES {
+		if strings.EqualFold(name, region_name) {
+			return Region(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown region %q, expected one of %s", name, strings.Join(REGION_NAMES[:], ", "))
+}
+
+// The region a cartridge was made for.  Multi-region games run as NTSC.
+func CartridgeRegion(cart *cartridge.Cartridge) Region {
+	switch cart.Timing {
+	case cartridge.TimingPAL:
+		return RegionPAL
+	case cartridge.TimingDendy:
+		return RegionDendy
+	}
+	return RegionNTSC
+}
+
+// How the CPU and PPU clocks divide down from the master clock, and the
+// shape of a frame.  Both clocks count in master clock ticks, so the
+// PPU:CPU ratio needn't be whole.
+type Timing struct {
+	Region     Region
+	MasterHz   float64
+	CPUDivider uint64
+	PPUDivider uint64
+	Scanlines  int
+	// The first scanline of vblank, and how many there are
+	VBlankStart     int
+	VBlankScanlines int
+	APU             APUTiming
+}
+
+// Rates for the APU, all in CPU cycles.
+type APUTiming struct {
+	NoisePeriods [16]uint16
+	DMCRates     [16]uint16
+	// When the frame counter's quarter and half frame steps fire in
+	// 4-step mode, the last also raising the frame IRQ
+	FrameSteps [4]uint32
+	// The length of a 5-step sequence, whose fifth step replaces the IRQ
+	FiveStepLength uint32
+}
+
+var NTSC_APU_TIMING = APUTiming{
+	NoisePeriods:   [16]uint16{4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068},
+	DMCRates:       [16]uint16{428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54},
+	FrameSteps:     [4]uint32{7457, 14913, 22371, 29829},
+	FiveStepLength: 37281,
+}
+
+var PAL_APU_TIMING = APUTiming{
+	NoisePeriods:   [16]uint16{4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778},
+	DMCRates:       [16]uint16{398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50},
+	FrameSteps:     [4]uint32{8313, 16627, 24939, 33253},
+	FiveStepLength: 41565,
+}
+
+var (
+	// 3 PPU dots per CPU cycle, vblank from 241 to 260
+	NTSC_TIMING = Timing{RegionNTSC, 236250000.0 / 11, 12, 4, 262, 241, 20, NTSC_APU_TIMING}
+	// 3.2 PPU dots per CPU cycle, and a long vblank
+	PAL_TIMING = Timing{RegionPAL, 26601712.5, 16, 5, 312, 241, 70, PAL_APU_TIMING}
+	// PAL's master clock and frame, but 3 dots per CPU cycle and NTSC's
+	// vblank after 51 idle scanlines, so NTSC games mostly run unchanged
+	DENDY_TIMING = Timing{RegionDendy, 26601712.5, 15, 5, 312, 291, 20, NTSC_APU_TIMING}
+)
+
+// The timing for a region, or NTSC's for RegionAuto.
+func RegionTiming(region Region) Timing {
+	switch region {
+	case RegionPAL:
+		return PAL_TIMING
+	case RegionDendy:
+		return DENDY_TIMING
+	}
+	return NTSC_TIMING
+}
+
+// CPU cycles per second.
+func (t Timing) CPUHz() float64 {
+	return t.MasterHz / float64(t.CPUDivider)
+}
+
+// Master clock ticks per frame, ignoring the dot NTSC skips on odd frames.
+func (t Timing) FrameTicks() uint64 {
+	return uint64(t.Scanlines) * DOTS_PER_SCANLINE * t.PPUDivider
+}
+
+func (t Timing) FrameRate() float64 {
+	return t.MasterHz / float64(t.FrameTicks())
+}
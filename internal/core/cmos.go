@@ -0,0 +1,106 @@
+package core
+
+// The 65C02's instruction set: the NMOS one with fixes and timing
+// changes, plus new instructions and the zero-page indirect mode.  This
+// is the original 65C02, without the Rockwell and WDC bit instructions
+// or WAI and STP.  JMP (abs,X) isn't supported yet.
+func cmosOpcodeList(nmos []Instruction) []Instruction {
+	list := make([]Instruction, 0, len(nmos))
+	for _, value := range nmos {
+		switch {
+		case value.name == "JMP" && value.mode == AddrIndirect:
+			// A cycle longer, to read the pointer's high byte from the
+			// right page
+			value.cycles = 6
+		case value.mode == AddrAbsoluteX && isShift(value.name):
+			// Only a page crossing costs the extra cycle now
+			value.cycles = 6
+		}
+		list = append(list, value)
+	}
+
+	return append(list, []Instruction{
+		{"ADC", AddrZeroPageIndirect, 0x72, 2, 5},
+		{"AND", AddrZeroPageIndirect, 0x32, 2, 5},
+		{"BIT", AddrImmediate, 0x89, 2, 2},
+		{"BIT", AddrZeroPageX, 0x34, 2, 4},
+		{"BIT", AddrAbsoluteX, 0x3c, 3, 4},
+		{"BRA", AddrImmediate, 0x80, 2, 2},
+		{"CMP", AddrZeroPageIndirect, 0xd2, 2, 5},
+		{"DEC", AddrAccumulator, 0x3a, 1, 2},
+		{"EOR", AddrZeroPageIndirect, 0x52, 2, 5},
+		{"INC", AddrAccumulator, 0x1a, 1, 2},
+		{"LDA", AddrZeroPageIndirect, 0xb2, 2, 5},
+		{"ORA", AddrZeroPageIndirect, 0x12, 2, 5},
+		{"PHX", AddrImplied, 0xda, 1, 3},
+		{"PHY", AddrImplied, 0x5a, 1, 3},
+		{"PLX", AddrImplied, 0xfa, 1, 4},
+		{"PLY", AddrImplied, 0x7a, 1, 4},
+		{"SBC", AddrZeroPageIndirect, 0xf2, 2, 5},
+		{"STA", AddrZeroPageIndirect, 0x92, 2, 5},
+		{"STZ", AddrZeroPage, 0x64, 2, 3},
+		{"STZ", AddrZeroPageX, 0x74, 2, 4},
+		{"STZ", AddrAbsolute, 0x9c, 3, 4},
+		{"STZ", AddrAbsoluteX, 0x9e, 3, 5},
+		{"TRB", AddrZeroPage, 0x14, 2, 5},
+		{"TRB", AddrAbsolute, 0x1c, 3, 6},
+		{"TSB", AddrZeroPage, 0x04, 2, 5},
+		{"TSB", AddrAbsolute, 0x0c, 3, 6},
+	}...)
+}
+
+// Every opcode the 65C02 doesn't define is documented as a NOP, so none
+// of them lock up, and the illegal opcode policy doesn't apply.  Those in
+// the $x3, $x7, $xB and $xF columns take a single byte and cycle.
+func cmosNOPList() []Instruction {
+	list := []Instruction{
+		{"NOP", AddrImmediate, 0x02, 2, 2},
+		{"NOP", AddrImmediate, 0x22, 2, 2},
+		{"NOP", AddrImmediate, 0x42, 2, 2},
+		{"NOP", AddrImmediate, 0x62, 2, 2},
+		{"NOP", AddrImmediate, 0x82, 2, 2},
+		{"NOP", AddrImmediate, 0xc2, 2, 2},
+		{"NOP", AddrImmediate, 0xe2, 2, 2},
+		{"NOP", AddrZeroPage, 0x44, 2, 3},
+		{"NOP", AddrZeroPageX, 0x54, 2, 4},
+		{"NOP", AddrZeroPageX, 0xd4, 2, 4},
+		{"NOP", AddrZeroPageX, 0xf4, 2, 4},
+		{"NOP", AddrAbsolute, 0x5c, 3, 8},
+		{"NOP", AddrAbsolute, 0xdc, 3, 4},
+		{"NOP", AddrAbsolute, 0xfc, 3, 4},
+	}
+	for hex := 0x03; hex <= 0xff; hex += 4 {
+		list = append(list, Instruction{"NOP", AddrImplied, uint8(hex), 1, 1})
+	}
+	return list
+}
+
+// The operation for a 65C02 instruction, where it differs from the NMOS
+// one with the same mnemonic.
+func getCMOSOperation(i Instruction) operation {
+	switch {
+	case i.name == "BIT" && i.mode == AddrImmediate:
+		// Immediate BIT has no memory to take N and V from
+		return readOperation(func(c *CPU, value uint8) {
+			setZeroFlag(c, c.accumulator&value == 0)
+		})
+	case i.name == "NOP" && i.hex != 0xea:
+		// The extra NOPs don't touch their operands
+		return operation{kind: opSkip}
+	}
+	return getOperation(i.name)
+}
+
+// Reads pay for page crossings as on the NMOS 6502, and so do shifts and
+// rotates with absolute X.
+func (i Instruction) hasCMOSPagePenalty() bool {
+	return i.hasPagePenalty() || i.name == "BIT" || i.mode == AddrAbsoluteX && isShift(i.name)
+}
+
+func isShift(name string) bool {
+	switch name {
+	case "ASL", "LSR", "ROL":
+		return true
+	}
+	return false
+}
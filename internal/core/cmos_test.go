@@ -0,0 +1,287 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCMOS_Instructions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		program  []uint8
+		setup    func(c *CPU)
+		check    func(t *testing.T, c *CPU)
+		size     uint16
+		expected uint64
+	}{
+		{
+			"BRA",
+			[]uint8{0x80, 0x02}, // BRA +2
+			nil,
+			func(t *testing.T, c *CPU) {},
+			4, 3,
+		},
+		{
+			"PHX",
+			[]uint8{0xda},
+			func(c *CPU) { c.index_x = 0x42 },
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0x42), c.memory[0x0180])
+				assert.Equal(t, uint8(0x7f), c.stack_pointer)
+			},
+			1, 3,
+		},
+		{
+			"PLY",
+			[]uint8{0x7a},
+			func(c *CPU) {
+				c.stack_pointer = 0x7f
+				c.memory[0x0180] = 0x80
+			},
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0x80), c.index_y)
+				assert.Equal(t, N_BIT_STATUS, c.status)
+			},
+			1, 4,
+		},
+		{
+			"STZ absolute X",
+			[]uint8{0x9e, 0x00, 0x02}, // STZ $0200,X
+			func(c *CPU) {
+				c.index_x = 1
+				c.memory[0x0201] = 0xff
+			},
+			func(t *testing.T, c *CPU) { assert.Equal(t, uint8(0x00), c.memory[0x0201]) },
+			3, 5,
+		},
+		{
+			"STA zero-page indirect",
+			[]uint8{0x92, 0x10}, // STA ($10)
+			func(c *CPU) {
+				c.accumulator = 0x42
+				c.writeAddressValue(0x10, 0x0234)
+			},
+			func(t *testing.T, c *CPU) { assert.Equal(t, uint8(0x42), c.memory[0x0234]) },
+			2, 5,
+		},
+		{
+			"TSB",
+			[]uint8{0x04, 0x10}, // TSB $10
+			func(c *CPU) {
+				c.accumulator = 0x0f
+				c.memory[0x10] = 0xf0
+			},
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0xff), c.memory[0x10])
+				assert.Equal(t, Z_BIT_STATUS, c.status)
+			},
+			2, 5,
+		},
+		{
+			"TRB",
+			[]uint8{0x1c, 0x00, 0x02}, // TRB $0200
+			func(c *CPU) {
+				c.accumulator = 0x0f
+				c.memory[0x0200] = 0x3c
+			},
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0x30), c.memory[0x0200])
+				assert.Equal(t, uint8(0x00), c.status)
+			},
+			3, 6,
+		},
+		{
+			"Zero-page indirect",
+			[]uint8{0xb2, 0x10}, // LDA ($10)
+			func(c *CPU) {
+				c.memory[0x10] = 0x00
+				c.memory[0x11] = 0x03
+				c.memory[0x0300] = 0x99
+			},
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0x99), c.accumulator)
+				assert.Equal(t, N_BIT_STATUS, c.status)
+			},
+			2, 5,
+		},
+		{
+			"BIT immediate only sets Z",
+			[]uint8{0x89, 0xc0}, // BIT #$C0
+			func(c *CPU) { c.accumulator = 0x01 },
+			func(t *testing.T, c *CPU) { assert.Equal(t, Z_BIT_STATUS, c.status) },
+			2, 2,
+		},
+		{
+			"BIT immediate leaves N and V",
+			[]uint8{0x89, 0x01}, // BIT #$01
+			func(c *CPU) {
+				c.accumulator = 0x01
+				c.status = N_BIT_STATUS | V_BIT_STATUS | Z_BIT_STATUS
+			},
+			func(t *testing.T, c *CPU) { assert.Equal(t, N_BIT_STATUS|V_BIT_STATUS, c.status) },
+			2, 2,
+		},
+		{
+			"BIT zero-page X takes N and V from memory",
+			[]uint8{0x34, 0x0f}, // BIT $0F,X
+			func(c *CPU) {
+				c.accumulator = 0x01
+				c.index_x = 1
+				c.memory[0x10] = 0xc0
+				c.status = V_BIT_STATUS
+			},
+			func(t *testing.T, c *CPU) { assert.Equal(t, N_BIT_STATUS|V_BIT_STATUS|Z_BIT_STATUS, c.status) },
+			2, 4,
+		},
+		{
+			"INC A",
+			[]uint8{0x1a},
+			func(c *CPU) { c.accumulator = 0xff },
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0x00), c.accumulator)
+				assert.Equal(t, Z_BIT_STATUS, c.status)
+			},
+			1, 2,
+		},
+		{
+			"JMP indirect takes a cycle longer",
+			[]uint8{0x6c, 0x00, 0x02}, // JMP ($0200)
+			func(c *CPU) {
+				c.memory[0x0200] = 0x34
+				c.memory[0x0201] = 0x12
+			},
+			func(t *testing.T, c *CPU) { assert.Equal(t, uint16(0x1234), c.program_counter) },
+			0, 6,
+		},
+		{
+			"Decimal ADC sets Z from the result, a cycle later",
+			[]uint8{0x69, 0x01}, // ADC #$01
+			func(c *CPU) {
+				c.accumulator = 0x99
+				c.status = D_BIT_STATUS
+			},
+			func(t *testing.T, c *CPU) {
+				assert.Equal(t, uint8(0x00), c.accumulator)
+				assert.Equal(t, D_BIT_STATUS|Z_BIT_STATUS|C_BIT_STATUS, c.status)
+			},
+			2, 3,
+		},
+		{
+			"ASL absolute X within a page",
+			[]uint8{0x1e, 0x00, 0x02}, // ASL $0200,X
+			func(c *CPU) { c.index_x = 1 },
+			func(t *testing.T, c *CPU) {},
+			3, 6,
+		},
+		{
+			"ASL absolute X across a page",
+			[]uint8{0x1e, 0xff, 0x02}, // ASL $02FF,X
+			func(c *CPU) { c.index_x = 1 },
+			func(t *testing.T, c *CPU) {},
+			3, 7,
+		},
+		{
+			"Single cycle NOP",
+			[]uint8{0x03},
+			nil,
+			func(t *testing.T, c *CPU) {},
+			1, 1,
+		},
+		{
+			"Extra NOPs aren't illegal",
+			[]uint8{0x02, 0x00}, // NOP #$00
+			func(c *CPU) { c.illegal_policy = IllegalError },
+			func(t *testing.T, c *CPU) {},
+			2, 2,
+		},
+		{
+			"Long NOP",
+			[]uint8{0x5c, 0x00, 0x02},
+			nil,
+			func(t *testing.T, c *CPU) {},
+			3, 8,
+		},
+	}
+
+	for _, test := range testCases {
+		for _, mode := range []CoreMode{CoreInstruction, CoreCycle} {
+			callback := func(t *testing.T) {
+				c := newPatternCPU(Variant65C02, mode, test.program, Registers{SP: 0x80})
+				if test.setup != nil {
+					test.setup(c)
+				}
+
+				running, err := c.Step()
+
+				assert.Nil(t, err)
+				assert.True(t, running)
+				assert.Equal(t, test.expected, c.Cycles())
+				if test.size > 0 {
+					assert.Equal(t, CYCLE_TEST_ORIGIN+test.size, c.program_counter)
+				}
+				test.check(t, c)
+			}
+			t.Run(test.name+", "+mode.String()+" core", callback)
+		}
+	}
+}
+
+func TestCMOS_NESUnchanged(t *testing.T) {
+	// $1A and $80 are undocumented NOPs on the NMOS 6502
+	c := newPatternCPU(VariantNES, CoreInstruction, []uint8{0x1a, 0x80, 0x10}, Registers{A: 0x41})
+
+	c.Step()
+	c.Step()
+
+	assert.Equal(t, uint8(0x41), c.accumulator)
+	assert.Equal(t, CYCLE_TEST_ORIGIN+3, c.program_counter)
+}
+
+func TestCMOS_InterruptClearsDecimal(t *testing.T) {
+	for _, mode := range []CoreMode{CoreInstruction, CoreCycle} {
+		callback := func(t *testing.T) {
+			c := NewCPUVariant(Variant65C02)
+			c.LoadAndReset([]uint8{0xea, 0xea, 0xea})
+			c.writeAddressValue(IRQ_VECTOR, 0x9000)
+			c.status = D_BIT_STATUS
+			c.SetCoreMode(mode)
+			c.SetIRQ(true)
+
+			for i := 0; i < 3 && c.Registers().PC < 0x9000; i++ {
+				c.Step()
+			}
+
+			assert.Equal(t, uint16(0x9000), c.Registers().PC)
+			assert.Equal(t, I_BIT_STATUS, c.status&(I_BIT_STATUS|D_BIT_STATUS))
+		}
+		t.Run(mode.String(), callback)
+	}
+}
+
+func TestVariant_LookupOpcode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		variant  Variant
+		hex      uint8
+		expected string
+		illegal  bool
+	}{
+		{"NES STZ slot", VariantNES, 0x9c, "", false},
+		{"NES undocumented NOP", VariantNES, 0x80, "NOP", true},
+		{"65C02 BRA", Variant65C02, 0x80, "BRA", false},
+		{"65C02 extra NOP", Variant65C02, 0x02, "NOP", false},
+		{"6502 shares the NES table", VariantNMOS, 0xa7, "LAX", true},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			instruction, ok := test.variant.LookupOpcode(test.hex)
+
+			assert.Equal(t, test.expected != "", ok)
+			assert.Equal(t, test.expected, instruction.Name())
+			assert.Equal(t, test.illegal, instruction.IsIllegal())
+		}
+		t.Run(test.name, callback)
+	}
+}
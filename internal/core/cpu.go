@@ -2,12 +2,17 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+
 	"pageer/myfinemu/internal/logging"
 )
 
 const (
 	N_BIT_STATUS uint8 = 0b10000000
 	V_BIT_STATUS uint8 = 0b01000000
+	// Always set in the status byte interrupts push
+	U_BIT_STATUS uint8 = 0b00100000
 	B_BIT_STATUS uint8 = 0b00010000
 	D_BIT_STATUS uint8 = 0b00001000
 	I_BIT_STATUS uint8 = 0b00000100
@@ -19,8 +24,16 @@ const (
 	// Memory locations
 	MEMORY_SIZE              = 0x010000
 	ROM_SEGMENT_START uint16 = 0x8000
+	PRG_BANK_SIZE            = 0x4000
 	STACK_START       uint16 = 0x0100
 	PC_RESET_ADDRESS         = 0xfffc
+	NMI_VECTOR        uint16 = 0xfffa
+	IRQ_VECTOR        uint16 = 0xfffe
+
+	// Cycles to push the PC and status and load the vector
+	INTERRUPT_CYCLES = 7
+
+	NOP_OPCODE uint8 = 0xea
 )
 
 type AddressMode int
@@ -58,8 +71,43 @@ const (
 	AddrIndirect
 	// No address, operate directly on the accumulator
 	AddrAccumulator
+	// Zero-page indirect, 65C02 only - reads the address at param.
+	// e.g. if param = 0x10 and the bytes at 0x10 are 0x00 0x80, the address is 0x8000.
+	AddrZeroPageIndirect
 )
 
+// What to do with undocumented opcodes.
+type IllegalOpcodePolicy int
+
+const (
+	// Execute them like the NMOS 6502 does.  JAM locks up the CPU.
+	IllegalEmulate IllegalOpcodePolicy = iota
+	// Skip over them, taking their usual time
+	IllegalNOP
+	// Stop with an IllegalOpcodeError
+	IllegalError
+	// Lock up the CPU, as if every one were JAM
+	IllegalJam
+)
+
+var ILLEGAL_POLICY_NAMES = [...]string{"emulate", "nop", "error", "jam"}
+
+func (p IllegalOpcodePolicy) String() string {
+	if p < 0 || int(p) >= len(ILLEGAL_POLICY_NAMES) {
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+	return ILLEGAL_POLICY_NAMES[p]
+}
+
+func ParseIllegalOpcodePolicy(name string) (IllegalOpcodePolicy, error) {
+	for i, policy_name := range ILLEGAL_POLICY_NAMES {
+		if strings.EqualFold(name, policy_name) {
+			return IllegalOpcodePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown illegal opcode policy %q, expected one of %s", name, strings.Join(ILLEGAL_POLICY_NAMES[:], ", "))
+}
+
 type CPU struct {
 	program_counter uint16
 	stack_pointer   uint8
@@ -68,6 +116,80 @@ type CPU struct {
 	index_y         uint8
 	status          uint8
 	memory          [MEMORY_SIZE]uint8
+	access_hook     AccessHook
+	// Called before each instruction, e.g. for tracing
+	instruction_hook InstructionHook
+	devices          []deviceMapping
+	// Nil unless logging has been set up, which logs nothing
+	log            *logging.Logger
+	illegal_policy IllegalOpcodePolicy
+	// Cycles executed since power-on
+	cycles uint64
+	// Extra cycles taken by the current instruction, for page crossings
+	// and taken branches
+	extra_cycles uint
+	// The first bus fault during the current instruction
+	fault *BusFaultError
+	// Addresses of recent instructions, for error context
+	recent       [ERROR_CONTEXT_INSTRUCTIONS + 1]uint16
+	recent_count int
+	core_mode    CoreMode
+	variant      Variant
+	// Progress through the current instruction on the cycle core
+	cycle cycleState
+	// Cycles the instruction core has run ahead by in StepCycle
+	owed_cycles uint64
+	// Interrupt inputs.  IRQ is a level, NMI is latched on its edge.
+	irq_line    bool
+	nmi_pending bool
+	// Consulted only for addresses with their bit set
+	read_override ReadOverride
+	overridden    [MEMORY_SIZE / 8]uint8
+	// What PowerOn fills RAM with
+	ram_pattern RAMPattern
+	ram_seed    int64
+}
+
+// Snapshot of the CPU registers, for debuggers and tests.
+type Registers struct {
+	PC     uint16
+	SP     uint8
+	A      uint8
+	X      uint8
+	Y      uint8
+	Status uint8
+}
+
+// Called for every memory read or write an instruction makes, but not
+// for opcode fetches or ReadMemory/WriteMemory calls.
+type AccessHook func(address uint16, value uint8, write bool)
+
+// Called before each instruction executes, with the PC at its opcode.
+type InstructionHook func(c *CPU)
+
+// Replaces the value the CPU reads from an address, e.g. for cheats.
+// It's given what the read would otherwise have returned.
+type ReadOverride func(address uint16, value uint8) uint8
+
+// Hardware mapped into the address space, such as controller ports.
+// Reads and writes by instructions in the mapped range go to the device
+// instead of memory.
+type Device interface {
+	ReadRegister(address uint16) uint8
+	WriteRegister(address uint16, value uint8)
+}
+
+// A device that can reject accesses, e.g. writes to a read-only
+// register.  A rejected access stops the CPU with a BusFaultError.
+type CheckedDevice interface {
+	Device
+	CheckAccess(address uint16, write bool) error
+}
+
+type deviceMapping struct {
+	start  uint16
+	end    uint16
+	device Device
 }
 
 type Instruction struct {
@@ -75,133 +197,404 @@ type Instruction struct {
 	mode AddressMode
 	hex  uint8
 	size uint
+	// Base cycle count, before page crossing and branch penalties
+	cycles uint
+}
+
+// Executes an instruction, once the PC has moved past its opcode.
+type opcodeHandler func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error)
+
+// Everything needed to execute an opcode byte, worked out once at init so
+// that each step is a single array lookup.
+type opcodeEntry struct {
+	instruction Instruction
+	operation   operation
+	handler     opcodeHandler
+	// False for bytes that aren't in the opcode table
+	known bool
+	// Undocumented opcodes, which the illegal opcode policy applies to
+	illegal      bool
+	jam          bool
+	page_penalty bool
+}
+
+// An instruction set, indexed by opcode byte.
+type opcodeTable struct {
+	entries [256]opcodeEntry
+	// What the undocumented opcodes become when the policy skips them
+	nops      [256]opcodeEntry
+	mnemonics map[string][]Instruction
+}
+
+// The NMOS instruction set, which the NES and stock 6502 share
+var opcodes opcodeTable
+
+// The 65C02's instruction set
+var cmos_opcodes opcodeTable
+
+func (i Instruction) Name() string {
+	return i.name
+}
+
+func (i Instruction) Mode() AddressMode {
+	return i.mode
 }
 
-var opcodes map[uint8]Instruction
+func (i Instruction) Opcode() uint8 {
+	return i.hex
+}
+
+func (i Instruction) Size() uint {
+	return i.size
+}
+
+func (i Instruction) Cycles() uint {
+	return i.cycles
+}
+
+func (i Instruction) IsIllegal() bool {
+	for _, table := range [...]*opcodeTable{&opcodes, &cmos_opcodes} {
+		if entry := table.entries[i.hex]; entry.known && entry.instruction == i {
+			return entry.illegal
+		}
+	}
+	return false
+}
+
+// Instructions that only read their operand take an extra cycle when
+// indexing crosses a page.  Writes and read-modify-writes always take
+// the longer path, so their base count already includes it.
+func (i Instruction) hasPagePenalty() bool {
+	switch i.name {
+	case "ADC", "AND", "CMP", "EOR", "LDA", "LDX", "LDY", "ORA", "SBC", "LAX", "NOP":
+		return true
+	}
+	return false
+}
+
+// Branch instructions share the immediate address mode, but their
+// parameter is a signed offset from the following instruction.
+func (i Instruction) IsBranch() bool {
+	switch i.name {
+	case "BCC", "BCS", "BEQ", "BMI", "BNE", "BPL", "BRA", "BVC", "BVS":
+		return true
+	}
+	return false
+}
+
+// Get every addressing mode variant of a mnemonic, e.g. "LDA", on the
+// NES.
+func LookupMnemonic(name string) []Instruction {
+	return VariantNES.LookupMnemonic(name)
+}
+
+// Look up the instruction for an opcode byte on the NES.
+func LookupOpcode(hex uint8) (Instruction, bool) {
+	return VariantNES.LookupOpcode(hex)
+}
 
 func init() {
 	opcodeList := []Instruction{
-		{"ADC", AddrImmediate, 0x69, 2},
-		{"ADC", AddrZeroPage, 0x65, 2},
-		{"ADC", AddrZeroPageX, 0x75, 2},
-		{"ADC", AddrAbsolute, 0x6d, 3},
-		{"ADC", AddrAbsoluteX, 0x7d, 3},
-		{"ADC", AddrAbsoluteY, 0x79, 3},
-		{"ADC", AddrIndirectX, 0x61, 3},
-		{"ADC", AddrIndirectY, 0x71, 3},
-		{"AND", AddrImmediate, 0x29, 2},
-		{"AND", AddrZeroPage, 0x25, 2},
-		{"AND", AddrZeroPageX, 0x35, 2},
-		{"AND", AddrAbsolute, 0x2d, 3},
-		{"AND", AddrAbsoluteX, 0x3d, 3},
-		{"AND", AddrAbsoluteY, 0x39, 3},
-		{"AND", AddrIndirectX, 0x21, 3},
-		{"AND", AddrIndirectY, 0x31, 3},
-		{"ASL", AddrImplied, 0x0a, 1},
-		{"ASL", AddrZeroPage, 0x06, 2},
-		{"ASL", AddrZeroPageX, 0x16, 2},
-		{"ASL", AddrAbsolute, 0x0e, 3},
-		{"ASL", AddrAbsoluteX, 0x1e, 3},
-		{"BCC", AddrImmediate, 0x90, 2},
-		{"BCS", AddrImmediate, 0xb0, 2},
-		{"BEQ", AddrImmediate, 0xf0, 2},
-		{"BIT", AddrZeroPage, 0x24, 2},
-		{"BIT", AddrAbsolute, 0x2c, 3},
-		{"BMI", AddrImmediate, 0x30, 2},
-		{"BNE", AddrImmediate, 0xd0, 2},
-		{"BPL", AddrImmediate, 0x10, 2},
-		{"BRK", AddrImplied, 0x00, 1},
-		{"BVC", AddrImmediate, 0x50, 2},
-		{"BVS", AddrImmediate, 0x70, 2},
-		{"CLC", AddrImmediate, 0x18, 1},
-		{"CLD", AddrImmediate, 0xd8, 1},
-		{"CLI", AddrImmediate, 0x58, 1},
-		{"CLV", AddrImmediate, 0xb8, 1},
-		{"CMP", AddrImmediate, 0xc9, 2},
-		{"CMP", AddrZeroPage, 0xc5, 2},
-		{"CMP", AddrZeroPageX, 0xd5, 2},
-		{"CMP", AddrAbsolute, 0xcd, 3},
-		{"CMP", AddrAbsoluteX, 0xdd, 3},
-		{"CMP", AddrAbsoluteY, 0xd9, 3},
-		{"CMP", AddrIndirectX, 0xc1, 2},
-		{"CMP", AddrIndirectY, 0xd1, 2},
-		{"CPX", AddrImmediate, 0xe0, 2},
-		{"CPX", AddrZeroPage, 0xe4, 2},
-		{"CPX", AddrAbsolute, 0xec, 3},
-		{"CPY", AddrImmediate, 0xc0, 2},
-		{"CPY", AddrZeroPage, 0xc4, 2},
-		{"CPY", AddrAbsolute, 0xcc, 3},
-		{"DEC", AddrZeroPage, 0xc6, 2},
-		{"DEC", AddrZeroPageX, 0xd6, 2},
-		{"DEC", AddrAbsolute, 0xce, 3},
-		{"DEC", AddrAbsoluteX, 0xde, 3},
-		{"DEX", AddrImplied, 0xca, 1},
-		{"DEY", AddrImplied, 0x88, 1},
-		{"EOR", AddrImmediate, 0x49, 2},
-		{"EOR", AddrZeroPage, 0x45, 2},
-		{"EOR", AddrZeroPageX, 0x55, 2},
-		{"EOR", AddrAbsolute, 0x4d, 3},
-		{"EOR", AddrAbsoluteX, 0x5d, 3},
-		{"EOR", AddrAbsoluteY, 0x59, 3},
-		{"EOR", AddrIndirectX, 0x41, 2},
-		{"EOR", AddrIndirectY, 0x51, 2},
-		{"INC", AddrZeroPage, 0xe6, 2},
-		{"INC", AddrZeroPageX, 0xf6, 2},
-		{"INC", AddrAbsolute, 0xee, 3},
-		{"INC", AddrAbsoluteX, 0xfe, 3},
-		{"INX", AddrImplied, 0xe8, 1},
-		{"INY", AddrImplied, 0xc8, 1},
-		{"JMP", AddrAbsolute, 0x4c, 3},
-		{"JMP", AddrIndirect, 0x6c, 3},
-		{"JSR", AddrAbsolute, 0x20, 3},
-		{"LDA", AddrImmediate, 0xa9, 2},
-		{"LDA", AddrZeroPage, 0xa5, 2},
-		{"LDA", AddrZeroPageX, 0xb5, 2},
-		{"LDA", AddrAbsolute, 0xad, 3},
-		{"LDA", AddrAbsoluteX, 0xbd, 3},
-		{"LDA", AddrAbsoluteY, 0xb9, 3},
-		{"LDA", AddrIndirectX, 0xa1, 3},
-		{"LDA", AddrIndirectY, 0xb1, 3},
-		{"LDX", AddrImmediate, 0xa2, 2},
-		{"LDX", AddrZeroPage, 0xa6, 2},
-		{"LDX", AddrZeroPageY, 0xb6, 2},
-		{"LDX", AddrAbsolute, 0xae, 3},
-		{"LDX", AddrAbsoluteY, 0xbe, 3},
-		{"LDY", AddrImmediate, 0xa0, 2},
-		{"LDY", AddrZeroPage, 0xa4, 2},
-		{"LDY", AddrZeroPageX, 0xb4, 2},
-		{"LDY", AddrAbsolute, 0xac, 3},
-		{"LDY", AddrAbsoluteX, 0xbc, 3},
-		{"LSR", AddrAccumulator, 0x4a, 1},
-		{"LSR", AddrZeroPage, 0x46, 2},
-		{"LSR", AddrZeroPageX, 0x56, 2},
-		{"LSR", AddrAbsolute, 0x4e, 3},
-		{"LSR", AddrAbsoluteX, 0x5e, 3},
-		{"NOP", AddrImplied, 0xea, 1},
-		{"ORA", AddrImmediate, 0x09, 2},
-		{"ORA", AddrZeroPage, 0x05, 2},
-		{"ORA", AddrZeroPageX, 0x15, 2},
-		{"ORA", AddrAbsolute, 0x0d, 3},
-		{"ORA", AddrAbsoluteX, 0x1d, 3},
-		{"ORA", AddrAbsoluteY, 0x19, 3},
-		{"ORA", AddrIndirectX, 0x01, 2},
-		{"ORA", AddrIndirectY, 0x11, 2},
-		{"PHA", AddrImplied, 0x48, 1},
-		{"PHP", AddrImplied, 0x08, 1},
-		{"PLA", AddrImplied, 0x68, 1},
-		{"PLP", AddrImplied, 0x28, 1},
-		{"ROL", AddrAccumulator, 0x2a, 1},
-		{"ROL", AddrZeroPage, 0x26, 2},
-		{"ROL", AddrZeroPageX, 0x36, 2},
-		{"ROL", AddrAbsolute, 0x2e, 3},
-		{"ROL", AddrAbsoluteX, 0x3e, 3},
-
-		{"TAX", AddrImplied, 0xaa, 1},
-	}
-
-	opcodes = make(map[uint8]Instruction)
-	for _, value := range opcodeList {
-		opcodes[value.hex] = value
+		{"ADC", AddrImmediate, 0x69, 2, 2},
+		{"ADC", AddrZeroPage, 0x65, 2, 3},
+		{"ADC", AddrZeroPageX, 0x75, 2, 4},
+		{"ADC", AddrAbsolute, 0x6d, 3, 4},
+		{"ADC", AddrAbsoluteX, 0x7d, 3, 4},
+		{"ADC", AddrAbsoluteY, 0x79, 3, 4},
+		{"ADC", AddrIndirectX, 0x61, 2, 6},
+		{"ADC", AddrIndirectY, 0x71, 2, 5},
+		{"AND", AddrImmediate, 0x29, 2, 2},
+		{"AND", AddrZeroPage, 0x25, 2, 3},
+		{"AND", AddrZeroPageX, 0x35, 2, 4},
+		{"AND", AddrAbsolute, 0x2d, 3, 4},
+		{"AND", AddrAbsoluteX, 0x3d, 3, 4},
+		{"AND", AddrAbsoluteY, 0x39, 3, 4},
+		{"AND", AddrIndirectX, 0x21, 2, 6},
+		{"AND", AddrIndirectY, 0x31, 2, 5},
+		{"ASL", AddrImplied, 0x0a, 1, 2},
+		{"ASL", AddrZeroPage, 0x06, 2, 5},
+		{"ASL", AddrZeroPageX, 0x16, 2, 6},
+		{"ASL", AddrAbsolute, 0x0e, 3, 6},
+		{"ASL", AddrAbsoluteX, 0x1e, 3, 7},
+		{"BCC", AddrImmediate, 0x90, 2, 2},
+		{"BCS", AddrImmediate, 0xb0, 2, 2},
+		{"BEQ", AddrImmediate, 0xf0, 2, 2},
+		{"BIT", AddrZeroPage, 0x24, 2, 3},
+		{"BIT", AddrAbsolute, 0x2c, 3, 4},
+		{"BMI", AddrImmediate, 0x30, 2, 2},
+		{"BNE", AddrImmediate, 0xd0, 2, 2},
+		{"BPL", AddrImmediate, 0x10, 2, 2},
+		{"BRK", AddrImplied, 0x00, 1, 7},
+		{"BVC", AddrImmediate, 0x50, 2, 2},
+		{"BVS", AddrImmediate, 0x70, 2, 2},
+		{"CLC", AddrImmediate, 0x18, 1, 2},
+		{"CLD", AddrImmediate, 0xd8, 1, 2},
+		{"CLI", AddrImmediate, 0x58, 1, 2},
+		{"CLV", AddrImmediate, 0xb8, 1, 2},
+		{"CMP", AddrImmediate, 0xc9, 2, 2},
+		{"CMP", AddrZeroPage, 0xc5, 2, 3},
+		{"CMP", AddrZeroPageX, 0xd5, 2, 4},
+		{"CMP", AddrAbsolute, 0xcd, 3, 4},
+		{"CMP", AddrAbsoluteX, 0xdd, 3, 4},
+		{"CMP", AddrAbsoluteY, 0xd9, 3, 4},
+		{"CMP", AddrIndirectX, 0xc1, 2, 6},
+		{"CMP", AddrIndirectY, 0xd1, 2, 5},
+		{"CPX", AddrImmediate, 0xe0, 2, 2},
+		{"CPX", AddrZeroPage, 0xe4, 2, 3},
+		{"CPX", AddrAbsolute, 0xec, 3, 4},
+		{"CPY", AddrImmediate, 0xc0, 2, 2},
+		{"CPY", AddrZeroPage, 0xc4, 2, 3},
+		{"CPY", AddrAbsolute, 0xcc, 3, 4},
+		{"DEC", AddrZeroPage, 0xc6, 2, 5},
+		{"DEC", AddrZeroPageX, 0xd6, 2, 6},
+		{"DEC", AddrAbsolute, 0xce, 3, 6},
+		{"DEC", AddrAbsoluteX, 0xde, 3, 7},
+		{"DEX", AddrImplied, 0xca, 1, 2},
+		{"DEY", AddrImplied, 0x88, 1, 2},
+		{"EOR", AddrImmediate, 0x49, 2, 2},
+		{"EOR", AddrZeroPage, 0x45, 2, 3},
+		{"EOR", AddrZeroPageX, 0x55, 2, 4},
+		{"EOR", AddrAbsolute, 0x4d, 3, 4},
+		{"EOR", AddrAbsoluteX, 0x5d, 3, 4},
+		{"EOR", AddrAbsoluteY, 0x59, 3, 4},
+		{"EOR", AddrIndirectX, 0x41, 2, 6},
+		{"EOR", AddrIndirectY, 0x51, 2, 5},
+		{"INC", AddrZeroPage, 0xe6, 2, 5},
+		{"INC", AddrZeroPageX, 0xf6, 2, 6},
+		{"INC", AddrAbsolute, 0xee, 3, 6},
+		{"INC", AddrAbsoluteX, 0xfe, 3, 7},
+		{"INX", AddrImplied, 0xe8, 1, 2},
+		{"INY", AddrImplied, 0xc8, 1, 2},
+		{"JMP", AddrAbsolute, 0x4c, 3, 3},
+		{"JMP", AddrIndirect, 0x6c, 3, 5},
+		{"JSR", AddrAbsolute, 0x20, 3, 6},
+		{"LDA", AddrImmediate, 0xa9, 2, 2},
+		{"LDA", AddrZeroPage, 0xa5, 2, 3},
+		{"LDA", AddrZeroPageX, 0xb5, 2, 4},
+		{"LDA", AddrAbsolute, 0xad, 3, 4},
+		{"LDA", AddrAbsoluteX, 0xbd, 3, 4},
+		{"LDA", AddrAbsoluteY, 0xb9, 3, 4},
+		{"LDA", AddrIndirectX, 0xa1, 2, 6},
+		{"LDA", AddrIndirectY, 0xb1, 2, 5},
+		{"LDX", AddrImmediate, 0xa2, 2, 2},
+		{"LDX", AddrZeroPage, 0xa6, 2, 3},
+		{"LDX", AddrZeroPageY, 0xb6, 2, 4},
+		{"LDX", AddrAbsolute, 0xae, 3, 4},
+		{"LDX", AddrAbsoluteY, 0xbe, 3, 4},
+		{"LDY", AddrImmediate, 0xa0, 2, 2},
+		{"LDY", AddrZeroPage, 0xa4, 2, 3},
+		{"LDY", AddrZeroPageX, 0xb4, 2, 4},
+		{"LDY", AddrAbsolute, 0xac, 3, 4},
+		{"LDY", AddrAbsoluteX, 0xbc, 3, 4},
+		{"LSR", AddrAccumulator, 0x4a, 1, 2},
+		{"LSR", AddrZeroPage, 0x46, 2, 5},
+		{"LSR", AddrZeroPageX, 0x56, 2, 6},
+		{"LSR", AddrAbsolute, 0x4e, 3, 6},
+		{"LSR", AddrAbsoluteX, 0x5e, 3, 7},
+		{"NOP", AddrImplied, 0xea, 1, 2},
+		{"ORA", AddrImmediate, 0x09, 2, 2},
+		{"ORA", AddrZeroPage, 0x05, 2, 3},
+		{"ORA", AddrZeroPageX, 0x15, 2, 4},
+		{"ORA", AddrAbsolute, 0x0d, 3, 4},
+		{"ORA", AddrAbsoluteX, 0x1d, 3, 4},
+		{"ORA", AddrAbsoluteY, 0x19, 3, 4},
+		{"ORA", AddrIndirectX, 0x01, 2, 6},
+		{"ORA", AddrIndirectY, 0x11, 2, 5},
+		{"PHA", AddrImplied, 0x48, 1, 3},
+		{"PHP", AddrImplied, 0x08, 1, 3},
+		{"PLA", AddrImplied, 0x68, 1, 4},
+		{"PLP", AddrImplied, 0x28, 1, 4},
+		{"ROL", AddrAccumulator, 0x2a, 1, 2},
+		{"ROL", AddrZeroPage, 0x26, 2, 5},
+		{"ROL", AddrZeroPageX, 0x36, 2, 6},
+		{"ROL", AddrAbsolute, 0x2e, 3, 6},
+		{"ROL", AddrAbsoluteX, 0x3e, 3, 7},
+		{"RTI", AddrImplied, 0x40, 1, 6},
+		{"RTS", AddrImplied, 0x60, 1, 6},
+
+		{"SBC", AddrImmediate, 0xe9, 2, 2},
+		{"SBC", AddrZeroPage, 0xe5, 2, 3},
+		{"SBC", AddrZeroPageX, 0xf5, 2, 4},
+		{"SBC", AddrAbsolute, 0xed, 3, 4},
+		{"SBC", AddrAbsoluteX, 0xfd, 3, 4},
+		{"SBC", AddrAbsoluteY, 0xf9, 3, 4},
+		{"SBC", AddrIndirectX, 0xe1, 2, 6},
+		{"SBC", AddrIndirectY, 0xf1, 2, 5},
+		{"SEC", AddrImplied, 0x38, 1, 2},
+		{"SED", AddrImplied, 0xf8, 1, 2},
+		{"SEI", AddrImplied, 0x78, 1, 2},
+		{"STA", AddrZeroPage, 0x85, 2, 3},
+		{"STA", AddrZeroPageX, 0x95, 2, 4},
+		{"STA", AddrAbsolute, 0x8d, 3, 4},
+		{"STA", AddrAbsoluteX, 0x9d, 3, 5},
+		{"STA", AddrAbsoluteY, 0x99, 3, 5},
+		{"STA", AddrIndirectX, 0x81, 2, 6},
+		{"STA", AddrIndirectY, 0x91, 2, 6},
+		{"STX", AddrZeroPage, 0x86, 2, 3},
+		{"STX", AddrZeroPageY, 0x96, 2, 4},
+		{"STX", AddrAbsolute, 0x8e, 3, 4},
+		{"STY", AddrZeroPage, 0x84, 2, 3},
+		{"STY", AddrZeroPageX, 0x94, 2, 4},
+		{"STY", AddrAbsolute, 0x8c, 3, 4},
+
+		{"TAX", AddrImplied, 0xaa, 1, 2},
+	}
+
+	// The stable undocumented opcodes.  The unstable ones, whose results
+	// depend on the chip, are left out and stay unknown.
+	illegalOpcodeList := []Instruction{
+		{"NOP", AddrImplied, 0x1a, 1, 2},
+		{"NOP", AddrImplied, 0x3a, 1, 2},
+		{"NOP", AddrImplied, 0x5a, 1, 2},
+		{"NOP", AddrImplied, 0x7a, 1, 2},
+		{"NOP", AddrImplied, 0xda, 1, 2},
+		{"NOP", AddrImplied, 0xfa, 1, 2},
+		{"NOP", AddrImmediate, 0x80, 2, 2},
+		{"NOP", AddrImmediate, 0x82, 2, 2},
+		{"NOP", AddrImmediate, 0x89, 2, 2},
+		{"NOP", AddrImmediate, 0xc2, 2, 2},
+		{"NOP", AddrImmediate, 0xe2, 2, 2},
+		{"NOP", AddrZeroPage, 0x04, 2, 3},
+		{"NOP", AddrZeroPage, 0x44, 2, 3},
+		{"NOP", AddrZeroPage, 0x64, 2, 3},
+		{"NOP", AddrZeroPageX, 0x14, 2, 4},
+		{"NOP", AddrZeroPageX, 0x34, 2, 4},
+		{"NOP", AddrZeroPageX, 0x54, 2, 4},
+		{"NOP", AddrZeroPageX, 0x74, 2, 4},
+		{"NOP", AddrZeroPageX, 0xd4, 2, 4},
+		{"NOP", AddrZeroPageX, 0xf4, 2, 4},
+		{"NOP", AddrAbsolute, 0x0c, 3, 4},
+		{"NOP", AddrAbsoluteX, 0x1c, 3, 4},
+		{"NOP", AddrAbsoluteX, 0x3c, 3, 4},
+		{"NOP", AddrAbsoluteX, 0x5c, 3, 4},
+		{"NOP", AddrAbsoluteX, 0x7c, 3, 4},
+		{"NOP", AddrAbsoluteX, 0xdc, 3, 4},
+		{"NOP", AddrAbsoluteX, 0xfc, 3, 4},
+
+		{"LAX", AddrZeroPage, 0xa7, 2, 3},
+		{"LAX", AddrZeroPageY, 0xb7, 2, 4},
+		{"LAX", AddrAbsolute, 0xaf, 3, 4},
+		{"LAX", AddrAbsoluteY, 0xbf, 3, 4},
+		{"LAX", AddrIndirectX, 0xa3, 2, 6},
+		{"LAX", AddrIndirectY, 0xb3, 2, 5},
+
+		{"SAX", AddrZeroPage, 0x87, 2, 3},
+		{"SAX", AddrZeroPageY, 0x97, 2, 4},
+		{"SAX", AddrAbsolute, 0x8f, 3, 4},
+		{"SAX", AddrIndirectX, 0x83, 2, 6},
+
+		{"SBC", AddrImmediate, 0xeb, 2, 2},
+
+		{"DCP", AddrZeroPage, 0xc7, 2, 5},
+		{"DCP", AddrZeroPageX, 0xd7, 2, 6},
+		{"DCP", AddrAbsolute, 0xcf, 3, 6},
+		{"DCP", AddrAbsoluteX, 0xdf, 3, 7},
+		{"DCP", AddrAbsoluteY, 0xdb, 3, 7},
+		{"DCP", AddrIndirectX, 0xc3, 2, 8},
+		{"DCP", AddrIndirectY, 0xd3, 2, 8},
+
+		{"ISC", AddrZeroPage, 0xe7, 2, 5},
+		{"ISC", AddrZeroPageX, 0xf7, 2, 6},
+		{"ISC", AddrAbsolute, 0xef, 3, 6},
+		{"ISC", AddrAbsoluteX, 0xff, 3, 7},
+		{"ISC", AddrAbsoluteY, 0xfb, 3, 7},
+		{"ISC", AddrIndirectX, 0xe3, 2, 8},
+		{"ISC", AddrIndirectY, 0xf3, 2, 8},
+
+		{"SLO", AddrZeroPage, 0x07, 2, 5},
+		{"SLO", AddrZeroPageX, 0x17, 2, 6},
+		{"SLO", AddrAbsolute, 0x0f, 3, 6},
+		{"SLO", AddrAbsoluteX, 0x1f, 3, 7},
+		{"SLO", AddrAbsoluteY, 0x1b, 3, 7},
+		{"SLO", AddrIndirectX, 0x03, 2, 8},
+		{"SLO", AddrIndirectY, 0x13, 2, 8},
+
+		{"RLA", AddrZeroPage, 0x27, 2, 5},
+		{"RLA", AddrZeroPageX, 0x37, 2, 6},
+		{"RLA", AddrAbsolute, 0x2f, 3, 6},
+		{"RLA", AddrAbsoluteX, 0x3f, 3, 7},
+		{"RLA", AddrAbsoluteY, 0x3b, 3, 7},
+		{"RLA", AddrIndirectX, 0x23, 2, 8},
+		{"RLA", AddrIndirectY, 0x33, 2, 8},
+
+		{"SRE", AddrZeroPage, 0x47, 2, 5},
+		{"SRE", AddrZeroPageX, 0x57, 2, 6},
+		{"SRE", AddrAbsolute, 0x4f, 3, 6},
+		{"SRE", AddrAbsoluteX, 0x5f, 3, 7},
+		{"SRE", AddrAbsoluteY, 0x5b, 3, 7},
+		{"SRE", AddrIndirectX, 0x43, 2, 8},
+		{"SRE", AddrIndirectY, 0x53, 2, 8},
+
+		{"RRA", AddrZeroPage, 0x67, 2, 5},
+		{"RRA", AddrZeroPageX, 0x77, 2, 6},
+		{"RRA", AddrAbsolute, 0x6f, 3, 6},
+		{"RRA", AddrAbsoluteX, 0x7f, 3, 7},
+		{"RRA", AddrAbsoluteY, 0x7b, 3, 7},
+		{"RRA", AddrIndirectX, 0x63, 2, 8},
+		{"RRA", AddrIndirectY, 0x73, 2, 8},
+
+		{"ANC", AddrImmediate, 0x0b, 2, 2},
+		{"ANC", AddrImmediate, 0x2b, 2, 2},
+		{"ALR", AddrImmediate, 0x4b, 2, 2},
+		{"ARR", AddrImmediate, 0x6b, 2, 2},
+		{"SBX", AddrImmediate, 0xcb, 2, 2},
+
+		// These never finish on hardware.  The cycles only count when
+		// the policy turns them into NOPs.
+		{"JAM", AddrImplied, 0x02, 1, 2},
+		{"JAM", AddrImplied, 0x12, 1, 2},
+		{"JAM", AddrImplied, 0x22, 1, 2},
+		{"JAM", AddrImplied, 0x32, 1, 2},
+		{"JAM", AddrImplied, 0x42, 1, 2},
+		{"JAM", AddrImplied, 0x52, 1, 2},
+		{"JAM", AddrImplied, 0x62, 1, 2},
+		{"JAM", AddrImplied, 0x72, 1, 2},
+		{"JAM", AddrImplied, 0x92, 1, 2},
+		{"JAM", AddrImplied, 0xb2, 1, 2},
+		{"JAM", AddrImplied, 0xd2, 1, 2},
+		{"JAM", AddrImplied, 0xf2, 1, 2},
+	}
+
+	nmosOperation := func(i Instruction) operation {
+		return getOperation(i.name)
+	}
+	opcodes.build(opcodeList, illegalOpcodeList, nmosOperation, Instruction.hasPagePenalty)
+	cmos_opcodes.build(append(cmosOpcodeList(opcodeList), cmosNOPList()...), nil, getCMOSOperation, Instruction.hasCMOSPagePenalty)
+}
+
+func (t *opcodeTable) build(official []Instruction, undocumented []Instruction, getOp func(Instruction) operation, hasPagePenalty func(Instruction) bool) {
+	unimplemented := getOpcodeImpl(operation{})
+	for hex := range t.entries {
+		t.entries[hex].handler = unimplemented
+	}
+
+	t.mnemonics = make(map[string][]Instruction)
+	// Official opcodes go first, so the assembler picks them over
+	// undocumented duplicates such as the extra NOPs
+	for i, value := range append(official, undocumented...) {
+		op := getOp(value)
+		t.entries[value.hex] = opcodeEntry{
+			instruction:  value,
+			operation:    op,
+			handler:      getOpcodeImpl(op),
+			known:        true,
+			illegal:      i >= len(official),
+			jam:          value.name == "JAM",
+			page_penalty: hasPagePenalty(value),
+		}
+		t.mnemonics[value.name] = append(t.mnemonics[value.name], value)
+	}
+
+	// Skipped opcodes keep their size and timing, but do nothing
+	skip := operation{kind: opSkip}
+	for hex, entry := range t.entries {
+		if entry.illegal {
+			entry.instruction.mode = AddrImplied
+			entry.operation = skip
+			entry.handler = getOpcodeImpl(skip)
+			entry.jam = false
+			t.nops[hex] = entry
+		}
 	}
 }
 
@@ -214,7 +607,7 @@ func (c *CPU) Run() error {
 	var keepLooping bool = true
 	var err error
 	for keepLooping {
-		keepLooping, err = c.processNextInstruction()
+		keepLooping, err = c.Step()
 		if err != nil {
 			return err
 		}
@@ -239,14 +632,22 @@ func (c *CPU) LoadROM(memory []uint8) error {
 	return nil
 }
 
-func (c *CPU) Reset() {
-	c.stack_pointer = 0
-	c.accumulator = 0
-	c.index_y = 0
-	c.index_y = 0
-	c.status = 0
+// Load cartridge PRG-ROM into the upper half of memory.
+// Unlike LoadROM, this leaves the vectors alone, since a real cartridge
+// supplies its own.  A single 16K bank is mirrored into $C000-$FFFF.
+func (c *CPU) LoadPRG(prg []uint8) error {
+	if len(prg) == 0 || len(prg)%PRG_BANK_SIZE != 0 {
+		return errors.New("PRG-ROM size must be a multiple of 16K")
+	}
+	if len(prg) > 2*PRG_BANK_SIZE {
+		return errors.New("PRG-ROM too big, bank switching is not supported")
+	}
+
+	for i := 0; i < 2*PRG_BANK_SIZE; i++ {
+		c.memory[int(ROM_SEGMENT_START)+i] = prg[i%len(prg)]
+	}
 
-	c.program_counter = c.readAddressValue(PC_RESET_ADDRESS)
+	return nil
 }
 
 func (c *CPU) LoadAndReset(memory []uint8) error {
@@ -260,10 +661,136 @@ func (c *CPU) LoadAndReset(memory []uint8) error {
 	return nil
 }
 
+// Execute a single instruction, or the entry into an interrupt handler.
+// Returns false once the CPU has halted.
+func (c *CPU) Step() (bool, error) {
+	if c.core_mode == CoreCycle || c.midInstruction() {
+		return c.stepCycles()
+	}
+	if c.interruptPending() {
+		c.interrupt()
+		return true, nil
+	}
+	return c.processNextInstruction()
+}
+
+// Number of CPU cycles executed since power-on.
+func (c *CPU) Cycles() uint64 {
+	return c.cycles
+}
+
+func (c *CPU) ReadMemory(address uint16) uint8 {
+	return c.memory[address]
+}
+
+func (c *CPU) WriteMemory(address uint16, value uint8) {
+	c.memory[address] = value
+}
+
+func (c *CPU) Registers() Registers {
+	return Registers{
+		PC:     c.program_counter,
+		SP:     c.stack_pointer,
+		A:      c.accumulator,
+		X:      c.index_x,
+		Y:      c.index_y,
+		Status: c.status,
+	}
+}
+
+func (c *CPU) SetRegisters(r Registers) {
+	c.program_counter = r.PC
+	c.stack_pointer = r.SP
+	c.accumulator = r.A
+	c.index_x = r.X
+	c.index_y = r.Y
+	c.status = r.Status
+}
+
+// Set the hook for memory accesses, or nil to remove it.
+func (c *CPU) SetAccessHook(hook AccessHook) {
+	c.access_hook = hook
+}
+
+func (c *CPU) SetIllegalOpcodePolicy(policy IllegalOpcodePolicy) {
+	c.illegal_policy = policy
+}
+
+func (c *CPU) IllegalOpcodePolicy() IllegalOpcodePolicy {
+	return c.illegal_policy
+}
+
+// Set where the CPU logs to, or nil to stop logging.
+func (c *CPU) SetLogger(log *logging.Logger) {
+	c.log = log
+}
+
+func (c *CPU) Logger() *logging.Logger {
+	return c.log
+}
+
+// Set the hook called before each instruction, or nil to remove it.
+func (c *CPU) SetInstructionHook(hook InstructionHook) {
+	c.instruction_hook = hook
+}
+
+// Map a device over an inclusive address range.  Later mappings take
+// priority where ranges overlap.
+func (c *CPU) MapDevice(start uint16, end uint16, device Device) {
+	c.devices = append([]deviceMapping{{start, end, device}}, c.devices...)
+}
+
+func (c *CPU) deviceAt(address uint16) Device {
+	for _, mapping := range c.devices {
+		if address >= mapping.start && address <= mapping.end {
+			return mapping.device
+		}
+	}
+	return nil
+}
+
+// Override reads of the given addresses, replacing any earlier
+// override.  A nil override, or no addresses, removes it.
+func (c *CPU) SetReadOverride(addresses []uint16, override ReadOverride) {
+	c.overridden = [MEMORY_SIZE / 8]uint8{}
+	for _, address := range addresses {
+		c.overridden[address>>3] |= 1 << (address & 7)
+	}
+	c.read_override = override
+	if len(addresses) == 0 {
+		c.read_override = nil
+	}
+}
+
+func (c *CPU) overrideRead(address uint16, value uint8) uint8 {
+	if c.read_override != nil && c.overridden[address>>3]&(1<<(address&7)) != 0 {
+		return c.read_override(address, value)
+	}
+	return value
+}
+
+// Read an opcode, operand or pointer.  These skip devices and the access
+// hook, but not read overrides.
+func (c *CPU) fetch(address uint16) uint8 {
+	if c.read_override == nil {
+		return c.memory[address]
+	}
+	return c.overrideRead(address, c.memory[address])
+}
+
 // Read a little-endian 2-byte value from the given location
 func (c *CPU) readAddressValue(address uint16) uint16 {
-	low := c.memory[address]
-	high := c.memory[address+1]
+	low := c.fetch(address)
+	high := c.fetch(address + 1)
+	return uint16(high)<<8 | uint16(low)
+}
+
+// Read a pointer from the zero page.  A pointer at $FF wraps around,
+// taking its high byte from $00.  These are bus reads, so watchpoints on
+// the pointer fire.
+func (c *CPU) readZeroPageAddress(pointer uint8) uint16 {
+	low := c.read(uint16(pointer))
+	high := c.read(uint16(uint8(pointer + 1)))
 	return uint16(high)<<8 | uint16(low)
 }
 
@@ -275,31 +802,135 @@ func (c *CPU) writeAddressValue(address uint16, value uint16) {
 	c.memory[address+1] = high
 }
 
+// Read memory on behalf of an instruction, as opposed to e.g. a debugger.
+func (c *CPU) read(address uint16) uint8 {
+	value := c.memory[address]
+	if device := c.deviceAt(address); device != nil {
+		if c.checkAccess(device, address, false) {
+			value = device.ReadRegister(address)
+		}
+		if c.log.Enabled(logging.LevelTrace, logging.CategoryBus) {
+			c.log.Tracef(logging.CategoryBus, "Read $%04X = $%02X", address, value)
+		}
+	}
+	value = c.overrideRead(address, value)
+	if c.access_hook != nil {
+		c.access_hook(address, value, false)
+	}
+	return value
+}
+
+// Write memory on behalf of an instruction.
+func (c *CPU) write(address uint16, value uint8) {
+	if device := c.deviceAt(address); device != nil {
+		if c.checkAccess(device, address, true) {
+			device.WriteRegister(address, value)
+		}
+		if c.log.Enabled(logging.LevelTrace, logging.CategoryBus) {
+			c.log.Tracef(logging.CategoryBus, "Write $%04X = $%02X", address, value)
+		}
+	} else {
+		c.memory[address] = value
+	}
+	if c.access_hook != nil {
+		c.access_hook(address, value, true)
+	}
+}
+
+// Whether the device accepts the access.  Records a bus fault if it
+// doesn't, keeping only the first in an instruction.
+func (c *CPU) checkAccess(device Device, address uint16, write bool) bool {
+	checked, ok := device.(CheckedDevice)
+	if !ok {
+		return true
+	}
+	err := checked.CheckAccess(address, write)
+	if err == nil {
+		return true
+	}
+	if c.fault == nil {
+		c.fault = &BusFaultError{Address: address, Write: write, Err: err}
+	}
+	return false
+}
+
+// The stack grows down from $01FF, with SP pointing at the next free
+// byte.
 func (c *CPU) pushStack(value uint8) {
-	c.memory[STACK_START+uint16(c.stack_pointer)] = value
-	c.stack_pointer++
+	c.write(STACK_START+uint16(c.stack_pointer), value)
+	c.stack_pointer--
 }
 
+// Pushes the high byte first, so the address reads back little-endian.
 func (c *CPU) pushStackAddress(address uint16) {
-	c.writeAddressValue(STACK_START+uint16(c.stack_pointer), address)
-	c.stack_pointer += 2
+	c.pushStack(uint8(address >> 8))
+	c.pushStack(uint8(address))
 }
 
 func (c *CPU) popStack() uint8 {
-	c.stack_pointer--
-	return c.memory[STACK_START+uint16(c.stack_pointer)]
+	c.stack_pointer++
+	return c.read(STACK_START + uint16(c.stack_pointer))
+}
+
+// Pulls the low byte first, undoing pushStackAddress.
+func (c *CPU) popStackAddress() uint16 {
+	low := c.popStack()
+	return uint16(c.popStack())<<8 | uint16(low)
+}
+
+// Look up the instruction at the PC, after calling the hooks.  Both
+// cores start each instruction here.
+func (c *CPU) decode() (uint16, *opcodeEntry, error) {
+	if c.instruction_hook != nil {
+		c.instruction_hook(c)
+	}
+	if c.log.Enabled(logging.LevelTrace, logging.CategoryCPU) {
+		c.log.Tracef(logging.CategoryCPU, "%s", c.Disassemble(c.program_counter))
+	}
+	pc := c.program_counter
+	c.recent[c.recent_count%len(c.recent)] = pc
+	c.recent_count++
+	table := c.variant.opcodes()
+	entry := &table.entries[c.fetch(pc)]
+	if entry.illegal && c.illegal_policy != IllegalEmulate {
+		switch c.illegal_policy {
+		case IllegalNOP:
+			entry = &table.nops[entry.instruction.hex]
+		case IllegalError:
+			return pc, nil, &IllegalOpcodeError{c.machineContext(pc, c.cycles)}
+		case IllegalJam:
+			return pc, nil, &JamError{c.machineContext(pc, c.cycles)}
+		}
+	}
+	if entry.jam {
+		return pc, nil, &JamError{c.machineContext(pc, c.cycles)}
+	}
+	return pc, entry, nil
 }
 
 func (c *CPU) processNextInstruction() (bool, error) {
-	instruction := c.memory[c.program_counter]
-	operation := opcodes[instruction]
-	init_pc := c.program_counter
+	pc, entry, err := c.decode()
+	if err != nil {
+		return false, err
+	}
+
+	start_cycles := c.cycles
 	c.program_counter++
-	postProcessing, err := c.runOpcode(operation)
+	c.extra_cycles = 0
+	c.fault = nil
+	postProcessing, err := entry.handler(c, entry.instruction.mode)
 	if postProcessing != InstructionProgramCounterUpdated {
-		c.program_counter += uint16(operation.size - 1)
+		c.program_counter += uint16(entry.instruction.size - 1)
+	}
+	c.cycles += uint64(entry.instruction.cycles + c.extra_cycles)
+
+	if err == errUnimplemented {
+		return false, &UnknownOpcodeError{c.machineContext(pc, start_cycles)}
+	}
+	if c.fault != nil {
+		c.fault.MachineContext = c.machineContext(pc, start_cycles)
+		return false, c.fault
 	}
-	logging.LogDebug("Instruction: %#v, PC start: %#v, PC end: %#v", operation, init_pc, c.program_counter)
 	return postProcessing != InstructionHalt, err
 }
 
@@ -334,33 +965,48 @@ func (c *CPU) getParameterValue(mode AddressMode) uint16 {
 		// In immediate mode, the next byte is the param
 		return param_address
 	case AddrZeroPage:
-		return uint16(c.memory[param_address])
+		return uint16(c.fetch(param_address))
 	case AddrZeroPageX:
-		return modularAdd(c.memory[param_address], c.index_x)
+		return modularAdd(c.fetch(param_address), c.index_x)
 	case AddrZeroPageY:
-		return modularAdd(c.memory[param_address], c.index_y)
+		return modularAdd(c.fetch(param_address), c.index_y)
 	case AddrAbsolute:
 		return c.readAddressValue(param_address)
 	case AddrAbsoluteX:
-		return c.readAddressValue(param_address) + uint16(c.index_x)
+		base := c.readAddressValue(param_address)
+		return c.indexAddress(base, c.index_x)
 	case AddrAbsoluteY:
-		return c.readAddressValue(param_address) + uint16(c.index_y)
+		base := c.readAddressValue(param_address)
+		return c.indexAddress(base, c.index_y)
 	case AddrIndirectX:
 		// Get the parameter
 		// Add X register to it, treating it as a zero-page address.
 		// Read that address.  That's where our param lives.
-		zero_page_addr := modularAdd(c.memory[param_address], c.index_x)
-		return c.readAddressValue(zero_page_addr)
+		return c.readZeroPageAddress(c.fetch(param_address) + c.index_x)
 	case AddrIndirectY:
 		// Get the parameter.  Treat it as a zero-page address.
 		// Get the two-bytes at that zero-page. That's our base address.
 		// Add the Y register to that address.  That's the param address.
-		addr := c.readAddressValue(uint16(c.memory[param_address]))
-		return uint16(c.index_y) + addr
+		addr := c.readZeroPageAddress(c.fetch(param_address))
+		return c.indexAddress(addr, c.index_y)
+	case AddrZeroPageIndirect:
+		return c.readZeroPageAddress(c.fetch(param_address))
 	}
 	return 0
 }
 
+// Add an index register to a base address, charging the page crossing
+// penalty to instructions that pay it.
+func (c *CPU) indexAddress(base uint16, index uint8) uint16 {
+	address := base + uint16(index)
+	if address&0xff00 != base&0xff00 {
+		if c.variant.opcodes().entries[c.fetch(c.program_counter-1)].page_penalty {
+			c.extra_cycles = 1
+		}
+	}
+	return address
+}
+
 func modularAdd(x uint8, y uint8) uint16 {
 	return ((uint16(x) + uint16(y)) % 0x0100)
 }
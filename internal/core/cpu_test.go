@@ -2,9 +2,13 @@ package core
 
 import (
 	"errors"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/logging"
 )
 
 const ZERO_BIT uint8 = 0
@@ -43,11 +47,69 @@ func initializeCpuState(c *CPU, test testInput) {
 }
 
 func TestRun_UndefinedOpcode(t *testing.T) {
-	memory := []uint8{0xff}
+	// LDX #$02, INX, then the unstable XAA, which isn't emulated
+	memory := []uint8{0xa2, 0x02, 0xe8, 0x8b}
+	c := NewCPU()
+	c.LoadAndReset(memory)
+	result := c.Run()
+
+	var unknown *UnknownOpcodeError
+	assert.True(t, errors.As(result, &unknown))
+	assert.Equal(t, uint16(0x8003), unknown.PC)
+	assert.Equal(t, uint8(0x8b), unknown.Opcode)
+	assert.Equal(t, uint64(4), unknown.Cycles)
+	assert.Equal(t, Registers{PC: 0x8003, SP: 0xfd, X: 0x03, Status: I_BIT_STATUS}, unknown.Registers)
+	assert.Equal(t, uint16(0x8003), c.program_counter)
+	assert.Equal(t, "Unknown opcode $8B at $8003, cycle 4\n"+
+		"  8000  A2 02     LDX #$02\n"+
+		"  8002  E8        INX\n"+
+		"> 8003  8B        .byte $8B\n"+
+		"  A:00 X:03 Y:00 P:04 SP:FD", result.Error())
+}
+
+func TestRun_ErrorContextLimit(t *testing.T) {
+	// Six INXs, then an unknown opcode
+	memory := []uint8{0xe8, 0xe8, 0xe8, 0xe8, 0xe8, 0xe8, 0x8b}
+	c := NewCPU()
+	c.LoadAndReset(memory)
+
+	var unknown *UnknownOpcodeError
+	assert.True(t, errors.As(c.Run(), &unknown))
+	assert.Len(t, unknown.Recent, ERROR_CONTEXT_INSTRUCTIONS+1)
+	assert.Equal(t, uint16(0x8002), unknown.Recent[0].Address)
+	assert.Equal(t, uint16(0x8006), unknown.Recent[ERROR_CONTEXT_INSTRUCTIONS].Address)
+}
+
+func TestRun_Jam(t *testing.T) {
+	memory := []uint8{0xe8, 0x02}
 	c := NewCPU()
 	c.LoadAndReset(memory)
 	result := c.Run()
-	assert.Equal(t, errors.New("Unimplemented opcode"), result)
+
+	var jam *JamError
+	assert.True(t, errors.As(result, &jam))
+	assert.Equal(t, uint16(0x8001), jam.PC)
+	assert.Equal(t, uint8(0x02), jam.Opcode)
+	// A jammed CPU stays put
+	running, err := c.Step()
+	assert.False(t, running)
+	assert.True(t, errors.As(err, &jam))
+	assert.Equal(t, uint16(0x8001), c.program_counter)
+}
+
+func TestRun_JamOverridden(t *testing.T) {
+	// INX, NOP, with the NOP overridden to a JAM
+	memory := []uint8{0xe8, 0xea}
+	c := NewCPU()
+	c.LoadAndReset(memory)
+	c.SetReadOverride([]uint16{0x8001}, func(address uint16, value uint8) uint8 {
+		return 0x02
+	})
+
+	var jam *JamError
+	assert.True(t, errors.As(c.Run(), &jam))
+	assert.Equal(t, uint16(0x8001), jam.PC)
+	assert.Equal(t, uint8(0x02), jam.Opcode)
 }
 
 func TestRun_Scenario(t *testing.T) {
@@ -57,7 +119,8 @@ func TestRun_Scenario(t *testing.T) {
 			memory:               []uint8{0xa9, 0xc0, 0xaa, 0xe8, 0x00},
 			expected_accumulator: 0xc0,
 			expected_index_x:     0xc1,
-			expected_status:      N_BIT_STATUS,
+			// I is still set from the reset
+			expected_status: N_BIT_STATUS | I_BIT_STATUS,
 		},
 	}
 
@@ -120,6 +183,256 @@ func TestLoadAndReset_Overflow(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 }
 
+func TestLoadPRG_Mirrored(t *testing.T) {
+	prg := make([]uint8, PRG_BANK_SIZE)
+	prg[0] = 0xa9
+	prg[PRG_BANK_SIZE-4] = 0x00
+	prg[PRG_BANK_SIZE-3] = 0xc0
+
+	c := NewCPU()
+	err := c.LoadPRG(prg)
+	c.Reset()
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(0xa9), c.memory[0x8000])
+	assert.Equal(t, uint8(0xa9), c.memory[0xc000])
+	assert.Equal(t, uint16(0xc000), c.program_counter)
+}
+
+func TestLoadPRG_InvalidSize(t *testing.T) {
+	c := NewCPU()
+
+	assert.NotNil(t, c.LoadPRG([]uint8{0x01}))
+	assert.NotNil(t, c.LoadPRG(make([]uint8, 3*PRG_BANK_SIZE)))
+}
+
+type fakeDevice struct {
+	reads  []uint16
+	writes map[uint16]uint8
+}
+
+func (d *fakeDevice) ReadRegister(address uint16) uint8 {
+	d.reads = append(d.reads, address)
+	return 0x42
+}
+
+func (d *fakeDevice) WriteRegister(address uint16, value uint8) {
+	d.writes[address] = value
+}
+
+func TestMapDevice(t *testing.T) {
+	device := &fakeDevice{writes: map[uint16]uint8{}}
+	c := NewCPU()
+	// LDA $4016, INC $4017
+	c.LoadAndReset([]uint8{0xad, 0x16, 0x40, 0xee, 0x17, 0x40, 0x00})
+	c.MapDevice(0x4016, 0x4017, device)
+
+	assert.Nil(t, c.Run())
+
+	assert.Equal(t, uint8(0x42), c.accumulator)
+	assert.Equal(t, []uint16{0x4016, 0x4017}, device.reads)
+	assert.Equal(t, map[uint16]uint8{0x4017: 0x43}, device.writes)
+	assert.Equal(t, uint8(0), c.memory[0x4017])
+}
+
+func TestRun_IllegalOpcodes(t *testing.T) {
+	testCases := []struct {
+		name            string
+		rom             []uint8
+		value           uint8
+		accumulator     uint8
+		index_x         uint8
+		status          uint8
+		expected_acc    uint8
+		expected_x      uint8
+		expected_value  uint8
+		expected_status uint8
+	}{
+		{"LAX", []uint8{0xa7, 0x10}, 0x80, 0, 0, 0, 0x80, 0x80, 0x80, N_BIT_STATUS},
+		{"SAX", []uint8{0x87, 0x10}, 0, 0xf0, 0x3c, 0, 0xf0, 0x3c, 0x30, 0},
+		{"DCP", []uint8{0xc7, 0x10}, 0x05, 0x04, 0, 0, 0x04, 0, 0x04, Z_BIT_STATUS | C_BIT_STATUS},
+		{"ISC", []uint8{0xe7, 0x10}, 0x01, 0x05, 0, C_BIT_STATUS, 0x03, 0, 0x02, C_BIT_STATUS},
+		{"SLO", []uint8{0x07, 0x10}, 0x81, 0x02, 0, 0, 0x02, 0, 0x02, C_BIT_STATUS},
+		{"RLA", []uint8{0x27, 0x10}, 0x81, 0xff, 0, C_BIT_STATUS, 0x03, 0, 0x03, C_BIT_STATUS},
+		{"SRE", []uint8{0x47, 0x10}, 0x03, 0x01, 0, 0, 0x00, 0, 0x01, Z_BIT_STATUS | C_BIT_STATUS},
+		{"RRA", []uint8{0x67, 0x10}, 0x02, 0x10, 0, 0, 0x11, 0, 0x01, 0},
+		{"RRA overflow", []uint8{0x67, 0x10}, 0x00, 0x80, 0, C_BIT_STATUS, 0x00, 0, 0x80, Z_BIT_STATUS | C_BIT_STATUS | V_BIT_STATUS},
+		{"ANC", []uint8{0x0b, 0x80}, 0, 0xff, 0, 0, 0x80, 0, 0, N_BIT_STATUS | C_BIT_STATUS},
+		{"ALR", []uint8{0x4b, 0x03}, 0, 0xff, 0, 0, 0x01, 0, 0, C_BIT_STATUS},
+		{"ARR", []uint8{0x6b, 0xff}, 0, 0xc0, 0, C_BIT_STATUS, 0xe0, 0, 0, N_BIT_STATUS | C_BIT_STATUS},
+		{"SBX", []uint8{0xcb, 0x01}, 0, 0x0f, 0x03, 0, 0x0f, 0x02, 0, C_BIT_STATUS},
+		{"SBC", []uint8{0xeb, 0x01}, 0, 0x05, 0, C_BIT_STATUS, 0x04, 0, 0, C_BIT_STATUS},
+		{"NOP zero page", []uint8{0x04, 0x10}, 0x55, 0x01, 0x02, 0, 0x01, 0x02, 0x55, 0},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(append(test.rom, 0x00))
+			c.memory[0x10] = test.value
+			c.accumulator = test.accumulator
+			c.index_x = test.index_x
+			c.status = test.status
+
+			assert.Nil(t, c.Run())
+
+			assert.Equal(t, test.expected_acc, c.accumulator, "Accumulator incorrect")
+			assert.Equal(t, test.expected_x, c.index_x, "X incorrect")
+			assert.Equal(t, test.expected_value, c.memory[0x10], "Memory incorrect")
+			assert.Equal(t, test.expected_status, c.status, "Status incorrect")
+			// Past the instruction and the BRK
+			assert.Equal(t, ROM_SEGMENT_START+uint16(len(test.rom))+1, c.program_counter)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestRun_IllegalOpcodePolicy(t *testing.T) {
+	testCases := []struct {
+		policy      IllegalOpcodePolicy
+		accumulator uint8
+		index_x     uint8
+		err         error
+	}{
+		{IllegalEmulate, 0x40, 0x41, nil},
+		{IllegalNOP, 0x00, 0x01, nil},
+		{IllegalError, 0x00, 0x00, &IllegalOpcodeError{}},
+		{IllegalJam, 0x00, 0x00, &JamError{}},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			// LAX $10, INX
+			c.LoadAndReset([]uint8{0xa7, 0x10, 0xe8, 0x00})
+			c.memory[0x10] = 0x40
+			c.SetIllegalOpcodePolicy(test.policy)
+
+			err := c.Run()
+
+			assert.Equal(t, test.accumulator, c.accumulator)
+			assert.Equal(t, test.index_x, c.index_x)
+			if test.err == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.IsType(t, test.err, err)
+				assert.Equal(t, ROM_SEGMENT_START, c.program_counter)
+			}
+		}
+		t.Run(test.policy.String(), callback)
+	}
+}
+
+func TestRun_JamAsNOP(t *testing.T) {
+	c := NewCPU()
+	c.LoadAndReset([]uint8{0x02, 0xe8, 0x00})
+	c.SetIllegalOpcodePolicy(IllegalNOP)
+
+	assert.Nil(t, c.Run())
+	assert.Equal(t, uint8(0x01), c.index_x)
+}
+
+func TestParseIllegalOpcodePolicy(t *testing.T) {
+	policy, err := ParseIllegalOpcodePolicy("NOP")
+	assert.Nil(t, err)
+	assert.Equal(t, IllegalNOP, policy)
+	_, err = ParseIllegalOpcodePolicy("ignore")
+	assert.NotNil(t, err)
+}
+
+type readOnlyDevice struct {
+	fakeDevice
+}
+
+var errReadOnly = errors.New("Read-only register")
+
+func (d *readOnlyDevice) CheckAccess(address uint16, write bool) error {
+	if write {
+		return errReadOnly
+	}
+	return nil
+}
+
+func TestRun_BusFault(t *testing.T) {
+	device := &readOnlyDevice{fakeDevice{writes: map[uint16]uint8{}}}
+	c := NewCPU()
+	// LDA $4016, INC $4016
+	c.LoadAndReset([]uint8{0xad, 0x16, 0x40, 0xee, 0x16, 0x40, 0x00})
+	c.MapDevice(0x4016, 0x4016, device)
+
+	result := c.Run()
+
+	var fault *BusFaultError
+	assert.True(t, errors.As(result, &fault))
+	assert.True(t, errors.Is(result, errReadOnly))
+	assert.Equal(t, uint16(0x8003), fault.PC)
+	assert.Equal(t, uint16(0x4016), fault.Address)
+	assert.True(t, fault.Write)
+	assert.Equal(t, uint64(4), fault.Cycles)
+	assert.Empty(t, device.writes)
+	assert.Contains(t, result.Error(), "Bus fault writing $4016: Read-only register at $8003, cycle 4\n")
+}
+
+func TestLogger(t *testing.T) {
+	capture := &logging.Capture{}
+	log := logging.New(capture, logging.LevelTrace)
+	log.SetCategories(logging.CategoryBus)
+	c := NewCPU()
+	c.SetLogger(log)
+	// LDA $4016, INX
+	c.LoadAndReset([]uint8{0xad, 0x16, 0x40, 0xe8, 0x00})
+	c.MapDevice(0x4016, 0x4016, &fakeDevice{})
+
+	assert.Nil(t, c.Run())
+	assert.Equal(t, []string{"Read $4016 = $42"}, capture.Messages())
+
+	capture.Clear()
+	log.Enable(logging.CategoryCPU)
+	c.Reset()
+	assert.Nil(t, c.Run())
+	assert.Equal(t, []string{
+		"Reset, PC=$8000",
+		"8000  AD 16 40  LDA $4016",
+		"Read $4016 = $42",
+		"8003  E8        INX",
+		"8004  00        BRK",
+	}, capture.Messages())
+}
+
+func TestStep_Cycles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rom      []uint8
+		index_x  uint8
+		expected uint64
+	}{
+		{"Immediate", []uint8{0xa9, 0x01}, 0, 2},
+		{"Absolute,X same page", []uint8{0xbd, 0x00, 0x02}, 0xff, 4},
+		{"Absolute,X page crossed", []uint8{0xbd, 0x01, 0x02}, 0xff, 5},
+		{"Read-modify-write page crossed", []uint8{0xfe, 0x01, 0x02}, 0xff, 7},
+		{"Branch not taken", []uint8{0xd0, 0x02}, 0, 2},
+		{"Branch taken", []uint8{0xf0, 0x02}, 0, 3},
+		{"Branch taken across page", []uint8{0xf0, 0x80}, 0, 4},
+		{"Undocumented NOP page crossed", []uint8{0x1c, 0x01, 0x02}, 0xff, 5},
+		{"Undocumented RMW page crossed", []uint8{0x1f, 0x01, 0x02}, 0xff, 7},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(test.rom)
+			c.index_x = test.index_x
+			c.status = Z_BIT_STATUS
+
+			_, err := c.Step()
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, c.Cycles())
+		}
+		t.Run(test.name, callback)
+	}
+}
+
 func TestRun_LDA(t *testing.T) {
 	testCases := []testInput{
 		mkImmediate("Positive value immediate", 0xa9, 0x7b, 0x00, 0x7b, ZERO_BIT),
@@ -163,6 +476,33 @@ func TestRun_LDA(t *testing.T) {
 	runTestCases(t, testCases, callback)
 }
 
+func TestStep_IndirectSize(t *testing.T) {
+	testCases := []struct {
+		name   string
+		opcode uint8
+	}{
+		{"ADC (zp,X)", 0x61},
+		{"ADC (zp),Y", 0x71},
+		{"AND (zp,X)", 0x21},
+		{"AND (zp),Y", 0x31},
+		{"LDA (zp,X)", 0xa1},
+		{"LDA (zp),Y", 0xb1},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset([]uint8{test.opcode, 0x10})
+
+			c.Step()
+
+			// Opcode and a one byte pointer
+			assert.Equal(t, uint16(0x8002), c.program_counter, "Program counter incorrect")
+		}
+		t.Run(test.name, callback)
+	}
+}
+
 func TestRun_TAX(t *testing.T) {
 	testCases := []testInput{
 		{name: "Positive accumulator", initial_accumulator: 0x77, initial_status: N_BIT_STATUS | Z_BIT_STATUS, expected_index_x: 0x77, expected_status: ZERO_BIT},
@@ -228,22 +568,25 @@ func TestRun_ADC(t *testing.T) {
 	testCases := []testInput{
 		mkImmediate("Immediate, positive, no carry", 0x69, 0x02, 0x03, 0x05, ZERO_BIT),
 		mkImmediate("Immediate, positive, carry", 0x69, 0xff, 0x03, 0x02, C_BIT_STATUS),
-		mkImmediate("Immediate, negative, no carry", 0x69, 0x7f, 0x03, 0x82, N_BIT_STATUS),
+		mkImmediate("Immediate, negative, no carry", 0x69, 0x7f, 0x03, 0x82, N_BIT_STATUS|V_BIT_STATUS),
 		mkImmediate("Immediate, negative, carry", 0x69, 0xff, 0xff, 0xfe, C_BIT_STATUS|N_BIT_STATUS),
 		mkImmediate("Immediate, zero, no carry", 0x69, 0x00, 0x00, 0x00, Z_BIT_STATUS),
 		mkImmediate("Immediate, zero, carry", 0x69, 0xff, 0x01, 0x00, Z_BIT_STATUS|C_BIT_STATUS),
+		mkImmediate("Immediate, positive overflow", 0x69, 0x50, 0x50, 0xa0, N_BIT_STATUS|V_BIT_STATUS),
+		mkImmediate("Immediate, negative overflow", 0x69, 0x90, 0xd0, 0x60, C_BIT_STATUS|V_BIT_STATUS),
+		{name: "Immediate, clears overflow", rom: []uint8{0x69, 0x01}, initial_accumulator: 0x01, initial_status: V_BIT_STATUS, expected_accumulator: 0x02, expected_status: ZERO_BIT},
 		mkZeroPage("Zero-page, positive no carry", 0x65, 0x7b, 0x03, 0x7e, ZERO_BIT),
 		mkZeroPage("Zero-page, positive, carry", 0x65, 0xf0, 0x13, 0x03, C_BIT_STATUS),
-		mkZeroPage("Zero-page, negative, no carry", 0x65, 0x70, 0x13, 0x83, N_BIT_STATUS),
+		mkZeroPage("Zero-page, negative, no carry", 0x65, 0x70, 0x13, 0x83, N_BIT_STATUS|V_BIT_STATUS),
 		mkZeroPage("Zero-page, negative, carry", 0x65, 0xf1, 0xff, 0xf0, C_BIT_STATUS|N_BIT_STATUS),
 		mkZeroPage("Zero-page, zero, no carry", 0x65, 0x00, 0x00, 0x00, Z_BIT_STATUS),
 		mkZeroPage("Zero-page, zero, carry", 0x65, 0x01, 0xff, 0x00, C_BIT_STATUS|Z_BIT_STATUS),
 		mkZeroPageX("Zero-page X, positive no carry", 0x75, 0x7b, 0x03, 0x7e, ZERO_BIT),
 		mkZeroPageX("Zero-page X, positive, carry", 0x75, 0xf0, 0x13, 0x03, C_BIT_STATUS),
-		mkZeroPageX("Zero-page X, negative, no carry", 0x75, 0x70, 0x13, 0x83, N_BIT_STATUS),
+		mkZeroPageX("Zero-page X, negative, no carry", 0x75, 0x70, 0x13, 0x83, N_BIT_STATUS|V_BIT_STATUS),
 		mkZeroPageX("Zero-page X, negative, carry", 0x75, 0xf1, 0xff, 0xf0, C_BIT_STATUS|N_BIT_STATUS),
 		mkZeroPageX("Zero-page X wrap-around, positive, no carry", 0x75, 0x7b, 0x03, 0x7e, ZERO_BIT),
-		mkZeroPageX("Zero-page X wrap-around, negative, no carry", 0x75, 0x7b, 0x06, 0x81, N_BIT_STATUS),
+		mkZeroPageX("Zero-page X wrap-around, negative, no carry", 0x75, 0x7b, 0x06, 0x81, N_BIT_STATUS|V_BIT_STATUS),
 		mkZeroPageX("Zero-page X wrap-around, positive, carry", 0x75, 0xeb, 0x16, 0x01, C_BIT_STATUS),
 		mkZeroPageX("Zero-page X wrap-around, negative, carry", 0x75, 0x95, 0xf5, 0x8a, N_BIT_STATUS|C_BIT_STATUS),
 		mkAbsolute("Absolute, positive, no carry", 0x6d, 0x7b, 0x03, 0x7e, ZERO_BIT),
@@ -253,13 +596,13 @@ func TestRun_ADC(t *testing.T) {
 		mkAbsolute("Absolute, zero, no carry", 0x6d, 0x00, 0x00, 0x00, Z_BIT_STATUS),
 		mkAbsolute("Absolute, zero, carry", 0x6d, 0xfd, 0x03, 0x00, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsoluteX("Absolute X, positive, no carry", 0x7d, 0x7b, 0x03, 0x7e, ZERO_BIT),
-		mkAbsoluteX("Absolute X, negative, no carry", 0x7d, 0x7b, 0x06, 0x81, N_BIT_STATUS),
+		mkAbsoluteX("Absolute X, negative, no carry", 0x7d, 0x7b, 0x06, 0x81, N_BIT_STATUS|V_BIT_STATUS),
 		mkAbsoluteX("Absolute X, positive, carry", 0x7d, 0xfe, 0x03, 0x01, C_BIT_STATUS),
 		mkAbsoluteX("Absolute X, negative, carry", 0x7d, 0xff, 0x82, 0x81, N_BIT_STATUS|C_BIT_STATUS),
 		mkAbsoluteX("Absolute X, zero, no carry", 0x7d, 0x00, 0x00, 0x00, Z_BIT_STATUS),
 		mkAbsoluteX("Absolute X, zero, carry", 0x7d, 0xff, 0x01, 0x00, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsoluteY("Absolute Y, positive, no carry", 0x79, 0x7b, 0x03, 0x7e, ZERO_BIT),
-		mkAbsoluteY("Absolute Y, negative, no carry", 0x79, 0x7b, 0x06, 0x81, N_BIT_STATUS),
+		mkAbsoluteY("Absolute Y, negative, no carry", 0x79, 0x7b, 0x06, 0x81, N_BIT_STATUS|V_BIT_STATUS),
 		mkAbsoluteY("Absolute Y, positive, carry", 0x79, 0xfe, 0x03, 0x01, C_BIT_STATUS),
 		mkAbsoluteY("Absolute Y, negative, carry", 0x79, 0xff, 0x82, 0x81, N_BIT_STATUS|C_BIT_STATUS),
 		mkAbsoluteY("Absolute Y, zero, no carry", 0x79, 0x00, 0x00, 0x00, Z_BIT_STATUS),
@@ -426,20 +769,20 @@ func TestRun_RelativeBranching(t *testing.T) {
 		expected_pc uint16
 	}{
 		{name: "BCC, carry set", opcode: 0x90, status: C_BIT_STATUS, expected_pc: 0x8003},
-		{name: "BCC, carry clear", opcode: 0x90, status: ZERO_BIT, expected_pc: 0x8009},
-		{name: "BCS, carry set", opcode: 0xb0, status: C_BIT_STATUS, expected_pc: 0x8009},
+		{name: "BCC, carry clear", opcode: 0x90, status: ZERO_BIT, expected_pc: 0x800a},
+		{name: "BCS, carry set", opcode: 0xb0, status: C_BIT_STATUS, expected_pc: 0x800a},
 		{name: "BCS, carry clear", opcode: 0xb0, status: ZERO_BIT, expected_pc: 0x8003},
-		{name: "BEQ, zero set", opcode: 0xf0, status: Z_BIT_STATUS, expected_pc: 0x8009},
+		{name: "BEQ, zero set", opcode: 0xf0, status: Z_BIT_STATUS, expected_pc: 0x800a},
 		{name: "BEQ, zero clear", opcode: 0xf0, status: ZERO_BIT, expected_pc: 0x8003},
-		{name: "BMI, negative set", opcode: 0x30, status: N_BIT_STATUS, expected_pc: 0x8009},
+		{name: "BMI, negative set", opcode: 0x30, status: N_BIT_STATUS, expected_pc: 0x800a},
 		{name: "BMI, negative clear", opcode: 0x30, status: ZERO_BIT, expected_pc: 0x8003},
 		{name: "BNE, zero set", opcode: 0xd0, status: Z_BIT_STATUS, expected_pc: 0x8003},
-		{name: "BNE, zero clear", opcode: 0xd0, status: ZERO_BIT, expected_pc: 0x8009},
+		{name: "BNE, zero clear", opcode: 0xd0, status: ZERO_BIT, expected_pc: 0x800a},
 		{name: "BPL, negative set", opcode: 0x10, status: N_BIT_STATUS, expected_pc: 0x8003},
-		{name: "BPL, negative clear", opcode: 0x10, status: ZERO_BIT, expected_pc: 0x8009},
+		{name: "BPL, negative clear", opcode: 0x10, status: ZERO_BIT, expected_pc: 0x800a},
 		{name: "BVC, overflow set", opcode: 0x50, status: V_BIT_STATUS, expected_pc: 0x8003},
-		{name: "BVC, overflow clear", opcode: 0x50, status: ZERO_BIT, expected_pc: 0x8009},
-		{name: "BVS, overflow set", opcode: 0x70, status: V_BIT_STATUS, expected_pc: 0x8009},
+		{name: "BVC, overflow clear", opcode: 0x50, status: ZERO_BIT, expected_pc: 0x800a},
+		{name: "BVS, overflow set", opcode: 0x70, status: V_BIT_STATUS, expected_pc: 0x800a},
 		{name: "BVS, overflow clear", opcode: 0x70, status: ZERO_BIT, expected_pc: 0x8003},
 	}
 
@@ -454,7 +797,8 @@ func TestRun_RelativeBranching(t *testing.T) {
 			result := c.Run()
 
 			assert.Nil(t, result, "Error was not nil")
-			// Start at 0x8000, 2 bytes for BCC, 1 byte for BRK
+			// Start at 0x8000, 2 bytes for BCC, 1 byte for BRK.
+			// A taken branch lands 7 bytes past the end of the branch.
 			assert.Equal(t, uint16(test.expected_pc), c.program_counter, "Program counter incorrect")
 		}
 		t.Run(test.name, callback)
@@ -471,6 +815,12 @@ func TestRun_BIT(t *testing.T) {
 		mkAbsolute("Absolute, AND non-zero, positive, no overflow", 0x2c, 0x04, 0x04, ZERO_BIT, ZERO_BIT),
 		mkAbsolute("Absolute, AND non-zero, negative, no overflow", 0x2c, 0x85, 0x80, ZERO_BIT, N_BIT_STATUS),
 		mkAbsolute("Absolute, AND non-zero, positive, overflow", 0x2c, 0x45, 0x40, ZERO_BIT, V_BIT_STATUS),
+		// N and V come from the operand, whatever the accumulator holds
+		mkZeroPage("Zero-page, N and V from memory", 0x24, 0xc1, 0x01, ZERO_BIT, N_BIT_STATUS|V_BIT_STATUS),
+		mkZeroPage("Zero-page, N and V with AND zero", 0x24, 0xc0, 0x01, ZERO_BIT, N_BIT_STATUS|V_BIT_STATUS|Z_BIT_STATUS),
+		mkAbsolute("Absolute, not from accumulator", 0x2c, 0x01, 0xc1, ZERO_BIT, ZERO_BIT),
+		mkZeroPageWithStatus("Zero-page, clears N and V", 0x24, 0x01, 0x01, ZERO_BIT, N_BIT_STATUS|V_BIT_STATUS, ZERO_BIT),
+		mkZeroPageWithStatus("Zero-page, clears Z", 0x24, 0x01, 0x01, ZERO_BIT, Z_BIT_STATUS, ZERO_BIT),
 	}
 
 	callback := func(t *testing.T, c *CPU, test testInput) {
@@ -507,32 +857,61 @@ func TestRun_ClearStatus(t *testing.T) {
 	}
 }
 
+func TestRun_SetStatus(t *testing.T) {
+	testCases := []struct {
+		name   string
+		opcode uint8
+		flag   uint8
+	}{
+		{name: "SEC", opcode: 0x38, flag: C_BIT_STATUS},
+		{name: "SED", opcode: 0xf8, flag: D_BIT_STATUS},
+		{name: "SEI", opcode: 0x78, flag: I_BIT_STATUS},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			rom := []uint8{test.opcode}
+			c.LoadAndReset(rom)
+			c.status = ZERO_BIT
+
+			result := c.Run()
+
+			assert.Nil(t, result, "Error was not nil")
+			assert.Equal(t, test.flag, c.status, "Status incorrect")
+		}
+		t.Run(test.name, callback)
+	}
+}
+
 func TestRun_CMP(t *testing.T) {
 	testCases := []testInput{
 		mkImmediate("Immediate, positive", 0xc9, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkImmediate("Immediate, negative", 0xc9, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkImmediate("Immediate, zero", 0xc9, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkImmediate("Immediate, zero", 0xc9, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkZeroPage("Zero-page, positive", 0xc5, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkZeroPage("Zero-page, negative", 0xc5, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkZeroPage("Zero-page, zero", 0xc5, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkZeroPage("Zero-page, zero", 0xc5, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkZeroPageX("Zero-page X, positive", 0xd5, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkZeroPageX("Zero-page X, negative", 0xd5, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkZeroPageX("Zero-page X, zero", 0xd5, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkZeroPageX("Zero-page X, zero", 0xd5, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsolute("Absolute, positive", 0xcd, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkAbsolute("Absolute, negative", 0xcd, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkAbsolute("Absolute, zero", 0xcd, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkAbsolute("Absolute, zero", 0xcd, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsoluteX("Absolute X, positive", 0xdd, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkAbsoluteX("Absolute X, negative", 0xdd, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkAbsoluteX("Absolute X, zero", 0xdd, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkAbsoluteX("Absolute X, zero", 0xdd, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsoluteY("Absolute Y, positive", 0xd9, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkAbsoluteY("Absolute Y, negative", 0xd9, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkAbsoluteY("Absolute Y, zero", 0xd9, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkAbsoluteY("Absolute Y, zero", 0xd9, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkIndirectX("Indirect X, positive", 0xc1, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkIndirectX("Indirect X, negative", 0xc1, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkIndirectX("Indirect X, zero", 0xc1, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkIndirectX("Indirect X, zero", 0xc1, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkIndirectY("Indirect Y, positive", 0xd1, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkIndirectY("Indirect Y, negative", 0xd1, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkIndirectY("Indirect Y, zero", 0xd1, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkIndirectY("Indirect Y, zero", 0xd1, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
+		{name: "Immediate, less clears carry", rom: []uint8{0xc9, 0x04}, initial_accumulator: 0x02, initial_status: C_BIT_STATUS, expected_status: N_BIT_STATUS},
+		mkImmediate("Immediate, equal sets carry", 0xc9, 0x80, 0x80, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 	}
 
 	callback := func(t *testing.T, c *CPU, test testInput) {
@@ -545,13 +924,15 @@ func TestRun_CPX(t *testing.T) {
 	testCases := []testInput{
 		mkImmediate("Immediate, positive", 0xe0, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkImmediate("Immediate, negative", 0xe0, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkImmediate("Immediate, zero", 0xe0, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkImmediate("Immediate, zero", 0xe0, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkZeroPage("Zero-page, positive", 0xe4, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkZeroPage("Zero-page, negative", 0xe4, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkZeroPage("Zero-page, zero", 0xe4, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkZeroPage("Zero-page, zero", 0xe4, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsolute("Absolute, positive", 0xec, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkAbsolute("Absolute, negative", 0xec, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkAbsolute("Absolute, zero", 0xec, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkAbsolute("Absolute, zero", 0xec, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
+		{name: "Immediate, less clears carry", rom: []uint8{0xe0, 0x04}, initial_accumulator: 0x02, initial_status: C_BIT_STATUS, expected_status: N_BIT_STATUS},
+		mkImmediate("Immediate, equal sets carry", 0xe0, 0x80, 0x80, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 	}
 
 	for _, test := range testCases {
@@ -575,13 +956,15 @@ func TestRun_CPY(t *testing.T) {
 	testCases := []testInput{
 		mkImmediate("Immediate, positive", 0xc0, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkImmediate("Immediate, negative", 0xc0, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkImmediate("Immediate, zero", 0xc0, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkImmediate("Immediate, zero", 0xc0, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkZeroPage("Zero-page, positive", 0xc4, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkZeroPage("Zero-page, negative", 0xc4, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkZeroPage("Zero-page, zero", 0xc4, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkZeroPage("Zero-page, zero", 0xc4, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 		mkAbsolute("Absolute, positive", 0xcc, 0x02, 0x04, ZERO_BIT, C_BIT_STATUS),
 		mkAbsolute("Absolute, negative", 0xcc, 0x04, 0x02, ZERO_BIT, N_BIT_STATUS),
-		mkAbsolute("Absolute, zero", 0xcc, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS),
+		mkAbsolute("Absolute, zero", 0xcc, 0x03, 0x03, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
+		{name: "Immediate, less clears carry", rom: []uint8{0xc0, 0x04}, initial_accumulator: 0x02, initial_status: C_BIT_STATUS, expected_status: N_BIT_STATUS},
+		mkImmediate("Immediate, equal sets carry", 0xc0, 0x80, 0x80, ZERO_BIT, Z_BIT_STATUS|C_BIT_STATUS),
 	}
 
 	for _, test := range testCases {
@@ -784,6 +1167,74 @@ func TestRun_JMP_Indirect(t *testing.T) {
 	assert.Equal(t, uint8(0x42), c.accumulator, "Memory value not correct")
 }
 
+func TestRun_JMP_IndirectPageBoundary(t *testing.T) {
+	testCases := []struct {
+		name     string
+		variant  Variant
+		mode     CoreMode
+		expected uint16
+	}{
+		// The high byte comes from $0200, not $0300
+		{"NMOS wraps in the page", VariantNES, CoreInstruction, 0x1234},
+		{"NMOS wraps in the page, cycle core", VariantNES, CoreCycle, 0x1234},
+		{"6502 wraps in the page", VariantNMOS, CoreInstruction, 0x1234},
+		{"65C02 crosses the page", Variant65C02, CoreInstruction, 0x5634},
+		{"65C02 crosses the page, cycle core", Variant65C02, CoreCycle, 0x5634},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPUVariant(test.variant)
+			c.LoadAndReset([]uint8{0x6c, 0xff, 0x02}) // JMP ($02FF)
+			c.SetCoreMode(test.mode)
+			c.memory[0x02ff] = 0x34
+			c.memory[0x0200] = 0x12
+			c.memory[0x0300] = 0x56
+
+			c.Step()
+
+			assert.Equal(t, test.expected, c.program_counter)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestRun_ZeroPagePointerWrap(t *testing.T) {
+	testCases := []struct {
+		name    string
+		variant Variant
+		program []uint8
+		index   uint8
+	}{
+		{"Indirect X", VariantNES, []uint8{0xa1, 0xfe}, 0x01},               // LDA ($FE,X)
+		{"Indirect X wraps the sum", VariantNES, []uint8{0xa1, 0x80}, 0x7f}, // LDA ($80,X)
+		{"Indirect Y", VariantNES, []uint8{0xb1, 0xff}, 0x00},               // LDA ($FF),Y
+		{"Zero-page indirect", Variant65C02, []uint8{0xb2, 0xff}, 0x00},     // LDA ($FF)
+	}
+
+	for _, test := range testCases {
+		for _, mode := range []CoreMode{CoreInstruction, CoreCycle} {
+			callback := func(t *testing.T) {
+				c := NewCPUVariant(test.variant)
+				c.LoadAndReset(test.program)
+				c.SetCoreMode(mode)
+				c.index_x = test.index
+				c.index_y = test.index
+				// The pointer is $03FF, and $FF,$01 would give $01FF
+				c.memory[0x00ff] = 0xff
+				c.memory[0x0000] = 0x03
+				c.memory[0x0100] = 0x01
+				c.memory[0x03ff] = 0x42
+
+				c.Step()
+
+				assert.Equal(t, uint8(0x42), c.accumulator)
+			}
+			t.Run(test.name+", "+mode.String()+" core", callback)
+		}
+	}
+}
+
 func TestRun_JSR(t *testing.T) {
 	c := NewCPU()
 	// Jump to an LDA of 42, with break immediately next
@@ -794,9 +1245,9 @@ func TestRun_JSR(t *testing.T) {
 	assert.Nil(t, result, "Error was not nil")
 	// PC ends on next instruction after the BRK
 	assert.Equal(t, uint16(0x8008), c.program_counter, "Program counter incorrect")
-	assert.Equal(t, uint8(0x02), c.stack_pointer, "Stack pointer incorrect")
-	assert.Equal(t, uint8(0x02), c.memory[0x0100], "Stack low byte incorrect")
-	assert.Equal(t, uint8(0x80), c.memory[0x0101], "Stack high byte pointer incorrect")
+	assert.Equal(t, uint8(0xfb), c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, uint8(0x02), c.memory[0x01fc], "Stack low byte incorrect")
+	assert.Equal(t, uint8(0x80), c.memory[0x01fd], "Stack high byte pointer incorrect")
 	assert.Equal(t, uint8(0x42), c.accumulator, "Memory value not correct")
 }
 
@@ -966,7 +1417,7 @@ func TestRun_NOP(t *testing.T) {
 	result := c.Run()
 
 	assert.Nil(t, result, "Error was not nil")
-	assert.Equal(t, ZERO_BIT, c.status)
+	assert.Equal(t, I_BIT_STATUS, c.status)
 	// One instruction for the no-op, one for the break
 	assert.Equal(t, ROM_SEGMENT_START+2, c.program_counter)
 }
@@ -1015,8 +1466,8 @@ func TestRun_PHA(t *testing.T) {
 	result := c.Run()
 
 	assert.Nil(t, result, "Error was not nil")
-	assert.Equal(t, uint8(0x17), c.memory[STACK_START], "Stack value incorrect")
-	assert.Equal(t, uint8(0x01), c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, uint8(0x17), c.memory[STACK_START+0xfd], "Stack value incorrect")
+	assert.Equal(t, uint8(0xfc), c.stack_pointer, "Stack pointer incorrect")
 }
 
 func TestRun_PHP(t *testing.T) {
@@ -1028,8 +1479,8 @@ func TestRun_PHP(t *testing.T) {
 	result := c.Run()
 
 	assert.Nil(t, result, "Error was not nil")
-	assert.Equal(t, uint8(0x07), c.memory[STACK_START], "Stack value incorrect")
-	assert.Equal(t, uint8(0x01), c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, uint8(0x07), c.memory[STACK_START+0xfd], "Stack value incorrect")
+	assert.Equal(t, uint8(0xfc), c.stack_pointer, "Stack pointer incorrect")
 }
 
 func TestRun_PLA_Positive(t *testing.T) {
@@ -1044,7 +1495,7 @@ func TestRun_PLA_Positive(t *testing.T) {
 	assert.Nil(t, result, "Error was not nil")
 	assert.Equal(t, uint8(0x06), c.accumulator, "Accumulator incorrect")
 	assert.Equal(t, ZERO_BIT, c.status, "Status incorrect")
-	assert.Equal(t, ZERO_BIT, c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, uint8(0xfd), c.stack_pointer, "Stack pointer incorrect")
 }
 
 func TestRun_PLA_Negative(t *testing.T) {
@@ -1057,22 +1508,22 @@ func TestRun_PLA_Negative(t *testing.T) {
 
 	assert.Nil(t, result, "Error was not nil")
 	assert.Equal(t, uint8(0x86), c.accumulator, "Accumulator incorrect")
-	assert.Equal(t, N_BIT_STATUS, c.status, "Status incorrect")
-	assert.Equal(t, ZERO_BIT, c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, N_BIT_STATUS|I_BIT_STATUS, c.status, "Status incorrect")
+	assert.Equal(t, uint8(0xfd), c.stack_pointer, "Stack pointer incorrect")
 }
 
 func TestRun_PLA_Zero(t *testing.T) {
 	c := NewCPU()
 	c.LoadAndReset([]uint8{0x68})
-	c.stack_pointer = uint8(0x01)
+	c.stack_pointer = uint8(0xfc)
 	c.accumulator = 0x17
 
 	result := c.Run()
 
 	assert.Nil(t, result, "Error was not nil")
-	assert.Equal(t, ZERO_BIT, c.memory[STACK_START], "Stack value incorrect")
-	assert.Equal(t, Z_BIT_STATUS, c.status, "Status incorrect")
-	assert.Equal(t, ZERO_BIT, c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, ZERO_BIT, c.memory[STACK_START+0xfd], "Stack value incorrect")
+	assert.Equal(t, Z_BIT_STATUS|I_BIT_STATUS, c.status, "Status incorrect")
+	assert.Equal(t, uint8(0xfd), c.stack_pointer, "Stack pointer incorrect")
 }
 
 func TestRun_PLP(t *testing.T) {
@@ -1085,7 +1536,7 @@ func TestRun_PLP(t *testing.T) {
 
 	assert.Nil(t, result, "Error was not nil")
 	assert.Equal(t, uint8(0xff), c.status, "Status incorrect")
-	assert.Equal(t, ZERO_BIT, c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, uint8(0xfd), c.stack_pointer, "Stack pointer incorrect")
 }
 
 func TestRun_ROL(t *testing.T) {
@@ -1209,6 +1660,79 @@ func TestRun_ROL(t *testing.T) {
 	runMemoryTests(absoluteXTests, uint16(0x1003))
 }
 
+func TestRun_Store(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rom      []uint8
+		address  uint16
+		expected uint8
+	}{
+		{"STA zero-page", []uint8{0x85, 0x10}, 0x0010, 0xa1},
+		{"STA zero-page X", []uint8{0x95, 0x10}, 0x0012, 0xa1},
+		{"STA zero-page X wraps", []uint8{0x95, 0xff}, 0x0001, 0xa1},
+		{"STA absolute", []uint8{0x8d, 0x34, 0x12}, 0x1234, 0xa1},
+		{"STA absolute X", []uint8{0x9d, 0xff, 0x12}, 0x1301, 0xa1},
+		{"STA absolute Y", []uint8{0x99, 0x34, 0x12}, 0x1237, 0xa1},
+		{"STA indirect X", []uint8{0x81, 0x10}, 0x1234, 0xa1},
+		{"STA indirect Y", []uint8{0x91, 0x20}, 0x1237, 0xa1},
+		{"STX zero-page", []uint8{0x86, 0x10}, 0x0010, 0x02},
+		{"STX zero-page Y", []uint8{0x96, 0x10}, 0x0013, 0x02},
+		{"STX absolute", []uint8{0x8e, 0x34, 0x12}, 0x1234, 0x02},
+		{"STY zero-page", []uint8{0x84, 0x10}, 0x0010, 0x03},
+		{"STY zero-page X", []uint8{0x94, 0x10}, 0x0012, 0x03},
+		{"STY absolute", []uint8{0x8c, 0x34, 0x12}, 0x1234, 0x03},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(test.rom)
+			c.writeAddressValue(0x0012, 0x1234)
+			c.writeAddressValue(0x0020, 0x1234)
+			c.accumulator = 0xa1
+			c.index_x = 0x02
+			c.index_y = 0x03
+			c.status = ZERO_BIT
+
+			result := c.Run()
+
+			assert.Nil(t, result, "Error was not nil")
+			assert.Equal(t, test.expected, c.memory[test.address], "Memory value not correct")
+			// Stores don't touch the flags
+			assert.Equal(t, ZERO_BIT, c.status, "Status incorrect")
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestRun_RTS(t *testing.T) {
+	c := NewCPU()
+	// Call an LDA of 42 and return to the BRK after the JSR
+	c.LoadAndReset([]uint8{0x20, 0x04, 0x80, 0x00, 0xa9, 0x42, 0x60})
+
+	result := c.Run()
+
+	assert.Nil(t, result, "Error was not nil")
+	assert.Equal(t, uint16(0x8004), c.program_counter, "Program counter incorrect")
+	assert.Equal(t, uint8(0xfd), c.stack_pointer, "Stack pointer incorrect")
+	assert.Equal(t, uint8(0x42), c.accumulator, "Memory value not correct")
+}
+
+func TestRun_RTI(t *testing.T) {
+	c := NewCPU()
+	// Return past the BRKs to a NOP
+	c.LoadAndReset([]uint8{0x40, 0x00, 0x00, 0x00, 0xea, 0x00})
+	c.pushStackAddress(0x8004)
+	c.pushStack(N_BIT_STATUS | C_BIT_STATUS)
+
+	result := c.Run()
+
+	assert.Nil(t, result, "Error was not nil")
+	assert.Equal(t, uint16(0x8006), c.program_counter, "Program counter incorrect")
+	assert.Equal(t, N_BIT_STATUS|C_BIT_STATUS, c.status, "Status incorrect")
+	assert.Equal(t, uint8(0xfd), c.stack_pointer, "Stack pointer incorrect")
+}
+
 func setCommonFields(test testInput, name string, initial, expected, status uint8) testInput {
 	test.name = name
 	test.initial = initial
@@ -1389,3 +1913,80 @@ func runTestCasesWithSetup(
 func runTestCases(t *testing.T, testCases []testInput, assertion_callback func(*testing.T, *CPU, testInput)) {
 	runTestCasesWithSetup(t, testCases, func(t *testing.T, c *CPU, input testInput) {}, assertion_callback)
 }
+
+// A loop of everyday instructions for measuring dispatch speed
+var benchmarkProgram = []uint8{
+	0xa2, 0x00, // LDX #$00
+	0xbd, 0x00, 0x02, // loop: LDA $0200,X
+	0x69, 0x01, // ADC #$01
+	0x45, 0x10, // EOR $10
+	0xe6, 0x11, // INC $11
+	0xe8,       // INX
+	0xd0, 0xf4, // BNE loop
+	0x4c, 0x00, 0x80, // JMP $8000
+}
+
+func TestStep_NoAllocations(t *testing.T) {
+	testCases := []struct {
+		name   string
+		rom    []uint8
+		policy IllegalOpcodePolicy
+		mode   CoreMode
+	}{
+		{"Official opcodes", benchmarkProgram, IllegalEmulate, CoreInstruction},
+		// SLO $10, JMP $8000
+		{"Emulated illegal opcode", []uint8{0x07, 0x10, 0x4c, 0x00, 0x80}, IllegalEmulate, CoreInstruction},
+		{"Illegal opcode as NOP", []uint8{0x07, 0x10, 0x4c, 0x00, 0x80}, IllegalNOP, CoreInstruction},
+		{"Cycle core", benchmarkProgram, IllegalEmulate, CoreCycle},
+		{"Cycle core, illegal opcode as NOP", []uint8{0x07, 0x10, 0x4c, 0x00, 0x80}, IllegalNOP, CoreCycle},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(test.rom)
+			c.SetIllegalOpcodePolicy(test.policy)
+			c.SetCoreMode(test.mode)
+
+			allocations := testing.AllocsPerRun(1000, func() {
+				c.Step()
+			})
+
+			assert.Equal(t, 0.0, allocations)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func BenchmarkStep(b *testing.B) {
+	testCases := []struct {
+		name string
+		log  *logging.Logger
+		mode CoreMode
+	}{
+		{"No logger", nil, CoreInstruction},
+		{"Logging off", logging.New(logging.NewWriterSink(io.Discard), logging.LevelOff), CoreInstruction},
+		{"Tracing", logging.New(logging.NewWriterSink(io.Discard), logging.LevelTrace), CoreInstruction},
+		{"Cycle core", nil, CoreCycle},
+	}
+
+	for _, test := range testCases {
+		b.Run(test.name, func(b *testing.B) {
+			c := NewCPU()
+			c.LoadAndReset(benchmarkProgram)
+			c.SetLogger(test.log)
+			c.SetCoreMode(test.mode)
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+
+			for i := 0; i < b.N; i++ {
+				c.Step()
+			}
+
+			elapsed := time.Since(start).Seconds()
+			b.ReportMetric(float64(b.N)/elapsed, "instructions/s")
+			b.ReportMetric(float64(c.Cycles())/elapsed/1e6, "emulated-MHz")
+		})
+	}
+}
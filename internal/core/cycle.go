@@ -0,0 +1,553 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Which core executes instructions.
+type CoreMode int
+
+const (
+	// Runs each instruction in one go.  Fastest, and exact at instruction
+	// boundaries.
+	CoreInstruction CoreMode = iota
+	// Runs each instruction a bus cycle at a time, including the dummy
+	// reads and writes the 6502 makes, and polls interrupts on the cycle
+	// the hardware does.
+	CoreCycle
+)
+
+var CORE_MODE_NAMES = [...]string{"instruction", "cycle"}
+
+func (m CoreMode) String() string {
+	if m < 0 || int(m) >= len(CORE_MODE_NAMES) {
+		return fmt.Sprintf("core(%d)", int(m))
+	}
+	return CORE_MODE_NAMES[m]
+}
+
+func ParseCoreMode(name string) (CoreMode, error) {
+	for i, mode_name := range CORE_MODE_NAMES {
+		if strings.EqualFold(name, mode_name) {
+			return CoreMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown core %q, expected one of %s", name, strings.Join(CORE_MODE_NAMES[:], ", "))
+}
+
+// Where the cycle core is in the current instruction.
+type cycleState struct {
+	// Cycles run so far, counting the opcode fetch.  Zero between
+	// instructions.
+	step  int
+	entry *opcodeEntry
+	// Entering an interrupt handler rather than running an instruction
+	interrupt    bool
+	pc           uint16
+	start_cycles uint64
+	// The step that finished working out the operand address, or zero
+	resolved int
+	address  uint16
+	pointer  uint8
+	value    uint8
+	crossed  bool
+	// Cycles the operation added on top of its bus accesses, such as the
+	// 65C02's decimal mode fix-up
+	extra uint
+	// Whether an interrupt was pending at the end of the last cycle, and
+	// the one before.  The CPU acts on the earlier one.
+	poll          bool
+	poll_previous bool
+}
+
+// Switch cores.  A change in the middle of an instruction takes effect
+// once it finishes.
+func (c *CPU) SetCoreMode(mode CoreMode) {
+	c.core_mode = mode
+	c.owed_cycles = 0
+}
+
+func (c *CPU) CoreMode() CoreMode {
+	return c.core_mode
+}
+
+// Run a single CPU cycle.  The instruction core runs each instruction
+// whole on its first cycle and idles for the rest, so its timing only
+// lines up at instruction boundaries.
+func (c *CPU) StepCycle() (bool, error) {
+	if c.core_mode == CoreCycle || c.midInstruction() {
+		return c.tick()
+	}
+	if c.owed_cycles > 0 {
+		c.owed_cycles--
+		return true, nil
+	}
+	start_cycles := c.cycles
+	running, err := c.Step()
+	if c.cycles > start_cycles {
+		c.owed_cycles = c.cycles - start_cycles - 1
+	}
+	return running, err
+}
+
+// Run the cycle core to the end of the current instruction.
+func (c *CPU) stepCycles() (bool, error) {
+	for {
+		running, err := c.tick()
+		if err != nil || !running || c.cycle.step == 0 {
+			return running, err
+		}
+	}
+}
+
+// Whether the cycle core has stopped part way through an instruction.
+func (c *CPU) midInstruction() bool {
+	return c.cycle.step != 0
+}
+
+// One cycle of the cycle core.
+func (c *CPU) tick() (bool, error) {
+	s := &c.cycle
+	if s.step == 0 {
+		err := c.beginInstruction()
+		if err != nil {
+			return false, err
+		}
+	}
+	s.step++
+	c.cycles++
+
+	done, running := false, true
+	switch {
+	case s.interrupt:
+		done = c.interruptCycle()
+	case s.step == 1:
+		// The opcode fetch, already done by beginInstruction, and all the
+		// 65C02's single-cycle NOPs do
+		done = s.entry.instruction.cycles == 1
+	default:
+		done, running = c.instructionCycle()
+	}
+
+	s.poll_previous = s.poll
+	s.poll = c.interruptPending()
+
+	if c.fault != nil {
+		s.step = 0
+		c.fault.MachineContext = c.machineContext(s.pc, s.start_cycles)
+		return false, c.fault
+	}
+	if done {
+		s.step = 0
+	}
+	return running, nil
+}
+
+// Start the next instruction, or an interrupt if one was pending in time.
+func (c *CPU) beginInstruction() error {
+	s := &c.cycle
+	s.start_cycles = c.cycles
+	s.resolved = 0
+	s.extra = 0
+	c.extra_cycles = 0
+	c.fault = nil
+	if s.poll_previous {
+		s.interrupt = true
+		s.pc = c.program_counter
+		return nil
+	}
+
+	s.interrupt = false
+	pc, entry, err := c.decode()
+	s.pc = pc
+	if err != nil {
+		return err
+	}
+	if !entry.known {
+		return &UnknownOpcodeError{c.machineContext(pc, c.cycles)}
+	}
+	s.entry = entry
+	c.program_counter++
+	return nil
+}
+
+// Fetch the next program byte.  Like opcodes, these aren't reported to
+// the access hook.
+func (c *CPU) fetchOperand() uint8 {
+	value := c.fetch(c.program_counter)
+	c.program_counter++
+	return value
+}
+
+// The cycles after the opcode fetch.  Returns whether the instruction
+// has finished, and false for running if it halted the CPU.
+func (c *CPU) instructionCycle() (bool, bool) {
+	s := &c.cycle
+	op := &s.entry.operation
+	mode := s.entry.instruction.mode
+	if s.extra > 0 {
+		c.read(c.program_counter)
+		s.extra--
+		return s.extra == 0, true
+	}
+
+	switch op.kind {
+	case opImplied:
+		c.read(c.program_counter)
+		op.implied(c)
+		return true, true
+
+	case opRead, opModify, opStore:
+		if isRegisterMode(mode) {
+			c.read(c.program_counter)
+			op.implied(c)
+			return true, true
+		}
+		done := c.operandCycle(op, mode)
+		if done && c.extra_cycles > 0 {
+			s.extra = c.extra_cycles
+			return false, true
+		}
+		return done, true
+
+	case opPush:
+		if s.step == 2 {
+			c.read(c.program_counter)
+			return false, true
+		}
+		c.pushStack(op.store(c))
+		return true, true
+
+	case opPull:
+		switch s.step {
+		case 2:
+			c.read(c.program_counter)
+		case 3:
+			c.read(STACK_START + uint16(c.stack_pointer))
+		default:
+			op.read(c, c.popStack())
+			return true, true
+		}
+		return false, true
+
+	case opBranch:
+		return c.branchCycle(op), true
+
+	case opJump:
+		return c.jumpCycle(mode), true
+
+	case opJumpSubroutine:
+		switch s.step {
+		case 2:
+			s.value = c.fetchOperand()
+		case 3:
+			c.read(STACK_START + uint16(c.stack_pointer))
+		case 4:
+			// High byte first, like pushStackAddress, with the PC on the
+			// last byte of the JSR
+			c.pushStack(uint8(c.program_counter >> 8))
+		case 5:
+			c.pushStack(uint8(c.program_counter))
+		default:
+			c.program_counter = uint16(c.fetch(c.program_counter))<<8 | uint16(s.value)
+			return true, true
+		}
+		return false, true
+
+	case opReturnSubroutine:
+		switch s.step {
+		case 2:
+			c.read(c.program_counter)
+		case 3:
+			c.read(STACK_START + uint16(c.stack_pointer))
+		case 4:
+			s.value = c.popStack()
+		case 5:
+			c.program_counter = uint16(c.popStack())<<8 | uint16(s.value)
+		default:
+			// Step past the last byte of the JSR
+			c.read(c.program_counter)
+			c.program_counter++
+			return true, true
+		}
+		return false, true
+
+	case opReturnInterrupt:
+		switch s.step {
+		case 2:
+			c.read(c.program_counter)
+		case 3:
+			c.read(STACK_START + uint16(c.stack_pointer))
+		case 4:
+			c.status = c.popStack()
+		case 5:
+			s.value = c.popStack()
+		default:
+			c.program_counter = uint16(c.popStack())<<8 | uint16(s.value)
+			return true, true
+		}
+		return false, true
+
+	case opBreak:
+		if s.step == 2 {
+			c.read(c.program_counter)
+		}
+		if s.step < int(s.entry.instruction.cycles) {
+			return false, true
+		}
+		return true, false
+
+	case opSkip:
+		if s.step < int(s.entry.instruction.cycles) {
+			return false, true
+		}
+		c.program_counter = s.pc + uint16(s.entry.instruction.size)
+		return true, true
+	}
+	return true, true
+}
+
+// A cycle of an instruction with a memory operand.  Working out the
+// address takes a few cycles, then reads take one more, writes one more
+// and read-modify-writes three.
+func (c *CPU) operandCycle(op *operation, mode AddressMode) bool {
+	s := &c.cycle
+	if mode == AddrImmediate {
+		op.read(c, c.read(c.program_counter))
+		c.program_counter++
+		return true
+	}
+	if s.resolved == 0 {
+		if c.addressCycle(op.kind, mode) {
+			s.resolved = s.step
+		}
+		return false
+	}
+
+	switch s.step - s.resolved {
+	case 1:
+		if op.kind == opStore {
+			c.write(s.address, op.store(c))
+			return true
+		}
+		s.value = c.read(s.address)
+		if op.kind == opRead {
+			op.read(c, s.value)
+			return true
+		}
+	case 2:
+		// The old value goes back out while the new one is worked out.
+		// The 65C02 reads it again instead.
+		if c.variant == Variant65C02 {
+			c.read(s.address)
+		} else {
+			c.write(s.address, s.value)
+		}
+		s.value = op.modify(c, s.value)
+	default:
+		c.write(s.address, s.value)
+		return true
+	}
+	return false
+}
+
+// A cycle spent working out an operand address.  Returns true once the
+// address is ready.
+func (c *CPU) addressCycle(kind operationKind, mode AddressMode) bool {
+	s := &c.cycle
+	switch mode {
+	case AddrZeroPage:
+		s.address = uint16(c.fetchOperand())
+		return true
+
+	case AddrZeroPageX, AddrZeroPageY:
+		if s.step == 2 {
+			s.address = uint16(c.fetchOperand())
+			return false
+		}
+		// Reads the unindexed address while adding
+		c.read(s.address)
+		s.address = modularAdd(uint8(s.address), c.modeIndex(mode))
+		return true
+
+	case AddrAbsolute:
+		if s.step == 2 {
+			s.address = uint16(c.fetchOperand())
+			return false
+		}
+		s.address |= uint16(c.fetchOperand()) << 8
+		return true
+
+	case AddrAbsoluteX, AddrAbsoluteY:
+		switch s.step {
+		case 2:
+			s.address = uint16(c.fetchOperand())
+			return false
+		case 3:
+			base := s.address | uint16(c.fetchOperand())<<8
+			return c.indexCycle(base, c.modeIndex(mode))
+		}
+		c.readUnfixedAddress()
+		return true
+
+	case AddrIndirectX:
+		switch s.step {
+		case 2:
+			s.pointer = c.fetchOperand()
+		case 3:
+			c.read(uint16(s.pointer))
+			s.pointer += c.index_x
+		case 4:
+			s.address = uint16(c.read(uint16(s.pointer)))
+		default:
+			s.address |= uint16(c.read(uint16(s.pointer+1))) << 8
+			return true
+		}
+		return false
+
+	case AddrIndirectY:
+		switch s.step {
+		case 2:
+			s.pointer = c.fetchOperand()
+		case 3:
+			s.address = uint16(c.read(uint16(s.pointer)))
+		case 4:
+			base := s.address | uint16(c.read(uint16(s.pointer+1)))<<8
+			return c.indexCycle(base, c.index_y)
+		default:
+			c.readUnfixedAddress()
+			return true
+		}
+		return false
+
+	case AddrZeroPageIndirect:
+		switch s.step {
+		case 2:
+			s.pointer = c.fetchOperand()
+		case 3:
+			s.address = uint16(c.read(uint16(s.pointer)))
+		default:
+			s.address |= uint16(c.read(uint16(s.pointer+1))) << 8
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+func (c *CPU) modeIndex(mode AddressMode) uint8 {
+	if mode == AddrZeroPageY || mode == AddrAbsoluteY {
+		return c.index_y
+	}
+	return c.index_x
+}
+
+// Index the base address.  Instructions with a page crossing penalty,
+// mostly reads, can use it straight away if the high byte didn't change,
+// but anything else needs another cycle to fix it.
+func (c *CPU) indexCycle(base uint16, index uint8) bool {
+	s := &c.cycle
+	s.address = base + uint16(index)
+	s.crossed = s.address&0xff00 != base&0xff00
+	return s.entry.page_penalty && !s.crossed
+}
+
+// The dummy read while the high byte of an indexed address is fixed,
+// from the address without the carry into the high byte.  The 65C02
+// reads the last operand byte again instead.
+func (c *CPU) readUnfixedAddress() {
+	s := &c.cycle
+	if s.crossed && c.variant == Variant65C02 {
+		c.read(c.program_counter - 1)
+	} else if s.crossed {
+		c.read(s.address - 0x0100)
+	} else {
+		c.read(s.address)
+	}
+}
+
+func (c *CPU) branchCycle(op *operation) bool {
+	s := &c.cycle
+	switch s.step {
+	case 2:
+		s.value = c.read(c.program_counter)
+		c.program_counter++
+		return !op.branchTaken(c)
+	case 3:
+		c.read(c.program_counter)
+		s.address = branchTarget(c.program_counter-1, s.value)
+		if s.address&0xff00 == c.program_counter&0xff00 {
+			c.program_counter = s.address
+			// A taken branch that stays on its page doesn't poll on this
+			// cycle, so an interrupt arriving now waits an instruction
+			if s.poll && !s.poll_previous {
+				s.poll = false
+			}
+			return true
+		}
+		c.program_counter = c.program_counter&0xff00 | s.address&0x00ff
+		return false
+	}
+	c.read(c.program_counter)
+	c.program_counter = s.address
+	return true
+}
+
+func (c *CPU) jumpCycle(mode AddressMode) bool {
+	s := &c.cycle
+	step := s.step
+	if mode == AddrIndirect && c.variant == Variant65C02 {
+		// The 65C02 takes a cycle to get the pointer's page right
+		if step == 4 {
+			c.read(c.program_counter - 1)
+			return false
+		}
+		if step > 4 {
+			step--
+		}
+	}
+	switch step {
+	case 2:
+		s.address = uint16(c.fetchOperand())
+		return false
+	case 3:
+		s.address |= uint16(c.fetchOperand()) << 8
+		if mode == AddrIndirect {
+			return false
+		}
+		c.program_counter = s.address
+		return true
+	case 4:
+		s.value = c.read(s.address)
+		return false
+	}
+	c.program_counter = uint16(c.read(c.variant.IndirectJumpHigh(s.address)))<<8 | uint16(s.value)
+	return true
+}
+
+// The cycles of entering an interrupt handler, which starts with two
+// reads at the PC in place of an opcode fetch.
+func (c *CPU) interruptCycle() bool {
+	s := &c.cycle
+	switch s.step {
+	case 1, 2:
+		c.read(c.program_counter)
+	case 3:
+		// High byte first, like pushStackAddress
+		c.pushStack(uint8(c.program_counter >> 8))
+	case 4:
+		c.pushStack(uint8(c.program_counter))
+	case 5:
+		// An NMI arriving up to here takes over the sequence
+		s.address = c.interruptVector()
+		c.pushStack(c.interruptStatus())
+	case 6:
+		s.value = c.read(s.address)
+		c.maskInterrupts()
+	default:
+		c.program_counter = uint16(c.read(s.address+1))<<8 | uint16(s.value)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const CYCLE_TEST_ORIGIN uint16 = 0x80f0
+
+// A CPU with a pattern through memory, so reads from the wrong address
+// give different results.
+func newPatternCPU(variant Variant, mode CoreMode, program []uint8, registers Registers) *CPU {
+	c := NewCPUVariant(variant)
+	for i := range c.memory {
+		c.memory[i] = uint8(i*7 + i>>8)
+	}
+	for i, value := range program {
+		c.memory[int(CYCLE_TEST_ORIGIN)+i] = value
+	}
+	registers.PC = CYCLE_TEST_ORIGIN
+	c.SetRegisters(registers)
+	c.SetCoreMode(mode)
+	return c
+}
+
+func TestCycleCore_MatchesInstructionCore(t *testing.T) {
+	operands := [][]uint8{{0xff, 0x10}, {0x20, 0x30}}
+	indexes := []uint8{0x00, 0x01, 0xff}
+	// Decimal mode on or off, for the 65C02's extra cycle
+	statuses := []uint8{0x00, 0xc3, 0xcb}
+
+	for _, variant := range []Variant{VariantNES, Variant65C02} {
+		for hex := 0; hex <= 0xff; hex++ {
+			instruction, ok := variant.LookupOpcode(uint8(hex))
+			if !ok || variant.opcodes().entries[hex].jam {
+				continue
+			}
+			for _, operand := range operands {
+				for _, index := range indexes {
+					for _, status := range statuses {
+						program := []uint8{uint8(hex), operand[0], operand[1]}
+						registers := Registers{SP: 0x80, A: 0x5a, X: index, Y: index, Status: status}
+						fast := newPatternCPU(variant, CoreInstruction, program, registers)
+						slow := newPatternCPU(variant, CoreCycle, program, registers)
+
+						fast_running, fast_err := fast.Step()
+						slow_running, slow_err := slow.Step()
+
+						name := variant.String() + " " + instruction.Name()
+						assert.Equal(t, fast_err, slow_err, name)
+						assert.Equal(t, fast_running, slow_running, name)
+						assert.Equal(t, fast.Registers(), slow.Registers(), "%s $%02X, X=Y=$%02X, P=$%02X", name, hex, index, status)
+						assert.Equal(t, fast.Cycles(), slow.Cycles(), "%s $%02X, X=Y=$%02X, P=$%02X", name, hex, index, status)
+						assert.True(t, fast.memory == slow.memory, "%s $%02X memory differs", name, hex)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCycleCore_MatchesInstructionCoreOverProgram(t *testing.T) {
+	fast := NewCPU()
+	fast.LoadAndReset(benchmarkProgram)
+	slow := NewCPU()
+	slow.LoadAndReset(benchmarkProgram)
+	slow.SetCoreMode(CoreCycle)
+
+	for i := 0; i < 5000; i++ {
+		fast.Step()
+		slow.Step()
+	}
+
+	assert.Equal(t, fast.Registers(), slow.Registers())
+	assert.Equal(t, fast.Cycles(), slow.Cycles())
+	assert.True(t, fast.memory == slow.memory)
+}
+
+type busAccess struct {
+	address uint16
+	value   uint8
+	write   bool
+}
+
+func TestCycleCore_BusAccesses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		program  []uint8
+		setup    func(c *CPU)
+		expected []busAccess
+	}{
+		{
+			"Implied reads the next byte",
+			[]uint8{0xe8}, // INX
+			nil,
+			[]busAccess{{0x80f1, 0x00, false}},
+		},
+		{
+			"Zero page X reads the unindexed address",
+			[]uint8{0xb5, 0x10}, // LDA $10,X
+			func(c *CPU) { c.index_x = 1 },
+			[]busAccess{{0x0010, 0x00, false}, {0x0011, 0x00, false}},
+		},
+		{
+			"Absolute X within a page",
+			[]uint8{0xbd, 0x00, 0x10}, // LDA $1000,X
+			func(c *CPU) { c.index_x = 1 },
+			[]busAccess{{0x1001, 0x00, false}},
+		},
+		{
+			"Absolute X read across a page",
+			[]uint8{0xbd, 0xff, 0x10}, // LDA $10FF,X
+			func(c *CPU) { c.index_x = 1 },
+			[]busAccess{{0x1000, 0x00, false}, {0x1100, 0x00, false}},
+		},
+		{
+			"Indirect Y read across a page",
+			[]uint8{0xb1, 0x10}, // LDA ($10),Y
+			func(c *CPU) {
+				c.index_y = 1
+				c.memory[0x10] = 0xff
+				c.memory[0x11] = 0x10
+			},
+			[]busAccess{{0x0010, 0xff, false}, {0x0011, 0x10, false}, {0x1000, 0x00, false}, {0x1100, 0x00, false}},
+		},
+		{
+			"Read-modify-write writes the old value first",
+			[]uint8{0xe6, 0x10}, // INC $10
+			func(c *CPU) { c.memory[0x10] = 0x41 },
+			[]busAccess{{0x0010, 0x41, false}, {0x0010, 0x41, true}, {0x0010, 0x42, true}},
+		},
+		{
+			"Read-modify-write absolute X always fixes the address",
+			[]uint8{0xfe, 0x00, 0x10}, // INC $1000,X
+			func(c *CPU) { c.index_x = 1 },
+			[]busAccess{{0x1001, 0x00, false}, {0x1001, 0x00, false}, {0x1001, 0x00, true}, {0x1001, 0x01, true}},
+		},
+		{
+			"Taken branch across a page",
+			[]uint8{0xd0, 0x20}, // BNE +$20
+			nil,
+			[]busAccess{{0x80f1, 0x20, false}, {0x80f2, 0x00, false}, {0x8012, 0x00, false}},
+		},
+		{
+			"Push",
+			[]uint8{0x48}, // PHA
+			func(c *CPU) { c.accumulator = 0x33 },
+			[]busAccess{{0x80f1, 0x00, false}, {0x0100, 0x33, true}},
+		},
+		{
+			"Jump to subroutine",
+			[]uint8{0x20, 0x34, 0x12}, // JSR $1234
+			nil,
+			[]busAccess{{0x0100, 0x00, false}, {0x0100, 0x80, true}, {0x01ff, 0xf2, true}},
+		},
+		{
+			"Return from subroutine",
+			[]uint8{0x60}, // RTS
+			func(c *CPU) {
+				c.memory[0x0101] = 0x33
+				c.memory[0x0102] = 0x12
+			},
+			[]busAccess{{0x80f1, 0x00, false}, {0x0100, 0x00, false}, {0x0101, 0x33, false}, {0x0102, 0x12, false}, {0x1233, 0x00, false}},
+		},
+		{
+			"Return from interrupt",
+			[]uint8{0x40}, // RTI
+			func(c *CPU) {
+				c.memory[0x0101] = 0xc3
+				c.memory[0x0102] = 0x34
+				c.memory[0x0103] = 0x12
+			},
+			[]busAccess{{0x80f1, 0x00, false}, {0x0100, 0x00, false}, {0x0101, 0xc3, false}, {0x0102, 0x34, false}, {0x0103, 0x12, false}},
+		},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			for i, value := range test.program {
+				c.memory[int(CYCLE_TEST_ORIGIN)+i] = value
+			}
+			c.program_counter = CYCLE_TEST_ORIGIN
+			c.SetCoreMode(CoreCycle)
+			if test.setup != nil {
+				test.setup(c)
+			}
+			accesses := []busAccess{}
+			c.SetAccessHook(func(address uint16, value uint8, write bool) {
+				accesses = append(accesses, busAccess{address, value, write})
+			})
+
+			_, err := c.Step()
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, accesses)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestCycleCore_StepCycle(t *testing.T) {
+	// INC $10, then the rest of the cycles go nowhere
+	c := NewCPU()
+	c.LoadAndReset([]uint8{0xe6, 0x10})
+	c.SetCoreMode(CoreCycle)
+
+	for i := 0; i < 4; i++ {
+		c.StepCycle()
+	}
+
+	assert.Equal(t, uint8(0), c.ReadMemory(0x10))
+	assert.True(t, c.midInstruction())
+
+	c.StepCycle()
+
+	assert.Equal(t, uint8(1), c.ReadMemory(0x10))
+	assert.False(t, c.midInstruction())
+	assert.Equal(t, uint64(5), c.Cycles())
+}
+
+func TestInstructionCore_StepCycle(t *testing.T) {
+	// INC $10 runs whole on its first cycle, then idles
+	c := NewCPU()
+	c.LoadAndReset([]uint8{0xe6, 0x10, 0xe8})
+
+	c.StepCycle()
+	assert.Equal(t, uint8(1), c.ReadMemory(0x10))
+	for i := 0; i < 4; i++ {
+		c.StepCycle()
+	}
+	assert.Equal(t, uint16(0x8002), c.Registers().PC)
+
+	c.StepCycle()
+	assert.Equal(t, uint16(0x8003), c.Registers().PC)
+}
+
+func TestInterrupts(t *testing.T) {
+	testCases := []struct {
+		name   string
+		mode   CoreMode
+		status uint8
+		irq    bool
+		nmi    bool
+		// Zero if the interrupt shouldn't be taken
+		expected uint16
+	}{
+		{"IRQ, instruction core", CoreInstruction, 0x00, true, false, 0x9000},
+		{"IRQ, cycle core", CoreCycle, 0x00, true, false, 0x9000},
+		{"IRQ masked, instruction core", CoreInstruction, I_BIT_STATUS, true, false, 0},
+		{"IRQ masked, cycle core", CoreCycle, I_BIT_STATUS, true, false, 0},
+		{"NMI ignores I, instruction core", CoreInstruction, I_BIT_STATUS, false, true, 0xa000},
+		{"NMI ignores I, cycle core", CoreCycle, I_BIT_STATUS, false, true, 0xa000},
+		{"NMI beats IRQ, instruction core", CoreInstruction, 0x00, true, true, 0xa000},
+		{"NMI beats IRQ, cycle core", CoreCycle, 0x00, true, true, 0xa000},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset([]uint8{0xea, 0xea, 0xea})
+			c.writeAddressValue(IRQ_VECTOR, 0x9000)
+			c.writeAddressValue(NMI_VECTOR, 0xa000)
+			c.status = test.status | B_BIT_STATUS
+			c.SetCoreMode(test.mode)
+			c.SetIRQ(test.irq)
+			if test.nmi {
+				c.TriggerNMI()
+			}
+
+			for i := 0; i < 3 && c.Registers().PC < 0x9000; i++ {
+				c.Step()
+			}
+
+			if test.expected == 0 {
+				assert.Equal(t, uint16(0x8003), c.Registers().PC)
+				return
+			}
+			assert.Equal(t, test.expected, c.Registers().PC)
+			assert.Equal(t, uint8(0x80), c.memory[0x01fd])
+			assert.Equal(t, test.status|U_BIT_STATUS, c.memory[0x01fb])
+			assert.Equal(t, I_BIT_STATUS, c.status&I_BIT_STATUS)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestCycleCore_InterruptPolling(t *testing.T) {
+	testCases := []struct {
+		name    string
+		program []uint8
+		status  uint8
+		// Cycles to run before asserting IRQ
+		delay int
+		// Instructions that run before the interrupt
+		expected int
+	}{
+		{"Asserted before the last cycle", []uint8{0xea, 0xea, 0xea}, 0x00, 0, 1},
+		{"Asserted on the last cycle", []uint8{0xea, 0xea, 0xea}, 0x00, 1, 2},
+		{"CLI delays by an instruction", []uint8{0x58, 0xea, 0xea}, I_BIT_STATUS, 0, 2},
+		{"Taken branch skips its last poll", []uint8{0xd0, 0x00, 0xea, 0xea}, 0x00, 1, 2},
+		{"Taken branch polls its second cycle", []uint8{0xd0, 0x00, 0xea, 0xea}, 0x00, 0, 1},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(test.program)
+			c.writeAddressValue(IRQ_VECTOR, 0x9000)
+			c.status = test.status
+			c.SetCoreMode(CoreCycle)
+
+			for i := 0; i < test.delay; i++ {
+				c.StepCycle()
+			}
+			c.SetIRQ(true)
+			instructions := 0
+			if test.delay > 0 {
+				instructions = 1
+				c.Step()
+			}
+			for c.Registers().PC != 0x9000 && instructions < 10 {
+				c.Step()
+				instructions++
+			}
+
+			assert.Equal(t, test.expected, instructions-1)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestParseCoreMode(t *testing.T) {
+	mode, err := ParseCoreMode("Cycle")
+	assert.Nil(t, err)
+	assert.Equal(t, CoreCycle, mode)
+
+	_, err = ParseCoreMode("fast")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,70 @@
+package core
+
+// Whether ADC and SBC work in BCD.
+func (c *CPU) decimalMode() bool {
+	return c.status&D_BIT_STATUS > 0 && c.variant.hasDecimalMode()
+}
+
+// NMOS decimal ADC.  The result and carry are proper BCD, but Z comes
+// from the binary sum, and N and V from the sum after adjusting only the
+// low digit.  See Bruce Clark's "Decimal Mode" tutorial, appendix A.
+func (c *CPU) addDecimal(value uint8) {
+	carry := uint16(c.status & C_BIT_STATUS)
+	low := uint16(c.accumulator&0x0f) + uint16(value&0x0f) + carry
+	if low >= 0x0a {
+		low = ((low + 0x06) & 0x0f) + 0x10
+	}
+	result := uint16(c.accumulator&0xf0) + uint16(value&0xf0) + low
+
+	binary, _ := addWithCarry(c.accumulator, value, uint8(carry))
+	c.updateStatusFlags(uint8(result))
+	setZeroFlag(c, binary == 0)
+	setOverflowFlag(c, (uint16(c.accumulator)^result)&(uint16(value)^result)&uint16(NEG_BIT) > 0)
+
+	if result >= 0xa0 {
+		result += 0x60
+	}
+	setCarryFlag(c, result >= 0x100)
+	c.accumulator = uint8(result)
+	c.fixDecimalFlags()
+}
+
+// NMOS decimal SBC.  Only the result is BCD; the flags are all the same
+// as for binary.
+func (c *CPU) subtractDecimal(value uint8) {
+	borrow := int(1 - c.status&C_BIT_STATUS)
+	low := int(c.accumulator&0x0f) - int(value&0x0f) - borrow
+	var result int
+	if c.variant == Variant65C02 {
+		// Adjusts the binary difference instead, which only gives a
+		// different answer for invalid BCD
+		result = int(c.accumulator) - int(value) - borrow
+		if result < 0 {
+			result -= 0x60
+		}
+		if low < 0 {
+			result -= 0x06
+		}
+	} else {
+		if low < 0 {
+			low = ((low - 0x06) & 0x0f) - 0x10
+		}
+		result = int(c.accumulator&0xf0) - int(value&0xf0) + low
+		if result < 0 {
+			result -= 0x60
+		}
+	}
+
+	c.addBinary(^value)
+	c.accumulator = uint8(result)
+	c.fixDecimalFlags()
+}
+
+// The 65C02 spends an extra cycle setting N and Z from the BCD result.
+// V and C stay as on the NMOS 6502.
+func (c *CPU) fixDecimalFlags() {
+	if c.variant == Variant65C02 {
+		c.updateStatusFlags(c.accumulator)
+		c.extra_cycles++
+	}
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run one immediate ADC or SBC.
+func runArithmetic(c *CPU, opcode uint8, a uint8, value uint8, status uint8) Registers {
+	c.WriteMemory(0x8000, opcode)
+	c.WriteMemory(0x8001, value)
+	c.SetRegisters(Registers{PC: 0x8000, A: a, Status: status})
+	c.Step()
+	return c.Registers()
+}
+
+// Hand-checked cases for the behaviour in Bruce Clark's "Decimal Mode"
+// tutorial.  TestDecimal_ClarkDormann runs his exhaustive test.
+func TestDecimal(t *testing.T) {
+	testCases := []struct {
+		name            string
+		variant         Variant
+		opcode          uint8
+		a               uint8
+		value           uint8
+		status          uint8
+		expected        uint8
+		expected_status uint8
+	}{
+		{"ADC", VariantNMOS, 0x69, 0x12, 0x34, 0, 0x46, 0},
+		{"ADC digit carry", VariantNMOS, 0x69, 0x15, 0x26, 0, 0x41, 0},
+		// N and V come from $A5, before the high digit is adjusted
+		{"ADC carry in and out", VariantNMOS, 0x69, 0x58, 0x46, C_BIT_STATUS, 0x05, N_BIT_STATUS | V_BIT_STATUS | C_BIT_STATUS},
+		// Z comes from the binary sum, $9A, and N from $A0
+		{"ADC zero result", VariantNMOS, 0x69, 0x99, 0x01, 0, 0x00, N_BIT_STATUS | C_BIT_STATUS},
+		{"ADC overflow", VariantNMOS, 0x69, 0x81, 0x92, 0, 0x73, V_BIT_STATUS | C_BIT_STATUS},
+		{"ADC negative", VariantNMOS, 0x69, 0x79, 0x00, C_BIT_STATUS, 0x80, N_BIT_STATUS | V_BIT_STATUS},
+		{"SBC", VariantNMOS, 0xe9, 0x46, 0x12, C_BIT_STATUS, 0x34, C_BIT_STATUS},
+		{"SBC digit borrow", VariantNMOS, 0xe9, 0x40, 0x13, C_BIT_STATUS, 0x27, C_BIT_STATUS},
+		{"SBC borrow in", VariantNMOS, 0xe9, 0x32, 0x02, 0, 0x29, C_BIT_STATUS},
+		{"SBC borrow out", VariantNMOS, 0xe9, 0x12, 0x21, C_BIT_STATUS, 0x91, N_BIT_STATUS},
+		{"SBC zero", VariantNMOS, 0xe9, 0x21, 0x21, C_BIT_STATUS, 0x00, Z_BIT_STATUS | C_BIT_STATUS},
+		// The 2A03 ignores the D flag
+		{"NES ADC", VariantNES, 0x69, 0x09, 0x01, 0, 0x0a, 0},
+		{"NES SBC", VariantNES, 0xe9, 0x10, 0x01, C_BIT_STATUS, 0x0f, C_BIT_STATUS},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPUVariant(test.variant)
+
+			registers := runArithmetic(c, test.opcode, test.a, test.value, test.status|D_BIT_STATUS)
+
+			assert.Equal(t, test.expected, registers.A)
+			assert.Equal(t, test.expected_status|D_BIT_STATUS, registers.Status)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestParseVariant(t *testing.T) {
+	variant, err := ParseVariant("6502")
+	assert.Nil(t, err)
+	assert.Equal(t, VariantNMOS, variant)
+
+	variant, err = ParseVariant("65C02")
+	assert.Nil(t, err)
+	assert.Equal(t, Variant65C02, variant)
+
+	variant, err = ParseVariant("NES")
+	assert.Nil(t, err)
+	assert.Equal(t, VariantNES, variant)
+
+	_, err = ParseVariant("z80")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names to show in place of raw addresses, e.g. from a debug symbol file.
+type Symbols map[uint16]string
+
+type MemoryReader interface {
+	ReadMemory(address uint16) uint8
+}
+
+type Disassembly struct {
+	Address uint16
+	Bytes   []uint8
+	// False if the opcode byte isn't in the opcode table
+	Known       bool
+	Instruction Instruction
+	// The operand in assembler syntax, e.g. "($10),Y"
+	Operand string
+}
+
+// The instruction in assembler syntax, e.g. "LDA ($10),Y"
+func (d Disassembly) Text() string {
+	if !d.Known {
+		return fmt.Sprintf(".byte $%02X", d.Bytes[0])
+	}
+	if d.Operand == "" {
+		return d.Instruction.name
+	}
+	return d.Instruction.name + " " + d.Operand
+}
+
+// Address, raw bytes and instruction text, e.g. "8000  A9 10     LDA #$10"
+func (d Disassembly) String() string {
+	hex := make([]string, len(d.Bytes))
+	for i, value := range d.Bytes {
+		hex[i] = fmt.Sprintf("%02X", value)
+	}
+	return fmt.Sprintf("%04X  %-8s  %s", d.Address, strings.Join(hex, " "), d.Text())
+}
+
+// Address of the instruction following this one.
+func (d Disassembly) Next() uint16 {
+	return d.Address + uint16(len(d.Bytes))
+}
+
+// Disassemble the instruction at the given address.  Symbols may be nil.
+// Memory that knows its CPU variant, such as a *CPU, is disassembled
+// with that variant's instruction set, and anything else as the NES's.
+func DisassembleAt(mem MemoryReader, address uint16, symbols Symbols) Disassembly {
+	variant := VariantNES
+	if cpu, ok := mem.(interface{ Variant() Variant }); ok {
+		variant = cpu.Variant()
+	}
+	opcode := mem.ReadMemory(address)
+	instruction, ok := variant.LookupOpcode(opcode)
+	if !ok {
+		return Disassembly{Address: address, Bytes: []uint8{opcode}}
+	}
+
+	bytes := make([]uint8, instruction.size)
+	for i := range bytes {
+		bytes[i] = mem.ReadMemory(address + uint16(i))
+	}
+
+	return Disassembly{
+		Address:     address,
+		Bytes:       bytes,
+		Known:       true,
+		Instruction: instruction,
+		Operand:     formatOperand(instruction, address, bytes, symbols),
+	}
+}
+
+// Disassemble every instruction starting in the range start-end, inclusive.
+func DisassembleRange(mem MemoryReader, start uint16, end uint16, symbols Symbols) []Disassembly {
+	var result []Disassembly
+	address := start
+	for {
+		d := DisassembleAt(mem, address, symbols)
+		result = append(result, d)
+		next := d.Next()
+		// Stop at the end of the range, including when we wrap past $FFFF
+		if next > end || next <= address {
+			break
+		}
+		address = next
+	}
+	return result
+}
+
+func (c *CPU) Disassemble(address uint16) Disassembly {
+	return DisassembleAt(c, address, nil)
+}
+
+func formatOperand(instruction Instruction, address uint16, bytes []uint8, symbols Symbols) string {
+	if instruction.size == 1 {
+		if instruction.mode == AddrAccumulator {
+			return "A"
+		}
+		return ""
+	}
+
+	if instruction.IsBranch() {
+		return formatAddress(branchTarget(address+1, bytes[1]), 4, symbols)
+	}
+
+	var word uint16
+	if len(bytes) > 2 {
+		word = uint16(bytes[2])<<8 | uint16(bytes[1])
+	}
+
+	switch instruction.mode {
+	case AddrImmediate:
+		return fmt.Sprintf("#$%02X", bytes[1])
+	case AddrZeroPage:
+		return formatAddress(uint16(bytes[1]), 2, symbols)
+	case AddrZeroPageX:
+		return formatAddress(uint16(bytes[1]), 2, symbols) + ",X"
+	case AddrZeroPageY:
+		return formatAddress(uint16(bytes[1]), 2, symbols) + ",Y"
+	case AddrAbsolute:
+		return formatAddress(word, 4, symbols)
+	case AddrAbsoluteX:
+		return formatAddress(word, 4, symbols) + ",X"
+	case AddrAbsoluteY:
+		return formatAddress(word, 4, symbols) + ",Y"
+	case AddrIndirectX:
+		return "(" + formatAddress(uint16(bytes[1]), 2, symbols) + ",X)"
+	case AddrIndirectY:
+		return "(" + formatAddress(uint16(bytes[1]), 2, symbols) + "),Y"
+	case AddrIndirect:
+		return "(" + formatAddress(word, 4, symbols) + ")"
+	case AddrZeroPageIndirect:
+		return "(" + formatAddress(uint16(bytes[1]), 2, symbols) + ")"
+	}
+	return ""
+}
+
+func formatAddress(address uint16, digits int, symbols Symbols) string {
+	if name, ok := symbols[address]; ok {
+		return name
+	}
+	return fmt.Sprintf("$%0*X", digits, address)
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisassembleAt(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rom      []uint8
+		expected string
+	}{
+		{"Implied", []uint8{0xe8}, "INX"},
+		{"Single byte immediate-mode flag", []uint8{0x18}, "CLC"},
+		{"Accumulator", []uint8{0x4a}, "LSR A"},
+		{"Immediate", []uint8{0xa9, 0x0f}, "LDA #$0F"},
+		{"Zero-page", []uint8{0xa5, 0x10}, "LDA $10"},
+		{"Zero-page X", []uint8{0xb5, 0x10}, "LDA $10,X"},
+		{"Zero-page Y", []uint8{0xb6, 0x10}, "LDX $10,Y"},
+		{"Absolute", []uint8{0xad, 0x34, 0x12}, "LDA $1234"},
+		{"Absolute X", []uint8{0xbd, 0x34, 0x12}, "LDA $1234,X"},
+		{"Absolute Y", []uint8{0xb9, 0x34, 0x12}, "LDA $1234,Y"},
+		{"Indirect X", []uint8{0xa1, 0x10}, "LDA ($10,X)"},
+		{"Indirect Y", []uint8{0xb1, 0x10}, "LDA ($10),Y"},
+		{"Indirect", []uint8{0x6c, 0x34, 0x12}, "JMP ($1234)"},
+		{"Branch forward", []uint8{0xd0, 0x05}, "BNE $8007"},
+		{"Branch backward", []uint8{0xd0, 0xfc}, "BNE $7FFE"},
+		{"Unknown opcode", []uint8{0x8b}, ".byte $8B"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(test.rom)
+
+			d := c.Disassemble(ROM_SEGMENT_START)
+
+			assert.Equal(t, test.expected, d.Text())
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestDisassembleAt_Symbols(t *testing.T) {
+	c := NewCPU()
+	c.LoadAndReset([]uint8{0x20, 0x05, 0x80, 0xb1, 0x10, 0xf0, 0xfc})
+	symbols := Symbols{0x8005: "loop", 0x8003: "next", 0x0010: "ptr"}
+
+	assert.Equal(t, "JSR loop", DisassembleAt(c, 0x8000, symbols).Text())
+	assert.Equal(t, "LDA (ptr),Y", DisassembleAt(c, 0x8003, symbols).Text())
+	assert.Equal(t, "BEQ next", DisassembleAt(c, 0x8005, symbols).Text())
+}
+
+func TestDisassembly_String(t *testing.T) {
+	c := NewCPU()
+	c.LoadAndReset([]uint8{0x6d, 0x34, 0x12})
+
+	assert.Equal(t, "8000  6D 34 12  ADC $1234", c.Disassemble(0x8000).String())
+}
+
+func TestDisassembleRange(t *testing.T) {
+	c := NewCPU()
+	c.LoadAndReset([]uint8{0xa9, 0xc0, 0xaa, 0xe8, 0x6d, 0x34, 0x12, 0x00})
+
+	result := DisassembleRange(c, 0x8000, 0x8004, nil)
+
+	var text []string
+	for _, d := range result {
+		text = append(text, d.Text())
+	}
+	assert.Equal(t, []string{"LDA #$C0", "TAX", "INX", "ADC $1234"}, text)
+	assert.Equal(t, uint16(0x8007), result[3].Next())
+}
+
+func TestDisassembleRange_WrapAround(t *testing.T) {
+	c := NewCPU()
+	c.memory[0xfffe] = 0xe8
+	c.memory[0xffff] = 0xe8
+
+	result := DisassembleRange(c, 0xfffe, 0xffff, nil)
+
+	assert.Equal(t, 2, len(result))
+}
@@ -0,0 +1,257 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+)
+
+// Bruce Clark's test from his "Decimal Mode" tutorial, as Klaus Dormann
+// packages it in his 6502 functional tests.  It runs ADC and SBC in
+// decimal mode on every pair of operands with carry clear and set, and
+// checks the result and flags against a prediction worked out in binary.
+// APRED and SPRED pick the prediction for the chip under test.
+const DECIMAL_TEST = `
+N1 = $00
+N2 = $01
+N1L = $02
+N1H = $03
+N2L = $04
+N2H = $05
+DA = $07
+DNVZC = $08
+HA = $09
+HNVZC = $0a
+AR = $0b
+NF = $0c
+VF = $0d
+ZF = $0e
+CF = $0f
+ERROR = $10
+
+TEST:	LDY #1		; Y loops through the carry values
+	STY ERROR	; 1 until the test passes
+	LDA #0
+	STA N1
+	STA N2
+LOOP1:	LDA N2		; N2L = N2 & $0F
+	AND #$0F
+	STA N2L
+	LDA N2		; N2H = N2 & $F0
+	AND #$F0
+	STA N2H
+	ORA #$0F	; N2H+1 = (N2 & $F0) + $0F
+	STA N2H+1
+LOOP2:	LDA N1		; N1L = N1 & $0F
+	AND #$0F
+	STA N1L
+	LDA N1		; N1H = N1 & $F0
+	AND #$F0
+	STA N1H
+	JSR ADD
+	JSR APRED
+	JSR COMPARE
+	BNE DONE
+	JSR SUB
+	JSR SPRED
+	JSR COMPARE
+	BNE DONE
+	INC N1
+	BNE LOOP2	; all 256 values of N1
+	INC N2
+	BNE LOOP1	; all 256 values of N2
+	DEY
+	BPL LOOP1	; both values of the carry
+	LDA #0
+	STA ERROR
+DONE:	BRK
+
+ADD:	SED
+	CPY #1		; carry set if Y = 1, clear if Y = 0
+	LDA N1
+	ADC N2
+	STA DA		; actual result in decimal mode
+	PHP
+	PLA
+	STA DNVZC	; actual flags in decimal mode
+	CLD
+	CPY #1
+	LDA N1
+	ADC N2
+	STA HA		; result in binary
+	PHP
+	PLA
+	STA HNVZC	; flags in binary
+	CPY #1
+	LDA N1L
+	ADC N2L
+	CMP #$0A
+	LDX #0
+	BCC A1
+	INX
+	ADC #5		; add 6, with the carry set
+	AND #$0F
+	SEC
+A1:	ORA N1H
+	ADC N2H,X	; add N2 & $F0, or (N2 & $F0) + $10 on a digit carry
+	PHP
+	BCS A2
+	CMP #$A0
+	BCC A3
+A2:	ADC #$5F	; add $60, with the carry set
+	SEC
+A3:	STA AR		; predicted result
+	PHP
+	PLA
+	STA CF		; predicted carry
+	PLA
+	STA VF		; predicted V, with all of P
+	RTS
+
+SUB:	SED
+	CPY #1
+	LDA N1
+	SBC N2
+	STA DA
+	PHP
+	PLA
+	STA DNVZC
+	CLD
+	CPY #1
+	LDA N1
+	SBC N2
+	STA HA
+	PHP
+	PLA
+	STA HNVZC
+	RTS
+
+; Predicted SBC result on the 6502
+SUB1:	CPY #1
+	LDA N1L
+	SBC N2L
+	LDX #0
+	BCS S11
+	INX
+	SBC #5		; subtract 6, with the carry clear
+	AND #$0F
+	CLC
+S11:	ORA N1H
+	SBC N2H,X	; subtract N2 & $F0, or (N2 & $F0) + $10 on a digit borrow
+	BCS S12
+	SBC #$5F	; subtract $60, with the carry clear
+S12:	STA AR
+	RTS
+
+; Predicted SBC result on the 65C02
+SUB2:	CPY #1
+	LDA N1L
+	SBC N2L
+	LDX #0
+	BCS S21
+	INX
+	AND #$0F
+	CLC
+S21:	ORA N1H
+	SBC N2H,X
+	BCS S22
+	SBC #$5F
+S22:	CPX #0
+	BEQ S23
+	SBC #6
+S23:	STA AR
+	RTS
+
+; Sets Z if the actual result and flags match the prediction
+COMPARE:	LDA DA
+	CMP AR
+	BNE C1
+	LDA DNVZC
+	EOR NF
+	AND #$80
+	BNE C1
+	LDA DNVZC
+	EOR VF
+	AND #$40
+	BNE C1
+	LDA DNVZC
+	EOR ZF
+	AND #2
+	BNE C1
+	LDA DNVZC
+	EOR CF
+	AND #1
+C1:	RTS
+
+; On the 6502 N and V come from the sum before the high digit is fixed
+; up, and Z from the binary sum
+A6502:	LDA VF
+	STA NF
+	LDA HNVZC
+	STA ZF
+	RTS
+
+; SBC's flags are all the binary ones
+S6502:	JSR SUB1
+	LDA HNVZC
+	STA NF
+	STA VF
+	STA ZF
+	STA CF
+	RTS
+
+; The 65C02 takes N and Z from the decimal result
+A65C02:	LDA AR
+	PHP
+	PLA
+	STA NF
+	STA ZF
+	RTS
+
+S65C02:	JSR SUB2
+	LDA AR
+	PHP
+	PLA
+	STA NF
+	STA ZF
+	LDA HNVZC
+	STA VF
+	STA CF
+	RTS
+`
+
+func TestDecimal_ClarkDormann(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs every pair of operands")
+	}
+
+	testCases := []struct {
+		name        string
+		variant     core.Variant
+		predictions string
+	}{
+		{"6502", core.VariantNMOS, "APRED = A6502\nSPRED = S6502\n"},
+		{"65C02", core.Variant65C02, "APRED = A65C02\nSPRED = S65C02\n"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			program, err := asm.AssembleVariant(DECIMAL_TEST+test.predictions, test.variant)
+			assert.Nil(t, err)
+			c := core.NewCPUVariant(test.variant)
+			c.LoadAndReset(program.Bytes)
+
+			err = c.Run()
+
+			assert.Nil(t, err)
+			assert.Equal(t, program.Labels["DONE"]+1, c.Registers().PC, "Didn't reach DONE")
+			// Which operands failed, if any
+			assert.Equal(t, uint8(0), c.ReadMemory(0x10), "N1=$%02X N2=$%02X Y=%d",
+				c.ReadMemory(0x00), c.ReadMemory(0x01), c.Registers().Y)
+		}
+		t.Run(test.name, callback)
+	}
+}
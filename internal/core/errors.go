@@ -0,0 +1,119 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Instructions shown before the failing one in an error's context
+const ERROR_CONTEXT_INSTRUCTIONS = 4
+
+// Returned by an opcode's implementation when there isn't one.  The CPU
+// turns it into an UnknownOpcodeError.
+var errUnimplemented = errors.New("Unimplemented opcode")
+
+// What the machine was doing when an error stopped it.
+type MachineContext struct {
+	// Address of the failing instruction
+	PC     uint16
+	Opcode uint8
+	// Cycles executed before the failing instruction
+	Cycles    uint64
+	Registers Registers
+	// The last few instructions executed, oldest first, ending with the
+	// failing one
+	Recent []Disassembly
+}
+
+// The opcode byte isn't one the CPU knows how to execute.
+type UnknownOpcodeError struct {
+	MachineContext
+}
+
+func (e *UnknownOpcodeError) Error() string {
+	return e.describe(fmt.Sprintf("Unknown opcode $%02X", e.Opcode))
+}
+
+// An undocumented opcode, with the policy set to IllegalError.
+type IllegalOpcodeError struct {
+	MachineContext
+}
+
+func (e *IllegalOpcodeError) Error() string {
+	return e.describe(fmt.Sprintf("Illegal opcode $%02X", e.Opcode))
+}
+
+// The CPU executed a JAM opcode, also known as KIL, which halts it
+// until reset.
+type JamError struct {
+	MachineContext
+}
+
+func (e *JamError) Error() string {
+	return e.describe(fmt.Sprintf("CPU jammed by opcode $%02X", e.Opcode))
+}
+
+// A device rejected a read or write.
+type BusFaultError struct {
+	MachineContext
+	Address uint16
+	Write   bool
+	Err     error
+}
+
+func (e *BusFaultError) Error() string {
+	access := "reading"
+	if e.Write {
+		access = "writing"
+	}
+	return e.describe(fmt.Sprintf("Bus fault %s $%04X: %v", access, e.Address, e.Err))
+}
+
+func (e *BusFaultError) Unwrap() error {
+	return e.Err
+}
+
+// e.g.
+//
+//	Unknown opcode $FF at $8003, cycle 4
+//	  8000  A2 02     LDX #$02
+//	> 8003  FF        .byte $FF
+//	  A:00 X:02 Y:00 P:00 SP:00
+func (m MachineContext) describe(summary string) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s at $%04X, cycle %d", summary, m.PC, m.Cycles)
+	for i, d := range m.Recent {
+		marker := " "
+		if i == len(m.Recent)-1 {
+			marker = ">"
+		}
+		fmt.Fprintf(&text, "\n%s %s", marker, d)
+	}
+	r := m.Registers
+	fmt.Fprintf(&text, "\n  A:%02X X:%02X Y:%02X P:%02X SP:%02X", r.A, r.X, r.Y, r.Status, r.SP)
+	return text.String()
+}
+
+// Snapshot the machine for an error from the instruction at pc.
+func (c *CPU) machineContext(pc uint16, cycles uint64) MachineContext {
+	registers := c.Registers()
+	registers.PC = pc
+	// The opcode as decode fetched it, so an override shows, without a
+	// device read's side effects
+	context := MachineContext{
+		PC:        pc,
+		Opcode:    c.fetch(pc),
+		Cycles:    cycles,
+		Registers: registers,
+	}
+	count := c.recent_count
+	if count > len(c.recent) {
+		count = len(c.recent)
+	}
+	for i := count; i > 0; i-- {
+		address := c.recent[(c.recent_count-i)%len(c.recent)]
+		context.Recent = append(context.Recent, c.Disassemble(address))
+	}
+	return context
+}
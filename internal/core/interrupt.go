@@ -0,0 +1,51 @@
+package core
+
+// Drive the IRQ line.  It's level-triggered, so the CPU keeps taking the
+// interrupt until the device releases the line or the I flag is set.
+func (c *CPU) SetIRQ(asserted bool) {
+	c.irq_line = asserted
+}
+
+// Signal an NMI.  It's edge-triggered, so each call gives one interrupt,
+// whatever the I flag says.
+func (c *CPU) TriggerNMI() {
+	c.nmi_pending = true
+}
+
+func (c *CPU) interruptPending() bool {
+	return c.nmi_pending || c.irq_line && c.status&I_BIT_STATUS == 0
+}
+
+// Vector to an interrupt handler in one go, for the instruction core.
+// The cycle core does the same thing spread over INTERRUPT_CYCLES.
+func (c *CPU) interrupt() {
+	vector := c.interruptVector()
+	c.pushStackAddress(c.program_counter)
+	c.pushStack(c.interruptStatus())
+	c.maskInterrupts()
+	low := c.read(vector)
+	c.program_counter = uint16(c.read(vector+1))<<8 | uint16(low)
+	c.cycles += INTERRUPT_CYCLES
+}
+
+// Set I on the way into a handler.  The 65C02 also leaves decimal mode.
+func (c *CPU) maskInterrupts() {
+	c.setFlag(I_BIT_STATUS)
+	if c.variant == Variant65C02 {
+		c.clearFlag(D_BIT_STATUS)
+	}
+}
+
+// NMI takes priority, and acknowledges the latched edge.
+func (c *CPU) interruptVector() uint16 {
+	if c.nmi_pending {
+		c.nmi_pending = false
+		return NMI_VECTOR
+	}
+	return IRQ_VECTOR
+}
+
+// The status pushed by a hardware interrupt, which has B clear.
+func (c *CPU) interruptStatus() uint8 {
+	return c.status&^B_BIT_STATUS | U_BIT_STATUS
+}
@@ -1,9 +1,5 @@
 package core
 
-import (
-	"errors"
-)
-
 type InstructionPostProccessingMode int
 
 const (
@@ -12,13 +8,68 @@ const (
 	InstructionProgramCounterUpdated
 )
 
-func (c *CPU) runOpcode(operation Instruction) (InstructionPostProccessingMode, error) {
-	callback := c.getOpcodeImpl(operation.name)
-	return callback(c, operation.mode)
+// How an operation uses its operand, which decides the bus accesses it
+// makes.
+type operationKind int
+
+const (
+	opUnimplemented operationKind = iota
+	// Reads the operand
+	opRead
+	// Reads the operand and writes back a changed value
+	opModify
+	// Writes the operand without reading it
+	opStore
+	// Only touches registers
+	opImplied
+	opPush
+	opPull
+	opBranch
+	opJump
+	opJumpSubroutine
+	opReturnSubroutine
+	opReturnInterrupt
+	opBreak
+	opJam
+	// Takes the instruction's time but does nothing, for the illegal
+	// opcode policy
+	opSkip
+)
+
+// What an instruction does, apart from fetching its operand.  Both the
+// instruction and cycle cores execute these, so they can't drift apart.
+type operation struct {
+	kind operationKind
+	// Uses the operand, for opRead and opPull
+	read func(c *CPU, value uint8)
+	// Returns the new value, for opModify
+	modify func(c *CPU, value uint8) uint8
+	// Returns the value to write, for opStore and opPush
+	store func(c *CPU) uint8
+	// For opImplied, and opRead or opModify on the accumulator
+	implied func(c *CPU)
+	// The status flag and value that take a branch
+	flag uint8
+	set  bool
+}
+
+// Modes where read and modify operations work on registers instead of
+// memory, e.g. "LSR A" or the implied NOP.
+func isRegisterMode(mode AddressMode) bool {
+	return mode == AddrImplied || mode == AddrAccumulator
+}
+
+func (op operation) branchTaken(c *CPU) bool {
+	if op.set {
+		return c.status&op.flag > 0
+	}
+	return c.status&op.flag == 0
 }
 
-func (c *CPU) getOpcodeImpl(operation string) func(*CPU, AddressMode) (InstructionPostProccessingMode, error) {
-	switch operation {
+// The operation for a mnemonic.  Only used at init, to build the opcode
+// table.
+func getOperation(name string) operation {
+	switch name {
 	case "ADC":
 		// "Add with carry" operation.
 		// Add the parameter value and the carry bit to the accumulator
@@ -26,377 +77,629 @@ func (c *CPU) getOpcodeImpl(operation string) func(*CPU, AddressMode) (Instructi
 		// set the carry bit.
 		// Example: If A=#80 and the carry bit is 1, then "ADC $#80" gives A=#02
 		// and carry bit 1.
-		// NOTE: Apparently the NES CPU doesn't have a decimal mode, so BCD is ignored.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
-
-			carry_bit := uint8(0)
-			if c.status&C_BIT_STATUS > 0 {
-				carry_bit = uint8(1)
-			}
-
-			result, carry := addWithCarry(c.accumulator, value, carry_bit)
-
-			c.accumulator = result
-			setCarryFlag(c, carry)
-			c.updateStatusFlags(result)
-			return InstructionContinue, nil
-		}
+		// NOTE: The NES CPU doesn't have a decimal mode, so BCD only
+		// applies to the other variants.
+		return readOperation(func(c *CPU, value uint8) {
+			c.addToAccumulator(value)
+		})
 
 	case "AND":
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
+		return readOperation(func(c *CPU, value uint8) {
 			c.accumulator = c.accumulator & value
 			c.updateStatusFlags(c.accumulator)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "ASL":
 		// "Arithmetic shift left" operation
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			var (
-				carry bool
-				value uint8
-			)
-			if mode == AddrImplied {
-				value, carry = shiftLeftWithCarry(c.accumulator)
+		return operation{
+			kind: opModify,
+			modify: func(c *CPU, value uint8) uint8 {
+				value, carry := shiftLeftWithCarry(value)
+				c.updateStatusFlags(value)
+				setCarryFlag(c, carry)
+				return value
+			},
+			implied: func(c *CPU) {
+				value, carry := shiftLeftWithCarry(c.accumulator)
 				c.accumulator = value
 				c.updateStatusFlags(c.accumulator)
-			} else {
-				value_address := c.getParameterValue(mode)
-				value, carry = shiftLeftWithCarry(c.memory[value_address])
-				c.memory[value_address] = value
-				c.updateStatusFlags(value)
-			}
-			setCarryFlag(c, carry)
-			return InstructionContinue, nil
+				setCarryFlag(c, carry)
+			},
 		}
 
 	case "BCC":
 		// "Branch if carry clear" operation, branches if carry bit unset
-		return generateBranchCallback(C_BIT_STATUS, false)
+		return branchOperation(C_BIT_STATUS, false)
 
 	case "BCS":
 		// "Branch if carry set" operation, branches if carry bit set
-		return generateBranchCallback(C_BIT_STATUS, true)
+		return branchOperation(C_BIT_STATUS, true)
 
 	case "BEQ":
 		// "Branch if equal" operation, branches if zero bit set
-		return generateBranchCallback(Z_BIT_STATUS, true)
+		return branchOperation(Z_BIT_STATUS, true)
 
 	case "BIT":
-		// "Bit test" operation, does AND with accumulator and sets Z, V, N bits
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
-			result := c.accumulator & value
-			c.updateStatusFlags(result)
-			c.status = c.status | (result & V_BIT_STATUS)
-			return InstructionContinue, nil
-		}
+		// "Bit test" operation, sets Z from the AND with accumulator, and
+		// copies bits 7 and 6 of the operand into N and V
+		return readOperation(func(c *CPU, value uint8) {
+			setZeroFlag(c, c.accumulator&value == 0)
+			c.status = c.status&^(N_BIT_STATUS|V_BIT_STATUS) | value&(N_BIT_STATUS|V_BIT_STATUS)
+		})
 
 	case "BMI":
 		// "Branch if minus" operation, branches if nevatige bit set
-		return generateBranchCallback(N_BIT_STATUS, true)
+		return branchOperation(N_BIT_STATUS, true)
 
 	case "BNE":
 		// "Branch not equal" operation, branches if zero bit not set
-		return generateBranchCallback(Z_BIT_STATUS, false)
+		return branchOperation(Z_BIT_STATUS, false)
 
 	case "BPL":
 		// "Branch if positive" operation, branches if negative bit not set
-		return generateBranchCallback(N_BIT_STATUS, false)
+		return branchOperation(N_BIT_STATUS, false)
 
 	case "BRK":
 		// "Break", generates an interrupt
 		// TODO: Push program counter and processor status to stack, load IRQ
 		// interrupt vector at $FFFE/F to PC, and set break flag.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			//c.status = c.status | B_BIT_STATUS
-			return InstructionHalt, nil
-		}
+		return operation{kind: opBreak}
 
 	case "BVC":
-		return generateBranchCallback(V_BIT_STATUS, false)
 		// "Branch if overflow clear" operation, branches if overflow bit not set
+		return branchOperation(V_BIT_STATUS, false)
 
 	case "BVS":
 		// "Branch if overflow set" operation, branches if overflow bit set
-		return generateBranchCallback(V_BIT_STATUS, true)
+		return branchOperation(V_BIT_STATUS, true)
 
 	case "CLC":
 		// "Clear cary" operation
-		return generateClearCallback(C_BIT_STATUS)
+		return clearOperation(C_BIT_STATUS)
 
 	case "CLD":
 		// "Clear decimal" operation
-		return generateClearCallback(D_BIT_STATUS)
+		return clearOperation(D_BIT_STATUS)
 
 	case "CLI":
 		// "Clear interrupt" operation
-		return generateClearCallback(I_BIT_STATUS)
+		return clearOperation(I_BIT_STATUS)
 
 	case "CLV":
 		// "Clear overflor" operation
-		return generateClearCallback(V_BIT_STATUS)
+		return clearOperation(V_BIT_STATUS)
 
 	case "CMP":
 		// "Compare" operation, sets flags as if subtrating from accumulator
-		return generateCompareCallback(c.accumulator)
+		return compareOperation(func(c *CPU) uint8 { return c.accumulator })
 
 	case "CPX":
 		// "Compare X" operation, sets flags as if subtrating from index_x
-		return generateCompareCallback(c.index_x)
+		return compareOperation(func(c *CPU) uint8 { return c.index_x })
 
 	case "CPY":
 		// "Compare Y" operation, sets flags as if subtrating from index_y
-		return generateCompareCallback(c.index_y)
+		return compareOperation(func(c *CPU) uint8 { return c.index_y })
 
 	case "DEC":
 		// "Decrement" operation, decrements memory location
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
 			result := value - 0x01
-			c.memory[value_address] = result
 			c.updateStatusFlags(result)
-			return InstructionContinue, nil
-		}
+			return result
+		})
 
 	case "DEX":
 		// "Decrement X register" operation
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+		return impliedOperation(func(c *CPU) {
 			result := c.index_x - 1
 			c.index_x = result
 			c.updateStatusFlags(result)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "DEY":
 		// "Decrement Y register" operation
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+		return impliedOperation(func(c *CPU) {
 			result := c.index_y - 1
 			c.index_y = result
 			c.updateStatusFlags(result)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "EOR":
 		// "Exclusive OR" operation, XOR on accumulator with memory location
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
+		return readOperation(func(c *CPU, value uint8) {
 			c.accumulator = c.accumulator ^ value
 			c.updateStatusFlags(c.accumulator)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "INC":
 		// "Increment memory" operation.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			var result uint8
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
-			if result == 0xff {
-				result = 0
-			} else {
-				result = value + 1
-			}
-			c.memory[value_address] = result
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			result := value + 1
 			c.updateStatusFlags(result)
-			return InstructionContinue, nil
-		}
+			return result
+		})
 
 	case "INX":
 		// "Increment X"
 		// Add 1 to the X register with overflow (no carry)
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			if c.index_x == 0xff {
-				c.index_x = 0x00
-			} else {
-				c.index_x = c.index_x + 1
-			}
+		return impliedOperation(func(c *CPU) {
+			c.index_x = c.index_x + 1
 			c.updateStatusFlags(c.index_x)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "INY":
 		// "Increment Y"
 		// Add 1 to the Y register with overflow (no carry)
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			if c.index_y == 0xff {
-				c.index_y = 0x00
-			} else {
-				c.index_y = c.index_y + 1
-			}
+		return impliedOperation(func(c *CPU) {
+			c.index_y = c.index_y + 1
 			c.updateStatusFlags(c.index_y)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "JMP":
 		// "Jump" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			param := c.readAddressValue(c.program_counter)
-			if mode == AddrIndirect {
-				param = c.readAddressValue(param)
-			}
-			c.program_counter = param
-			return InstructionProgramCounterUpdated, nil
-		}
+		return operation{kind: opJump}
 
 	case "JSR":
 		// "Jump to SubRoutine" operation
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			param := c.readAddressValue(c.program_counter)
-			// Return address is next instruction, minus 1
-			return_addr := c.program_counter + uint16(0x0001)
-			c.pushStackAddress(return_addr)
-			c.program_counter = param
-			return InstructionProgramCounterUpdated, nil
-		}
+		return operation{kind: opJumpSubroutine}
 
 	case "LDA":
 		// "Load accumulator" operation.
 		// Stores the parameter into the A register.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
+		return readOperation(func(c *CPU, value uint8) {
 			c.accumulator = value
 			c.updateStatusFlags(value)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "LDX":
 		// "Load reg X" operation - stores the parameter into the X register.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
+		return readOperation(func(c *CPU, value uint8) {
 			c.index_x = value
 			c.updateStatusFlags(value)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "LDY":
 		// "Load reg Y" operation - stores the parameter into the Y register.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value_address := c.getParameterValue(mode)
-			value := c.memory[value_address]
+		return readOperation(func(c *CPU, value uint8) {
 			c.index_y = value
 			c.updateStatusFlags(value)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "LSR":
 		// "Logical shift right" operation
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			var init_value, new_value uint8
-			if mode == AddrAccumulator {
-				init_value = c.accumulator
-				new_value = init_value >> 1
-				c.accumulator = new_value
-			} else {
-				value_address := c.getParameterValue(mode)
-				init_value = c.memory[value_address]
-				new_value = init_value >> 1
-				c.memory[value_address] = new_value
-			}
-			if init_value&uint8(0x01) > 0 {
-				c.setFlag(C_BIT_STATUS)
-			} else {
-				c.clearFlag(C_BIT_STATUS)
-			}
-			c.updateStatusFlags(new_value)
-			return InstructionContinue, nil
+		shift := func(c *CPU, value uint8) uint8 {
+			setCarryFlag(c, value&uint8(0x01) > 0)
+			value = value >> 1
+			c.updateStatusFlags(value)
+			return value
+		}
+		return operation{
+			kind:    opModify,
+			modify:  shift,
+			implied: func(c *CPU) { c.accumulator = shift(c, c.accumulator) },
 		}
 
 	case "NOP":
 		// "No-op" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			return InstructionContinue, nil
+		// The undocumented variants with an operand still read it.
+		return operation{
+			kind:    opRead,
+			read:    func(c *CPU, value uint8) {},
+			implied: func(c *CPU) {},
 		}
 
 	case "ORA":
 		// "OR with accumulator" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value := c.memory[c.getParameterValue(mode)]
+		return readOperation(func(c *CPU, value uint8) {
 			c.accumulator = c.accumulator | value
 			c.updateStatusFlags(c.accumulator)
-			return InstructionContinue, nil
-		}
+		})
 
 	case "PHA":
 		// "Push accumulator to stack" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			c.pushStack(c.accumulator)
-			return InstructionContinue, nil
-		}
+		return operation{kind: opPush, store: func(c *CPU) uint8 { return c.accumulator }}
 
 	case "PHP":
 		// "Push status register to stack" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			c.pushStack(c.status)
-			return InstructionContinue, nil
-		}
+		return operation{kind: opPush, store: func(c *CPU) uint8 { return c.status }}
 
 	case "PLA":
 		// "Pull stack to accumulator" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			c.accumulator = c.popStack()
+		return operation{kind: opPull, read: func(c *CPU, value uint8) {
+			c.accumulator = value
 			c.updateStatusFlags(c.accumulator)
-			return InstructionContinue, nil
-		}
+		}}
 
 	case "PLP":
 		// "Pull stack to status register" instruction
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			c.status = c.popStack()
-			return InstructionContinue, nil
-		}
+		return operation{kind: opPull, read: func(c *CPU, value uint8) {
+			c.status = value
+		}}
 
 	case "ROL":
 		// "Rotate left" instruction
 		// This differs from ASL in the handling of the carry bit
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			var (
-				carry bool
-				value uint8
-			)
-			if mode == AddrAccumulator {
-				value, carry = shiftLeftWithCarry(c.accumulator)
+		return operation{
+			kind: opModify,
+			modify: func(c *CPU, value uint8) uint8 {
+				value, carry := shiftLeftWithCarry(value)
+				result := value
+				if c.status&C_BIT_STATUS == C_BIT_STATUS {
+					result += uint8(0x01)
+				}
+				c.updateStatusFlags(value)
+				setCarryFlag(c, carry)
+				return result
+			},
+			implied: func(c *CPU) {
+				value, carry := shiftLeftWithCarry(c.accumulator)
 				c.accumulator = value
 				if c.status&C_BIT_STATUS == C_BIT_STATUS {
 					c.accumulator += uint8(0x01)
 				}
 				c.updateStatusFlags(c.accumulator)
-			} else {
-				value_address := c.getParameterValue(mode)
-				value, carry = shiftLeftWithCarry(c.memory[value_address])
-				c.memory[value_address] = value
-				if c.status&C_BIT_STATUS == C_BIT_STATUS {
-					c.memory[value_address] += uint8(0x01)
-				}
-				c.updateStatusFlags(value)
-			}
-			setCarryFlag(c, carry)
-			return InstructionContinue, nil
+				setCarryFlag(c, carry)
+			},
 		}
 
 	case "TAX":
 		// "Transfer A to X"
 		// Copies the value in the accumulator to the index X register.
-		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-			value := c.accumulator
+		return impliedOperation(func(c *CPU) {
+			c.index_x = c.accumulator
+			c.updateStatusFlags(c.index_x)
+		})
+
+	// 65C02 instructions
+
+	case "BRA":
+		// "Branch always"
+		return branchOperation(0, false)
+
+	case "PHX":
+		// "Push X to stack"
+		return operation{kind: opPush, store: func(c *CPU) uint8 { return c.index_x }}
+
+	case "PHY":
+		// "Push Y to stack"
+		return operation{kind: opPush, store: func(c *CPU) uint8 { return c.index_y }}
+
+	case "PLX":
+		// "Pull stack to X"
+		return operation{kind: opPull, read: func(c *CPU, value uint8) {
+			c.index_x = value
+			c.updateStatusFlags(c.index_x)
+		}}
+
+	case "PLY":
+		// "Pull stack to Y"
+		return operation{kind: opPull, read: func(c *CPU, value uint8) {
+			c.index_y = value
+			c.updateStatusFlags(c.index_y)
+		}}
+
+	case "STZ":
+		// "Store zero"
+		return operation{kind: opStore, store: func(c *CPU) uint8 { return 0 }}
+
+	case "TRB":
+		// "Test and reset bits", clearing the accumulator's bits in memory.
+		// Z is set as for BIT.
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			setZeroFlag(c, c.accumulator&value == 0)
+			return value &^ c.accumulator
+		})
+
+	case "TSB":
+		// "Test and set bits", setting the accumulator's bits in memory
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			setZeroFlag(c, c.accumulator&value == 0)
+			return value | c.accumulator
+		})
+
+	// Undocumented opcodes
+
+	case "ALR":
+		// AND immediate, then LSR A
+		return readOperation(func(c *CPU, value uint8) {
+			value = c.accumulator & value
+			setCarryFlag(c, value&0x01 > 0)
+			c.accumulator = value >> 1
+			c.updateStatusFlags(c.accumulator)
+		})
+
+	case "ANC":
+		// AND immediate, copying the negative flag into carry
+		return readOperation(func(c *CPU, value uint8) {
+			c.accumulator &= value
+			c.updateStatusFlags(c.accumulator)
+			setCarryFlag(c, c.accumulator&NEG_BIT > 0)
+		})
+
+	case "ARR":
+		// AND immediate, then ROR A, with carry and overflow taken from
+		// bits 6 and 5 of the result
+		return readOperation(func(c *CPU, value uint8) {
+			value = c.accumulator & value
+			c.accumulator, _ = rotateRightWithCarry(value, c.status&C_BIT_STATUS > 0)
+			c.updateStatusFlags(c.accumulator)
+			setCarryFlag(c, c.accumulator&0x40 > 0)
+			setOverflowFlag(c, (c.accumulator>>6^c.accumulator>>5)&0x01 > 0)
+		})
+
+	case "DCP":
+		// DEC memory, then CMP with it
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			value--
+			c.updateStatusFlags(c.accumulator - value)
+			setCarryFlag(c, c.accumulator >= value)
+			return value
+		})
+
+	case "ISC":
+		// INC memory, then SBC it
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			value++
+			c.subtractFromAccumulator(value)
+			return value
+		})
+
+	case "JAM":
+		// Locks up the CPU, which the CPU reports before getting here
+		return operation{kind: opJam}
+
+	case "LAX":
+		// LDA and LDX at once
+		return readOperation(func(c *CPU, value uint8) {
+			c.accumulator = value
 			c.index_x = value
+			c.updateStatusFlags(value)
+		})
+
+	case "RLA":
+		// ROL memory, then AND it
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			value, carry := shiftLeftWithCarry(value)
+			if c.status&C_BIT_STATUS > 0 {
+				value |= 0x01
+			}
+			setCarryFlag(c, carry)
+			c.accumulator &= value
+			c.updateStatusFlags(c.accumulator)
+			return value
+		})
+
+	case "RRA":
+		// ROR memory, then ADC it, using the carry from the rotate
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			value, carry := rotateRightWithCarry(value, c.status&C_BIT_STATUS > 0)
+			setCarryFlag(c, carry)
+			c.addToAccumulator(value)
+			return value
+		})
+
+	case "RTI":
+		// "Return from interrupt", pulling the status and then the PC
+		return operation{kind: opReturnInterrupt}
+
+	case "RTS":
+		// "Return from subroutine", pulling the address JSR pushed
+		return operation{kind: opReturnSubroutine}
+
+	case "SAX":
+		// Store A AND X, without touching the flags
+		return operation{kind: opStore, store: func(c *CPU) uint8 {
+			return c.accumulator & c.index_x
+		}}
+
+	case "SBC":
+		// "Subtract with carry", which is adding the inverted value
+		return readOperation(func(c *CPU, value uint8) {
+			c.subtractFromAccumulator(value)
+		})
+
+	case "SBX":
+		// X = (A AND X) - immediate, setting carry like CMP
+		return readOperation(func(c *CPU, value uint8) {
+			masked := c.accumulator & c.index_x
+			c.index_x = masked - value
+			setCarryFlag(c, masked >= value)
 			c.updateStatusFlags(c.index_x)
+		})
+
+	case "SEC":
+		// "Set carry" operation
+		return setOperation(C_BIT_STATUS)
+
+	case "SED":
+		// "Set decimal" operation.  The NES CPU keeps the flag but ignores it
+		return setOperation(D_BIT_STATUS)
+
+	case "SEI":
+		// "Set interrupt disable" operation
+		return setOperation(I_BIT_STATUS)
+
+	case "SLO":
+		// ASL memory, then ORA it
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			value, carry := shiftLeftWithCarry(value)
+			setCarryFlag(c, carry)
+			c.accumulator |= value
+			c.updateStatusFlags(c.accumulator)
+			return value
+		})
+
+	case "SRE":
+		// LSR memory, then EOR it
+		return modifyOperation(func(c *CPU, value uint8) uint8 {
+			setCarryFlag(c, value&0x01 > 0)
+			value >>= 1
+			c.accumulator ^= value
+			c.updateStatusFlags(c.accumulator)
+			return value
+		})
+
+	case "STA":
+		// "Store accumulator" operation
+		return operation{kind: opStore, store: func(c *CPU) uint8 { return c.accumulator }}
+
+	case "STX":
+		// "Store X"
+		return operation{kind: opStore, store: func(c *CPU) uint8 { return c.index_x }}
+
+	case "STY":
+		// "Store Y"
+		return operation{kind: opStore, store: func(c *CPU) uint8 { return c.index_y }}
+	}
+
+	return operation{kind: opUnimplemented}
+}
+
+func readOperation(read func(c *CPU, value uint8)) operation {
+	return operation{kind: opRead, read: read}
+}
+
+// The same change works on the accumulator, e.g. the 65C02's "INC A".
+func modifyOperation(modify func(c *CPU, value uint8) uint8) operation {
+	return operation{
+		kind:    opModify,
+		modify:  modify,
+		implied: func(c *CPU) { c.accumulator = modify(c, c.accumulator) },
+	}
+}
+
+func impliedOperation(implied func(c *CPU)) operation {
+	return operation{kind: opImplied, implied: implied}
+}
+
+func branchOperation(flag uint8, set bool) operation {
+	return operation{kind: opBranch, flag: flag, set: set}
+}
+
+func clearOperation(bit uint8) operation {
+	return impliedOperation(func(c *CPU) {
+		c.status = c.status & (bit ^ uint8(0xff))
+	})
+}
+
+func setOperation(bit uint8) operation {
+	return impliedOperation(func(c *CPU) {
+		c.setFlag(bit)
+	})
+}
+
+func compareOperation(getRegister func(*CPU) uint8) operation {
+	return readOperation(func(c *CPU, value uint8) {
+		register := getRegister(c)
+		result := register - value
+		c.updateStatusFlags(result)
+		setCarryFlag(c, register >= value)
+	})
+}
+
+// The instruction core's handler for an operation, which does all of its
+// bus accesses in one go.
+func getOpcodeImpl(op operation) opcodeHandler {
+	switch op.kind {
+	case opRead:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			if isRegisterMode(mode) {
+				op.implied(c)
+			} else {
+				op.read(c, c.read(c.getParameterValue(mode)))
+			}
+			return InstructionContinue, nil
+		}
+
+	case opModify:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			if isRegisterMode(mode) {
+				op.implied(c)
+			} else {
+				value_address := c.getParameterValue(mode)
+				c.write(value_address, op.modify(c, c.read(value_address)))
+			}
+			return InstructionContinue, nil
+		}
+
+	case opStore:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			c.write(c.getParameterValue(mode), op.store(c))
+			return InstructionContinue, nil
+		}
+
+	case opImplied:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			op.implied(c)
+			return InstructionContinue, nil
+		}
+
+	case opPush:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			c.pushStack(op.store(c))
+			return InstructionContinue, nil
+		}
+
+	case opPull:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			op.read(c, c.popStack())
 			return InstructionContinue, nil
 		}
 
+	case opBranch:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			return branchOnStatus(c, mode, op)
+		}
+
+	case opJump:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			param := c.readAddressValue(c.program_counter)
+			if mode == AddrIndirect {
+				low := c.read(param)
+				param = uint16(c.read(c.variant.IndirectJumpHigh(param)))<<8 | uint16(low)
+			}
+			c.program_counter = param
+			return InstructionProgramCounterUpdated, nil
+		}
+
+	case opJumpSubroutine:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			param := c.readAddressValue(c.program_counter)
+			// Return address is next instruction, minus 1
+			return_addr := c.program_counter + uint16(0x0001)
+			c.pushStackAddress(return_addr)
+			c.program_counter = param
+			return InstructionProgramCounterUpdated, nil
+		}
+
+	case opReturnSubroutine:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			// JSR pushed the address of its last byte
+			c.program_counter = c.popStackAddress() + 1
+			return InstructionProgramCounterUpdated, nil
+		}
+
+	case opReturnInterrupt:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			c.status = c.popStack()
+			c.program_counter = c.popStackAddress()
+			return InstructionProgramCounterUpdated, nil
+		}
+
+	case opBreak, opJam:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			return InstructionHalt, nil
+		}
+
+	case opSkip:
+		return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
+			return InstructionContinue, nil
+		}
 	}
 
 	return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-		return InstructionHalt, errors.New("Unimplemented opcode")
+		return InstructionHalt, errUnimplemented
 	}
 }
 
@@ -410,6 +713,45 @@ func shiftLeftWithCarry(val uint8) (uint8, bool) {
 	return returnByteWithCarry(result)
 }
 
+// Rotate right through carry, returning the new value and carry.
+func rotateRightWithCarry(val uint8, carry_in bool) (uint8, bool) {
+	result := val >> 1
+	if carry_in {
+		result |= NEG_BIT
+	}
+	return result, val&0x01 > 0
+}
+
+// Add a value and the carry to the accumulator, setting carry, overflow,
+// negative and zero.  In BCD on variants with decimal mode.
+func (c *CPU) addToAccumulator(value uint8) {
+	if c.decimalMode() {
+		c.addDecimal(value)
+		return
+	}
+	c.addBinary(value)
+}
+
+// The binary add, which SBC is with the value inverted.
+func (c *CPU) addBinary(value uint8) {
+	carry_bit := c.status & C_BIT_STATUS
+	result, carry := addWithCarry(c.accumulator, value, carry_bit)
+	// Overflow when both inputs have the same sign and the result doesn't
+	setOverflowFlag(c, (c.accumulator^result)&(value^result)&NEG_BIT > 0)
+	setCarryFlag(c, carry)
+	c.accumulator = result
+	c.updateStatusFlags(result)
+}
+
+// Subtract a value and the borrow (inverted carry) from the accumulator.
+func (c *CPU) subtractFromAccumulator(value uint8) {
+	if c.decimalMode() {
+		c.subtractDecimal(value)
+		return
+	}
+	c.addBinary(^value)
+}
+
 func returnByteWithCarry(result uint16) (uint8, bool) {
 	if result > 0xff {
 		return uint8(result & 0xff), true
@@ -426,46 +768,41 @@ func setCarryFlag(c *CPU, carry bool) {
 	}
 }
 
-func branchOnStatus(c *CPU, mode AddressMode, flag uint8, set bool) (InstructionPostProccessingMode, error) {
-	var do_branch bool
-	value_address := c.getParameterValue(mode)
-	value := c.memory[value_address]
-	if set {
-		do_branch = c.status&flag > 0
+func setZeroFlag(c *CPU, zero bool) {
+	if zero {
+		c.setFlag(Z_BIT_STATUS)
 	} else {
-
-		do_branch = c.status&flag == 0
-	}
-	if do_branch {
-		c.program_counter += uint16(value)
-		return InstructionProgramCounterUpdated, nil
-	} else {
-		return InstructionContinue, nil
+		c.clearFlag(Z_BIT_STATUS)
 	}
 }
 
-func generateBranchCallback(status uint8, set bool) func(*CPU, AddressMode) (InstructionPostProccessingMode, error) {
-	return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-		return branchOnStatus(c, mode, status, set)
+func setOverflowFlag(c *CPU, overflow bool) {
+	if overflow {
+		c.setFlag(V_BIT_STATUS)
+	} else {
+		c.clearFlag(V_BIT_STATUS)
 	}
 }
 
-func generateClearCallback(bit uint8) func(*CPU, AddressMode) (InstructionPostProccessingMode, error) {
-	return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-		c.status = c.status & (bit ^ uint8(0xff))
+func branchOnStatus(c *CPU, mode AddressMode, op operation) (InstructionPostProccessingMode, error) {
+	value_address := c.getParameterValue(mode)
+	value := c.read(value_address)
+	if op.branchTaken(c) {
+		// Taken branches cost a cycle, and another if they cross a page
+		next := value_address + 1
+		c.program_counter = branchTarget(value_address, value)
+		c.extra_cycles = 1
+		if next&0xff00 != c.program_counter&0xff00 {
+			c.extra_cycles = 2
+		}
+		return InstructionProgramCounterUpdated, nil
+	} else {
 		return InstructionContinue, nil
 	}
 }
 
-func generateCompareCallback(register uint8) func(*CPU, AddressMode) (InstructionPostProccessingMode, error) {
-	return func(c *CPU, mode AddressMode) (InstructionPostProccessingMode, error) {
-		value_address := c.getParameterValue(mode)
-		value := c.memory[value_address]
-		result := register - value
-		c.updateStatusFlags(result)
-		if register > value {
-			c.status |= C_BIT_STATUS
-		}
-		return InstructionContinue, nil
-	}
+// Branch offsets are signed and relative to the instruction following
+// the branch, i.e. the byte after the offset parameter.
+func branchTarget(param_address uint16, offset uint8) uint16 {
+	return param_address + 1 + uint16(int16(int8(offset)))
 }
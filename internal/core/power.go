@@ -0,0 +1,104 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"pageer/myfinemu/internal/logging"
+)
+
+// The NES's internal RAM, which holds whatever the chips powered up with
+// until a game clears it.
+const RAM_SIZE = 0x0800
+
+// What internal RAM holds at power-on.  Real consoles vary, and a few
+// games depend on it, so it's worth trying more than one.
+type RAMPattern int
+
+const (
+	RAMZero RAMPattern = iota
+	RAMOnes
+	// Pseudo-random bytes from a seed, so runs can be repeated
+	RAMRandom
+)
+
+var RAM_PATTERN_NAMES = [...]string{"zero", "ff", "random"}
+
+func (p RAMPattern) String() string {
+	if p < 0 || int(p) >= len(RAM_PATTERN_NAMES) {
+		return fmt.Sprintf("pattern(%d)", int(p))
+	}
+	return RAM_PATTERN_NAMES[p]
+}
+
+func ParseRAMPattern(name string) (RAMPattern, error) {
+	for i, pattern_name := range RAM_PATTERN_NAMES {
+		if strings.EqualFold(name, pattern_name) {
+			return RAMPattern(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown RAM pattern %q, expected one of %s", name, strings.Join(RAM_PATTERN_NAMES[:], ", "))
+}
+
+// Choose what PowerOn fills internal RAM with.  The seed is only used by
+// RAMRandom.
+func (c *CPU) SetPowerOnRAM(pattern RAMPattern, seed int64) {
+	c.ram_pattern = pattern
+	c.ram_seed = seed
+}
+
+// The pattern and seed PowerOn will use.
+func (c *CPU) PowerOnRAM() (RAMPattern, int64) {
+	return c.ram_pattern, c.ram_seed
+}
+
+func (c *CPU) fillRAM() {
+	switch c.ram_pattern {
+	case RAMOnes:
+		for i := 0; i < RAM_SIZE; i++ {
+			c.memory[i] = 0xff
+		}
+	case RAMRandom:
+		random := rand.New(rand.NewSource(c.ram_seed))
+		for i := 0; i < RAM_SIZE; i++ {
+			c.memory[i] = uint8(random.Intn(0x100))
+		}
+	default:
+		for i := 0; i < RAM_SIZE; i++ {
+			c.memory[i] = 0
+		}
+	}
+}
+
+// Switch the CPU on: RAM gets its power-up pattern, the registers start
+// from zero, and then the reset sequence runs, leaving SP at $FD.
+// Cartridge memory above RAM is left alone, so load the ROM first.
+func (c *CPU) PowerOn() {
+	c.fillRAM()
+	c.accumulator = 0
+	c.index_x = 0
+	c.index_y = 0
+	c.stack_pointer = 0
+	c.status = 0
+	c.cycles = 0
+	c.recent_count = 0
+	c.irq_line = false
+	c.Reset()
+}
+
+// Press the reset button.  The CPU runs an interrupt sequence with its
+// writes suppressed, so SP drops by 3 without touching the stack, and I
+// is set.  A, X, Y, the other flags and RAM keep their values.
+func (c *CPU) Reset() {
+	// Anything half done is abandoned
+	c.cycle = cycleState{}
+	c.owed_cycles = 0
+	c.nmi_pending = false
+
+	c.stack_pointer -= 3
+	c.maskInterrupts()
+
+	c.program_counter = c.readAddressValue(PC_RESET_ADDRESS)
+	c.log.Debugf(logging.CategoryCPU, "Reset, PC=$%04X", c.program_counter)
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPowerOn_RAM(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pattern RAMPattern
+		first   uint8
+		last    uint8
+	}{
+		{"Zero", RAMZero, 0x00, 0x00},
+		{"FF", RAMOnes, 0xff, 0xff},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.memory[0x0000] = 0x55
+			c.memory[RAM_SIZE] = 0x55
+			c.SetPowerOnRAM(test.pattern, 0)
+
+			c.PowerOn()
+
+			assert.Equal(t, test.first, c.memory[0x0000])
+			assert.Equal(t, test.last, c.memory[RAM_SIZE-1])
+			// Only internal RAM
+			assert.Equal(t, uint8(0x55), c.memory[RAM_SIZE])
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestPowerOn_RandomRAMRepeats(t *testing.T) {
+	first := NewCPU()
+	first.SetPowerOnRAM(RAMRandom, 42)
+	first.PowerOn()
+	second := NewCPU()
+	second.SetPowerOnRAM(RAMRandom, 42)
+	second.PowerOn()
+	other := NewCPU()
+	other.SetPowerOnRAM(RAMRandom, 43)
+	other.PowerOn()
+
+	assert.Equal(t, first.memory[:RAM_SIZE], second.memory[:RAM_SIZE])
+	assert.NotEqual(t, first.memory[:RAM_SIZE], other.memory[:RAM_SIZE])
+}
+
+func TestPowerOn_Registers(t *testing.T) {
+	c := NewCPU()
+	c.LoadROM([]uint8{0xea})
+	c.SetRegisters(Registers{PC: 0x1234, SP: 0x42, A: 1, X: 2, Y: 3, Status: 0xff})
+
+	c.PowerOn()
+
+	assert.Equal(t, Registers{PC: 0x8000, SP: 0xfd, Status: I_BIT_STATUS}, c.Registers())
+	assert.Equal(t, uint64(0), c.Cycles())
+}
+
+func TestReset(t *testing.T) {
+	testCases := []struct {
+		name     string
+		variant  Variant
+		status   uint8
+		expected uint8
+	}{
+		{"Keeps the flags", VariantNES, C_BIT_STATUS | D_BIT_STATUS, C_BIT_STATUS | D_BIT_STATUS | I_BIT_STATUS},
+		{"65C02 clears D", Variant65C02, C_BIT_STATUS | D_BIT_STATUS, C_BIT_STATUS | I_BIT_STATUS},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := NewCPUVariant(test.variant)
+			c.LoadROM([]uint8{0xea})
+			c.SetRegisters(Registers{PC: 0x1234, SP: 0xf0, A: 1, X: 2, Y: 3, Status: test.status})
+			c.memory[0x01f0] = 0x55
+			c.memory[0x0010] = 0x66
+
+			c.Reset()
+
+			assert.Equal(t, Registers{PC: 0x8000, SP: 0xed, A: 1, X: 2, Y: 3, Status: test.expected}, c.Registers())
+			// The stack writes are suppressed, and RAM survives
+			assert.Equal(t, uint8(0x55), c.memory[0x01f0])
+			assert.Equal(t, uint8(0x66), c.memory[0x0010])
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestReset_AbandonsInstruction(t *testing.T) {
+	c := NewCPU()
+	// INC $0200, which Reset interrupts half way through
+	c.LoadAndReset([]uint8{0xee, 0x00, 0x02, 0xea})
+	c.SetCoreMode(CoreCycle)
+	c.StepCycle()
+	c.StepCycle()
+
+	c.Reset()
+	c.Step()
+
+	// Only the restarted INC got as far as writing
+	assert.Equal(t, uint16(0x8003), c.program_counter)
+	assert.Equal(t, uint8(0x01), c.memory[0x0200])
+}
+
+func TestParseRAMPattern(t *testing.T) {
+	pattern, err := ParseRAMPattern("FF")
+	assert.Nil(t, err)
+	assert.Equal(t, RAMOnes, pattern)
+
+	_, err = ParseRAMPattern("checkerboard")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Bump this when the layout of cpuState changes.  Older states can still
+// be loaded as long as LoadState knows how to convert them.
+const CPU_STATE_VERSION uint16 = 3
+
+// Everything needed to resume execution exactly where it left off.
+// The access hook is deliberately excluded, since it belongs to whoever
+// is observing the CPU rather than to the machine.
+type cpuState struct {
+	Version uint16
+	PC      uint16
+	SP      uint8
+	A       uint8
+	X       uint8
+	Y       uint8
+	Status  uint8
+	Cycles  uint64
+	// Added in version 2
+	Variant       uint8
+	IllegalPolicy uint8
+	CoreMode      uint8
+	IRQLine       bool
+	NMIPending    bool
+	// Added in version 3, so states can be saved between any two cycles
+	OwedCycles uint64
+	Cycle      savedCycleState
+	Memory     [MEMORY_SIZE]uint8
+}
+
+// The cycle core's place in an instruction.  The opcode entry is saved as
+// its opcode, and looked up again on load.
+type savedCycleState struct {
+	Step         uint8
+	Opcode       uint8
+	Interrupt    bool
+	PC           uint16
+	StartCycles  uint64
+	Resolved     uint8
+	Address      uint16
+	Pointer      uint8
+	Value        uint8
+	Crossed      bool
+	Extra        uint8
+	Poll         bool
+	PollPrevious bool
+}
+
+// Version 2, from before states could be saved part way through an
+// instruction.
+type cpuStateV2 struct {
+	Version       uint16
+	PC            uint16
+	SP            uint8
+	A             uint8
+	X             uint8
+	Y             uint8
+	Status        uint8
+	Cycles        uint64
+	Variant       uint8
+	IllegalPolicy uint8
+	CoreMode      uint8
+	IRQLine       bool
+	NMIPending    bool
+	Memory        [MEMORY_SIZE]uint8
+}
+
+// Version 2 states were always saved between instructions.
+func (old *cpuStateV2) upgrade() cpuState {
+	return cpuState{
+		Version:       CPU_STATE_VERSION,
+		PC:            old.PC,
+		SP:            old.SP,
+		A:             old.A,
+		X:             old.X,
+		Y:             old.Y,
+		Status:        old.Status,
+		Cycles:        old.Cycles,
+		Variant:       old.Variant,
+		IllegalPolicy: old.IllegalPolicy,
+		CoreMode:      old.CoreMode,
+		IRQLine:       old.IRQLine,
+		NMIPending:    old.NMIPending,
+		Memory:        old.Memory,
+	}
+}
+
+// Version 1, from before the interrupt inputs and CPU configuration were
+// saved.
+type cpuStateV1 struct {
+	Version uint16
+	PC      uint16
+	SP      uint8
+	A       uint8
+	X       uint8
+	Y       uint8
+	Status  uint8
+	Cycles  uint64
+	Memory  [MEMORY_SIZE]uint8
+}
+
+// Version 1 states keep the CPU's current configuration, with no
+// interrupt pending.
+func (old *cpuStateV1) upgrade(c *CPU) cpuState {
+	return cpuState{
+		Version:       CPU_STATE_VERSION,
+		PC:            old.PC,
+		SP:            old.SP,
+		A:             old.A,
+		X:             old.X,
+		Y:             old.Y,
+		Status:        old.Status,
+		Cycles:        old.Cycles,
+		Variant:       uint8(c.variant),
+		IllegalPolicy: uint8(c.illegal_policy),
+		CoreMode:      uint8(c.core_mode),
+		Memory:        old.Memory,
+	}
+}
+
+// Identifies the CPU's chunk in a save state.
+func (c *CPU) StateID() string {
+	return "CPU "
+}
+
+func (c *CPU) SaveState() ([]byte, error) {
+	s := &c.cycle
+	cycle := savedCycleState{
+		Step:         uint8(s.step),
+		Interrupt:    s.interrupt,
+		PC:           s.pc,
+		StartCycles:  s.start_cycles,
+		Resolved:     uint8(s.resolved),
+		Address:      s.address,
+		Pointer:      s.pointer,
+		Value:        s.value,
+		Crossed:      s.crossed,
+		Extra:        uint8(s.extra),
+		Poll:         s.poll,
+		PollPrevious: s.poll_previous,
+	}
+	if s.entry != nil {
+		cycle.Opcode = s.entry.instruction.hex
+	}
+	state := cpuState{
+		Version:       CPU_STATE_VERSION,
+		PC:            c.program_counter,
+		SP:            c.stack_pointer,
+		A:             c.accumulator,
+		X:             c.index_x,
+		Y:             c.index_y,
+		Status:        c.status,
+		Cycles:        c.cycles,
+		Variant:       uint8(c.variant),
+		IllegalPolicy: uint8(c.illegal_policy),
+		CoreMode:      uint8(c.core_mode),
+		IRQLine:       c.irq_line,
+		NMIPending:    c.nmi_pending,
+		OwedCycles:    c.owed_cycles,
+		Cycle:         cycle,
+		Memory:        c.memory,
+	}
+	var buffer bytes.Buffer
+	err := binary.Write(&buffer, binary.LittleEndian, &state)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (c *CPU) LoadState(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("CPU state too short: %d bytes", len(data))
+	}
+	version := binary.LittleEndian.Uint16(data)
+
+	var state cpuState
+	switch version {
+	case CPU_STATE_VERSION:
+		err := decodeState(data, &state)
+		if err != nil {
+			return err
+		}
+	case 2:
+		var old cpuStateV2
+		err := decodeState(data, &old)
+		if err != nil {
+			return err
+		}
+		state = old.upgrade()
+	case 1:
+		var old cpuStateV1
+		err := decodeState(data, &old)
+		if err != nil {
+			return err
+		}
+		state = old.upgrade(c)
+	default:
+		return fmt.Errorf("Unsupported CPU state version %d", version)
+	}
+	if int(state.Variant) >= len(VARIANT_NAMES) || int(state.IllegalPolicy) >= len(ILLEGAL_POLICY_NAMES) ||
+		int(state.CoreMode) >= len(CORE_MODE_NAMES) {
+		return errors.New("CPU state has an invalid variant, illegal opcode policy or core mode")
+	}
+
+	c.program_counter = state.PC
+	c.stack_pointer = state.SP
+	c.accumulator = state.A
+	c.index_x = state.X
+	c.index_y = state.Y
+	c.status = state.Status
+	c.cycles = state.Cycles
+	c.variant = Variant(state.Variant)
+	c.illegal_policy = IllegalOpcodePolicy(state.IllegalPolicy)
+	c.core_mode = CoreMode(state.CoreMode)
+	c.irq_line = state.IRQLine
+	c.nmi_pending = state.NMIPending
+	c.memory = state.Memory
+	// Instructions from before the load would be misleading in errors
+	c.recent_count = 0
+	c.owed_cycles = state.OwedCycles
+	c.loadCycleState(&state.Cycle)
+	return nil
+}
+
+func (c *CPU) loadCycleState(saved *savedCycleState) {
+	c.cycle = cycleState{
+		step:          int(saved.Step),
+		interrupt:     saved.Interrupt,
+		pc:            saved.PC,
+		start_cycles:  saved.StartCycles,
+		resolved:      int(saved.Resolved),
+		address:       saved.Address,
+		pointer:       saved.Pointer,
+		value:         saved.Value,
+		crossed:       saved.Crossed,
+		extra:         uint(saved.Extra),
+		poll:          saved.Poll,
+		poll_previous: saved.PollPrevious,
+	}
+	if c.cycle.step == 0 || c.cycle.interrupt {
+		return
+	}
+	// The same entry decode picked, including the illegal opcode policy's
+	// substitute
+	table := c.variant.opcodes()
+	c.cycle.entry = &table.entries[saved.Opcode]
+	if c.cycle.entry.illegal && c.illegal_policy == IllegalNOP {
+		c.cycle.entry = &table.nops[saved.Opcode]
+	}
+}
+
+// Decode a state of a fixed size, which has to match exactly.
+func decodeState(data []byte, state interface{}) error {
+	if len(data) != binary.Size(state) {
+		return fmt.Errorf("CPU state is %d bytes, expected %d", len(data), binary.Size(state))
+	}
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, state)
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestState_RoundTrip(t *testing.T) {
+	c := NewCPUVariant(VariantNMOS)
+	c.LoadAndReset([]uint8{0xea, 0xea, 0xea})
+	c.writeAddressValue(NMI_VECTOR, 0xa000)
+	c.SetIllegalOpcodePolicy(IllegalError)
+	c.SetCoreMode(CoreCycle)
+	c.SetIRQ(true)
+	c.TriggerNMI()
+
+	data, err := c.SaveState()
+	assert.Nil(t, err)
+	restored := NewCPU()
+	assert.Nil(t, restored.LoadState(data))
+
+	assert.Equal(t, VariantNMOS, restored.Variant())
+	assert.Equal(t, IllegalError, restored.IllegalOpcodePolicy())
+	assert.Equal(t, CoreCycle, restored.CoreMode())
+	assert.True(t, restored.irq_line)
+	again, _ := restored.SaveState()
+	assert.Equal(t, data, again)
+
+	// The pending NMI is taken by both, at the same point
+	for i := 0; i < 3 && c.Registers().PC < 0xa000; i++ {
+		c.Step()
+		restored.Step()
+		assert.Equal(t, c.Registers(), restored.Registers())
+	}
+	assert.Equal(t, uint16(0xa000), restored.Registers().PC)
+}
+
+func TestState_MidInstruction(t *testing.T) {
+	// INC $10, LDA $0010, JMP $8000, so 7 cycles is part way through the
+	// LDA
+	program := []uint8{0xe6, 0x10, 0xad, 0x10, 0x00, 0x4c, 0x00, 0x80}
+
+	for _, mode := range []CoreMode{CoreInstruction, CoreCycle} {
+		callback := func(t *testing.T) {
+			c := NewCPU()
+			c.LoadAndReset(program)
+			c.SetCoreMode(mode)
+			for i := 0; i < 7; i++ {
+				c.StepCycle()
+			}
+
+			data, err := c.SaveState()
+			assert.Nil(t, err)
+			restored := NewCPU()
+			assert.Nil(t, restored.LoadState(data))
+
+			// To the end of the third INC
+			for i := 0; i < 22; i++ {
+				c.StepCycle()
+				restored.StepCycle()
+				assert.Equal(t, c.Registers(), restored.Registers())
+				assert.Equal(t, c.Cycles(), restored.Cycles())
+			}
+			assert.Equal(t, uint8(3), restored.ReadMemory(0x10))
+		}
+		t.Run(mode.String(), callback)
+	}
+}
+
+func TestState_Version2(t *testing.T) {
+	old := cpuStateV2{Version: 2, PC: 0x8123, SP: 0xf0, Variant: uint8(Variant65C02), CoreMode: uint8(CoreCycle), NMIPending: true}
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, &old)
+
+	c := NewCPU()
+	assert.Nil(t, c.LoadState(buffer.Bytes()))
+
+	assert.Equal(t, uint16(0x8123), c.Registers().PC)
+	assert.Equal(t, Variant65C02, c.Variant())
+	assert.Equal(t, CoreCycle, c.CoreMode())
+	assert.True(t, c.nmi_pending)
+	assert.False(t, c.midInstruction())
+}
+
+func TestState_Version1(t *testing.T) {
+	old := cpuStateV1{Version: 1, PC: 0x8123, SP: 0xf0, A: 1, X: 2, Y: 3, Status: 0x24, Cycles: 99}
+	old.Memory[0x0200] = 0x42
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, &old)
+
+	c := NewCPUVariant(Variant65C02)
+	c.SetIRQ(true)
+	c.TriggerNMI()
+	assert.Nil(t, c.LoadState(buffer.Bytes()))
+
+	assert.Equal(t, Registers{PC: 0x8123, SP: 0xf0, A: 1, X: 2, Y: 3, Status: 0x24}, c.Registers())
+	assert.Equal(t, uint64(99), c.Cycles())
+	assert.Equal(t, uint8(0x42), c.ReadMemory(0x0200))
+	// Configuration is kept, and nothing is pending
+	assert.Equal(t, Variant65C02, c.Variant())
+	assert.False(t, c.irq_line)
+	assert.False(t, c.nmi_pending)
+}
+
+func TestState_Invalid(t *testing.T) {
+	c := NewCPU()
+	data, _ := c.SaveState()
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"Too short", data[:1], "CPU state too short: 1 bytes"},
+		{"Unknown version", append([]byte{9, 0}, data[2:]...), "Unsupported CPU state version 9"},
+		{"Wrong size", data[:len(data)-1], "CPU state is 65587 bytes, expected 65588"},
+		{"Bad variant", func() []byte {
+			bad := append([]byte(nil), data...)
+			// After the version, PC, registers and cycles
+			bad[2+2+5+8] = 7
+			return bad
+		}(), "CPU state has an invalid variant, illegal opcode policy or core mode"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			assert.EqualError(t, NewCPU().LoadState(test.data), test.expected)
+		}
+		t.Run(test.name, callback)
+	}
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Which member of the 6502 family to emulate.
+type Variant int
+
+const (
+	// The NES's 2A03, an NMOS 6502 without decimal mode
+	VariantNES Variant = iota
+	// A stock NMOS 6502, as in the Apple II or C64
+	VariantNMOS
+	// The CMOS 65C02, with new instructions and the NMOS bugs fixed
+	Variant65C02
+)
+
+var VARIANT_NAMES = [...]string{"nes", "6502", "65c02"}
+
+func (v Variant) String() string {
+	if v < 0 || int(v) >= len(VARIANT_NAMES) {
+		return fmt.Sprintf("variant(%d)", int(v))
+	}
+	return VARIANT_NAMES[v]
+}
+
+func ParseVariant(name string) (Variant, error) {
+	for i, variant_name := range VARIANT_NAMES {
+		if strings.EqualFold(name, variant_name) {
+			return Variant(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown CPU variant %q, expected one of %s", name, strings.Join(VARIANT_NAMES[:], ", "))
+}
+
+// The 2A03 has the D flag, but nothing uses it.
+func (v Variant) hasDecimalMode() bool {
+	return v != VariantNES
+}
+
+func (v Variant) opcodes() *opcodeTable {
+	if v == Variant65C02 {
+		return &cmos_opcodes
+	}
+	return &opcodes
+}
+
+// Look up the instruction for an opcode byte.
+func (v Variant) LookupOpcode(hex uint8) (Instruction, bool) {
+	entry := v.opcodes().entries[hex]
+	return entry.instruction, entry.known
+}
+
+// Get every addressing mode variant of a mnemonic, e.g. "LDA".
+func (v Variant) LookupMnemonic(name string) []Instruction {
+	return v.opcodes().mnemonics[name]
+}
+
+// Where JMP ($xxxx) reads the high byte of its target.  The NMOS 6502
+// doesn't carry into the pointer's high byte, so JMP ($10FF) reads $10FF
+// and $1000.  The 65C02 fixed that.
+func (v Variant) IndirectJumpHigh(pointer uint16) uint16 {
+	if v == Variant65C02 {
+		return pointer + 1
+	}
+	return pointer&0xff00 | uint16(uint8(pointer)+1)
+}
+
+// A CPU of another variant than the NES's.
+func NewCPUVariant(variant Variant) *CPU {
+	c := NewCPU()
+	c.variant = variant
+	return c
+}
+
+func (c *CPU) Variant() Variant {
+	return c.variant
+}
@@ -0,0 +1,252 @@
+package dap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const program = `; Count down from three
+	LDX #3
+loop:	DEX
+	BNE loop
+	JSR done
+	NOP
+
+done:	INC $0200
+	BRK
+`
+
+// A decoded message from the server, requests and events alike.
+type message struct {
+	Type       string                 `json:"type"`
+	Command    string                 `json:"command"`
+	Event      string                 `json:"event"`
+	RequestSeq int                    `json:"request_seq"`
+	Success    bool                   `json:"success"`
+	Message    string                 `json:"message"`
+	Body       map[string]interface{} `json:"body"`
+}
+
+func writeSource(t *testing.T, source string) string {
+	path := filepath.Join(t.TempDir(), "countdown.s")
+	assert.Nil(t, os.WriteFile(path, []byte(source), 0644))
+	return path
+}
+
+// Frame a recorded sequence of requests as an editor would send them.
+func script(requests ...map[string]interface{}) *bytes.Buffer {
+	var buffer bytes.Buffer
+	for i, request := range requests {
+		request["seq"] = i + 1
+		request["type"] = "request"
+		data, _ := json.Marshal(request)
+		fmt.Fprintf(&buffer, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	}
+	return &buffer
+}
+
+func request(command string, arguments map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"command": command, "arguments": arguments}
+}
+
+func replay(t *testing.T, input *bytes.Buffer) []message {
+	var output bytes.Buffer
+	assert.Nil(t, Serve(input, &output))
+
+	var messages []message
+	reader := bufio.NewReader(&output)
+	headers := textproto.NewReader(reader)
+	for {
+		header, err := headers.ReadMIMEHeader()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		assert.Nil(t, err)
+		data := make([]byte, length)
+		_, err = io.ReadFull(reader, data)
+		assert.Nil(t, err)
+
+		var m message
+		assert.Nil(t, json.Unmarshal(data, &m))
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// Summarise messages as "response:command" or "event:name".
+func kinds(messages []message) []string {
+	var result []string
+	for _, m := range messages {
+		if m.Type == "response" {
+			result = append(result, "response:"+m.Command)
+		} else {
+			result = append(result, "event:"+m.Event)
+		}
+	}
+	return result
+}
+
+func find(messages []message, kind string, name string) []message {
+	var result []message
+	for _, m := range messages {
+		if m.Type == kind && (m.Command == name || m.Event == name) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func TestSession_BreakpointsAndStepping(t *testing.T) {
+	path := writeSource(t, program)
+	source := map[string]interface{}{"path": path}
+
+	messages := replay(t, script(
+		request("initialize", map[string]interface{}{"adapterID": "myfinemu"}),
+		request("launch", map[string]interface{}{"program": path}),
+		// Line 7 is blank, so the breakpoint moves to line 8
+		request("setBreakpoints", map[string]interface{}{
+			"source":      source,
+			"breakpoints": []map[string]interface{}{{"line": 7}, {"line": 20}},
+		}),
+		request("configurationDone", nil),
+		request("threads", nil),
+		request("stackTrace", map[string]interface{}{"threadId": 1}),
+		request("scopes", map[string]interface{}{"frameId": 0}),
+		request("variables", map[string]interface{}{"variablesReference": REF_REGISTERS}),
+		request("variables", map[string]interface{}{"variablesReference": REF_FLAGS}),
+		request("stepIn", map[string]interface{}{"threadId": 1}),
+		request("stepOut", map[string]interface{}{"threadId": 1}),
+		request("variables", map[string]interface{}{"variablesReference": REF_ZERO_PAGE}),
+		request("setBreakpoints", map[string]interface{}{"source": source, "breakpoints": []interface{}{}}),
+		request("continue", map[string]interface{}{"threadId": 1}),
+		request("disconnect", nil),
+	))
+
+	assert.Equal(t, []string{
+		"response:initialize",
+		"event:initialized",
+		"response:launch",
+		"response:setBreakpoints",
+		"response:configurationDone",
+		"event:stopped",
+		"response:threads",
+		"response:stackTrace",
+		"response:scopes",
+		"response:variables",
+		"response:variables",
+		"response:stepIn",
+		"event:stopped",
+		// There's no return, so stepping out runs into the BRK
+		"response:stepOut",
+		"event:output",
+		"event:terminated",
+		"response:variables",
+		"response:setBreakpoints",
+		"response:continue",
+		"response:disconnect",
+	}, kinds(messages))
+	for _, m := range messages {
+		assert.True(t, m.Type == "event" || m.Success, m.Message)
+	}
+
+	breakpoints := find(messages, "response", "setBreakpoints")[0].Body["breakpoints"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"id": 1.0, "verified": true, "line": 8.0}, breakpoints[0])
+	assert.Equal(t, false, breakpoints[1].(map[string]interface{})["verified"])
+
+	stops := find(messages, "event", "stopped")
+	assert.Equal(t, "breakpoint", stops[0].Body["reason"])
+	assert.Equal(t, "step", stops[1].Body["reason"])
+
+	// Stopped in done, called from the top level
+	frames := find(messages, "response", "stackTrace")[0].Body["stackFrames"].([]interface{})
+	assert.Len(t, frames, 2)
+	inner := frames[0].(map[string]interface{})
+	outer := frames[1].(map[string]interface{})
+	assert.Equal(t, "done", inner["name"])
+	assert.Equal(t, 8.0, inner["line"])
+	assert.Equal(t, path, inner["source"].(map[string]interface{})["path"])
+	assert.Equal(t, "$8000", outer["name"])
+	assert.Equal(t, 5.0, outer["line"])
+
+	variables := find(messages, "response", "variables")
+	registers := variables[0].Body["variables"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"name": "X", "value": "$00", "variablesReference": 0.0}, registers[2])
+	flags := variables[1].Body["variables"].([]interface{})
+	assert.Len(t, flags, 7)
+	zero_page := variables[2].Body["variables"].([]interface{})
+	assert.Len(t, zero_page, 16)
+	assert.Equal(t, map[string]interface{}{
+		"name":               "$0000",
+		"value":              "00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00",
+		"variablesReference": 0.0,
+	}, zero_page[0])
+}
+
+func TestSession_StopOnEntry(t *testing.T) {
+	path := writeSource(t, program)
+
+	messages := replay(t, script(
+		request("initialize", nil),
+		request("launch", map[string]interface{}{"program": path, "stopOnEntry": true}),
+		request("configurationDone", nil),
+		request("next", map[string]interface{}{"threadId": 1}),
+		request("next", map[string]interface{}{"threadId": 1}),
+		request("stackTrace", map[string]interface{}{"threadId": 1}),
+		request("pause", map[string]interface{}{"threadId": 1}),
+	))
+
+	stops := find(messages, "event", "stopped")
+	assert.Len(t, stops, 3)
+	assert.Equal(t, "entry", stops[0].Body["reason"])
+
+	// LDX and DEX have run
+	frames := find(messages, "response", "stackTrace")[0].Body["stackFrames"].([]interface{})
+	assert.Len(t, frames, 1)
+	assert.Equal(t, 4.0, frames[0].(map[string]interface{})["line"])
+	assert.True(t, find(messages, "response", "pause")[0].Success)
+}
+
+func TestSession_PauseBehindContinue(t *testing.T) {
+	path := writeSource(t, "loop:	JMP loop\n")
+
+	// The pause is read before the continue has started running, and
+	// still has to stop it
+	messages := replay(t, script(
+		request("initialize", nil),
+		request("launch", map[string]interface{}{"program": path, "stopOnEntry": true}),
+		request("configurationDone", nil),
+		request("continue", map[string]interface{}{"threadId": 1}),
+		request("pause", map[string]interface{}{"threadId": 1}),
+	))
+
+	stops := find(messages, "event", "stopped")
+	assert.Len(t, stops, 2)
+	assert.Equal(t, "entry", stops[0].Body["reason"])
+	assert.Equal(t, "pause", stops[1].Body["reason"])
+}
+
+func TestSession_Errors(t *testing.T) {
+	messages := replay(t, script(
+		request("threads", nil),
+		request("launch", map[string]interface{}{"program": "missing.s"}),
+		request("bogus", nil),
+	))
+
+	assert.Len(t, messages, 3)
+	for _, m := range messages {
+		assert.False(t, m.Success)
+		assert.NotEmpty(t, m.Message)
+	}
+}
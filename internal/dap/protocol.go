@@ -0,0 +1,102 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// The subset of the Debug Adapter Protocol message types we use.  Bodies
+// and arguments are left as raw JSON and decoded per command.
+
+type Request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type Response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type Event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// Reads and writes Content-Length framed JSON messages.
+type connection struct {
+	reader     *textproto.Reader
+	body       *bufio.Reader
+	writer     io.Writer
+	write_lock sync.Mutex
+	seq        int
+}
+
+func newConnection(in io.Reader, out io.Writer) *connection {
+	buffered := bufio.NewReader(in)
+	return &connection{
+		reader: textproto.NewReader(buffered),
+		body:   buffered,
+		writer: out,
+	}
+}
+
+func (c *connection) readRequest() (*Request, error) {
+	header, err := c.reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad Content-Length header: %w", err)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(c.body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var request Request
+	err = json.Unmarshal(data, &request)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (c *connection) send(message interface{}) error {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+
+	c.seq++
+	switch m := message.(type) {
+	case *Response:
+		m.Seq = c.seq
+		m.Type = "response"
+	case *Event:
+		m.Seq = c.seq
+		m.Type = "event"
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.writer, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
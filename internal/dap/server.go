@@ -0,0 +1,501 @@
+package dap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/debugger"
+)
+
+// There's only one thread of execution
+const THREAD_ID = 1
+
+// Variable references for the scopes shown in the editor
+const (
+	REF_REGISTERS = iota + 1
+	REF_FLAGS
+	REF_ZERO_PAGE
+	REF_STACK
+)
+
+// Bytes shown per row in the memory scopes
+const MEMORY_ROW_SIZE = 16
+
+type Session struct {
+	conn     *connection
+	requests chan *Request
+	done     chan struct{}
+	read_err error
+
+	// Set by launch.  The debugger is loaded atomically since the reader
+	// goroutine uses it to handle pause.
+	d             atomic.Pointer[debugger.Debugger]
+	program       *asm.Program
+	source        string
+	stop_on_entry bool
+	// Breakpoint IDs set through setBreakpoints, replaced on each request
+	breakpoints []int
+	// Continues and steps that have been read but not finished, so pause
+	// knows whether there's anything to interrupt.  Counted up by the
+	// reader and down by Run, since editors may send several at once.
+	run_lock sync.Mutex
+	running  int
+	exited   bool
+}
+
+// Serve a single debug session over a pair of streams, normally stdin and
+// stdout when started by an editor.
+func Serve(in io.Reader, out io.Writer) error {
+	return NewSession(in, out).Run()
+}
+
+func NewSession(in io.Reader, out io.Writer) *Session {
+	return &Session{
+		conn:     newConnection(in, out),
+		requests: make(chan *Request),
+		done:     make(chan struct{}),
+	}
+}
+
+// Handle requests until the client disconnects or closes the stream.
+func (s *Session) Run() error {
+	defer close(s.done)
+	go s.readRequests()
+
+	for request := range s.requests {
+		body, err := s.handle(request)
+		response := &Response{RequestSeq: request.Seq, Command: request.Command, Success: err == nil, Body: body}
+		if err != nil {
+			response.Message = err.Error()
+		}
+		err = s.conn.send(response)
+		if err != nil {
+			return err
+		}
+
+		err = s.afterResponse(request)
+		if resumes(request.Command) {
+			s.stopped()
+		}
+		if err != nil {
+			return err
+		}
+		if request.Command == "disconnect" {
+			return nil
+		}
+	}
+	if errors.Is(s.read_err, io.EOF) {
+		return nil
+	}
+	return s.read_err
+}
+
+// Pause has to be seen while the CPU is running, so it's handled as soon
+// as it's read rather than waiting its turn.
+func (s *Session) readRequests() {
+	defer close(s.requests)
+	for {
+		request, err := s.conn.readRequest()
+		if err != nil {
+			s.read_err = err
+			return
+		}
+		switch {
+		case request.Command == "pause":
+			s.interrupt()
+		case resumes(request.Command):
+			// Before reading on, so a pause right behind the request
+			// isn't dropped
+			s.resumed()
+		}
+		select {
+		case s.requests <- request:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// The requests that run the CPU, once their response has been sent.
+func resumes(command string) bool {
+	switch command {
+	case "configurationDone", "continue", "next", "stepIn", "stepOut":
+		return true
+	}
+	return false
+}
+
+func (s *Session) resumed() {
+	s.run_lock.Lock()
+	defer s.run_lock.Unlock()
+	s.running++
+}
+
+// Pauses while stopped are ignored, since there's nothing to stop and
+// they'd otherwise end the next continue at once.
+func (s *Session) interrupt() {
+	s.run_lock.Lock()
+	defer s.run_lock.Unlock()
+	if d := s.d.Load(); s.running > 0 && d != nil {
+		d.Interrupt()
+	}
+}
+
+// Called once a resuming request is done.  A pause that raced with the
+// last stop is answered by its stopped event, so it mustn't carry over.
+func (s *Session) stopped() {
+	s.run_lock.Lock()
+	defer s.run_lock.Unlock()
+	s.running--
+	if d := s.d.Load(); s.running == 0 && d != nil {
+		d.ClearInterrupt()
+	}
+}
+
+func (s *Session) sendEvent(name string, body interface{}) error {
+	return s.conn.send(&Event{Event: name, Body: body})
+}
+
+// Handle a request and produce the response body.
+func (s *Session) handle(request *Request) (interface{}, error) {
+	switch request.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		return nil, s.launch(request.Arguments)
+	case "disconnect", "terminate", "configurationDone":
+		return nil, nil
+	}
+
+	if s.d.Load() == nil {
+		return nil, fmt.Errorf("%s before launch", request.Command)
+	}
+
+	switch request.Command {
+	case "setBreakpoints":
+		return s.setBreakpoints(request.Arguments)
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": THREAD_ID, "name": "6502"}},
+		}, nil
+	case "stackTrace":
+		return s.stackTrace(), nil
+	case "scopes":
+		return s.scopes(), nil
+	case "variables":
+		return s.variables(request.Arguments)
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut", "pause":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unsupported request %q", request.Command)
+}
+
+// Events that have to follow the response, including running the CPU for
+// the execution requests.
+func (s *Session) afterResponse(request *Request) error {
+	switch request.Command {
+	case "initialize":
+		return s.sendEvent("initialized", nil)
+	case "terminate":
+		return s.sendEvent("terminated", nil)
+	}
+
+	if s.d.Load() == nil || s.exited {
+		return nil
+	}
+
+	switch request.Command {
+	case "configurationDone":
+		if s.stop_on_entry {
+			return s.sendStopped("entry", "")
+		}
+		return s.run(s.d.Load().Continue)
+	case "continue":
+		return s.run(s.d.Load().Continue)
+	case "next":
+		return s.run(s.d.Load().StepOver)
+	case "stepIn":
+		return s.run(s.d.Load().Step)
+	case "stepOut":
+		return s.run(s.d.Load().StepOut)
+	}
+	return nil
+}
+
+func (s *Session) launch(arguments json.RawMessage) error {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return errors.New("No program to launch")
+	}
+
+	source, err := os.ReadFile(args.Program)
+	if err != nil {
+		return err
+	}
+	program, err := asm.Assemble(string(source))
+	if err != nil {
+		return err
+	}
+	c := core.NewCPU()
+	err = c.LoadAndReset(program.Bytes)
+	if err != nil {
+		return err
+	}
+
+	d := debugger.New(c)
+	d.Symbols = program.Symbols()
+	s.d.Store(d)
+	s.program = program
+	s.source = args.Program
+	s.stop_on_entry = args.StopOnEntry
+	return nil
+}
+
+// Run the CPU and report why it stopped.
+func (s *Session) run(execute func() debugger.Stop) error {
+	stop := execute()
+
+	switch stop.Reason {
+	case debugger.StopBreakpoint:
+		return s.sendStopped("breakpoint", "")
+	case debugger.StopWatchpoint:
+		return s.sendStopped("data breakpoint", stop.String())
+	case debugger.StopInterrupted:
+		return s.sendStopped("pause", "")
+	case debugger.StopError:
+		return s.sendStopped("exception", stop.String())
+	case debugger.StopHalted:
+		s.exited = true
+		err := s.sendEvent("output", map[string]interface{}{"category": "console", "output": stop.String() + "\n"})
+		if err != nil {
+			return err
+		}
+		return s.sendEvent("terminated", nil)
+	}
+	return s.sendStopped("step", "")
+}
+
+func (s *Session) sendStopped(reason string, description string) error {
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          THREAD_ID,
+		"allThreadsStopped": true,
+	}
+	if description != "" {
+		body["description"] = description
+	}
+	return s.sendEvent("stopped", body)
+}
+
+type sourceBreakpoint struct {
+	Line      int    `json:"line"`
+	Condition string `json:"condition"`
+}
+
+func (s *Session) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	}
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range s.breakpoints {
+		s.d.Load().Delete(id)
+	}
+	s.breakpoints = nil
+
+	same_source := sameFile(args.Source.Path, s.source)
+	results := []map[string]interface{}{}
+	for _, requested := range args.Breakpoints {
+		result := map[string]interface{}{"verified": false, "line": requested.Line}
+		results = append(results, result)
+
+		if !same_source {
+			result["message"] = "Not part of the program being debugged"
+			continue
+		}
+		line, address, ok := s.codeAtOrAfter(requested.Line)
+		if !ok {
+			result["message"] = "No code at or after this line"
+			continue
+		}
+		b, err := s.d.Load().AddBreakpoint(address, requested.Condition)
+		if err != nil {
+			result["message"] = err.Error()
+			continue
+		}
+		s.breakpoints = append(s.breakpoints, b.ID)
+		result["id"] = b.ID
+		result["verified"] = true
+		result["line"] = line
+	}
+	return map[string]interface{}{"breakpoints": results}, nil
+}
+
+// Breakpoints on blank lines, comments and labels move to the next line
+// that generates code.
+func (s *Session) codeAtOrAfter(line int) (int, uint16, bool) {
+	lines := make([]int, 0, len(s.program.Lines))
+	for l := range s.program.Lines {
+		lines = append(lines, l)
+	}
+	sort.Ints(lines)
+	for _, l := range lines {
+		if l >= line {
+			return l, s.program.Lines[l], true
+		}
+	}
+	return 0, 0, false
+}
+
+// The innermost frame is the current PC, then each JSR we're inside.
+func (s *Session) stackTrace() interface{} {
+	calls := s.d.Load().CallStack()
+	pc := s.d.Load().CPU().Registers().PC
+
+	frames := []map[string]interface{}{}
+	entry := s.program.Origin
+	if len(calls) > 0 {
+		entry = calls[len(calls)-1].Entry
+	}
+	frames = append(frames, s.frame(0, pc, entry))
+	for i := len(calls) - 1; i >= 0; i-- {
+		entry = s.program.Origin
+		if i > 0 {
+			entry = calls[i-1].Entry
+		}
+		frames = append(frames, s.frame(len(calls)-i, calls[i].CallSite, entry))
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+func (s *Session) frame(id int, address uint16, entry uint16) map[string]interface{} {
+	name, ok := s.d.Load().Symbols[entry]
+	if !ok {
+		name = fmt.Sprintf("$%04X", entry)
+	}
+	frame := map[string]interface{}{
+		"id":                          id,
+		"name":                        name,
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("$%04X", address),
+	}
+	if line, ok := s.program.LineForAddress(address); ok {
+		frame["line"] = line
+		frame["column"] = 1
+		frame["source"] = map[string]interface{}{"name": filepath.Base(s.source), "path": s.source}
+	}
+	return frame
+}
+
+func (s *Session) scopes() interface{} {
+	scope := func(name string, reference int) map[string]interface{} {
+		return map[string]interface{}{"name": name, "variablesReference": reference, "expensive": false}
+	}
+	return map[string]interface{}{
+		"scopes": []map[string]interface{}{
+			scope("Registers", REF_REGISTERS),
+			scope("Flags", REF_FLAGS),
+			scope("Zero Page", REF_ZERO_PAGE),
+			scope("Stack", REF_STACK),
+		},
+	}
+}
+
+func (s *Session) variables(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	variables := []map[string]interface{}{}
+	add := func(name string, value string) {
+		variables = append(variables, map[string]interface{}{"name": name, "value": value, "variablesReference": 0})
+	}
+
+	registers := s.d.Load().CPU().Registers()
+	switch args.VariablesReference {
+	case REF_REGISTERS:
+		add("PC", fmt.Sprintf("$%04X", registers.PC))
+		add("A", fmt.Sprintf("$%02X", registers.A))
+		add("X", fmt.Sprintf("$%02X", registers.X))
+		add("Y", fmt.Sprintf("$%02X", registers.Y))
+		add("SP", fmt.Sprintf("$%02X", registers.SP))
+		add("P", fmt.Sprintf("$%02X", registers.Status))
+	case REF_FLAGS:
+		for i, name := range "NV-BDIZC" {
+			if name == '-' {
+				continue
+			}
+			add(string(name), fmt.Sprint(registers.Status>>(7-i)&1))
+		}
+	case REF_ZERO_PAGE:
+		s.addMemoryRows(0x0000, add)
+	case REF_STACK:
+		s.addMemoryRows(core.STACK_START, add)
+	default:
+		return nil, fmt.Errorf("Unknown variables reference %d", args.VariablesReference)
+	}
+	return map[string]interface{}{"variables": variables}, nil
+}
+
+// Show a page of memory as rows of hex bytes.
+func (s *Session) addMemoryRows(start uint16, add func(string, string)) {
+	c := s.d.Load().CPU()
+	for row := start; row < start+0x100; row += MEMORY_ROW_SIZE {
+		text := ""
+		for i := uint16(0); i < MEMORY_ROW_SIZE; i++ {
+			if i > 0 {
+				text += " "
+			}
+			text += fmt.Sprintf("%02X", c.ReadMemory(row+i))
+		}
+		add(fmt.Sprintf("$%04X", row), text)
+	}
+}
+
+func sameFile(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	info_a, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	info_b, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(info_a, info_b)
+}
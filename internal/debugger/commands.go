@@ -0,0 +1,418 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"pageer/myfinemu/internal/cheat"
+	"pageer/myfinemu/internal/core"
+)
+
+// Number of instructions to show after the PC in listings
+const LIST_AFTER = 6
+
+const HELP = `Commands:
+  s, step [N]             Execute N instructions (default 1)
+  n, next                 Step, running over subroutine calls
+  finish, out             Run until the current subroutine returns
+  c, continue             Run until a breakpoint, watchpoint or halt
+  u, until ADDR           Run until the PC reaches ADDR
+  b, break ADDR [if COND] Set a breakpoint, e.g. "break $8010 if A == $10 && X > 2"
+  w, watch [r|w|rw|x] START[-END]
+                          Stop on reads, writes or execution in a memory range
+  d, delete ID            Delete a breakpoint or watchpoint
+  enable ID, disable ID   Enable or disable a breakpoint or watchpoint
+  i, info                 List breakpoints and watchpoints
+  r, regs                 Show registers
+  set REG VALUE           Set a register (A, X, Y, SP, P, PC)
+  m, mem ADDR [LEN]       Dump memory
+  poke ADDR VALUE         Write a byte to memory
+  cheat [add CODE [NAME] | on N | off N | del N]
+                          List, add, toggle or delete Game Genie or ADDR:VALUE cheats
+  l, list [ADDR [COUNT]]  Disassemble, default around the PC
+  h, help                 Show this help
+  q, quit                 Exit the debugger
+`
+
+// Read commands from in until EOF or quit, writing results to out.
+func (d *Debugger) Repl(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	last := ""
+	d.list(out, nil)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		// An empty line repeats the previous command, like gdb
+		if line == "" {
+			line = last
+		}
+		last = line
+		if d.Execute(line, out) {
+			return
+		}
+	}
+}
+
+// Run a single command line.  Returns true if the user asked to quit.
+func (d *Debugger) Execute(line string, out io.Writer) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	args := fields[1:]
+
+	var err error
+	switch strings.ToLower(fields[0]) {
+	case "s", "step":
+		count := 1
+		if len(args) > 0 {
+			count, err = ParseNumber(args[0])
+			if err != nil {
+				break
+			}
+		}
+		stop := Stop{Reason: StopStep}
+		for i := 0; i < count && stop.Reason == StopStep; i++ {
+			stop = d.Step()
+		}
+		d.report(out, stop)
+	case "n", "next":
+		d.report(out, d.StepOver())
+	case "finish", "out":
+		d.report(out, d.StepOut())
+	case "c", "continue":
+		d.report(out, d.Continue())
+	case "u", "until":
+		var address uint16
+		address, err = d.parseAddress(args, 0)
+		if err == nil {
+			d.report(out, d.RunTo(address))
+		}
+	case "b", "break":
+		err = d.breakCommand(out, args)
+	case "w", "watch":
+		err = d.watchCommand(out, args)
+	case "d", "delete":
+		var id int
+		id, err = parseID(args)
+		if err == nil {
+			err = d.Delete(id)
+		}
+	case "enable", "disable":
+		var id int
+		id, err = parseID(args)
+		if err == nil {
+			err = d.SetEnabled(id, strings.ToLower(fields[0]) == "enable")
+		}
+	case "i", "info":
+		for _, b := range d.breakpoints {
+			fmt.Fprintln(out, b)
+		}
+		for _, w := range d.watchpoints {
+			fmt.Fprintln(out, w)
+		}
+	case "r", "regs":
+		fmt.Fprintln(out, FormatRegisters(d.cpu.Registers()))
+	case "set":
+		err = d.setCommand(args)
+	case "m", "mem":
+		err = d.memCommand(out, args)
+	case "poke":
+		err = d.pokeCommand(args)
+	case "cheat":
+		err = d.cheatCommand(out, args)
+	case "l", "list":
+		err = d.list(out, args)
+	case "h", "help", "?":
+		fmt.Fprint(out, HELP)
+	case "q", "quit", "exit":
+		return true
+	default:
+		err = fmt.Errorf("Unknown command %q, try \"help\"", fields[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(out, err)
+	}
+	return false
+}
+
+func (d *Debugger) report(out io.Writer, stop Stop) {
+	if stop.Reason != StopStep {
+		fmt.Fprintln(out, stop)
+	}
+	fmt.Fprintln(out, FormatRegisters(d.cpu.Registers()))
+	fmt.Fprintln(out, core.DisassembleAt(d.cpu, stop.PC, d.Symbols))
+}
+
+func (d *Debugger) breakCommand(out io.Writer, args []string) error {
+	address, err := d.parseAddress(args, 0)
+	if err != nil {
+		return err
+	}
+	condition := ""
+	if len(args) > 1 {
+		if strings.ToLower(args[1]) != "if" {
+			return fmt.Errorf("Expected \"if\" before condition")
+		}
+		condition = strings.Join(args[2:], " ")
+	}
+	b, err := d.AddBreakpoint(address, condition)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, b)
+	return nil
+}
+
+func (d *Debugger) watchCommand(out io.Writer, args []string) error {
+	kind := WatchWrite
+	if len(args) > 1 {
+		kind = 0
+		for _, char := range strings.ToLower(args[0]) {
+			switch char {
+			case 'r':
+				kind |= WatchRead
+			case 'w':
+				kind |= WatchWrite
+			case 'x':
+				kind |= WatchExecute
+			default:
+				return fmt.Errorf("Invalid watch type %q", args[0])
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: watch [r|w|rw|x] START[-END]")
+	}
+
+	bounds := strings.SplitN(args[0], "-", 2)
+	start, err := d.parseAddress(bounds, 0)
+	if err != nil {
+		return err
+	}
+	end := start
+	if len(bounds) > 1 {
+		end, err = d.parseAddress(bounds, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := d.AddWatchpoint(start, end, kind)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, w)
+	return nil
+}
+
+func (d *Debugger) setCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: set REG VALUE")
+	}
+	value, err := ParseNumber(args[1])
+	if err != nil {
+		return err
+	}
+	registers := d.cpu.Registers()
+	switch strings.ToUpper(args[0]) {
+	case "A":
+		registers.A = uint8(value)
+	case "X":
+		registers.X = uint8(value)
+	case "Y":
+		registers.Y = uint8(value)
+	case "SP", "S":
+		registers.SP = uint8(value)
+	case "P", "STATUS":
+		registers.Status = uint8(value)
+	case "PC":
+		registers.PC = uint16(value)
+	default:
+		return fmt.Errorf("Unknown register %q", args[0])
+	}
+	d.cpu.SetRegisters(registers)
+	return nil
+}
+
+func (d *Debugger) memCommand(out io.Writer, args []string) error {
+	address, err := d.parseAddress(args, 0)
+	if err != nil {
+		return err
+	}
+	length := 64
+	if len(args) > 1 {
+		length, err = ParseNumber(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	DumpMemory(out, d.cpu, address, length)
+	return nil
+}
+
+func (d *Debugger) pokeCommand(args []string) error {
+	address, err := d.parseAddress(args, 0)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: poke ADDR VALUE")
+	}
+	value, err := ParseNumber(args[1])
+	if err != nil {
+		return err
+	}
+	d.cpu.WriteMemory(address, uint8(value))
+	return nil
+}
+
+func (d *Debugger) cheatCommand(out io.Writer, args []string) error {
+	if d.Cheats == nil {
+		d.Cheats = cheat.New()
+		d.Cheats.Attach(d.cpu)
+	}
+	if len(args) == 0 {
+		for i, c := range d.Cheats.Cheats() {
+			fmt.Fprintf(out, "%d: %s\n", i, c)
+		}
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(args) < 2 {
+			return fmt.Errorf("Usage: cheat add CODE [NAME]")
+		}
+		index, err := d.Cheats.Add(args[1], strings.Join(args[2:], " "))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d: %s\n", index, d.Cheats.Cheats()[index])
+		return nil
+	case "on", "off", "del":
+		index, err := parseCheatIndex(args[1:])
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(args[0]) == "del" {
+			return d.Cheats.Remove(index)
+		}
+		return d.Cheats.SetEnabled(index, strings.ToLower(args[0]) == "on")
+	}
+	return fmt.Errorf("Unknown cheat command %q", args[0])
+}
+
+func parseCheatIndex(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("Expected a cheat number")
+	}
+	return ParseNumber(args[0])
+}
+
+// Show recently executed instructions, then the PC and what follows it.
+// With an address, disassemble from there instead.
+func (d *Debugger) list(out io.Writer, args []string) error {
+	pc := d.cpu.Registers().PC
+	if len(args) > 0 {
+		address, err := d.parseAddress(args, 0)
+		if err != nil {
+			return err
+		}
+		count := 2 * LIST_AFTER
+		if len(args) > 1 {
+			count, err = ParseNumber(args[1])
+			if err != nil {
+				return err
+			}
+		}
+		for i := 0; i < count; i++ {
+			disassembly := core.DisassembleAt(d.cpu, address, d.Symbols)
+			fmt.Fprintln(out, "  ", disassembly)
+			address = disassembly.Next()
+		}
+		return nil
+	}
+
+	for _, address := range d.history {
+		if address != pc {
+			fmt.Fprintln(out, "  ", core.DisassembleAt(d.cpu, address, d.Symbols))
+		}
+	}
+	address := pc
+	for i := 0; i < LIST_AFTER; i++ {
+		marker := "  "
+		if address == pc {
+			marker = "=>"
+		}
+		disassembly := core.DisassembleAt(d.cpu, address, d.Symbols)
+		fmt.Fprintln(out, marker, disassembly)
+		address = disassembly.Next()
+	}
+	return nil
+}
+
+// Parse an address argument, which may be a number or a symbol name.
+func (d *Debugger) parseAddress(args []string, index int) (uint16, error) {
+	if len(args) <= index {
+		return 0, fmt.Errorf("Missing address")
+	}
+	for address, name := range d.Symbols {
+		if name == args[index] {
+			return address, nil
+		}
+	}
+	value, err := ParseNumber(args[index])
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value > 0xffff {
+		return 0, fmt.Errorf("Address %s out of range", args[index])
+	}
+	return uint16(value), nil
+}
+
+func parseID(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("Expected a breakpoint or watchpoint ID")
+	}
+	return ParseNumber(args[0])
+}
+
+// Registers and flags on one line, e.g.
+// "PC:8002 A:C0 X:00 Y:00 SP:00 P:80 [N.......]"
+func FormatRegisters(r core.Registers) string {
+	flags := []byte("NV-BDIZC")
+	for i := range flags {
+		if r.Status&(0x80>>i) == 0 {
+			flags[i] = '.'
+		}
+	}
+	return fmt.Sprintf("PC:%04X A:%02X X:%02X Y:%02X SP:%02X P:%02X [%s]", r.PC, r.A, r.X, r.Y, r.SP, r.Status, flags)
+}
+
+// Hex and ASCII dump, 16 bytes per line.
+func DumpMemory(out io.Writer, mem core.MemoryReader, address uint16, length int) {
+	for offset := 0; offset < length; offset += 16 {
+		line_start := address + uint16(offset)
+		var hex, text strings.Builder
+		for i := 0; i < 16 && offset+i < length; i++ {
+			value := mem.ReadMemory(line_start + uint16(i))
+			fmt.Fprintf(&hex, "%02X ", value)
+			if value >= 0x20 && value < 0x7f {
+				text.WriteByte(value)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(out, "%04X  %-48s %s\n", line_start, hex.String(), text.String())
+	}
+}
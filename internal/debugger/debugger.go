@@ -0,0 +1,526 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"pageer/myfinemu/internal/cheat"
+	"pageer/myfinemu/internal/core"
+)
+
+// Number of executed instructions to remember for showing context
+const HISTORY_SIZE = 8
+
+type StopReason int
+
+const (
+	StopStep StopReason = iota
+	StopBreakpoint
+	StopWatchpoint
+	StopHalted
+	StopError
+	StopInterrupted
+)
+
+// Why execution stopped, and what triggered it.
+type Stop struct {
+	Reason     StopReason
+	PC         uint16
+	Breakpoint *Breakpoint
+	Watchpoint *Watchpoint
+	// The access that triggered a read or write watchpoint
+	Access Access
+	Err    error
+}
+
+func (s Stop) String() string {
+	switch s.Reason {
+	case StopBreakpoint:
+		return fmt.Sprintf("Breakpoint %d at $%04X", s.Breakpoint.ID, s.PC)
+	case StopWatchpoint:
+		if s.Watchpoint.Kind == WatchExecute {
+			return fmt.Sprintf("Watchpoint %d: execute $%04X", s.Watchpoint.ID, s.PC)
+		}
+		return fmt.Sprintf("Watchpoint %d: %s", s.Watchpoint.ID, s.Access)
+	case StopHalted:
+		return fmt.Sprintf("CPU halted at $%04X", s.PC)
+	case StopError:
+		return fmt.Sprintf("Error at $%04X: %s", s.PC, s.Err)
+	case StopInterrupted:
+		return fmt.Sprintf("Interrupted at $%04X", s.PC)
+	}
+	return fmt.Sprintf("Stopped at $%04X", s.PC)
+}
+
+type Access struct {
+	Address uint16
+	Value   uint8
+	Write   bool
+}
+
+func (a Access) String() string {
+	if a.Write {
+		return fmt.Sprintf("write $%02X to $%04X", a.Value, a.Address)
+	}
+	return fmt.Sprintf("read $%02X from $%04X", a.Value, a.Address)
+}
+
+type Breakpoint struct {
+	ID        int
+	Address   uint16
+	Condition *Condition
+	Enabled   bool
+}
+
+func (b *Breakpoint) String() string {
+	text := fmt.Sprintf("%d: break $%04X", b.ID, b.Address)
+	if b.Condition != nil {
+		text += " if " + b.Condition.String()
+	}
+	if !b.Enabled {
+		text += " (disabled)"
+	}
+	return text
+}
+
+type WatchKind int
+
+const (
+	WatchRead WatchKind = 1 << iota
+	WatchWrite
+	WatchExecute
+)
+
+func (k WatchKind) String() string {
+	var text string
+	if k&WatchRead > 0 {
+		text += "r"
+	}
+	if k&WatchWrite > 0 {
+		text += "w"
+	}
+	if k&WatchExecute > 0 {
+		text += "x"
+	}
+	return text
+}
+
+type Watchpoint struct {
+	ID      int
+	Start   uint16
+	End     uint16
+	Kind    WatchKind
+	Enabled bool
+}
+
+func (w *Watchpoint) Contains(address uint16) bool {
+	return address >= w.Start && address <= w.End
+}
+
+func (w *Watchpoint) String() string {
+	text := fmt.Sprintf("%d: watch %s $%04X-$%04X", w.ID, w.Kind, w.Start, w.End)
+	if !w.Enabled {
+		text += " (disabled)"
+	}
+	return text
+}
+
+// A subroutine call, tracked from JSR to the matching RTS, or an
+// interrupt handler, tracked to its RTI.
+type Frame struct {
+	// Address of the JSR instruction, or the one the interrupt came before
+	CallSite uint16
+	// Address of the subroutine or handler
+	Entry     uint16
+	Interrupt bool
+}
+
+type Debugger struct {
+	cpu     *core.CPU
+	Symbols core.Symbols
+	// Created on first use if not set up front
+	Cheats      *cheat.Engine
+	breakpoints []*Breakpoint
+	watchpoints []*Watchpoint
+	next_id     int
+	halted      bool
+	// Subroutine calls we're nested inside, for step-over and step-out
+	frames  []Frame
+	history []uint16
+	// The first watchpoint hit during the current instruction
+	hit_watchpoint *Watchpoint
+	hit_access     Access
+	// Set from another goroutine to stop a running Continue
+	interrupted atomic.Bool
+}
+
+func New(c *core.CPU) *Debugger {
+	d := &Debugger{cpu: c, next_id: 1}
+	c.SetAccessHook(d.onAccess)
+	return d
+}
+
+func (d *Debugger) CPU() *core.CPU {
+	return d.cpu
+}
+
+// Addresses of the most recently executed instructions, oldest first.
+func (d *Debugger) History() []uint16 {
+	return d.history
+}
+
+// Number of subroutine calls we're currently nested inside.
+func (d *Debugger) Depth() int {
+	return len(d.frames)
+}
+
+// The subroutine calls we're nested inside, innermost last.  This is
+// reconstructed by watching JSR and RTS, so code that manipulates the
+// stack directly can confuse it.
+func (d *Debugger) CallStack() []Frame {
+	return d.frames
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+func (d *Debugger) Watchpoints() []*Watchpoint {
+	return d.watchpoints
+}
+
+// Add a breakpoint at an address.  The condition may be empty, otherwise
+// it's parsed with ParseCondition.
+func (d *Debugger) AddBreakpoint(address uint16, condition string) (*Breakpoint, error) {
+	b := &Breakpoint{ID: d.next_id, Address: address, Enabled: true}
+	if strings.TrimSpace(condition) != "" {
+		parsed, err := ParseCondition(condition)
+		if err != nil {
+			return nil, err
+		}
+		b.Condition = parsed
+	}
+	d.next_id++
+	d.breakpoints = append(d.breakpoints, b)
+	return b, nil
+}
+
+func (d *Debugger) AddWatchpoint(start uint16, end uint16, kind WatchKind) (*Watchpoint, error) {
+	if end < start {
+		return nil, errors.New("Watchpoint range ends before it starts")
+	}
+	if kind == 0 {
+		return nil, errors.New("Watchpoint must watch reads, writes or execution")
+	}
+	w := &Watchpoint{ID: d.next_id, Start: start, End: end, Kind: kind, Enabled: true}
+	d.next_id++
+	d.watchpoints = append(d.watchpoints, w)
+	return w, nil
+}
+
+// Remove a breakpoint or watchpoint by ID.
+func (d *Debugger) Delete(id int) error {
+	for i, b := range d.breakpoints {
+		if b.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	for i, w := range d.watchpoints {
+		if w.ID == id {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No breakpoint or watchpoint %d", id)
+}
+
+// Enable or disable a breakpoint or watchpoint by ID.
+func (d *Debugger) SetEnabled(id int, enabled bool) error {
+	for _, b := range d.breakpoints {
+		if b.ID == id {
+			b.Enabled = enabled
+			return nil
+		}
+	}
+	for _, w := range d.watchpoints {
+		if w.ID == id {
+			w.Enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("No breakpoint or watchpoint %d", id)
+}
+
+// Ask a running Continue, RunTo, StepOver or StepOut to stop.  This is
+// safe to call from another goroutine.
+func (d *Debugger) Interrupt() {
+	d.interrupted.Store(true)
+}
+
+// Drop an interrupt that arrived after the run it was meant for had
+// already stopped.
+func (d *Debugger) ClearInterrupt() {
+	d.interrupted.Store(false)
+}
+
+// Execute a single instruction, or enter the handler of a pending
+// interrupt, ignoring breakpoints.
+func (d *Debugger) Step() Stop {
+	if d.halted {
+		return d.stop(StopHalted)
+	}
+
+	before := d.cpu.Registers()
+	pc := before.PC
+	instruction, _ := d.cpu.Variant().LookupOpcode(d.cpu.ReadMemory(pc))
+	d.hit_watchpoint = nil
+
+	running, err := d.cpu.Step()
+
+	// A pending interrupt runs instead of the instruction.  Entering the
+	// handler is the only thing that pushes three bytes.
+	after := d.cpu.Registers()
+	if before.SP-after.SP == 3 {
+		d.frames = append(d.frames, Frame{CallSite: pc, Entry: after.PC, Interrupt: true})
+	} else {
+		d.history = append(d.history, pc)
+		if len(d.history) > HISTORY_SIZE {
+			d.history = d.history[1:]
+		}
+		switch instruction.Name() {
+		case "JSR":
+			d.frames = append(d.frames, Frame{CallSite: pc, Entry: after.PC})
+		case "RTS", "RTI":
+			if len(d.frames) > 0 {
+				d.frames = d.frames[:len(d.frames)-1]
+			}
+		}
+	}
+
+	if err != nil {
+		d.halted = true
+		stop := d.stop(StopError)
+		stop.Err = err
+		return stop
+	}
+	if !running {
+		d.halted = true
+		return d.stop(StopHalted)
+	}
+	if d.hit_watchpoint != nil {
+		stop := d.stop(StopWatchpoint)
+		stop.Watchpoint = d.hit_watchpoint
+		stop.Access = d.hit_access
+		return stop
+	}
+	return d.stop(StopStep)
+}
+
+// Run until a breakpoint, watchpoint or halt.
+func (d *Debugger) Continue() Stop {
+	return d.runUntil(func() bool { return false })
+}
+
+// Run until the PC reaches the given address.
+func (d *Debugger) RunTo(address uint16) Stop {
+	return d.runUntil(func() bool { return d.cpu.Registers().PC == address })
+}
+
+// Step one instruction, but run a JSR through to its return.
+func (d *Debugger) StepOver() Stop {
+	pc := d.cpu.Registers().PC
+	instruction, _ := d.cpu.Variant().LookupOpcode(d.cpu.ReadMemory(pc))
+	if instruction.Name() != "JSR" {
+		return d.Step()
+	}
+	depth := len(d.frames)
+	return d.runUntil(func() bool { return len(d.frames) <= depth })
+}
+
+// Run until the current subroutine returns.
+func (d *Debugger) StepOut() Stop {
+	if len(d.frames) == 0 {
+		return d.Continue()
+	}
+	depth := len(d.frames)
+	return d.runUntil(func() bool { return len(d.frames) < depth })
+}
+
+// Step until done() is true after an instruction, or something else stops us.
+// The first instruction always runs, so we don't stop on the breakpoint
+// we're already sitting on.
+func (d *Debugger) runUntil(done func() bool) Stop {
+	first := true
+	for {
+		if d.interrupted.Swap(false) {
+			return d.stop(StopInterrupted)
+		}
+		if !first {
+			if stop, ok := d.checkBreakpoints(); ok {
+				return stop
+			}
+		}
+		first = false
+
+		stop := d.Step()
+		if stop.Reason != StopStep {
+			return stop
+		}
+		if done() {
+			return stop
+		}
+	}
+}
+
+// Check whether we should stop before executing the instruction at PC.
+func (d *Debugger) checkBreakpoints() (Stop, bool) {
+	registers := d.cpu.Registers()
+	for _, b := range d.breakpoints {
+		if b.Enabled && b.Address == registers.PC && (b.Condition == nil || b.Condition.Matches(registers)) {
+			stop := d.stop(StopBreakpoint)
+			stop.Breakpoint = b
+			return stop, true
+		}
+	}
+	for _, w := range d.watchpoints {
+		if w.Enabled && w.Kind&WatchExecute > 0 && w.Contains(registers.PC) {
+			stop := d.stop(StopWatchpoint)
+			stop.Watchpoint = w
+			return stop, true
+		}
+	}
+	return Stop{}, false
+}
+
+func (d *Debugger) onAccess(address uint16, value uint8, write bool) {
+	if d.hit_watchpoint != nil {
+		return
+	}
+	kind := WatchRead
+	if write {
+		kind = WatchWrite
+	}
+	for _, w := range d.watchpoints {
+		if w.Enabled && w.Kind&kind > 0 && w.Contains(address) {
+			d.hit_watchpoint = w
+			d.hit_access = Access{Address: address, Value: value, Write: write}
+			return
+		}
+	}
+}
+
+func (d *Debugger) stop(reason StopReason) Stop {
+	return Stop{Reason: reason, PC: d.cpu.Registers().PC}
+}
+
+// A set of register comparisons that must all be true, e.g. "A == $10 && X > 2"
+type Condition struct {
+	terms []conditionTerm
+	text  string
+}
+
+type conditionTerm struct {
+	register string
+	operator string
+	value    int
+}
+
+var conditionOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func ParseCondition(text string) (*Condition, error) {
+	condition := &Condition{text: strings.TrimSpace(text)}
+	for _, part := range strings.Split(text, "&&") {
+		part = strings.TrimSpace(part)
+		var term conditionTerm
+		for _, operator := range conditionOperators {
+			if index := strings.Index(part, operator); index > 0 {
+				term.register = strings.ToUpper(strings.TrimSpace(part[:index]))
+				term.operator = operator
+				value, err := ParseNumber(strings.TrimSpace(part[index+len(operator):]))
+				if err != nil {
+					return nil, err
+				}
+				term.value = value
+				break
+			}
+		}
+		if term.operator == "" {
+			return nil, fmt.Errorf("Invalid condition %q", part)
+		}
+		if _, ok := registerValue(core.Registers{}, term.register); !ok {
+			return nil, fmt.Errorf("Unknown register %q", term.register)
+		}
+		condition.terms = append(condition.terms, term)
+	}
+	return condition, nil
+}
+
+func (c *Condition) Matches(registers core.Registers) bool {
+	for _, term := range c.terms {
+		value, _ := registerValue(registers, term.register)
+		var result bool
+		switch term.operator {
+		case "==":
+			result = value == term.value
+		case "!=":
+			result = value != term.value
+		case "<=":
+			result = value <= term.value
+		case ">=":
+			result = value >= term.value
+		case "<":
+			result = value < term.value
+		case ">":
+			result = value > term.value
+		}
+		if !result {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Condition) String() string {
+	return c.text
+}
+
+func registerValue(registers core.Registers, name string) (int, bool) {
+	switch name {
+	case "A":
+		return int(registers.A), true
+	case "X":
+		return int(registers.X), true
+	case "Y":
+		return int(registers.Y), true
+	case "SP", "S":
+		return int(registers.SP), true
+	case "P", "STATUS":
+		return int(registers.Status), true
+	case "PC":
+		return int(registers.PC), true
+	}
+	return 0, false
+}
+
+// Parse $hex, 0xhex, %binary or decimal.
+func ParseNumber(text string) (int, error) {
+	base := 10
+	digits := text
+	switch {
+	case strings.HasPrefix(text, "$"):
+		base, digits = 16, text[1:]
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+		base, digits = 16, text[2:]
+	case strings.HasPrefix(text, "%"):
+		base, digits = 2, text[1:]
+	}
+	value, err := strconv.ParseInt(digits, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number %q", text)
+	}
+	return int(value), nil
+}
@@ -0,0 +1,312 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+)
+
+func newDebugger(t *testing.T, source string) (*Debugger, *asm.Program) {
+	program, err := asm.Assemble(source)
+	assert.Nil(t, err)
+
+	c := core.NewCPU()
+	c.LoadAndReset(program.Bytes)
+	d := New(c)
+	d.Symbols = program.Symbols()
+	return d, program
+}
+
+const countdown = `
+	LDX #3
+loop:	INC $0200
+	DEX
+	BNE loop
+done:	BRK
+`
+
+func TestStep(t *testing.T) {
+	d, _ := newDebugger(t, countdown)
+
+	stop := d.Step()
+
+	assert.Equal(t, StopStep, stop.Reason)
+	assert.Equal(t, uint16(0x8002), stop.PC)
+	assert.Equal(t, uint8(3), d.CPU().Registers().X)
+	assert.Equal(t, []uint16{0x8000}, d.History())
+}
+
+func TestContinue_Halts(t *testing.T) {
+	d, program := newDebugger(t, countdown)
+
+	stop := d.Continue()
+
+	assert.Equal(t, StopHalted, stop.Reason)
+	assert.Equal(t, program.Labels["done"]+1, stop.PC)
+	assert.Equal(t, StopHalted, d.Step().Reason)
+}
+
+func TestContinue_Breakpoint(t *testing.T) {
+	d, program := newDebugger(t, countdown)
+	b, err := d.AddBreakpoint(program.Labels["loop"], "")
+	assert.Nil(t, err)
+
+	stop := d.Continue()
+	assert.Equal(t, StopBreakpoint, stop.Reason)
+	assert.Equal(t, b, stop.Breakpoint)
+	assert.Equal(t, uint8(0), d.CPU().ReadMemory(0x0200))
+
+	// Continuing from a breakpoint moves past it
+	stop = d.Continue()
+	assert.Equal(t, StopBreakpoint, stop.Reason)
+	assert.Equal(t, uint8(1), d.CPU().ReadMemory(0x0200))
+}
+
+func TestContinue_ConditionalBreakpoint(t *testing.T) {
+	d, program := newDebugger(t, countdown)
+	_, err := d.AddBreakpoint(program.Labels["loop"], "X == 1 && A == 0")
+	assert.Nil(t, err)
+
+	stop := d.Continue()
+
+	assert.Equal(t, StopBreakpoint, stop.Reason)
+	assert.Equal(t, uint8(1), d.CPU().Registers().X)
+	assert.Equal(t, uint8(2), d.CPU().ReadMemory(0x0200))
+}
+
+func TestContinue_DisabledBreakpoint(t *testing.T) {
+	d, program := newDebugger(t, countdown)
+	b, _ := d.AddBreakpoint(program.Labels["loop"], "")
+	d.SetEnabled(b.ID, false)
+
+	assert.Equal(t, StopHalted, d.Continue().Reason)
+}
+
+func TestWatchpoints(t *testing.T) {
+	testCases := []struct {
+		name     string
+		kind     WatchKind
+		start    uint16
+		end      uint16
+		expected Access
+	}{
+		{"Read", WatchRead, 0x0200, 0x0200, Access{Address: 0x0200, Value: 0x00}},
+		{"Write", WatchWrite, 0x01ff, 0x0201, Access{Address: 0x0200, Value: 0x01, Write: true}},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			d, _ := newDebugger(t, countdown)
+			w, err := d.AddWatchpoint(test.start, test.end, test.kind)
+			assert.Nil(t, err)
+
+			stop := d.Continue()
+
+			assert.Equal(t, StopWatchpoint, stop.Reason)
+			assert.Equal(t, w, stop.Watchpoint)
+			assert.Equal(t, test.expected, stop.Access)
+			assert.Equal(t, uint16(0x8005), stop.PC)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestWatchpoint_Pointer(t *testing.T) {
+	testCases := []struct {
+		name        string
+		source      string
+		expected_pc uint16
+	}{
+		{"Indirect Y", "LDA ($10),Y\nBRK", 0x8002},
+		{"Indirect X", "LDA ($10,X)\nBRK", 0x8002},
+		{"Indirect jump", "JMP ($0010)\nBRK", 0x8003},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			d, _ := newDebugger(t, test.source)
+			d.CPU().WriteMemory(0x0010, 0x03)
+			d.CPU().WriteMemory(0x0011, 0x80)
+			w, _ := d.AddWatchpoint(0x0010, 0x0011, WatchRead)
+
+			stop := d.Continue()
+
+			assert.Equal(t, StopWatchpoint, stop.Reason)
+			assert.Equal(t, w, stop.Watchpoint)
+			assert.Equal(t, Access{Address: 0x0010, Value: 0x03}, stop.Access)
+			assert.Equal(t, test.expected_pc, stop.PC)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestWatchpoint_Execute(t *testing.T) {
+	d, program := newDebugger(t, countdown)
+	d.AddWatchpoint(program.Labels["done"], program.Labels["done"], WatchExecute)
+
+	stop := d.Continue()
+
+	assert.Equal(t, StopWatchpoint, stop.Reason)
+	assert.Equal(t, program.Labels["done"], stop.PC)
+}
+
+func TestRunTo(t *testing.T) {
+	d, program := newDebugger(t, countdown)
+
+	stop := d.RunTo(program.Labels["done"])
+
+	assert.Equal(t, StopStep, stop.Reason)
+	assert.Equal(t, program.Labels["done"], stop.PC)
+	assert.Equal(t, uint8(3), d.CPU().ReadMemory(0x0200))
+}
+
+func TestStepOver_NotACall(t *testing.T) {
+	d, _ := newDebugger(t, countdown)
+
+	stop := d.StepOver()
+
+	assert.Equal(t, uint16(0x8002), stop.PC)
+}
+
+const call = `
+	JSR sub
+	NOP
+	BRK
+sub:	LDA #1
+	RTS
+`
+
+func TestStepOver_Call(t *testing.T) {
+	d, program := newDebugger(t, call)
+
+	stop := d.StepOver()
+
+	assert.Equal(t, StopStep, stop.Reason)
+	assert.Equal(t, uint16(0x8003), stop.PC)
+	assert.Equal(t, uint8(1), d.CPU().Registers().A)
+	assert.Equal(t, 0, d.Depth())
+	assert.Equal(t, []uint16{0x8000, program.Labels["sub"], program.Labels["sub"] + 2}, d.History())
+}
+
+func TestStepOut(t *testing.T) {
+	d, program := newDebugger(t, call)
+	d.Step()
+	assert.Equal(t, []Frame{{CallSite: 0x8000, Entry: program.Labels["sub"]}}, d.CallStack())
+
+	stop := d.StepOut()
+
+	assert.Equal(t, StopStep, stop.Reason)
+	assert.Equal(t, uint16(0x8003), stop.PC)
+	assert.Equal(t, 0, d.Depth())
+}
+
+func TestStep_Interrupt(t *testing.T) {
+	d, program := newDebugger(t, `
+		JSR sub
+		BRK
+	sub:	RTS
+	nmi:	LDA #1
+		RTI
+	`)
+	nmi := program.Labels["nmi"]
+	d.CPU().WriteMemory(core.NMI_VECTOR, uint8(nmi))
+	d.CPU().WriteMemory(core.NMI_VECTOR+1, uint8(nmi>>8))
+	d.CPU().TriggerNMI()
+
+	stop := d.Step()
+
+	// The handler runs before the JSR, which isn't pushed
+	assert.Equal(t, nmi, stop.PC)
+	assert.Equal(t, []Frame{{CallSite: 0x8000, Entry: nmi, Interrupt: true}}, d.CallStack())
+	assert.Empty(t, d.History())
+
+	stop = d.StepOut()
+
+	assert.Equal(t, uint16(0x8000), stop.PC)
+	assert.Equal(t, 0, d.Depth())
+
+	d.Step()
+
+	assert.Equal(t, []Frame{{CallSite: 0x8000, Entry: program.Labels["sub"]}}, d.CallStack())
+}
+
+func TestDelete(t *testing.T) {
+	d, _ := newDebugger(t, countdown)
+	b, _ := d.AddBreakpoint(0x8002, "")
+	w, _ := d.AddWatchpoint(0x0200, 0x0200, WatchWrite)
+
+	assert.Nil(t, d.Delete(b.ID))
+	assert.Nil(t, d.Delete(w.ID))
+	assert.NotNil(t, d.Delete(b.ID))
+	assert.Empty(t, d.Breakpoints())
+	assert.Empty(t, d.Watchpoints())
+}
+
+func TestParseCondition_Invalid(t *testing.T) {
+	for _, text := range []string{"A", "Q == 1", "A == zz", "A == 1 && "} {
+		_, err := ParseCondition(text)
+		assert.NotNil(t, err, text)
+	}
+}
+
+func TestRepl(t *testing.T) {
+	d, _ := newDebugger(t, countdown)
+	input := strings.Join([]string{
+		"break loop if X == 2",
+		"watch w $0300",
+		"info",
+		"continue",
+		"regs",
+		"",
+		"mem $0200 4",
+		"set A $42",
+		"poke $0300 7",
+		"list loop 2",
+		"bogus",
+		"quit",
+		"step",
+	}, "\n")
+	var out bytes.Buffer
+
+	d.Repl(strings.NewReader(input), &out)
+
+	text := out.String()
+	assert.Contains(t, text, "1: break $8002 if X == 2")
+	assert.Contains(t, text, "2: watch w $0300-$0300")
+	assert.Contains(t, text, "Breakpoint 1 at $8002")
+	assert.Contains(t, text, "PC:8002 A:00 X:02 Y:00 SP:FD P:04 [.....I..]")
+	assert.Contains(t, text, "0200  01 00 00 00")
+	assert.Contains(t, text, "8002  EE 00 02  INC $0200")
+	assert.Contains(t, text, "Unknown command \"bogus\"")
+	assert.Equal(t, uint8(0x42), d.CPU().Registers().A)
+	assert.Equal(t, uint8(7), d.CPU().ReadMemory(0x0300))
+	// Shown after "continue", by "regs", and again for the blank line
+	assert.Equal(t, 3, strings.Count(text, "PC:8002 A:00 X:02"))
+}
+
+func TestRepl_Cheat(t *testing.T) {
+	d, _ := newDebugger(t, countdown)
+	input := strings.Join([]string{
+		// LDX #$03 becomes LDX #$01
+		"cheat add 8001:01 One pass",
+		"cheat add AAAAAA",
+		"cheat off 1",
+		"cheat",
+		"cheat on 5",
+		"continue",
+	}, "\n")
+	var out bytes.Buffer
+
+	d.Repl(strings.NewReader(input), &out)
+
+	text := out.String()
+	assert.Contains(t, text, "0: 8001:01: $8001 = $01 One pass\n")
+	assert.Contains(t, text, "1: AAAAAA: $8000 = $00 (disabled)\n")
+	assert.Contains(t, text, "No cheat 5")
+	assert.Equal(t, uint8(1), d.CPU().ReadMemory(0x0200))
+}
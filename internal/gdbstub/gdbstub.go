@@ -0,0 +1,618 @@
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/debugger"
+)
+
+// Largest packet we'll accept, advertised to the client in qSupported
+const PACKET_SIZE = 0x1000
+
+// Register numbers, in the order they appear in a "g" reply.  The 8-bit
+// registers come first, then the little-endian 16-bit PC.
+const (
+	REG_A = iota
+	REG_X
+	REG_Y
+	REG_P
+	REG_SP
+	REG_PC
+	REGISTER_COUNT
+)
+
+// Describes the register layout to the client, served via qXfer.
+const TARGET_XML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.myfinemu.6502.core">
+    <reg name="a" bitsize="8" regnum="0" type="uint8"/>
+    <reg name="x" bitsize="8" regnum="1" type="uint8"/>
+    <reg name="y" bitsize="8" regnum="2" type="uint8"/>
+    <reg name="p" bitsize="8" regnum="3" type="uint8"/>
+    <reg name="sp" bitsize="8" regnum="4" type="uint8"/>
+    <reg name="pc" bitsize="16" regnum="5" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+// Signal numbers used in stop replies
+const (
+	SIGINT  = 2
+	SIGILL  = 4
+	SIGTRAP = 5
+)
+
+// Listen on a TCP address, e.g. "localhost:1234", and serve debugger
+// sessions one at a time until the listener fails.
+func ListenAndServe(address string, d *debugger.Debugger) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return Serve(listener, d)
+}
+
+func Serve(listener net.Listener, d *debugger.Debugger) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		err = NewSession(conn, d).Run()
+		conn.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+}
+
+// Breakpoints and watchpoints are keyed by the Z packet that created them.
+type pointKey struct {
+	kind    string
+	address uint16
+	length  int
+}
+
+type Session struct {
+	conn     io.ReadWriter
+	d        *debugger.Debugger
+	packets  chan string
+	done     chan struct{}
+	read_err error
+	// Protects writes, since the reader goroutine sends acks
+	write_lock sync.Mutex
+	no_ack     atomic.Bool
+	// Whether a step or continue is under way, so an interrupt has
+	// something to stop.  Set by the reader, cleared by Run.
+	run_lock sync.Mutex
+	running  bool
+	points   map[pointKey]int
+	detached bool
+}
+
+func NewSession(conn io.ReadWriter, d *debugger.Debugger) *Session {
+	return &Session{
+		conn:    conn,
+		d:       d,
+		packets: make(chan string),
+		done:    make(chan struct{}),
+		points:  map[pointKey]int{},
+	}
+}
+
+// Handle packets until the client detaches, kills or disconnects.
+// The connection should be closed afterwards to stop the reader.
+func (s *Session) Run() error {
+	defer close(s.done)
+	go s.readPackets()
+
+	for packet := range s.packets {
+		// Kill doesn't get a reply
+		if packet == "k" {
+			return nil
+		}
+		reply := s.handle(packet)
+		if resumes(packet) {
+			s.stopped()
+		}
+		err := s.sendPacket(reply)
+		if err != nil {
+			return err
+		}
+		if s.detached {
+			return nil
+		}
+	}
+	return s.read_err
+}
+
+// Split the byte stream into packets.  A bare 0x03 is an interrupt
+// request, which has to be seen while the CPU is running.
+func (s *Session) readPackets() {
+	defer close(s.packets)
+	reader := bufio.NewReader(s.conn)
+	for {
+		char, err := reader.ReadByte()
+		if err != nil {
+			s.read_err = err
+			return
+		}
+
+		switch char {
+		case 0x03:
+			s.interrupt()
+			continue
+		case '$':
+		default:
+			// Acks for our own packets, and noise
+			continue
+		}
+
+		body, err := reader.ReadString('#')
+		if err != nil {
+			s.read_err = err
+			return
+		}
+		body = body[:len(body)-1]
+		checksum := make([]byte, 2)
+		_, err = io.ReadFull(reader, checksum)
+		if err != nil {
+			s.read_err = err
+			return
+		}
+
+		expected, err := strconv.ParseUint(string(checksum), 16, 8)
+		if err != nil || uint8(expected) != packetChecksum(body) {
+			s.write([]byte("-"))
+			continue
+		}
+		if !s.no_ack.Load() {
+			s.write([]byte("+"))
+		}
+		packet := unescape(body)
+		if resumes(packet) {
+			// Before reading on, so an interrupt right behind the
+			// packet isn't dropped
+			s.setRunning(true)
+		}
+		select {
+		case s.packets <- packet:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Step and continue run the target until it stops.
+func resumes(packet string) bool {
+	return packet != "" && (packet[0] == 's' || packet[0] == 'c')
+}
+
+func (s *Session) setRunning(running bool) {
+	s.run_lock.Lock()
+	defer s.run_lock.Unlock()
+	s.running = running
+}
+
+// Interrupts while the target is stopped are ignored, since there's
+// nothing to stop and they'd otherwise end the next continue at once.
+func (s *Session) interrupt() {
+	s.run_lock.Lock()
+	defer s.run_lock.Unlock()
+	if s.running {
+		s.d.Interrupt()
+	}
+}
+
+// Called once the target has stopped.  An interrupt that raced with the
+// stop is answered by the stop reply, so it mustn't carry over.
+func (s *Session) stopped() {
+	s.run_lock.Lock()
+	defer s.run_lock.Unlock()
+	s.running = false
+	s.d.ClearInterrupt()
+}
+
+func (s *Session) sendPacket(body string) error {
+	escaped := escape(body)
+	return s.write([]byte(fmt.Sprintf("$%s#%02x", escaped, packetChecksum(escaped))))
+}
+
+func (s *Session) write(data []byte) error {
+	s.write_lock.Lock()
+	defer s.write_lock.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+// Handle one packet and produce the reply.  An empty reply tells the
+// client the packet isn't supported.
+func (s *Session) handle(packet string) string {
+	if packet == "" {
+		return ""
+	}
+
+	switch packet[0] {
+	case '?':
+		return "S05"
+	case 'g':
+		return s.readRegisters()
+	case 'G':
+		return s.writeRegisters(packet[1:])
+	case 'p':
+		return s.readRegister(packet[1:])
+	case 'P':
+		return s.writeRegister(packet[1:])
+	case 'm':
+		return s.readMemory(packet[1:])
+	case 'M':
+		return s.writeMemory(packet[1:])
+	case 's':
+		if !s.resumeAt(packet[1:]) {
+			return "E01"
+		}
+		return stopReply(s.d.Step())
+	case 'c':
+		if !s.resumeAt(packet[1:]) {
+			return "E01"
+		}
+		return stopReply(s.d.Continue())
+	case 'Z':
+		return s.insertPoint(packet[1:])
+	case 'z':
+		return s.removePoint(packet[1:])
+	case 'H', 'T':
+		// Single thread, so thread selection always succeeds
+		return "OK"
+	case 'D':
+		s.detached = true
+		return "OK"
+	case 'q', 'Q':
+		return s.handleQuery(packet)
+	}
+	return ""
+}
+
+func (s *Session) handleQuery(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;QStartNoAckMode+;qXfer:features:read+;swbreak+;hwbreak+", PACKET_SIZE)
+	case packet == "QStartNoAckMode":
+		s.no_ack.Store(true)
+		return "OK"
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		return readChunk(TARGET_XML, strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"))
+	}
+	return ""
+}
+
+func (s *Session) readRegisters() string {
+	var text strings.Builder
+	for i := 0; i < REGISTER_COUNT; i++ {
+		text.WriteString(encodeRegister(s.d.CPU().Registers(), i))
+	}
+	return text.String()
+}
+
+func (s *Session) writeRegisters(data string) string {
+	values, err := hex.DecodeString(data)
+	if err != nil || len(values) != REGISTER_COUNT+1 {
+		return "E01"
+	}
+	s.d.CPU().SetRegisters(core.Registers{
+		A:      values[REG_A],
+		X:      values[REG_X],
+		Y:      values[REG_Y],
+		Status: values[REG_P],
+		SP:     values[REG_SP],
+		PC:     uint16(values[REG_PC+1])<<8 | uint16(values[REG_PC]),
+	})
+	return "OK"
+}
+
+func (s *Session) readRegister(data string) string {
+	number, err := strconv.ParseUint(data, 16, 8)
+	if err != nil || number >= REGISTER_COUNT {
+		return "E01"
+	}
+	return encodeRegister(s.d.CPU().Registers(), int(number))
+}
+
+func (s *Session) writeRegister(data string) string {
+	parts := strings.SplitN(data, "=", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+	number, err := strconv.ParseUint(parts[0], 16, 8)
+	if err != nil || number >= REGISTER_COUNT {
+		return "E01"
+	}
+	values, err := hex.DecodeString(parts[1])
+	if err != nil || len(values) == 0 {
+		return "E01"
+	}
+
+	registers := s.d.CPU().Registers()
+	switch number {
+	case REG_A:
+		registers.A = values[0]
+	case REG_X:
+		registers.X = values[0]
+	case REG_Y:
+		registers.Y = values[0]
+	case REG_P:
+		registers.Status = values[0]
+	case REG_SP:
+		registers.SP = values[0]
+	case REG_PC:
+		if len(values) < 2 {
+			return "E01"
+		}
+		registers.PC = uint16(values[1])<<8 | uint16(values[0])
+	}
+	s.d.CPU().SetRegisters(registers)
+	return "OK"
+}
+
+func (s *Session) readMemory(data string) string {
+	address, length, ok := parseAddressLength(data)
+	if !ok {
+		return "E01"
+	}
+	values := make([]byte, length)
+	for i := range values {
+		values[i] = s.d.CPU().ReadMemory(address + uint16(i))
+	}
+	return hex.EncodeToString(values)
+}
+
+func (s *Session) writeMemory(data string) string {
+	parts := strings.SplitN(data, ":", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+	address, length, ok := parseAddressLength(parts[0])
+	if !ok {
+		return "E01"
+	}
+	values, err := hex.DecodeString(parts[1])
+	if err != nil || len(values) != length {
+		return "E01"
+	}
+	for i, value := range values {
+		s.d.CPU().WriteMemory(address+uint16(i), value)
+	}
+	return "OK"
+}
+
+// Handle the optional resume address on s and c packets.
+func (s *Session) resumeAt(data string) bool {
+	if data == "" {
+		return true
+	}
+	address, err := strconv.ParseUint(data, 16, 16)
+	if err != nil {
+		return false
+	}
+	registers := s.d.CPU().Registers()
+	registers.PC = uint16(address)
+	s.d.CPU().SetRegisters(registers)
+	return true
+}
+
+// Z packets: 0 software breakpoint, 1 hardware breakpoint, 2 write
+// watchpoint, 3 read watchpoint, 4 access watchpoint.
+func (s *Session) insertPoint(data string) string {
+	key, ok := parsePoint(data)
+	if !ok {
+		return "E01"
+	}
+	if _, exists := s.points[key]; exists {
+		return "OK"
+	}
+
+	var id int
+	switch key.kind {
+	case "0", "1":
+		b, err := s.d.AddBreakpoint(key.address, "")
+		if err != nil {
+			return "E01"
+		}
+		id = b.ID
+	case "2", "3", "4":
+		kinds := map[string]debugger.WatchKind{
+			"2": debugger.WatchWrite,
+			"3": debugger.WatchRead,
+			"4": debugger.WatchRead | debugger.WatchWrite,
+		}
+		end := int(key.address) + key.length - 1
+		if key.length < 1 || end > 0xffff {
+			return "E01"
+		}
+		w, err := s.d.AddWatchpoint(key.address, uint16(end), kinds[key.kind])
+		if err != nil {
+			return "E01"
+		}
+		id = w.ID
+	default:
+		return ""
+	}
+	s.points[key] = id
+	return "OK"
+}
+
+func (s *Session) removePoint(data string) string {
+	key, ok := parsePoint(data)
+	if !ok {
+		return "E01"
+	}
+	id, exists := s.points[key]
+	if !exists {
+		return "E01"
+	}
+	delete(s.points, key)
+	if s.d.Delete(id) != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+// Translate a debugger stop into a stop reply packet.
+func stopReply(stop debugger.Stop) string {
+	switch stop.Reason {
+	case debugger.StopHalted:
+		return "W00"
+	case debugger.StopError:
+		return fmt.Sprintf("S%02x", SIGILL)
+	case debugger.StopInterrupted:
+		return fmt.Sprintf("S%02x", SIGINT)
+	case debugger.StopBreakpoint:
+		return fmt.Sprintf("T%02xswbreak:;", SIGTRAP)
+	case debugger.StopWatchpoint:
+		kind := stop.Watchpoint.Kind
+		name := "awatch"
+		switch {
+		case kind == debugger.WatchExecute:
+			return fmt.Sprintf("S%02x", SIGTRAP)
+		case kind == debugger.WatchWrite:
+			name = "watch"
+		case kind == debugger.WatchRead:
+			name = "rwatch"
+		}
+		return fmt.Sprintf("T%02x%s:%04x;", SIGTRAP, name, stop.Access.Address)
+	}
+	return fmt.Sprintf("S%02x", SIGTRAP)
+}
+
+func encodeRegister(registers core.Registers, number int) string {
+	switch number {
+	case REG_A:
+		return fmt.Sprintf("%02x", registers.A)
+	case REG_X:
+		return fmt.Sprintf("%02x", registers.X)
+	case REG_Y:
+		return fmt.Sprintf("%02x", registers.Y)
+	case REG_P:
+		return fmt.Sprintf("%02x", registers.Status)
+	case REG_SP:
+		return fmt.Sprintf("%02x", registers.SP)
+	}
+	return fmt.Sprintf("%02x%02x", registers.PC&0xff, registers.PC>>8)
+}
+
+// Parse "addr,length" as used by m and M packets.
+func parseAddressLength(data string) (uint16, int, bool) {
+	parts := strings.SplitN(data, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	address, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil || length > PACKET_SIZE/2 {
+		return 0, 0, false
+	}
+	return uint16(address), int(length), true
+}
+
+// Parse "type,addr,kind" as used by Z and z packets.
+func parsePoint(data string) (pointKey, bool) {
+	parts := strings.Split(data, ",")
+	if len(parts) < 3 {
+		return pointKey{}, false
+	}
+	address, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return pointKey{}, false
+	}
+	length, err := strconv.ParseUint(parts[2], 16, 16)
+	if err != nil {
+		return pointKey{}, false
+	}
+	key := pointKey{kind: parts[0], address: uint16(address), length: int(length)}
+	// Breakpoint kinds describe the instruction size, not a range
+	if key.kind == "0" || key.kind == "1" {
+		key.length = 0
+	}
+	return key, true
+}
+
+// Answer a qXfer read of "offset,length" from document.
+func readChunk(document string, data string) string {
+	parts := strings.SplitN(data, ",", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+	offset, err1 := strconv.ParseUint(parts[0], 16, 32)
+	length, err2 := strconv.ParseUint(parts[1], 16, 32)
+	if err1 != nil || err2 != nil {
+		return "E01"
+	}
+	if offset >= uint64(len(document)) {
+		return "l"
+	}
+	end := offset + length
+	if end >= uint64(len(document)) {
+		return "l" + document[offset:]
+	}
+	return "m" + document[offset:end]
+}
+
+func packetChecksum(body string) uint8 {
+	var sum uint8
+	for i := 0; i < len(body); i++ {
+		sum += body[i]
+	}
+	return sum
+}
+
+// Binary data in packets escapes $, #, } and * as } followed by the
+// character XOR 0x20.
+func escape(body string) string {
+	var text strings.Builder
+	for i := 0; i < len(body); i++ {
+		switch body[i] {
+		case '$', '#', '}', '*':
+			text.WriteByte('}')
+			text.WriteByte(body[i] ^ 0x20)
+		default:
+			text.WriteByte(body[i])
+		}
+	}
+	return text.String()
+}
+
+func unescape(body string) string {
+	var text strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] == '}' && i+1 < len(body) {
+			i++
+			text.WriteByte(body[i] ^ 0x20)
+			continue
+		}
+		text.WriteByte(body[i])
+	}
+	return text.String()
+}
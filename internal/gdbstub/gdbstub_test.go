@@ -0,0 +1,225 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/debugger"
+)
+
+// A minimal GDB client that talks to the stub over loopback.
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	no_ack bool
+}
+
+func startServer(t *testing.T, source string) (*client, *debugger.Debugger, *asm.Program) {
+	program, err := asm.Assemble(source)
+	assert.Nil(t, err)
+	c := core.NewCPU()
+	c.LoadAndReset(program.Bytes)
+	d := debugger.New(c)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go Serve(listener, d)
+	t.Cleanup(func() { listener.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return &client{t: t, conn: conn, reader: bufio.NewReader(conn)}, d, program
+}
+
+// Send a packet and return the reply body.
+func (c *client) request(body string) string {
+	fmt.Fprintf(c.conn, "$%s#%02x", body, packetChecksum(body))
+	if !c.no_ack {
+		ack, err := c.reader.ReadByte()
+		assert.Nil(c.t, err)
+		assert.Equal(c.t, byte('+'), ack, "Packet %q not acknowledged", body)
+	}
+	return c.readPacket()
+}
+
+func (c *client) readPacket() string {
+	_, err := c.reader.ReadString('$')
+	assert.Nil(c.t, err)
+	body, err := c.reader.ReadString('#')
+	assert.Nil(c.t, err)
+	body = body[:len(body)-1]
+	checksum := make([]byte, 2)
+	_, err = c.reader.Read(checksum)
+	assert.Nil(c.t, err)
+	assert.Equal(c.t, fmt.Sprintf("%02x", packetChecksum(body)), string(checksum))
+	if !c.no_ack {
+		c.conn.Write([]byte("+"))
+	}
+	return unescape(body)
+}
+
+const countdown = `
+	LDX #3
+loop:	INC $0200
+	DEX
+	BNE loop
+	BRK
+`
+
+func TestSession_Handshake(t *testing.T) {
+	c, _, _ := startServer(t, countdown)
+
+	assert.Contains(t, c.request("qSupported:multiprocess+;swbreak+"), "qXfer:features:read+")
+	assert.Equal(t, "OK", c.request("QStartNoAckMode"))
+	c.no_ack = true
+	assert.Equal(t, "", c.request("vMustReplyEmpty"))
+	assert.Equal(t, "OK", c.request("Hg0"))
+	assert.Equal(t, "1", c.request("qAttached"))
+	assert.Equal(t, "S05", c.request("?"))
+
+	var xml strings.Builder
+	for offset := 0; ; offset += 0x40 {
+		chunk := c.request(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", offset))
+		xml.WriteString(chunk[1:])
+		if chunk[0] == 'l' {
+			break
+		}
+		assert.Equal(t, byte('m'), chunk[0])
+	}
+	assert.Equal(t, TARGET_XML, xml.String())
+}
+
+func TestSession_Registers(t *testing.T) {
+	c, d, _ := startServer(t, countdown)
+
+	// a, x, y, p, sp, then pc little-endian
+	assert.Equal(t, "00000004fd0080", c.request("g"))
+	assert.Equal(t, "OK", c.request("G0102038004"+"3412"))
+	assert.Equal(t, core.Registers{A: 1, X: 2, Y: 3, Status: 0x80, SP: 4, PC: 0x1234}, d.CPU().Registers())
+	assert.Equal(t, "3412", c.request("p5"))
+	assert.Equal(t, "OK", c.request("P1=7f"))
+	assert.Equal(t, "7f", c.request("p1"))
+	assert.Equal(t, "OK", c.request("P5=0080"))
+	assert.Equal(t, uint16(0x8000), d.CPU().Registers().PC)
+	assert.Equal(t, "E01", c.request("p9"))
+	assert.Equal(t, "E01", c.request("G00"))
+}
+
+func TestSession_Memory(t *testing.T) {
+	c, d, _ := startServer(t, countdown)
+
+	assert.Equal(t, "a203ee", c.request("m8000,3"))
+	assert.Equal(t, "OK", c.request("M0300,2:beef"))
+	assert.Equal(t, uint8(0xbe), d.CPU().ReadMemory(0x0300))
+	assert.Equal(t, uint8(0xef), d.CPU().ReadMemory(0x0301))
+	assert.Equal(t, "E01", c.request("M0300,2:be"))
+	assert.Equal(t, "E01", c.request("mzz,1"))
+}
+
+func TestSession_StepAndContinue(t *testing.T) {
+	c, d, program := startServer(t, countdown)
+
+	assert.Equal(t, "S05", c.request("s"))
+	assert.Equal(t, uint16(0x8002), d.CPU().Registers().PC)
+
+	assert.Equal(t, "OK", c.request(fmt.Sprintf("Z0,%x,1", program.Labels["loop"])))
+	assert.Equal(t, "T05swbreak:;", c.request("c"))
+	assert.Equal(t, uint8(1), d.CPU().ReadMemory(0x0200))
+	assert.Equal(t, "T05swbreak:;", c.request("c"))
+	assert.Equal(t, uint8(2), d.CPU().ReadMemory(0x0200))
+
+	assert.Equal(t, "OK", c.request(fmt.Sprintf("z0,%x,1", program.Labels["loop"])))
+	assert.Equal(t, "E01", c.request(fmt.Sprintf("z0,%x,1", program.Labels["loop"])))
+	assert.Equal(t, "W00", c.request("c"))
+	assert.Equal(t, uint8(3), d.CPU().ReadMemory(0x0200))
+}
+
+func TestSession_StepAtAddress(t *testing.T) {
+	c, d, _ := startServer(t, countdown)
+
+	// Skip the LDX and go straight to the DEX
+	assert.Equal(t, "S05", c.request("s8005"))
+	assert.Equal(t, uint8(0xff), d.CPU().Registers().X)
+	assert.Equal(t, uint16(0x8006), d.CPU().Registers().PC)
+}
+
+func TestSession_Watchpoints(t *testing.T) {
+	testCases := []struct {
+		packet   string
+		expected string
+	}{
+		{"Z2,0200,1", "T05watch:0200;"},
+		{"Z3,01ff,2", "T05rwatch:0200;"},
+		{"Z4,0200,1", "T05awatch:0200;"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c, _, _ := startServer(t, countdown)
+
+			assert.Equal(t, "OK", c.request(test.packet))
+			assert.Equal(t, test.expected, c.request("c"))
+			assert.Equal(t, "OK", c.request("z"+test.packet[1:]))
+		}
+		t.Run(test.packet, callback)
+	}
+}
+
+func TestSession_Interrupt(t *testing.T) {
+	c, d, _ := startServer(t, "loop: JMP loop")
+
+	fmt.Fprintf(c.conn, "$c#%02x", packetChecksum("c"))
+	ack, _ := c.reader.ReadByte()
+	assert.Equal(t, byte('+'), ack)
+	c.conn.Write([]byte{0x03})
+
+	assert.Equal(t, "S02", c.readPacket())
+	assert.Equal(t, uint16(0x8000), d.CPU().Registers().PC)
+}
+
+func TestSession_InterruptWhileStopped(t *testing.T) {
+	c, d, _ := startServer(t, countdown)
+
+	c.conn.Write([]byte{0x03})
+	assert.Equal(t, "S05", c.request("?"))
+
+	// Runs to the end rather than stopping straight away
+	assert.Equal(t, "W00", c.request("c"))
+	assert.Equal(t, uint8(3), d.CPU().ReadMemory(0x0200))
+}
+
+func TestSession_BadChecksum(t *testing.T) {
+	c, _, _ := startServer(t, countdown)
+
+	c.conn.Write([]byte("$g#00"))
+	nak, _ := c.reader.ReadByte()
+
+	assert.Equal(t, byte('-'), nak)
+	assert.Equal(t, "S05", c.request("?"))
+}
+
+func TestSession_Detach(t *testing.T) {
+	c, _, _ := startServer(t, countdown)
+
+	assert.Equal(t, "OK", c.request("D"))
+	_, err := c.reader.ReadByte()
+
+	assert.NotNil(t, err)
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, "a}\x03}\x04}]}\x0ab", escape("a#$}*b"))
+	assert.Equal(t, "a#$}*b", unescape(escape("a#$}*b")))
+}
@@ -0,0 +1,124 @@
+package input
+
+import (
+	"errors"
+)
+
+// Controller port registers.  Writing bit 0 of $4016 strobes both pads,
+// and each port is read a bit at a time.
+const (
+	PORT1_ADDRESS uint16 = 0x4016
+	PORT2_ADDRESS uint16 = 0x4017
+	PORT_COUNT           = 2
+
+	// The upper bits of a port read come from the open bus, which still
+	// holds the high byte of the address
+	OPEN_BUS_BITS uint8 = 0x40
+)
+
+// Standard controller buttons, in the order they're shifted out.
+type Buttons uint8
+
+const (
+	ButtonA Buttons = 1 << iota
+	ButtonB
+	ButtonSelect
+	ButtonStart
+	ButtonUp
+	ButtonDown
+	ButtonLeft
+	ButtonRight
+)
+
+// A standard NES controller, with its 8-bit shift register.
+type Joypad struct {
+	buttons Buttons
+	strobe  bool
+	shift   uint8
+}
+
+// Set which buttons are held.
+func (j *Joypad) Set(buttons Buttons) {
+	j.buttons = buttons
+	if j.strobe {
+		j.shift = uint8(buttons)
+	}
+}
+
+func (j *Joypad) Buttons() Buttons {
+	return j.buttons
+}
+
+// While strobe is high the shift register keeps reloading, so reads
+// return button A.
+func (j *Joypad) Strobe(high bool) {
+	j.strobe = high
+	if high {
+		j.shift = uint8(j.buttons)
+	}
+}
+
+// Read the next button.  After all eight, official pads return 1s.
+func (j *Joypad) Read() uint8 {
+	if j.strobe {
+		return uint8(j.buttons & ButtonA)
+	}
+	bit := j.shift & 1
+	j.shift = j.shift>>1 | 0x80
+	return bit
+}
+
+// Both controller ports, mapped at $4016-$4017.
+type Ports struct {
+	Pads [PORT_COUNT]Joypad
+}
+
+func (p *Ports) ReadRegister(address uint16) uint8 {
+	switch address {
+	case PORT1_ADDRESS:
+		return OPEN_BUS_BITS | p.Pads[0].Read()
+	case PORT2_ADDRESS:
+		return OPEN_BUS_BITS | p.Pads[1].Read()
+	}
+	return OPEN_BUS_BITS
+}
+
+// Only $4016 is ours to write; $4017 belongs to the APU frame counter.
+func (p *Ports) WriteRegister(address uint16, value uint8) {
+	if address == PORT1_ADDRESS {
+		for i := range p.Pads {
+			p.Pads[i].Strobe(value&1 > 0)
+		}
+	}
+}
+
+func (p *Ports) StateID() string {
+	return "PADS"
+}
+
+// Three bytes per pad: buttons, strobe and shift register.
+func (p *Ports) SaveState() ([]byte, error) {
+	var data []byte
+	for _, pad := range p.Pads {
+		strobe := uint8(0)
+		if pad.strobe {
+			strobe = 1
+		}
+		data = append(data, uint8(pad.buttons), strobe, pad.shift)
+	}
+	return data, nil
+}
+
+func (p *Ports) LoadState(data []byte) error {
+	if len(data) != 3*PORT_COUNT {
+		return errors.New("Controller state has the wrong size")
+	}
+	for i := range p.Pads {
+		p.Pads[i] = Joypad{
+			buttons: Buttons(data[3*i]),
+			strobe:  data[3*i+1] != 0,
+			shift:   data[3*i+2],
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package input
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(p *Ports, address uint16, count int) []uint8 {
+	var bits []uint8
+	for i := 0; i < count; i++ {
+		bits = append(bits, p.ReadRegister(address)&1)
+	}
+	return bits
+}
+
+func TestPorts_ShiftOut(t *testing.T) {
+	var p Ports
+	p.Pads[0].Set(ButtonA | ButtonStart | ButtonRight)
+	p.Pads[1].Set(ButtonB)
+
+	p.WriteRegister(PORT1_ADDRESS, 1)
+	p.WriteRegister(PORT1_ADDRESS, 0)
+
+	assert.Equal(t, []uint8{1, 0, 0, 1, 0, 0, 0, 1, 1, 1}, readAll(&p, PORT1_ADDRESS, 10))
+	assert.Equal(t, []uint8{0, 1, 0, 0, 0, 0, 0, 0}, readAll(&p, PORT2_ADDRESS, 8))
+}
+
+func TestPorts_StrobeHeld(t *testing.T) {
+	var p Ports
+	p.WriteRegister(PORT1_ADDRESS, 1)
+	p.Pads[0].Set(ButtonA)
+
+	assert.Equal(t, []uint8{1, 1, 1}, readAll(&p, PORT1_ADDRESS, 3))
+	assert.Equal(t, OPEN_BUS_BITS|1, p.ReadRegister(PORT1_ADDRESS))
+}
+
+func TestPorts_State(t *testing.T) {
+	var p Ports
+	p.Pads[0].Set(ButtonUp | ButtonA)
+	p.WriteRegister(PORT1_ADDRESS, 1)
+	p.WriteRegister(PORT1_ADDRESS, 0)
+	p.ReadRegister(PORT1_ADDRESS)
+
+	data, err := p.SaveState()
+	assert.Nil(t, err)
+	var restored Ports
+	assert.Nil(t, restored.LoadState(data))
+
+	assert.Equal(t, readAll(&p, PORT1_ADDRESS, 8), readAll(&restored, PORT1_ADDRESS, 8))
+	assert.NotNil(t, restored.LoadState(data[:2]))
+}
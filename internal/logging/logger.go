@@ -1,26 +1,180 @@
 package logging
 
 import (
-	"bytes"
 	"fmt"
-	"log"
+	"strings"
+	"sync/atomic"
 )
 
-var logger *log.Logger
-var buffer bytes.Buffer
+type Level int32
 
-func init() {
-	logger = log.New(&buffer, "", 0)
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	// Above every level, so nothing is logged
+	LevelOff
+)
+
+var LEVEL_NAMES = [...]string{"trace", "debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(LEVEL_NAMES) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return LEVEL_NAMES[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, level_name := range LEVEL_NAMES {
+		if strings.EqualFold(name, level_name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q, expected one of %s", name, strings.Join(LEVEL_NAMES[:], ", "))
+}
+
+// The subsystem a message comes from.  Categories are bits, so a set of
+// them can be enabled at once.
+type Category uint32
+
+const (
+	CategoryCPU Category = 1 << iota
+	CategoryPPU
+	CategoryAPU
+	CategoryMapper
+	CategoryBus
+
+	CategoryAll = CategoryCPU | CategoryPPU | CategoryAPU | CategoryMapper | CategoryBus
+)
+
+var CATEGORY_NAMES = map[Category]string{
+	CategoryCPU:    "cpu",
+	CategoryPPU:    "ppu",
+	CategoryAPU:    "apu",
+	CategoryMapper: "mapper",
+	CategoryBus:    "bus",
+}
+
+func (c Category) String() string {
+	if name, ok := CATEGORY_NAMES[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("category(%#x)", uint32(c))
+}
+
+// Parse a comma separated list such as "cpu,bus", or "all".
+func ParseCategories(text string) (Category, error) {
+	var categories Category
+	for _, name := range strings.Split(text, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			categories |= CategoryAll
+			continue
+		}
+		found := false
+		for category, category_name := range CATEGORY_NAMES {
+			if name == category_name {
+				categories |= category
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Unknown log category %q", name)
+		}
+	}
+	return categories, nil
+}
+
+// A single logged message.
+type Entry struct {
+	Level    Level
+	Category Category
+	Message  string
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("[%s] %s: %s", e.Level, e.Category, e.Message)
+}
+
+// Logs messages at or above a level, for enabled categories, to a sink.
+// Safe for use from several goroutines.  A nil *Logger is valid and logs
+// nothing, so components can hold one without checking.
+type Logger struct {
+	sink       Sink
+	level      atomic.Int32
+	categories atomic.Uint32
+}
+
+// A logger for every category at the given level.
+func New(sink Sink, level Level) *Logger {
+	l := &Logger{sink: sink}
+	l.level.Store(int32(level))
+	l.categories.Store(uint32(CategoryAll))
+	return l
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.level.Store(int32(level))
+}
+
+// Log only these categories from now on.
+func (l *Logger) SetCategories(categories Category) {
+	l.categories.Store(uint32(categories))
+}
+
+func (l *Logger) Enable(categories Category) {
+	for {
+		old := l.categories.Load()
+		if l.categories.CompareAndSwap(old, old|uint32(categories)) {
+			return
+		}
+	}
+}
+
+func (l *Logger) Disable(categories Category) {
+	for {
+		old := l.categories.Load()
+		if l.categories.CompareAndSwap(old, old&^uint32(categories)) {
+			return
+		}
+	}
+}
+
+// Whether a message would be logged.  Check this before building
+// anything expensive to log.
+func (l *Logger) Enabled(level Level, category Category) bool {
+	return l != nil && level >= Level(l.level.Load()) && Category(l.categories.Load())&category != 0
+}
+
+func (l *Logger) Logf(level Level, category Category, format string, v ...any) {
+	if !l.Enabled(level, category) {
+		return
+	}
+	l.sink.Write(Entry{level, category, fmt.Sprintf(format, v...)})
+}
+
+func (l *Logger) Tracef(category Category, format string, v ...any) {
+	l.Logf(LevelTrace, category, format, v...)
+}
+
+func (l *Logger) Debugf(category Category, format string, v ...any) {
+	l.Logf(LevelDebug, category, format, v...)
 }
 
-func Clear() {
-	buffer.Truncate(0)
+func (l *Logger) Infof(category Category, format string, v ...any) {
+	l.Logf(LevelInfo, category, format, v...)
 }
 
-func Flush() {
-	fmt.Print(&buffer)
+func (l *Logger) Warnf(category Category, format string, v ...any) {
+	l.Logf(LevelWarn, category, format, v...)
 }
 
-func LogDebug(format string, v ...any) {
-	logger.Printf(format, v...)
+func (l *Logger) Errorf(category Category, format string, v ...any) {
+	l.Logf(LevelError, category, format, v...)
 }
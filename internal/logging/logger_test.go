@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Filtering(t *testing.T) {
+	testCases := []struct {
+		name       string
+		level      Level
+		categories Category
+		expected   []string
+	}{
+		{"everything", LevelTrace, CategoryAll, []string{"cpu trace", "ppu info", "bus warn", "cpu error"}},
+		{"info and above", LevelInfo, CategoryAll, []string{"ppu info", "bus warn", "cpu error"}},
+		{"cpu only", LevelTrace, CategoryCPU, []string{"cpu trace", "cpu error"}},
+		{"off", LevelOff, CategoryAll, []string{}},
+		{"no categories", LevelTrace, 0, []string{}},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			capture := &Capture{}
+			l := New(capture, test.level)
+			l.SetCategories(test.categories)
+
+			l.Tracef(CategoryCPU, "cpu %s", "trace")
+			l.Infof(CategoryPPU, "ppu info")
+			l.Warnf(CategoryBus, "bus warn")
+			l.Errorf(CategoryCPU, "cpu error")
+
+			assert.Equal(t, test.expected, capture.Messages())
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestLogger_EnableDisable(t *testing.T) {
+	capture := &Capture{}
+	l := New(capture, LevelDebug)
+	l.Disable(CategoryAPU | CategoryMapper)
+	assert.False(t, l.Enabled(LevelError, CategoryAPU))
+	assert.True(t, l.Enabled(LevelDebug, CategoryPPU))
+	assert.False(t, l.Enabled(LevelTrace, CategoryPPU))
+
+	l.Enable(CategoryAPU)
+	l.SetLevel(LevelTrace)
+	l.Tracef(CategoryAPU, "apu")
+	l.Tracef(CategoryMapper, "mapper")
+	assert.Equal(t, []Entry{{LevelTrace, CategoryAPU, "apu"}}, capture.Entries())
+}
+
+func TestLogger_Nil(t *testing.T) {
+	var l *Logger
+	assert.False(t, l.Enabled(LevelError, CategoryAll))
+	l.Errorf(CategoryCPU, "nowhere")
+}
+
+func TestLogger_DisabledDoesNotAllocate(t *testing.T) {
+	l := New(&Capture{}, LevelOff)
+	value := 0x1234
+	allocations := testing.AllocsPerRun(100, func() {
+		if l.Enabled(LevelTrace, CategoryCPU) {
+			l.Tracef(CategoryCPU, "PC=$%04X", value)
+		}
+	})
+	assert.Equal(t, 0.0, allocations)
+}
+
+func TestWriterSink(t *testing.T) {
+	var out bytes.Buffer
+	l := New(NewWriterSink(&out), LevelTrace)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				l.Debugf(CategoryMapper, "bank switch")
+			}
+		}()
+	}
+	wait.Wait()
+
+	assert.Equal(t, 400*len("[debug] mapper: bank switch\n"), out.Len())
+}
+
+func TestRingBuffer(t *testing.T) {
+	ring := NewRingBuffer(3)
+	l := New(ring, LevelTrace)
+	assert.Empty(t, ring.Entries())
+
+	for _, message := range []string{"a", "b", "c", "d", "e"} {
+		l.Infof(CategoryCPU, message)
+	}
+
+	var out bytes.Buffer
+	_, err := ring.WriteTo(&out)
+	assert.Nil(t, err)
+	assert.Equal(t, "[info] cpu: c\n[info] cpu: d\n[info] cpu: e\n", out.String())
+}
+
+func TestParse(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = ParseLevel("loud")
+	assert.NotNil(t, err)
+
+	categories, err := ParseCategories("cpu, bus")
+	assert.Nil(t, err)
+	assert.Equal(t, CategoryCPU|CategoryBus, categories)
+	categories, err = ParseCategories("all")
+	assert.Nil(t, err)
+	assert.Equal(t, CategoryAll, categories)
+	_, err = ParseCategories("cpu,gpu")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"io"
+	"sync"
+)
+
+// Where log entries go.  Sinks must be safe for concurrent use.
+type Sink interface {
+	Write(entry Entry)
+}
+
+// Writes each entry as a line of text.
+type WriterSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(entry Entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	io.WriteString(s.w, entry.String()+"\n")
+}
+
+// Keeps the most recent entries, e.g. to dump after a crash without the
+// cost of writing everything out.
+type RingBuffer struct {
+	mutex   sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+func NewRingBuffer(capacity int) *RingBuffer {
+	return &RingBuffer{entries: make([]Entry, capacity)}
+}
+
+func (r *RingBuffer) Write(entry Entry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = entry
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// The kept entries, oldest first.
+func (r *RingBuffer) Entries() []Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.full {
+		return append([]Entry(nil), r.entries[:r.next]...)
+	}
+	return append(append([]Entry(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// Write the kept entries out, oldest first.
+func (r *RingBuffer) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, entry := range r.Entries() {
+		n, err := io.WriteString(w, entry.String()+"\n")
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Collects every entry, for checking what was logged in tests.
+type Capture struct {
+	mutex   sync.Mutex
+	entries []Entry
+}
+
+func (c *Capture) Write(entry Entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = append(c.entries, entry)
+}
+
+func (c *Capture) Entries() []Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Entry(nil), c.entries...)
+}
+
+// Just the messages, in the order they were logged.
+func (c *Capture) Messages() []string {
+	entries := c.Entries()
+	messages := make([]string, len(entries))
+	for i, entry := range entries {
+		messages[i] = entry.Message
+	}
+	return messages
+}
+
+func (c *Capture) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = nil
+}
@@ -0,0 +1,215 @@
+package movie
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/input"
+)
+
+// FM2 is FCEUX's text movie format.  A header of "key value" lines is
+// followed by one line per frame:
+//
+//	|commands|port0|port1|port2|
+//
+// where each gamepad is eight characters for RLDUTSBA, '.' or ' ' when
+// released.  See https://fceux.com/web/help/fm2.html
+//
+// We add ramPattern and ramSeed to the header for Movie's power-on RAM.
+// FCEUX skips keys it doesn't know.
+const (
+	FM2_VERSION = 3
+	// Claim to be FCEUX 2.2.3, which is what most tools expect
+	FM2_EMU_VERSION = 22030
+	FM2_BUTTONS     = "RLDUTSBA"
+	// Port type for a standard gamepad
+	FM2_GAMEPAD = 1
+)
+
+func LoadFM2(path string) (*Movie, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseFM2(file)
+}
+
+func SaveFM2(path string, m *Movie) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = m.WriteFM2(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func ParseFM2(r io.Reader) (*Movie, error) {
+	m := &Movie{}
+	scanner := bufio.NewScanner(r)
+	// Save states can make for long header lines
+	scanner.Buffer(nil, 16*1024*1024)
+	line_number := 0
+	// Standard gamepads unless the header says otherwise
+	ports := [3]int{FM2_GAMEPAD, FM2_GAMEPAD, 0}
+
+	for scanner.Scan() {
+		line_number++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '|' {
+			frame, err := parseFrame(line, ports)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %w", line_number, err)
+			}
+			m.Frames = append(m.Frames, frame)
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "version":
+			var version int
+			version, err = strconv.Atoi(value)
+			if err == nil && version != FM2_VERSION {
+				err = fmt.Errorf("Unsupported FM2 version %d", version)
+			}
+		case "romFilename":
+			m.ROMFilename = value
+		case "romChecksum":
+			m.ROMChecksum = value
+		case "guid":
+			m.GUID = value
+		case "rerecordCount":
+			m.RerecordCount, err = strconv.Atoi(value)
+		case "palFlag":
+			m.PAL = value == "1"
+		case "comment":
+			m.Comments = append(m.Comments, value)
+		case "savestate":
+			m.StartState, err = decodeBinary(value)
+		case "ramPattern":
+			m.RAMPattern, err = core.ParseRAMPattern(value)
+		case "ramSeed":
+			m.RAMSeed, err = strconv.ParseInt(value, 10, 64)
+		case "port0", "port1", "port2":
+			ports[key[4]-'0'], err = strconv.Atoi(value)
+		case "fourscore":
+			if value == "1" {
+				err = fmt.Errorf("Four Score movies aren't supported")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", line_number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseFrame(line string, ports [3]int) (Frame, error) {
+	var frame Frame
+	fields := strings.Split(line, "|")
+	// Leading and trailing bars give empty first and last fields
+	if len(fields) < 3 {
+		return frame, fmt.Errorf("Invalid input line %q", line)
+	}
+	fields = fields[1 : len(fields)-1]
+
+	command, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return frame, fmt.Errorf("Invalid command %q", fields[0])
+	}
+	frame.Command = Command(command)
+
+	for i := 0; i < input.PORT_COUNT && i+1 < len(fields); i++ {
+		if ports[i] != FM2_GAMEPAD {
+			continue
+		}
+		pad := fields[i+1]
+		if len(pad) != len(FM2_BUTTONS) {
+			return frame, fmt.Errorf("Invalid gamepad input %q", pad)
+		}
+		for j, char := range pad {
+			if char != '.' && char != ' ' {
+				// RLDUTSBA is most significant bit first
+				frame.Pads[i] |= 1 << (7 - j)
+			}
+		}
+	}
+	return frame, nil
+}
+
+func (m *Movie) WriteFM2(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	fmt.Fprintf(buffered, "version %d\n", FM2_VERSION)
+	fmt.Fprintf(buffered, "emuVersion %d\n", FM2_EMU_VERSION)
+	fmt.Fprintf(buffered, "rerecordCount %d\n", m.RerecordCount)
+	fmt.Fprintf(buffered, "palFlag %d\n", boolFlag(m.PAL))
+	fmt.Fprintf(buffered, "romFilename %s\n", m.ROMFilename)
+	fmt.Fprintf(buffered, "romChecksum %s\n", m.ROMChecksum)
+	if m.GUID != "" {
+		fmt.Fprintf(buffered, "guid %s\n", m.GUID)
+	}
+	fmt.Fprintf(buffered, "fourscore 0\nmicrophone 0\n")
+	fmt.Fprintf(buffered, "port0 %d\nport1 %d\nport2 0\n", FM2_GAMEPAD, FM2_GAMEPAD)
+	fmt.Fprintf(buffered, "FDS 0\nNewPPU 0\n")
+	fmt.Fprintf(buffered, "ramPattern %s\nramSeed %d\n", m.RAMPattern, m.RAMSeed)
+	for _, comment := range m.Comments {
+		fmt.Fprintf(buffered, "comment %s\n", comment)
+	}
+	if m.StartState != nil {
+		fmt.Fprintf(buffered, "savestate base64:%s\n", base64.StdEncoding.EncodeToString(m.StartState))
+	}
+
+	for _, frame := range m.Frames {
+		fmt.Fprintf(buffered, "|%d|", frame.Command)
+		for _, pad := range frame.Pads {
+			for j := range FM2_BUTTONS {
+				if pad&(1<<(7-j)) > 0 {
+					buffered.WriteByte(FM2_BUTTONS[j])
+				} else {
+					buffered.WriteByte('.')
+				}
+			}
+			buffered.WriteByte('|')
+		}
+		buffered.WriteString("|\n")
+	}
+	return buffered.Flush()
+}
+
+// FM2 binary values are either "base64:..." or "0x" followed by hex.
+func decodeBinary(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "base64:"):
+		return base64.StdEncoding.DecodeString(value[len("base64:"):])
+	case strings.HasPrefix(value, "0x"):
+		return hex.DecodeString(value[2:])
+	}
+	return nil, fmt.Errorf("Invalid binary value %q", value)
+}
+
+func boolFlag(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package movie
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/input"
+)
+
+// Commands that can accompany a frame's input.
+type Command uint8
+
+const (
+	CommandReset Command = 1 << iota
+	CommandPower
+)
+
+// Input for a single frame.
+type Frame struct {
+	Command Command
+	Pads    [input.PORT_COUNT]input.Buttons
+}
+
+// A recording of controller input, along with what's needed to check
+// it's replayed against the same game from the same starting point.
+type Movie struct {
+	ROMFilename string
+	// "base64:" followed by the MD5 of the ROM, as FCEUX writes it
+	ROMChecksum   string
+	GUID          string
+	RerecordCount int
+	PAL           bool
+	Comments      []string
+	// Save state to load before the first frame.  Without one, the movie
+	// starts from power-on.
+	StartState []byte
+	// What internal RAM held at power-on, both at the start and for
+	// CommandPower.  Some games read RAM before clearing it.
+	RAMPattern core.RAMPattern
+	RAMSeed    int64
+	Frames     []Frame
+}
+
+// Checksum ROM data the way FCEUX does, for Movie.ROMChecksum.
+func ROMChecksum(prg []byte, chr []byte) string {
+	hash := md5.New()
+	hash.Write(prg)
+	hash.Write(chr)
+	return "base64:" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// Check a movie was recorded against the given ROM.
+func (m *Movie) CheckROM(checksum string) error {
+	if m.ROMChecksum != "" && m.ROMChecksum != checksum {
+		return fmt.Errorf("Movie was recorded with a different ROM (%s, expected %s)", checksum, m.ROMChecksum)
+	}
+	return nil
+}
+
+// Note how a CPU will fill RAM at power-on, for recording.
+func (m *Movie) RecordPowerOnRAM(c *core.CPU) {
+	m.RAMPattern, m.RAMSeed = c.PowerOnRAM()
+}
+
+// Have a CPU fill RAM at power-on the way it did when the movie was
+// recorded.  Call this before powering on to play it back.
+func (m *Movie) ApplyPowerOnRAM(c *core.CPU) {
+	c.SetPowerOnRAM(m.RAMPattern, m.RAMSeed)
+}
+
+// Records the controller state each frame.
+type Recorder struct {
+	movie *Movie
+	ports *input.Ports
+}
+
+func NewRecorder(movie *Movie, ports *input.Ports) *Recorder {
+	return &Recorder{movie: movie, ports: ports}
+}
+
+// Record the input for the frame about to run.  Call this once per frame,
+// after setting the pads and before running the frame.
+func (r *Recorder) Record(command Command) {
+	frame := Frame{Command: command}
+	for i := range frame.Pads {
+		frame.Pads[i] = r.ports.Pads[i].Buttons()
+	}
+	r.movie.Frames = append(r.movie.Frames, frame)
+}
+
+// Drives the controllers from a movie.
+type Player struct {
+	movie *Movie
+	ports *input.Ports
+	frame int
+}
+
+func NewPlayer(movie *Movie, ports *input.Ports) *Player {
+	return &Player{movie: movie, ports: ports}
+}
+
+// Set the pads for the next frame and return any command the caller
+// should carry out before running it.  Returns false once the movie is
+// over, leaving the pads as they were.
+func (p *Player) Next() (Command, bool) {
+	if p.Done() {
+		return 0, false
+	}
+	frame := p.movie.Frames[p.frame]
+	p.frame++
+	for i, buttons := range frame.Pads {
+		p.ports.Pads[i].Set(buttons)
+	}
+	return frame.Command, true
+}
+
+// Number of frames played so far.
+func (p *Player) Frame() int {
+	return p.frame
+}
+
+func (p *Player) Done() bool {
+	return p.frame >= len(p.movie.Frames)
+}
@@ -0,0 +1,230 @@
+package movie
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/input"
+	"pageer/myfinemu/internal/savestate"
+)
+
+// Reads the first pad over and over, keeping a running sum of the
+// buttons on the stack.
+const game = `
+loop:	LDX #8
+read:	LDA $4016
+	LSR A
+	ROL $10
+	DEX
+	BNE read
+	PLA
+	ADC $10
+	PHA
+	INC $11
+	JMP loop
+`
+
+// Cycles per pretend frame
+const FRAME_CYCLES = 2000
+
+type machine struct {
+	cpu   *core.CPU
+	ports *input.Ports
+	rom   []byte
+}
+
+func newMachine(t *testing.T) *machine {
+	program, err := asm.Assemble(game)
+	assert.Nil(t, err)
+	m := &machine{cpu: core.NewCPU(), ports: &input.Ports{}, rom: program.Bytes}
+	m.cpu.LoadAndReset(program.Bytes)
+	m.cpu.MapDevice(input.PORT1_ADDRESS, input.PORT2_ADDRESS, m.ports)
+	return m
+}
+
+// Carry out a frame's command, then run it.  The game doesn't strobe the
+// pads itself, so we do it at the start of each frame.
+func (m *machine) runFrame(t *testing.T, command Command) {
+	if command&CommandPower > 0 {
+		m.cpu.PowerOn()
+	} else if command&CommandReset > 0 {
+		m.cpu.Reset()
+	}
+	m.ports.WriteRegister(input.PORT1_ADDRESS, 1)
+	m.ports.WriteRegister(input.PORT1_ADDRESS, 0)
+
+	end := m.cpu.Cycles() + FRAME_CYCLES
+	for m.cpu.Cycles() < end {
+		_, err := m.cpu.Step()
+		assert.Nil(t, err)
+	}
+}
+
+func (m *machine) ramHash() [32]byte {
+	ram := make([]byte, 0x0800)
+	for i := range ram {
+		ram[i] = m.cpu.ReadMemory(uint16(i))
+	}
+	return sha256.Sum256(ram)
+}
+
+// Record a run with random input, and a reset part way through.
+func record(t *testing.T, m *machine, movie *Movie, frames int) {
+	recorder := NewRecorder(movie, m.ports)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < frames; i++ {
+		m.ports.Pads[0].Set(input.Buttons(random.Intn(256)))
+		m.ports.Pads[1].Set(input.Buttons(random.Intn(256)))
+		command := Command(0)
+		if i == frames/2 {
+			command = CommandReset
+		}
+		recorder.Record(command)
+		m.runFrame(t, command)
+	}
+}
+
+func replay(t *testing.T, m *machine, movie *Movie) {
+	assert.Nil(t, movie.CheckROM(ROMChecksum(m.rom, nil)))
+	if movie.StartState != nil {
+		assert.Nil(t, savestate.Load(bytes.NewReader(movie.StartState), m.cpu, m.ports))
+	}
+	player := NewPlayer(movie, m.ports)
+	for {
+		command, ok := player.Next()
+		if !ok {
+			break
+		}
+		m.runFrame(t, command)
+	}
+	assert.Equal(t, len(movie.Frames), player.Frame())
+}
+
+func TestReplay_IdenticalRAM(t *testing.T) {
+	recorded := newMachine(t)
+	m := &Movie{ROMFilename: "game", ROMChecksum: ROMChecksum(recorded.rom, nil)}
+	record(t, recorded, m, 120)
+
+	var fm2 bytes.Buffer
+	assert.Nil(t, m.WriteFM2(&fm2))
+	parsed, err := ParseFM2(&fm2)
+	assert.Nil(t, err)
+	assert.Equal(t, m, parsed)
+
+	replayed := newMachine(t)
+	replay(t, replayed, parsed)
+
+	assert.Equal(t, recorded.ramHash(), replayed.ramHash())
+	assert.Equal(t, recorded.cpu.Registers(), replayed.cpu.Registers())
+
+	// Different input gives different RAM, so the comparison means something
+	parsed.Frames[3].Pads[0] ^= input.ButtonA
+	different := newMachine(t)
+	replay(t, different, parsed)
+	assert.NotEqual(t, recorded.ramHash(), different.ramHash())
+}
+
+func TestReplay_FromSaveState(t *testing.T) {
+	recorded := newMachine(t)
+	for i := 0; i < 10; i++ {
+		recorded.runFrame(t, 0)
+	}
+	var start bytes.Buffer
+	assert.Nil(t, savestate.Save(&start, recorded.cpu, recorded.ports))
+	m := &Movie{StartState: start.Bytes()}
+	record(t, recorded, m, 30)
+
+	var fm2 bytes.Buffer
+	assert.Nil(t, m.WriteFM2(&fm2))
+	parsed, err := ParseFM2(&fm2)
+	assert.Nil(t, err)
+	replayed := newMachine(t)
+	replay(t, replayed, parsed)
+
+	assert.Equal(t, recorded.ramHash(), replayed.ramHash())
+}
+
+func TestReplay_PowerOnRAM(t *testing.T) {
+	recorded := newMachine(t)
+	recorded.cpu.SetPowerOnRAM(core.RAMRandom, 1234)
+	recorded.cpu.PowerOn()
+	m := &Movie{}
+	m.RecordPowerOnRAM(recorded.cpu)
+	record(t, recorded, m, 30)
+
+	var fm2 bytes.Buffer
+	assert.Nil(t, m.WriteFM2(&fm2))
+	parsed, err := ParseFM2(&fm2)
+	assert.Nil(t, err)
+	assert.Equal(t, core.RAMRandom, parsed.RAMPattern)
+	assert.Equal(t, int64(1234), parsed.RAMSeed)
+
+	replayed := newMachine(t)
+	parsed.ApplyPowerOnRAM(replayed.cpu)
+	replayed.cpu.PowerOn()
+	replay(t, replayed, parsed)
+	assert.Equal(t, recorded.ramHash(), replayed.ramHash())
+
+	// The game sums RAM it never cleared, so the pattern matters
+	zeroed := newMachine(t)
+	zeroed.cpu.PowerOn()
+	replay(t, zeroed, parsed)
+	assert.NotEqual(t, recorded.ramHash(), zeroed.ramHash())
+}
+
+func TestParseFM2(t *testing.T) {
+	text := strings.Join([]string{
+		"version 3",
+		"emuVersion 22020",
+		"rerecordCount 12",
+		"palFlag 0",
+		"romFilename Super Mario Bros.",
+		"romChecksum base64:jjYwGG411HcjG/j9UOVM3Q==",
+		"guid 452DE2C3-EF43-2FA9-77AC-0677FC51543B",
+		"comment author someone",
+		"port0 1",
+		"port1 0",
+		"port2 0",
+		"|0|........|||",
+		"|1|R......A|||",
+		"|0|    TS  |||",
+	}, "\r\n")
+
+	m, err := ParseFM2(strings.NewReader(text))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Super Mario Bros.", m.ROMFilename)
+	assert.Equal(t, 12, m.RerecordCount)
+	assert.Equal(t, []string{"author someone"}, m.Comments)
+	assert.Equal(t, []Frame{
+		{},
+		{Command: CommandReset, Pads: [2]input.Buttons{input.ButtonRight | input.ButtonA}},
+		{Pads: [2]input.Buttons{input.ButtonStart | input.ButtonSelect}},
+	}, m.Frames)
+	assert.NotNil(t, m.CheckROM("base64:AAAA"))
+}
+
+func TestParseFM2_Invalid(t *testing.T) {
+	for _, text := range []string{
+		"version 2\n",
+		"|0|RLD|||\n",
+		"|x|........|||\n",
+		"savestate zz\n",
+		"fourscore 1\n",
+		"ramPattern stripes\n",
+		"ramSeed x\n",
+	} {
+		_, err := ParseFM2(strings.NewReader(text))
+		assert.NotNil(t, err, text)
+	}
+
+	_, err := ParseFM2(strings.NewReader("version 3\n|0|RLD|||\n"))
+	assert.EqualError(t, err, `Line 2: Invalid gamepad input "RLD"`)
+}
@@ -0,0 +1,124 @@
+package patch
+
+import (
+	"fmt"
+)
+
+// BPS actions, in the bottom two bits of each command
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+// Apply a BPS patch.  After the sizes and metadata, the target is built
+// from commands that copy from the source at the same offset, take bytes
+// from the patch, or copy from elsewhere in the source or the target so
+// far.  The footer has CRC32s of the source, target and patch.
+func ApplyBPS(patch []byte, source []byte) ([]byte, error) {
+	magic_size := len(FORMAT_MAGIC[FormatBPS])
+	if format, err := Detect(patch); err != nil || format != FormatBPS {
+		return nil, ErrUnknownFormat
+	}
+	sums, err := checkPatch(patch, source, magic_size)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{data: patch, position: magic_size, end: len(patch) - CHECKSUMS_SIZE}
+	var sizes [3]uint64
+	for i := range sizes {
+		sizes[i], err = r.number()
+		if err != nil {
+			return nil, err
+		}
+	}
+	source_size, target_size, metadata_size := sizes[0], sizes[1], sizes[2]
+	if source_size != uint64(len(source)) {
+		return nil, fmt.Errorf("BPS patch is for a %d byte ROM, this one is %d bytes", source_size, len(source))
+	}
+	if target_size > MAX_TARGET_SIZE {
+		return nil, fmt.Errorf("BPS patch makes a %d byte ROM, which is too big", target_size)
+	}
+	if metadata_size > uint64(r.end-r.position) {
+		return nil, errTruncated
+	}
+	r.position += int(metadata_size)
+
+	target := make([]byte, 0, target_size)
+	source_relative := int64(0)
+	target_relative := int64(0)
+	for !r.done() {
+		command, err := r.number()
+		if err != nil {
+			return nil, err
+		}
+		length := command>>2 + 1
+		if uint64(len(target))+length > target_size {
+			return nil, fmt.Errorf("BPS patch writes past the end of the %d byte target", target_size)
+		}
+
+		switch command & 3 {
+		case bpsSourceRead:
+			start := uint64(len(target))
+			if start+length > uint64(len(source)) {
+				return nil, fmt.Errorf("BPS patch reads past the end of the source at $%X", start)
+			}
+			target = append(target, source[start:start+length]...)
+		case bpsTargetRead:
+			if length > uint64(r.end-r.position) {
+				return nil, errTruncated
+			}
+			target = append(target, patch[r.position:r.position+int(length)]...)
+			r.position += int(length)
+		case bpsSourceCopy:
+			offset, err := r.relativeOffset()
+			if err != nil {
+				return nil, err
+			}
+			source_relative += offset
+			if source_relative < 0 || uint64(source_relative)+length > uint64(len(source)) {
+				return nil, fmt.Errorf("BPS patch copies from outside the source at $%X", source_relative)
+			}
+			target = append(target, source[source_relative:source_relative+int64(length)]...)
+			source_relative += int64(length)
+		case bpsTargetCopy:
+			offset, err := r.relativeOffset()
+			if err != nil {
+				return nil, err
+			}
+			target_relative += offset
+			if target_relative < 0 || target_relative >= int64(len(target)) {
+				return nil, fmt.Errorf("BPS patch copies from outside the target so far at $%X", target_relative)
+			}
+			// A byte at a time, since the copy can overlap what it writes
+			for i := uint64(0); i < length; i++ {
+				target = append(target, target[target_relative])
+				target_relative++
+			}
+		}
+	}
+
+	if uint64(len(target)) != target_size {
+		return nil, fmt.Errorf("BPS patch made %d bytes, expected %d", len(target), target_size)
+	}
+	err = checkTarget(target, sums)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// A signed offset, with the sign in the bottom bit.
+func (r *reader) relativeOffset() (int64, error) {
+	value, err := r.number()
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(value >> 1)
+	if value&1 != 0 {
+		offset = -offset
+	}
+	return offset, nil
+}
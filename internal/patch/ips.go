@@ -0,0 +1,79 @@
+package patch
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Where a record's offset would be, "EOF" ends the patch
+const IPS_EOF = "EOF"
+
+// Apply an IPS patch.  Records are a 3-byte offset and 2-byte length,
+// big-endian, then the data.  A zero length marks an RLE record, with a
+// 2-byte count and the byte to repeat.  A 3-byte size after "EOF", as
+// Lunar IPS writes, truncates the result.
+func ApplyIPS(patch []byte, source []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte(FORMAT_MAGIC[FormatIPS])) {
+		return nil, ErrUnknownFormat
+	}
+	target := append([]byte(nil), source...)
+	position := len(FORMAT_MAGIC[FormatIPS])
+
+	for {
+		if position+3 > len(patch) {
+			return nil, fmt.Errorf("IPS patch is truncated at $%06X, with no EOF marker", position)
+		}
+		if string(patch[position:position+3]) == IPS_EOF {
+			position += 3
+			break
+		}
+		if position+5 > len(patch) {
+			return nil, fmt.Errorf("IPS patch is truncated in the record at $%06X", position)
+		}
+		offset := bigEndian(patch[position : position+3])
+		size := bigEndian(patch[position+3 : position+5])
+		record := position
+		position += 5
+
+		var data []byte
+		if size == 0 {
+			if position+3 > len(patch) {
+				return nil, fmt.Errorf("IPS patch is truncated in the RLE record at $%06X", record)
+			}
+			count := bigEndian(patch[position : position+2])
+			data = bytes.Repeat(patch[position+2:position+3], count)
+			position += 3
+		} else {
+			if position+size > len(patch) {
+				return nil, fmt.Errorf("IPS patch is truncated in the record at $%06X", record)
+			}
+			data = patch[position : position+size]
+			position += size
+		}
+
+		if offset+len(data) > len(target) {
+			target = append(target, make([]byte, offset+len(data)-len(target))...)
+		}
+		copy(target[offset:], data)
+	}
+
+	switch len(patch) - position {
+	case 0:
+	case 3:
+		size := bigEndian(patch[position : position+3])
+		if size < len(target) {
+			target = target[:size]
+		}
+	default:
+		return nil, fmt.Errorf("IPS patch has %d unexpected bytes after EOF", len(patch)-position)
+	}
+	return target, nil
+}
+
+func bigEndian(data []byte) int {
+	value := 0
+	for _, b := range data {
+		value = value<<8 | int(b)
+	}
+	return value
+}
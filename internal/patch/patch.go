@@ -0,0 +1,199 @@
+// Package patch applies IPS, UPS and BPS soft patches, as used for
+// translations and romhacks, to ROM images as they're loaded.
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Format int
+
+const (
+	FormatIPS Format = iota
+	FormatUPS
+	FormatBPS
+)
+
+var FORMAT_NAMES = [...]string{"IPS", "UPS", "BPS"}
+
+// What each format's files start with, and the extension they use.
+var (
+	FORMAT_MAGIC      = [...]string{"PATCH", "UPS1", "BPS1"}
+	FORMAT_EXTENSIONS = [...]string{".ips", ".ups", ".bps"}
+)
+
+var ErrUnknownFormat = errors.New("Not an IPS, UPS or BPS patch")
+
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(FORMAT_NAMES) {
+		return fmt.Sprintf("format(%d)", int(f))
+	}
+	return FORMAT_NAMES[f]
+}
+
+// Work out a patch's format from its magic number.
+func Detect(patch []byte) (Format, error) {
+	for i, magic := range FORMAT_MAGIC {
+		if bytes.HasPrefix(patch, []byte(magic)) {
+			return Format(i), nil
+		}
+	}
+	return 0, ErrUnknownFormat
+}
+
+// Apply a patch of any supported format, returning the patched copy of
+// the source.
+func Apply(patch []byte, source []byte) ([]byte, error) {
+	format, err := Detect(patch)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatUPS:
+		return ApplyUPS(patch, source)
+	case FormatBPS:
+		return ApplyBPS(patch, source)
+	}
+	return ApplyIPS(patch, source)
+}
+
+// Find a patch next to a ROM with the same name, e.g. game.ips for
+// game.nes.  Returns "" if there isn't one, and an error if there's more
+// than one, since which to apply would be a guess.
+func FindPatch(rom_path string) (string, error) {
+	base := strings.TrimSuffix(rom_path, filepath.Ext(rom_path))
+	found := ""
+	for _, extension := range FORMAT_EXTENSIONS {
+		path := base + extension
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if found != "" {
+			return "", fmt.Errorf("Found both %s and %s, remove one", found, path)
+		}
+		found = path
+	}
+	return found, nil
+}
+
+// Read a ROM, applying the patch next to it if there is one.  Also
+// returns the path of the patch applied, or "" if there wasn't one.
+func LoadROM(rom_path string) ([]byte, string, error) {
+	data, err := os.ReadFile(rom_path)
+	if err != nil {
+		return nil, "", err
+	}
+	patch_path, err := FindPatch(rom_path)
+	if err != nil || patch_path == "" {
+		return data, "", err
+	}
+
+	patch, err := os.ReadFile(patch_path)
+	if err != nil {
+		return nil, "", err
+	}
+	patched, err := Apply(patch, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", patch_path, err)
+	}
+	return patched, patch_path, nil
+}
+
+// The CRC32s at the end of UPS and BPS patches.
+type checksums struct {
+	source uint32
+	target uint32
+	patch  uint32
+}
+
+const (
+	CHECKSUMS_SIZE = 12
+	// Guards against allocating huge buffers for corrupt sizes
+	MAX_TARGET_SIZE = 64 * 1024 * 1024
+)
+
+// Check the patch against its own CRC32, and the source against the one
+// it was made for.  Returns the CRC32s for checking the target later.
+func checkPatch(patch []byte, source []byte, magic_size int) (checksums, error) {
+	if len(patch) < magic_size+CHECKSUMS_SIZE {
+		return checksums{}, errTruncated
+	}
+	footer := patch[len(patch)-CHECKSUMS_SIZE:]
+	sums := checksums{
+		source: littleEndian32(footer[0:4]),
+		target: littleEndian32(footer[4:8]),
+		patch:  littleEndian32(footer[8:12]),
+	}
+	if actual := crc32.ChecksumIEEE(patch[:len(patch)-4]); actual != sums.patch {
+		return sums, fmt.Errorf("Patch is corrupt: its CRC32 is %08X, expected %08X", actual, sums.patch)
+	}
+	if actual := crc32.ChecksumIEEE(source); actual != sums.source {
+		return sums, fmt.Errorf("Patch is for a different ROM: CRC32 %08X, but this one's is %08X", sums.source, actual)
+	}
+	return sums, nil
+}
+
+func checkTarget(target []byte, sums checksums) error {
+	if actual := crc32.ChecksumIEEE(target); actual != sums.target {
+		return fmt.Errorf("Patched ROM has CRC32 %08X, expected %08X", actual, sums.target)
+	}
+	return nil
+}
+
+func littleEndian32(data []byte) uint32 {
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+}
+
+// Reads the body of a UPS or BPS patch, up to the footer.
+type reader struct {
+	data     []byte
+	position int
+	// Where the footer starts
+	end int
+}
+
+var errTruncated = errors.New("Patch is truncated")
+
+func (r *reader) readByte() (byte, error) {
+	if r.position >= r.end {
+		return 0, errTruncated
+	}
+	value := r.data[r.position]
+	r.position++
+	return value, nil
+}
+
+// The variable-length numbers UPS and BPS use: seven bits a byte, least
+// significant first, with the top bit marking the last byte.  Each
+// continuation adds one, so every number has a single encoding.
+func (r *reader) number() (uint64, error) {
+	var value uint64
+	shift := uint64(1)
+	for i := 0; i < 10; i++ {
+		x, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		value += uint64(x&0x7f) * shift
+		if x&0x80 != 0 {
+			return value, nil
+		}
+		shift <<= 7
+		value += shift
+	}
+	return 0, errors.New("Patch has a number that's too long")
+}
+
+func (r *reader) done() bool {
+	return r.position >= r.end
+}
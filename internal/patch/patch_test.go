@@ -0,0 +1,220 @@
+package patch
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSource = []byte("The quick brown fox jumps over the lazy dog")
+
+// The inverse of reader.number.
+func encodeNumber(value uint64) []byte {
+	var data []byte
+	for {
+		x := byte(value & 0x7f)
+		value >>= 7
+		if value == 0 {
+			return append(data, 0x80|x)
+		}
+		data = append(data, x)
+		value--
+	}
+}
+
+func appendLittleEndian32(data []byte, value uint32) []byte {
+	return append(data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+// Add the CRC32 footer to a UPS or BPS patch body.
+func finishPatch(body []byte, source []byte, target []byte) []byte {
+	body = appendLittleEndian32(body, crc32.ChecksumIEEE(source))
+	body = appendLittleEndian32(body, crc32.ChecksumIEEE(target))
+	return appendLittleEndian32(body, crc32.ChecksumIEEE(body))
+}
+
+// A UPS patch that turns source into target.
+func makeUPS(source []byte, target []byte) []byte {
+	body := []byte("UPS1")
+	body = append(body, encodeNumber(uint64(len(source)))...)
+	body = append(body, encodeNumber(uint64(len(target)))...)
+	at := func(data []byte, i int) byte {
+		if i < len(data) {
+			return data[i]
+		}
+		return 0
+	}
+	last := 0
+	for i := 0; i < len(target); i++ {
+		if at(source, i) == at(target, i) {
+			continue
+		}
+		body = append(body, encodeNumber(uint64(i-last))...)
+		for ; i < len(target) && at(source, i) != at(target, i); i++ {
+			body = append(body, at(source, i)^at(target, i))
+		}
+		body = append(body, 0)
+		last = i + 1
+	}
+	return finishPatch(body, source, target)
+}
+
+func TestNumber_RoundTrip(t *testing.T) {
+	for _, value := range []uint64{0, 1, 0x7f, 0x80, 0x407f, 0x4080, 1 << 40} {
+		encoded := encodeNumber(value)
+		r := &reader{data: encoded, end: len(encoded)}
+		decoded, err := r.number()
+		assert.Nil(t, err)
+		assert.Equal(t, value, decoded)
+		assert.True(t, r.done())
+	}
+}
+
+func TestApplyIPS(t *testing.T) {
+	testCases := []struct {
+		name     string
+		records  string
+		expected string
+	}{
+		{"Record", "\x00\x00\x04\x00\x05quack" + "EOF", "The quack brown fox jumps over the lazy dog"},
+		{"RLE", "\x00\x00\x00\x00\x00\x00\x03z" + "EOF", "zzz quick brown fox jumps over the lazy dog"},
+		{"Extends", "\x00\x00\x2b\x00\x01!" + "EOF", "The quick brown fox jumps over the lazy dog!"},
+		{"Leaves a gap", "\x00\x00\x2c\x00\x01!" + "EOF", "The quick brown fox jumps over the lazy dog\x00!"},
+		{"Truncates", "\x00\x00\x00\x00\x01t" + "EOF\x00\x00\x09", "the quick"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			target, err := Apply([]byte("PATCH"+test.records), testSource)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, string(target))
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestApplyIPS_Invalid(t *testing.T) {
+	testCases := []struct {
+		name     string
+		patch    string
+		expected string
+	}{
+		{"No EOF", "PATCH\x00\x00\x00\x00\x01t", "IPS patch is truncated at $00000B, with no EOF marker"},
+		{"Short record", "PATCH\x00\x00\x00\x00\x05abc", "IPS patch is truncated in the record at $000005"},
+		{"Trailing bytes", "PATCHEOF\x00\x00", "IPS patch has 2 unexpected bytes after EOF"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			_, err := ApplyIPS([]byte(test.patch), testSource)
+
+			assert.EqualError(t, err, test.expected)
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestApplyUPS(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+	}{
+		{"Same size", "The quick brown cat jumps over the lazy dog"},
+		{"Longer", "The quick brown fox jumps over the lazy dog and cat"},
+		{"Shorter", "The quick brown fox"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			target, err := Apply(makeUPS(testSource, []byte(test.target)), testSource)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.target, string(target))
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestApplyUPS_Mismatch(t *testing.T) {
+	patch := makeUPS(testSource, []byte("The quick brown cat"))
+
+	_, err := ApplyUPS(patch, []byte("The quick brown dog jumps over the lazy fox"))
+	assert.Contains(t, err.Error(), "Patch is for a different ROM")
+
+	patch[10] ^= 0xff
+	_, err = ApplyUPS(patch, testSource)
+	assert.Contains(t, err.Error(), "Patch is corrupt")
+}
+
+func TestApplyBPS(t *testing.T) {
+	expected := "The lazy dog jumps over the lazy dog, ha ha ha"
+	body := []byte("BPS1")
+	body = append(body, encodeNumber(uint64(len(testSource)))...)
+	body = append(body, encodeNumber(uint64(len(expected)))...)
+	body = append(body, encodeNumber(4)...)
+	body = append(body, "meta"...)
+	command := func(action uint64, length uint64) {
+		body = append(body, encodeNumber((length-1)<<2|action)...)
+	}
+	// "The "
+	command(bpsSourceRead, 4)
+	// "lazy dog", from 35 in the source
+	command(bpsSourceCopy, 8)
+	body = append(body, encodeNumber(35<<1)...)
+	// " jumps over the lazy dog", back at 19 in the source, since "lazy
+	// dog" is shorter than "quick brown fox"
+	command(bpsSourceCopy, 24)
+	body = append(body, encodeNumber((35+8-19)<<1|1)...)
+	// ", ha"
+	command(bpsTargetRead, 4)
+	body = append(body, ", ha"...)
+	// " ha ha", overlapping the bytes it copies
+	command(bpsTargetCopy, 6)
+	body = append(body, encodeNumber(uint64(len(expected)-9)<<1)...)
+	patch := finishPatch(body, testSource, []byte(expected))
+
+	target, err := Apply(patch, testSource)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(target))
+
+	_, err = ApplyBPS(patch, testSource[1:])
+	assert.Contains(t, err.Error(), "Patch is for a different ROM")
+}
+
+func TestApply_UnknownFormat(t *testing.T) {
+	_, err := Apply([]byte("NES\x1a"), testSource)
+
+	assert.Equal(t, ErrUnknownFormat, err)
+}
+
+func TestLoadROM(t *testing.T) {
+	directory := t.TempDir()
+	rom := filepath.Join(directory, "game.nes")
+	os.WriteFile(rom, testSource, 0644)
+
+	data, applied, err := LoadROM(rom)
+	assert.Nil(t, err)
+	assert.Equal(t, "", applied)
+	assert.Equal(t, testSource, data)
+
+	ips := filepath.Join(directory, "game.ips")
+	os.WriteFile(ips, []byte("PATCH\x00\x00\x00\x00\x01tEOF"), 0644)
+	data, applied, err = LoadROM(rom)
+	assert.Nil(t, err)
+	assert.Equal(t, ips, applied)
+	assert.Equal(t, "the quick", string(data[:9]))
+
+	bps := filepath.Join(directory, "game.bps")
+	os.WriteFile(bps, []byte("BPS1"), 0644)
+	_, _, err = LoadROM(rom)
+	assert.EqualError(t, err, "Found both "+ips+" and "+bps+", remove one")
+
+	os.Remove(ips)
+	_, _, err = LoadROM(rom)
+	assert.EqualError(t, err, bps+": Patch is truncated")
+}
@@ -0,0 +1,65 @@
+package patch
+
+import (
+	"fmt"
+)
+
+// Apply a UPS patch.  After the source and target sizes, each record
+// skips some bytes, then XORs bytes into the target up to and including
+// a zero.  The footer has CRC32s of the source, target and patch.
+func ApplyUPS(patch []byte, source []byte) ([]byte, error) {
+	magic_size := len(FORMAT_MAGIC[FormatUPS])
+	if format, err := Detect(patch); err != nil || format != FormatUPS {
+		return nil, ErrUnknownFormat
+	}
+	sums, err := checkPatch(patch, source, magic_size)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{data: patch, position: magic_size, end: len(patch) - CHECKSUMS_SIZE}
+	source_size, err := r.number()
+	if err != nil {
+		return nil, err
+	}
+	target_size, err := r.number()
+	if err != nil {
+		return nil, err
+	}
+	if source_size != uint64(len(source)) {
+		return nil, fmt.Errorf("UPS patch is for a %d byte ROM, this one is %d bytes", source_size, len(source))
+	}
+	if target_size > MAX_TARGET_SIZE {
+		return nil, fmt.Errorf("UPS patch makes a %d byte ROM, which is too big", target_size)
+	}
+
+	target := make([]byte, target_size)
+	copy(target, source)
+	position := uint64(0)
+	for !r.done() {
+		skip, err := r.number()
+		if err != nil {
+			return nil, err
+		}
+		position += skip
+		for {
+			x, err := r.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if position < target_size {
+				target[position] ^= x
+			}
+			position++
+			if x == 0 {
+				break
+			}
+		}
+	}
+
+	err = checkTarget(target, sums)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
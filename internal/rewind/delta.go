@@ -0,0 +1,74 @@
+package rewind
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Encode target as the XOR of base and target, run-length encoded.
+// Snapshots a frame apart are mostly identical, so the XOR is mostly
+// zeros.  The encoding is a sequence of
+//
+//	zeros    uvarint  number of unchanged bytes
+//	literals uvarint  number of changed bytes that follow
+//	data     literals bytes, each base^target
+//
+// base and target must be the same length.
+func encodeDelta(base []byte, target []byte) []byte {
+	var delta []byte
+	i := 0
+	for i < len(target) {
+		start := i
+		for i < len(target) && base[i] == target[i] {
+			i++
+		}
+		zeros := i - start
+
+		start = i
+		for i < len(target) && base[i] != target[i] {
+			i++
+		}
+		if i == start {
+			// Nothing changed at the end
+			break
+		}
+		delta = binary.AppendUvarint(delta, uint64(zeros))
+		delta = binary.AppendUvarint(delta, uint64(i-start))
+		for j := start; j < i; j++ {
+			delta = append(delta, base[j]^target[j])
+		}
+	}
+	return delta
+}
+
+// Reverse encodeDelta.  Since XOR is symmetric, this also recovers base
+// from target.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	result := make([]byte, len(base))
+	copy(result, base)
+
+	position := 0
+	for len(delta) > 0 {
+		zeros, n := binary.Uvarint(delta)
+		if n <= 0 {
+			return nil, errors.New("Corrupt rewind delta")
+		}
+		delta = delta[n:]
+		literals, n := binary.Uvarint(delta)
+		if n <= 0 {
+			return nil, errors.New("Corrupt rewind delta")
+		}
+		delta = delta[n:]
+
+		position += int(zeros)
+		if position+int(literals) > len(result) || int(literals) > len(delta) {
+			return nil, errors.New("Rewind delta doesn't match snapshot size")
+		}
+		for i := 0; i < int(literals); i++ {
+			result[position+i] ^= delta[i]
+		}
+		position += int(literals)
+		delta = delta[literals:]
+	}
+	return result, nil
+}
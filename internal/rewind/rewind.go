@@ -0,0 +1,229 @@
+// Package rewind keeps a bounded history of machine snapshots for
+// stepping backwards.  Call Rewinder.Capture at the start of every
+// frame; RewindTo then restores the start of any captured frame still in
+// the history, after which the next Capture is for that frame again and
+// everything newer is forgotten.
+package rewind
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"pageer/myfinemu/internal/savestate"
+)
+
+// Capture every frame, and keep about ten seconds of snapshots.
+const (
+	DEFAULT_INTERVAL = 1
+	DEFAULT_CAPACITY = 600
+)
+
+// What we need from the emulated machine.  Snapshots use the same state
+// serialisation as save states, so the state must be complete enough to
+// resume bit-identically.
+type Machine interface {
+	savestate.Component
+	Step() (bool, error)
+	Cycles() uint64
+}
+
+type snapshot struct {
+	frame  int
+	cycles uint64
+	// The newest snapshot is stored whole.  Older ones are deltas against
+	// the next newer snapshot, so restoring walks back from the newest.
+	data  []byte
+	whole bool
+}
+
+// Keeps a bounded history of machine state for stepping backwards.
+//
+// Call Capture at every frame boundary, including before the first frame.
+// Every interval frames it saves a snapshot, and once it holds capacity
+// snapshots the oldest is dropped.
+type Rewinder struct {
+	machine  Machine
+	interval int
+	capacity int
+	// Oldest first
+	snapshots []snapshot
+	// Number of the next frame Capture will see
+	frame int
+	// Cycle count at the start of each frame we can still rewind to,
+	// indexed from first_frame
+	frame_starts []uint64
+	first_frame  int
+}
+
+func New(machine Machine, interval int, capacity int) *Rewinder {
+	if interval < 1 {
+		interval = DEFAULT_INTERVAL
+	}
+	if capacity < 1 {
+		capacity = DEFAULT_CAPACITY
+	}
+	return &Rewinder{machine: machine, interval: interval, capacity: capacity}
+}
+
+// The number of the frame about to start.
+func (r *Rewinder) Frame() int {
+	return r.frame
+}
+
+// Number of snapshots held.
+func (r *Rewinder) Len() int {
+	return len(r.snapshots)
+}
+
+// The earliest frame we can rewind to, or -1 with no snapshots.
+func (r *Rewinder) OldestFrame() int {
+	if len(r.snapshots) == 0 {
+		return -1
+	}
+	return r.snapshots[0].frame
+}
+
+// Total bytes of snapshot data held.
+func (r *Rewinder) Size() int {
+	size := 0
+	for _, s := range r.snapshots {
+		size += len(s.data)
+	}
+	return size
+}
+
+// Mark the start of a frame, taking a snapshot if one is due.
+func (r *Rewinder) Capture() error {
+	frame := r.frame
+	cycles := r.machine.Cycles()
+	r.frame++
+	r.frame_starts = append(r.frame_starts, cycles)
+
+	if frame%r.interval != 0 {
+		return nil
+	}
+
+	data, err := r.machine.SaveState()
+	if err != nil {
+		return err
+	}
+	// After a rewind we're back at the start of the restored snapshot's
+	// frame, so we take it again rather than keeping two
+	if len(r.snapshots) > 0 && r.snapshots[len(r.snapshots)-1].frame == frame {
+		r.snapshots = r.snapshots[:len(r.snapshots)-1]
+	}
+	if len(r.snapshots) > 0 {
+		newest := &r.snapshots[len(r.snapshots)-1]
+		if len(newest.data) == len(data) {
+			newest.data = encodeDelta(data, newest.data)
+			newest.whole = false
+		}
+	}
+	r.snapshots = append(r.snapshots, snapshot{frame: frame, cycles: cycles, data: data, whole: true})
+
+	if len(r.snapshots) > r.capacity {
+		r.snapshots = r.snapshots[1:]
+		r.trimFrameStarts()
+	}
+	return nil
+}
+
+// Restore the machine to the start of a frame, ready to Capture it again
+// and carry on.  If the frame falls between
+// snapshots, we restore the one before it and run forward, so this is
+// only frame-exact when the machine is driven purely by its own state.
+// Callers feeding input per frame should replay from RewindToSnapshot
+// instead.  Snapshots after the restored point are discarded, since
+// execution may now diverge.
+func (r *Rewinder) RewindTo(frame int) error {
+	if frame < r.first_frame || frame >= r.frame {
+		return fmt.Errorf("Frame %d is outside the rewind history", frame)
+	}
+	return r.RewindToCycle(r.frame_starts[frame-r.first_frame])
+}
+
+// Restore the newest snapshot at or before a frame, returning the frame
+// it was taken at.  As with RewindTo, the next Capture is for that frame.
+func (r *Rewinder) RewindToSnapshot(frame int) (int, error) {
+	index := sort.Search(len(r.snapshots), func(i int) bool { return r.snapshots[i].frame > frame }) - 1
+	if index < 0 {
+		return 0, fmt.Errorf("No snapshot at or before frame %d", frame)
+	}
+	err := r.restore(index)
+	if err != nil {
+		return 0, err
+	}
+	restored := r.snapshots[index].frame
+	r.frame = restored
+	r.frame_starts = r.frame_starts[:restored-r.first_frame]
+	return restored, nil
+}
+
+// Restore the machine to the first instruction boundary at or after an
+// earlier cycle, by restoring the snapshot before it and executing
+// forward.
+func (r *Rewinder) RewindToCycle(cycle uint64) error {
+	if cycle > r.machine.Cycles() {
+		return fmt.Errorf("Cycle %d hasn't happened yet", cycle)
+	}
+	index := sort.Search(len(r.snapshots), func(i int) bool { return r.snapshots[i].cycles > cycle }) - 1
+	if index < 0 {
+		return fmt.Errorf("Cycle %d is before the rewind history", cycle)
+	}
+	// Frames that started before the target have been captured, so the
+	// next Capture is for the one after them
+	started := sort.Search(len(r.frame_starts), func(i int) bool { return r.frame_starts[i] >= cycle })
+
+	err := r.restore(index)
+	if err != nil {
+		return err
+	}
+	r.frame = r.first_frame + started
+	r.frame_starts = r.frame_starts[:started]
+
+	for r.machine.Cycles() < cycle {
+		running, err := r.machine.Step()
+		if err != nil {
+			return err
+		}
+		if !running {
+			return errors.New("Machine halted before reaching the rewind target")
+		}
+	}
+	return nil
+}
+
+// Rebuild the snapshot at index, load it, and make it the newest.
+func (r *Rewinder) restore(index int) error {
+	data := r.snapshots[len(r.snapshots)-1].data
+	for i := len(r.snapshots) - 2; i >= index; i-- {
+		if r.snapshots[i].whole {
+			data = r.snapshots[i].data
+			continue
+		}
+		var err error
+		data, err = applyDelta(data, r.snapshots[i].data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := r.machine.LoadState(data)
+	if err != nil {
+		return err
+	}
+
+	restored := r.snapshots[index]
+	restored.data = data
+	restored.whole = true
+	r.snapshots = append(r.snapshots[:index], restored)
+	return nil
+}
+
+// Forget frame start cycles from before the oldest snapshot.
+func (r *Rewinder) trimFrameStarts() {
+	drop := r.snapshots[0].frame - r.first_frame
+	r.frame_starts = r.frame_starts[drop:]
+	r.first_frame = r.snapshots[0].frame
+}
@@ -0,0 +1,154 @@
+package rewind
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+)
+
+// Runs forever, touching a little memory on each pass.
+const workload = `
+loop:	INC $10
+	BNE skip
+	INC $11
+skip:	ADC $10
+	ROL $20,X
+	INX
+	JMP loop
+`
+
+// Cycles per pretend frame, about a tenth of a real one to keep tests fast
+const FRAME_CYCLES = 3000
+
+func newCPU(t *testing.T) *core.CPU {
+	program, err := asm.Assemble(workload)
+	assert.Nil(t, err)
+	c := core.NewCPU()
+	c.LoadAndReset(program.Bytes)
+	return c
+}
+
+func runFrame(t *testing.T, c *core.CPU) {
+	end := c.Cycles() + FRAME_CYCLES
+	for c.Cycles() < end {
+		_, err := c.Step()
+		assert.Nil(t, err)
+	}
+}
+
+func state(t *testing.T, c *core.CPU) []byte {
+	data, err := c.SaveState()
+	assert.Nil(t, err)
+	return data
+}
+
+// Run frames, capturing at each boundary, and return the state at the
+// start of every frame.
+func record(t *testing.T, c *core.CPU, r *Rewinder, frames int) [][]byte {
+	var states [][]byte
+	for i := 0; i < frames; i++ {
+		states = append(states, state(t, c))
+		assert.Nil(t, r.Capture())
+		runFrame(t, c)
+	}
+	return states
+}
+
+func TestRewindToSnapshot(t *testing.T) {
+	c := newCPU(t)
+	r := New(c, 1, 100)
+	states := record(t, c, r, 40)
+
+	frame, err := r.RewindToSnapshot(17)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 17, frame)
+	assert.Equal(t, states[17], state(t, c))
+	assert.Equal(t, 17, r.Frame())
+	assert.Equal(t, 18, r.Len())
+
+	// Capturing the restored frame again replaces its snapshot
+	assert.Nil(t, r.Capture())
+	assert.Equal(t, 18, r.Len())
+}
+
+func TestRewindTo_BetweenSnapshots(t *testing.T) {
+	c := newCPU(t)
+	r := New(c, 4, 100)
+	states := record(t, c, r, 30)
+	assert.Equal(t, 8, r.Len())
+
+	frame, err := r.RewindToSnapshot(10)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, frame)
+
+	// Carrying on from a rewind re-executes identically
+	replayed := record(t, c, r, 10)
+	assert.Equal(t, states[8:18], replayed)
+
+	assert.Nil(t, r.RewindTo(13))
+	assert.Equal(t, states[13], state(t, c))
+	assert.Equal(t, 13, r.Frame())
+}
+
+func TestRewindToCycle(t *testing.T) {
+	c := newCPU(t)
+	r := New(c, 2, 100)
+	record(t, c, r, 20)
+	target := uint64(7*FRAME_CYCLES + 123)
+
+	// The same machine run straight to the target
+	expected := newCPU(t)
+	for expected.Cycles() < target {
+		expected.Step()
+	}
+
+	assert.Nil(t, r.RewindToCycle(target))
+	assert.Equal(t, state(t, expected), state(t, c))
+	assert.Equal(t, 8, r.Frame())
+	assert.NotNil(t, r.RewindToCycle(c.Cycles()+1))
+}
+
+func TestCapacity(t *testing.T) {
+	c := newCPU(t)
+	r := New(c, 2, 5)
+	record(t, c, r, 30)
+
+	assert.Equal(t, 5, r.Len())
+	assert.Equal(t, 20, r.OldestFrame())
+	assert.NotNil(t, r.RewindTo(19))
+	_, err := r.RewindToSnapshot(19)
+	assert.NotNil(t, err)
+	assert.Nil(t, r.RewindTo(21))
+}
+
+func TestDeltasAreSmall(t *testing.T) {
+	c := newCPU(t)
+	r := New(c, 1, 100)
+	record(t, c, r, 50)
+
+	whole := len(state(t, c))
+	assert.Less(t, r.Size(), 2*whole)
+}
+
+func TestDelta_RoundTrip(t *testing.T) {
+	base := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	target := []byte{1, 2, 9, 9, 5, 6, 7, 0}
+
+	delta := encodeDelta(base, target)
+	decoded, err := applyDelta(base, delta)
+	assert.Nil(t, err)
+	assert.Equal(t, target, decoded)
+
+	// XOR works in both directions
+	decoded, err = applyDelta(target, delta)
+	assert.Nil(t, err)
+	assert.Equal(t, base, decoded)
+
+	assert.Empty(t, encodeDelta(base, base))
+	_, err = applyDelta(base[:3], delta)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,184 @@
+// Package savestate stores machine state in a versioned, chunked binary
+// format.
+//
+// A state file starts with a header:
+//
+//	magic   4 bytes  "MFNS"
+//	version uint16   FORMAT_VERSION
+//
+// followed by chunks, each of which is:
+//
+//	id       4 bytes   e.g. "CPU ", see Component.StateID
+//	length   uint32
+//	checksum uint32    CRC-32 (IEEE) of the data
+//	data     length bytes
+//
+// and finishes with an empty "END " chunk.  All integers are
+// little-endian.  Chunks nobody asks for are skipped, so states written by
+// newer versions with extra components still load, and each component
+// versions its own data.
+package savestate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	MAGIC                 = "MFNS"
+	FORMAT_VERSION uint16 = 1
+	END_CHUNK             = "END "
+	// Guards against allocating huge buffers for corrupt lengths
+	MAX_CHUNK_SIZE = 16 * 1024 * 1024
+)
+
+var (
+	ErrBadMagic = errors.New("Not a save state")
+	ErrChecksum = errors.New("Save state checksum mismatch")
+)
+
+// Part of the machine that can be saved and restored.
+type Component interface {
+	// Four character chunk ID, unique within a state
+	StateID() string
+	SaveState() ([]byte, error)
+	LoadState(data []byte) error
+}
+
+type chunkHeader struct {
+	ID       [4]byte
+	Length   uint32
+	Checksum uint32
+}
+
+// Write the state of each component.
+func Save(w io.Writer, components ...Component) error {
+	buffered := bufio.NewWriter(w)
+
+	_, err := buffered.WriteString(MAGIC)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(buffered, binary.LittleEndian, FORMAT_VERSION)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, component := range components {
+		id := component.StateID()
+		if len(id) != 4 || id == END_CHUNK {
+			return fmt.Errorf("Invalid state chunk ID %q", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("Duplicate state chunk ID %q", id)
+		}
+		seen[id] = true
+
+		data, err := component.SaveState()
+		if err != nil {
+			return fmt.Errorf("Saving %q: %w", id, err)
+		}
+		err = writeChunk(buffered, id, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeChunk(buffered, END_CHUNK, nil)
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// Restore each component from a state written by Save.  The whole state
+// is read and checked before anything is restored, so a corrupt state
+// leaves the components untouched.
+func Load(r io.Reader, components ...Component) error {
+	chunks, err := readChunks(r)
+	if err != nil {
+		return err
+	}
+
+	for _, component := range components {
+		if _, ok := chunks[component.StateID()]; !ok {
+			return fmt.Errorf("Save state has no %q chunk", component.StateID())
+		}
+	}
+	for _, component := range components {
+		err = component.LoadState(chunks[component.StateID()])
+		if err != nil {
+			return fmt.Errorf("Loading %q: %w", component.StateID(), err)
+		}
+	}
+	return nil
+}
+
+func writeChunk(w io.Writer, id string, data []byte) error {
+	header := chunkHeader{Length: uint32(len(data)), Checksum: crc32.ChecksumIEEE(data)}
+	copy(header.ID[:], id)
+	err := binary.Write(w, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Read every chunk up to the end marker, keyed by ID.
+func readChunks(r io.Reader) (map[string][]byte, error) {
+	buffered := bufio.NewReader(r)
+
+	magic := make([]byte, len(MAGIC))
+	_, err := io.ReadFull(buffered, magic)
+	if err != nil || string(magic) != MAGIC {
+		return nil, ErrBadMagic
+	}
+	var version uint16
+	err = binary.Read(buffered, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if version > FORMAT_VERSION {
+		return nil, fmt.Errorf("Save state format version %d is newer than supported version %d", version, FORMAT_VERSION)
+	}
+
+	chunks := map[string][]byte{}
+	for {
+		var header chunkHeader
+		err = binary.Read(buffered, binary.LittleEndian, &header)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		id := string(header.ID[:])
+		if id == END_CHUNK {
+			return chunks, nil
+		}
+		if header.Length > MAX_CHUNK_SIZE {
+			return nil, fmt.Errorf("Save state chunk %q is too big: %d bytes", id, header.Length)
+		}
+
+		data := make([]byte, header.Length)
+		_, err = io.ReadFull(buffered, data)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if crc32.ChecksumIEEE(data) != header.Checksum {
+			return nil, fmt.Errorf("%w in chunk %q", ErrChecksum, id)
+		}
+		chunks[id] = data
+	}
+}
+
+// A state that stops before the end marker is truncated, not empty.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
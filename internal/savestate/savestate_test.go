@@ -0,0 +1,165 @@
+package savestate
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+)
+
+// Fills the zero page with a running checksum so any divergence shows up
+// in memory as well as registers.
+const workload = `
+	LDY #0
+outer:	LDX #0
+inner:	ADC $00,X
+	EOR #$5A
+	ROL $00,X
+	INC $00,X
+	DEX
+	BNE inner
+	INY
+	CPY #4
+	BNE outer
+	BRK
+`
+
+func newCPU(t *testing.T) *core.CPU {
+	program, err := asm.Assemble(workload)
+	assert.Nil(t, err)
+	c := core.NewCPU()
+	c.LoadAndReset(program.Bytes)
+	return c
+}
+
+func step(t *testing.T, c *core.CPU, count int) {
+	for i := 0; i < count; i++ {
+		running, err := c.Step()
+		assert.Nil(t, err)
+		if !running {
+			return
+		}
+	}
+}
+
+func snapshot(t *testing.T, c *core.CPU) []byte {
+	data, err := c.SaveState()
+	assert.Nil(t, err)
+	return data
+}
+
+func TestRoundTrip_ContinuesIdentically(t *testing.T) {
+	original := newCPU(t)
+	step(t, original, 1000)
+
+	var state bytes.Buffer
+	assert.Nil(t, Save(&state, original))
+
+	// Load into a CPU that's been doing something else entirely
+	restored := newCPU(t)
+	step(t, restored, 37)
+	assert.Nil(t, Load(bytes.NewReader(state.Bytes()), restored))
+	assert.Equal(t, snapshot(t, original), snapshot(t, restored))
+
+	for i := 0; i < 20; i++ {
+		step(t, original, 500)
+		step(t, restored, 500)
+		assert.Equal(t, original.Registers(), restored.Registers())
+		assert.Equal(t, original.Cycles(), restored.Cycles())
+		assert.Equal(t, snapshot(t, original), snapshot(t, restored))
+	}
+	assert.NotZero(t, original.Cycles())
+}
+
+// A component from a newer version that we don't know about.
+type extra struct {
+	id   string
+	data []byte
+}
+
+func (e *extra) StateID() string             { return e.id }
+func (e *extra) SaveState() ([]byte, error)  { return e.data, nil }
+func (e *extra) LoadState(data []byte) error { e.data = data; return nil }
+
+func TestLoad_SkipsUnknownChunks(t *testing.T) {
+	c := newCPU(t)
+	step(t, c, 50)
+	var state bytes.Buffer
+	assert.Nil(t, Save(&state, &extra{"PPU ", []byte{1, 2, 3}}, c, &extra{"APU ", nil}))
+
+	restored := newCPU(t)
+	err := Load(&state, restored)
+
+	assert.Nil(t, err)
+	assert.Equal(t, c.Registers(), restored.Registers())
+}
+
+func TestLoad_MultipleComponents(t *testing.T) {
+	var state bytes.Buffer
+	assert.Nil(t, Save(&state, &extra{"MAPR", []byte{7, 8}}, &extra{"PAD1", []byte{0x80}}))
+
+	mapper := &extra{id: "MAPR"}
+	pad := &extra{id: "PAD1"}
+	assert.Nil(t, Load(&state, pad, mapper))
+
+	assert.Equal(t, []byte{7, 8}, mapper.data)
+	assert.Equal(t, []byte{0x80}, pad.data)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	c := newCPU(t)
+	var state bytes.Buffer
+	assert.Nil(t, Save(&state, c))
+	valid := state.Bytes()
+
+	corrupt := append([]byte{}, valid...)
+	corrupt[len(MAGIC)+2+12+100] ^= 0xff
+
+	newer := append([]byte{}, valid...)
+	newer[len(MAGIC)] = 0xff
+
+	testCases := []struct {
+		name  string
+		data  []byte
+		check func(error) bool
+	}{
+		{"Bad magic", []byte("NES\x1a\x01\x00"), func(err error) bool { return errors.Is(err, ErrBadMagic) }},
+		{"Corrupt data", corrupt, func(err error) bool { return errors.Is(err, ErrChecksum) }},
+		{"Truncated", valid[:len(valid)-4], func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) }},
+		{"Newer format", newer, func(err error) bool { return err != nil }},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			target := newCPU(t)
+			step(t, target, 3)
+			before := snapshot(t, target)
+
+			err := Load(bytes.NewReader(test.data), target)
+
+			assert.True(t, test.check(err), "Unexpected error %v", err)
+			assert.Equal(t, before, snapshot(t, target), "State changed by failed load")
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestLoad_MissingChunk(t *testing.T) {
+	var state bytes.Buffer
+	assert.Nil(t, Save(&state, &extra{"PPU ", nil}))
+
+	err := Load(&state, newCPU(t))
+
+	assert.ErrorContains(t, err, `no "CPU " chunk`)
+}
+
+func TestSave_InvalidIDs(t *testing.T) {
+	assert.NotNil(t, Save(io.Discard, &extra{"CPU", nil}))
+	assert.NotNil(t, Save(io.Discard, &extra{END_CHUNK, nil}))
+	assert.NotNil(t, Save(io.Discard, &extra{"RAM ", nil}, &extra{"RAM ", nil}))
+}
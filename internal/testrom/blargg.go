@@ -0,0 +1,220 @@
+package testrom
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pageer/myfinemu/internal/cartridge"
+	"pageer/myfinemu/internal/console"
+)
+
+// Blargg's test ROMs report their progress through a block of memory
+// starting at $6000.  The layout is:
+//
+//	$6000      status byte
+//	$6001-6003 signature, $DE $B0 $61, written once the block is valid
+//	$6004-     null-terminated text output
+const (
+	STATUS_ADDRESS    uint16 = 0x6000
+	SIGNATURE_ADDRESS uint16 = 0x6001
+	MESSAGE_ADDRESS   uint16 = 0x6004
+	MESSAGE_END       uint16 = 0x7fff
+
+	STATUS_RUNNING         uint8 = 0x80
+	STATUS_RESET_REQUESTED uint8 = 0x81
+
+	// Roughly 100ms of NTSC CPU time, which is the minimum the ROMs ask
+	// us to wait before pressing reset.
+	DEFAULT_RESET_DELAY_CYCLES = 179000
+	DEFAULT_MAX_CYCLES         = 150000000
+)
+
+var SIGNATURE = [3]uint8{0xde, 0xb0, 0x61}
+
+// The parts of a machine the runner needs to drive a test ROM, which
+// *console.Console has.
+type Machine interface {
+	RunCycles(cycles uint64) error
+	ReadMemory(address uint16) uint8
+	Reset()
+}
+
+type Result struct {
+	Name    string
+	Code    uint8
+	Message string
+	Err     error
+}
+
+// A test passes when it finishes with result code 0.
+func (r Result) Passed() bool {
+	return r.Err == nil && r.Code == 0
+}
+
+type BlarggRunner struct {
+	MaxCycles        int
+	ResetDelayCycles int
+	// The console RunFile emulates
+	Region console.Region
+}
+
+func NewBlarggRunner() *BlarggRunner {
+	return &BlarggRunner{
+		MaxCycles:        DEFAULT_MAX_CYCLES,
+		ResetDelayCycles: DEFAULT_RESET_DELAY_CYCLES,
+	}
+}
+
+// Run the machine a cycle at a time until the test ROM reports a final
+// status.
+func (r *BlarggRunner) Run(m Machine) Result {
+	var result Result
+	reset_countdown := -1
+
+	for cycle := 0; cycle < r.MaxCycles; cycle++ {
+		err := m.RunCycles(1)
+		if errors.Is(err, console.ErrHalted) {
+			err = errors.New("CPU halted before test completed")
+		}
+		if err != nil {
+			result.Err = err
+			result.Message = ReadMessage(m)
+			return result
+		}
+
+		if reset_countdown > 0 {
+			reset_countdown--
+			if reset_countdown == 0 {
+				m.Reset()
+				reset_countdown = -1
+			}
+			continue
+		}
+
+		if !HasSignature(m) {
+			continue
+		}
+
+		status := m.ReadMemory(STATUS_ADDRESS)
+		switch {
+		case status == STATUS_RUNNING:
+			continue
+		case status == STATUS_RESET_REQUESTED:
+			reset_countdown = r.ResetDelayCycles
+			if reset_countdown <= 0 {
+				m.Reset()
+				reset_countdown = -1
+			}
+		case status < STATUS_RUNNING:
+			result.Code = status
+			result.Message = ReadMessage(m)
+			return result
+		}
+	}
+
+	result.Err = fmt.Errorf("Test did not complete within %d cycles", r.MaxCycles)
+	result.Message = ReadMessage(m)
+	return result
+}
+
+// Load an iNES test ROM and run it on a fresh console.
+func (r *BlarggRunner) RunFile(path string) Result {
+	result := Result{Name: filepath.Base(path)}
+
+	cart, err := cartridge.Load(path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	c := console.New(r.Region)
+	err = c.LoadCartridge(cart)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	run_result := r.Run(c)
+	run_result.Name = result.Name
+	return run_result
+}
+
+// Run every .nes file in a directory, sorted by name.
+func (r *BlarggRunner) RunDirectory(dir string) ([]Result, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".nes") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	results := make([]Result, 0, len(names))
+	for _, name := range names {
+		results = append(results, r.RunFile(filepath.Join(dir, name)))
+	}
+	return results, nil
+}
+
+func HasSignature(m Machine) bool {
+	for i, value := range SIGNATURE {
+		if m.ReadMemory(SIGNATURE_ADDRESS+uint16(i)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Read the null-terminated text the ROM has written so far.
+func ReadMessage(m Machine) string {
+	if !HasSignature(m) {
+		return ""
+	}
+
+	var builder strings.Builder
+	for address := MESSAGE_ADDRESS; address <= MESSAGE_END; address++ {
+		value := m.ReadMemory(address)
+		if value == 0 {
+			break
+		}
+		builder.WriteByte(value)
+	}
+	return builder.String()
+}
+
+// Print one line per test plus a summary count.
+func WriteMatrix(w io.Writer, results []Result) {
+	passed := 0
+	for _, result := range results {
+		outcome := "FAIL"
+		if result.Passed() {
+			outcome = "PASS"
+			passed++
+		}
+
+		detail := firstLine(result.Message)
+		if result.Err != nil {
+			detail = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%-4s  %3d  %-40s  %s\n", outcome, result.Code, result.Name, detail)
+	}
+	fmt.Fprintf(w, "%d/%d passed\n", passed, len(results))
+}
+
+func firstLine(message string) string {
+	message = strings.TrimSpace(message)
+	if index := strings.IndexByte(message, '\n'); index >= 0 {
+		return message[:index]
+	}
+	return message
+}
@@ -0,0 +1,163 @@
+package testrom
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/console"
+)
+
+// A machine that applies a scripted set of memory writes, one batch per
+// cycle.
+type fakeMachine struct {
+	memory  [0x10000]uint8
+	script  []map[uint16]uint8
+	cycles  int
+	resets  int
+	halt_at int
+	err     error
+}
+
+func (m *fakeMachine) RunCycles(cycles uint64) error {
+	for i := uint64(0); i < cycles; i++ {
+		if m.err != nil {
+			return m.err
+		}
+		if m.halt_at > 0 && m.cycles == m.halt_at {
+			return console.ErrHalted
+		}
+		if m.cycles < len(m.script) {
+			for address, value := range m.script[m.cycles] {
+				m.memory[address] = value
+			}
+		}
+		m.cycles++
+	}
+	return nil
+}
+
+func (m *fakeMachine) ReadMemory(address uint16) uint8 {
+	return m.memory[address]
+}
+
+func (m *fakeMachine) Reset() {
+	m.resets++
+}
+
+func signatureWrite(status uint8) map[uint16]uint8 {
+	return map[uint16]uint8{
+		STATUS_ADDRESS:        status,
+		SIGNATURE_ADDRESS:     0xde,
+		SIGNATURE_ADDRESS + 1: 0xb0,
+		SIGNATURE_ADDRESS + 2: 0x61,
+	}
+}
+
+func messageWrite(message string) map[uint16]uint8 {
+	writes := map[uint16]uint8{}
+	for i := 0; i < len(message); i++ {
+		writes[MESSAGE_ADDRESS+uint16(i)] = message[i]
+	}
+	writes[MESSAGE_ADDRESS+uint16(len(message))] = 0
+	return writes
+}
+
+func TestRun_Passed(t *testing.T) {
+	m := &fakeMachine{script: []map[uint16]uint8{
+		{},
+		signatureWrite(STATUS_RUNNING),
+		messageWrite("01-basics\n\nPassed\n"),
+		{STATUS_ADDRESS: 0x00},
+	}}
+
+	result := NewBlarggRunner().Run(m)
+
+	assert.Nil(t, result.Err)
+	assert.True(t, result.Passed())
+	assert.Equal(t, uint8(0), result.Code)
+	assert.Equal(t, "01-basics\n\nPassed\n", result.Message)
+	assert.Equal(t, 4, m.cycles)
+}
+
+func TestRun_Failed(t *testing.T) {
+	m := &fakeMachine{script: []map[uint16]uint8{
+		signatureWrite(STATUS_RUNNING),
+		messageWrite("Failed #3"),
+		{STATUS_ADDRESS: 0x03},
+	}}
+
+	result := NewBlarggRunner().Run(m)
+
+	assert.Nil(t, result.Err)
+	assert.False(t, result.Passed())
+	assert.Equal(t, uint8(3), result.Code)
+	assert.Equal(t, "Failed #3", result.Message)
+}
+
+func TestRun_ResetRequested(t *testing.T) {
+	m := &fakeMachine{script: []map[uint16]uint8{
+		signatureWrite(STATUS_RESET_REQUESTED),
+		{}, {}, {},
+		{STATUS_ADDRESS: STATUS_RUNNING},
+		{STATUS_ADDRESS: 0x00},
+	}}
+	runner := NewBlarggRunner()
+	runner.ResetDelayCycles = 3
+
+	result := runner.Run(m)
+
+	assert.True(t, result.Passed())
+	assert.Equal(t, 1, m.resets)
+}
+
+func TestRun_IgnoresStatusWithoutSignature(t *testing.T) {
+	m := &fakeMachine{script: []map[uint16]uint8{
+		{STATUS_ADDRESS: 0x00},
+	}}
+	runner := NewBlarggRunner()
+	runner.MaxCycles = 10
+
+	result := runner.Run(m)
+
+	assert.NotNil(t, result.Err)
+	assert.False(t, result.Passed())
+	assert.Equal(t, 10, m.cycles)
+}
+
+func TestRun_Halted(t *testing.T) {
+	m := &fakeMachine{halt_at: 2}
+
+	result := NewBlarggRunner().Run(m)
+
+	assert.EqualError(t, result.Err, "CPU halted before test completed")
+	assert.False(t, result.Passed())
+}
+
+func TestRun_StepError(t *testing.T) {
+	m := &fakeMachine{err: errors.New("Unimplemented opcode")}
+
+	result := NewBlarggRunner().Run(m)
+
+	assert.Equal(t, m.err, result.Err)
+}
+
+func TestWriteMatrix(t *testing.T) {
+	var out bytes.Buffer
+	results := []Result{
+		{Name: "01-basics.nes", Message: "01-basics\n\nPassed\n"},
+		{Name: "02-implied.nes", Code: 2, Message: "Failed #2\n"},
+		{Name: "03-immediate.nes", Err: errors.New("Unimplemented opcode")},
+	}
+
+	WriteMatrix(&out, results)
+
+	expected := "" +
+		"PASS    0  01-basics.nes                             01-basics\n" +
+		"FAIL    2  02-implied.nes                            Failed #2\n" +
+		"FAIL    0  03-immediate.nes                          Unimplemented opcode\n" +
+		"1/3 passed\n"
+	assert.Equal(t, expected, out.String())
+}
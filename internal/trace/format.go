@@ -0,0 +1,219 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"pageer/myfinemu/internal/core"
+)
+
+type Format int
+
+const (
+	// The layout of nestest.log, as written by Nintendulator
+	FormatNintendulator Format = iota
+	FormatFCEUX
+	FormatMesen
+	// One JSON object per line
+	FormatJSON
+)
+
+// PPU dots per CPU cycle and per scanline on NTSC, for showing a PPU
+// position in formats that expect one.  Until there's a PPU this is
+// derived from the cycle count, which matches nestest.log.
+const (
+	PPU_DOTS_PER_CYCLE  = 3
+	PPU_DOTS_PER_LINE   = 341
+	PPU_LINES_PER_FRAME = 262
+)
+
+// Widths of the instruction text column
+const (
+	NINTENDULATOR_TEXT_WIDTH = 32
+	TEXT_WIDTH               = 28
+)
+
+const (
+	FORMAT_NAMES        = "nintendulator, fceux, mesen, json"
+	STATUS_FLAG_LETTERS = "NVUBDIZC"
+	// Shown before undocumented instructions and bytes that aren't in the
+	// opcode table, as nestest.log does
+	UNKNOWN_OPCODE_MARKER = "*"
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "nintendulator", "nestest":
+		return FormatNintendulator, nil
+	case "fceux":
+		return FormatFCEUX, nil
+	case "mesen":
+		return FormatMesen, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("Unknown trace format %q, expected one of %s", name, FORMAT_NAMES)
+}
+
+// Everything known about an instruction when it's traced.
+type record struct {
+	Disassembly core.Disassembly
+	Registers   core.Registers
+	Cycles      uint64
+	Frame       int
+	memory      core.MemoryReader
+	variant     core.Variant
+}
+
+func (f Format) format(line record) string {
+	switch f {
+	case FormatFCEUX:
+		return formatFCEUX(line)
+	case FormatMesen:
+		return formatMesen(line)
+	case FormatJSON:
+		return formatJSON(line)
+	}
+	return formatNintendulator(line)
+}
+
+// e.g. "C000  4C F5 C5  JMP $C5F5    ...    A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"
+func formatNintendulator(line record) string {
+	r := line.Registers
+	marker := " "
+	if !line.Disassembly.Known || line.Disassembly.Instruction.IsIllegal() {
+		marker = UNKNOWN_OPCODE_MARKER
+	}
+	text := line.Disassembly.Text()
+	if annotation := annotate(line); annotation != "" {
+		text += " " + annotation
+	}
+	dots := line.Cycles * PPU_DOTS_PER_CYCLE
+	scanline := dots / PPU_DOTS_PER_LINE % PPU_LINES_PER_FRAME
+	dot := dots % PPU_DOTS_PER_LINE
+	return fmt.Sprintf("%04X  %-8s %s%-*sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		line.Disassembly.Address, hexBytes(line.Disassembly.Bytes), marker, NINTENDULATOR_TEXT_WIDTH, text,
+		r.A, r.X, r.Y, r.Status, r.SP, scanline, dot, line.Cycles)
+}
+
+// e.g. "$C000:4C F5 C5  JMP $C5F5    ...    A:00 X:00 Y:00 S:FD P:nvUbdIzc"
+func formatFCEUX(line record) string {
+	r := line.Registers
+	return fmt.Sprintf("$%04X:%-9s %-*s A:%02X X:%02X Y:%02X S:%02X P:%s",
+		line.Disassembly.Address, hexBytes(line.Disassembly.Bytes), TEXT_WIDTH, line.Disassembly.Text(),
+		r.A, r.X, r.Y, r.SP, flagLetters(r.Status))
+}
+
+// e.g. "C000  JMP $C5F5    ...    A:00 X:00 Y:00 S:FD P:nvUbdIzc Fr:0 Cycle:7"
+func formatMesen(line record) string {
+	r := line.Registers
+	return fmt.Sprintf("%04X  %-*s A:%02X X:%02X Y:%02X S:%02X P:%s Fr:%d Cycle:%d",
+		line.Disassembly.Address, TEXT_WIDTH, line.Disassembly.Text(),
+		r.A, r.X, r.Y, r.SP, flagLetters(r.Status), line.Frame, line.Cycles)
+}
+
+type jsonLine struct {
+	PC          uint16 `json:"pc"`
+	Bytes       string `json:"bytes"`
+	Instruction string `json:"instruction"`
+	A           uint8  `json:"a"`
+	X           uint8  `json:"x"`
+	Y           uint8  `json:"y"`
+	SP          uint8  `json:"sp"`
+	P           uint8  `json:"p"`
+	Cycles      uint64 `json:"cycles"`
+	Frame       int    `json:"frame"`
+}
+
+func formatJSON(line record) string {
+	r := line.Registers
+	data, _ := json.Marshal(jsonLine{
+		PC:          line.Disassembly.Address,
+		Bytes:       hexBytes(line.Disassembly.Bytes),
+		Instruction: line.Disassembly.Text(),
+		A:           r.A,
+		X:           r.X,
+		Y:           r.Y,
+		SP:          r.SP,
+		P:           r.Status,
+		Cycles:      line.Cycles,
+		Frame:       line.Frame,
+	})
+	return string(data)
+}
+
+// Show the memory an instruction is about to use, the way nestest.log
+// does, e.g. "@ 0300 = 89" for indexed modes.
+func annotate(line record) string {
+	d := line.Disassembly
+	if !d.Known || len(d.Bytes) < 2 {
+		return ""
+	}
+	r := line.Registers
+	mem := line.memory
+	operand := uint16(d.Bytes[1])
+	if len(d.Bytes) > 2 {
+		operand |= uint16(d.Bytes[2]) << 8
+	}
+	// Pointers wrap within the zero page
+	read16 := func(address uint8) uint16 {
+		return uint16(mem.ReadMemory(uint16(address))) | uint16(mem.ReadMemory(uint16(address+1)))<<8
+	}
+
+	switch d.Instruction.Mode() {
+	case core.AddrZeroPage:
+		return fmt.Sprintf("= %02X", mem.ReadMemory(operand))
+	case core.AddrZeroPageX:
+		address := uint16(uint8(operand) + r.X)
+		return fmt.Sprintf("@ %02X = %02X", address, mem.ReadMemory(address))
+	case core.AddrZeroPageY:
+		address := uint16(uint8(operand) + r.Y)
+		return fmt.Sprintf("@ %02X = %02X", address, mem.ReadMemory(address))
+	case core.AddrAbsolute:
+		if d.Instruction.Name() == "JMP" || d.Instruction.Name() == "JSR" {
+			return ""
+		}
+		return fmt.Sprintf("= %02X", mem.ReadMemory(operand))
+	case core.AddrAbsoluteX:
+		address := operand + uint16(r.X)
+		return fmt.Sprintf("@ %04X = %02X", address, mem.ReadMemory(address))
+	case core.AddrAbsoluteY:
+		address := operand + uint16(r.Y)
+		return fmt.Sprintf("@ %04X = %02X", address, mem.ReadMemory(address))
+	case core.AddrIndirectX:
+		pointer := uint8(operand) + r.X
+		address := read16(pointer)
+		return fmt.Sprintf("@ %02X = %04X = %02X", pointer, address, mem.ReadMemory(address))
+	case core.AddrIndirectY:
+		base := read16(uint8(operand))
+		address := base + uint16(r.Y)
+		return fmt.Sprintf("= %04X @ %04X = %02X", base, address, mem.ReadMemory(address))
+	case core.AddrIndirect:
+		target := uint16(mem.ReadMemory(operand)) | uint16(mem.ReadMemory(line.variant.IndirectJumpHigh(operand)))<<8
+		return fmt.Sprintf("= %04X", target)
+	case core.AddrZeroPageIndirect:
+		address := read16(uint8(operand))
+		return fmt.Sprintf("= %04X = %02X", address, mem.ReadMemory(address))
+	}
+	return ""
+}
+
+func hexBytes(values []uint8) string {
+	text := make([]string, len(values))
+	for i, value := range values {
+		text[i] = fmt.Sprintf("%02X", value)
+	}
+	return strings.Join(text, " ")
+}
+
+// Status flags as letters, upper case when set, e.g. "nvUbdIzc".
+func flagLetters(status uint8) string {
+	letters := []byte(STATUS_FLAG_LETTERS)
+	for i := range letters {
+		if status&(0x80>>i) == 0 {
+			letters[i] += 'a' - 'A'
+		}
+	}
+	return string(letters)
+}
@@ -0,0 +1,205 @@
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"pageer/myfinemu/internal/core"
+	"pageer/myfinemu/internal/debugger"
+)
+
+type TriggerKind int
+
+const (
+	// Fires straight away, for starting, or never, for stopping
+	TriggerNone TriggerKind = iota
+	TriggerPC
+	TriggerFrame
+	TriggerCycle
+)
+
+// A condition for starting or stopping the trace.
+type Trigger struct {
+	Kind  TriggerKind
+	Value uint64
+}
+
+// Parse "pc=$C000", "frame=10" or "cycle=100000".
+func ParseTrigger(text string) (Trigger, error) {
+	if text == "" {
+		return Trigger{}, nil
+	}
+	name, value_text, ok := strings.Cut(text, "=")
+	if !ok {
+		return Trigger{}, fmt.Errorf("Invalid trigger %q, expected e.g. pc=$C000", text)
+	}
+	value, err := debugger.ParseNumber(strings.TrimSpace(value_text))
+	if err != nil || value < 0 {
+		return Trigger{}, fmt.Errorf("Invalid trigger value %q", value_text)
+	}
+
+	trigger := Trigger{Value: uint64(value)}
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "pc":
+		trigger.Kind = TriggerPC
+	case "frame":
+		trigger.Kind = TriggerFrame
+	case "cycle", "cycles":
+		trigger.Kind = TriggerCycle
+	default:
+		return Trigger{}, fmt.Errorf("Unknown trigger %q", name)
+	}
+	return trigger, nil
+}
+
+func (t Trigger) fired(pc uint16, frame int, cycles uint64) bool {
+	switch t.Kind {
+	case TriggerPC:
+		return uint64(pc) == t.Value
+	case TriggerFrame:
+		return uint64(frame) >= t.Value
+	case TriggerCycle:
+		return cycles >= t.Value
+	}
+	return false
+}
+
+// An inclusive address range.
+type Range struct {
+	Start uint16
+	End   uint16
+}
+
+// Parse "$8000-$8FFF", or a single address.
+func ParseRange(text string) (Range, error) {
+	start_text, end_text, found := strings.Cut(text, "-")
+	start, err := debugger.ParseNumber(strings.TrimSpace(start_text))
+	if err != nil {
+		return Range{}, err
+	}
+	end := start
+	if found {
+		end, err = debugger.ParseNumber(strings.TrimSpace(end_text))
+		if err != nil {
+			return Range{}, err
+		}
+	}
+	if start < 0 || end > 0xffff || end < start {
+		return Range{}, fmt.Errorf("Invalid address range %q", text)
+	}
+	return Range{uint16(start), uint16(end)}, nil
+}
+
+type Options struct {
+	Format Format
+	// Only trace instructions within these ranges, or anywhere if empty
+	Ranges []Range
+	// Only trace these mnemonics, e.g. "JSR", or all if empty
+	Mnemonics []string
+	// When to start tracing.  The default starts immediately.
+	Start Trigger
+	// When to stop for good.  The default never stops.
+	Stop Trigger
+}
+
+// Writes a line per executed instruction, streaming to a writer rather
+// than keeping the trace in memory.
+type Tracer struct {
+	out       *bufio.Writer
+	options   Options
+	mnemonics map[string]bool
+	frame     int
+	started   bool
+	stopped   bool
+	err       error
+}
+
+func New(w io.Writer, options Options) *Tracer {
+	t := &Tracer{out: bufio.NewWriter(w), options: options}
+	if len(options.Mnemonics) > 0 {
+		t.mnemonics = map[string]bool{}
+		for _, name := range options.Mnemonics {
+			t.mnemonics[strings.ToUpper(name)] = true
+		}
+	}
+	return t
+}
+
+// Trace every instruction the CPU executes from now on.
+func (t *Tracer) Attach(c *core.CPU) {
+	c.SetInstructionHook(t.Trace)
+}
+
+// Tell the tracer which frame is running, for frame triggers and formats
+// that show it.
+func (t *Tracer) SetFrame(frame int) {
+	t.frame = frame
+}
+
+// Whether instructions are currently being written.
+func (t *Tracer) Active() bool {
+	return t.started && !t.stopped
+}
+
+// The first error writing the trace, if any.  Once writing fails, the
+// tracer stops.
+func (t *Tracer) Err() error {
+	return t.err
+}
+
+func (t *Tracer) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.out.Flush()
+}
+
+// Log the instruction the CPU is about to execute, if it passes the
+// triggers and filters.  Used as the CPU's instruction hook.
+func (t *Tracer) Trace(c *core.CPU) {
+	if t.stopped {
+		return
+	}
+	registers := c.Registers()
+	cycles := c.Cycles()
+	if !t.started {
+		if t.options.Start.Kind != TriggerNone && !t.options.Start.fired(registers.PC, t.frame, cycles) {
+			return
+		}
+		t.started = true
+	}
+	if t.options.Stop.fired(registers.PC, t.frame, cycles) {
+		t.stopped = true
+		t.Flush()
+		return
+	}
+	if !t.inRange(registers.PC) {
+		return
+	}
+
+	d := c.Disassemble(registers.PC)
+	if t.mnemonics != nil && !(d.Known && t.mnemonics[d.Instruction.Name()]) {
+		return
+	}
+
+	line := record{Disassembly: d, Registers: registers, Cycles: cycles, Frame: t.frame, memory: c, variant: c.Variant()}
+	_, err := t.out.WriteString(t.options.Format.format(line) + "\n")
+	if err != nil {
+		t.err = err
+		t.stopped = true
+	}
+}
+
+func (t *Tracer) inRange(pc uint16) bool {
+	if len(t.options.Ranges) == 0 {
+		return true
+	}
+	for _, r := range t.options.Ranges {
+		if pc >= r.Start && pc <= r.End {
+			return true
+		}
+	}
+	return false
+}
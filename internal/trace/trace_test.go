@@ -0,0 +1,185 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"pageer/myfinemu/internal/asm"
+	"pageer/myfinemu/internal/core"
+)
+
+const program = `
+	LDX #$02
+	LDA $10,X
+	INC $0300
+	JSR sub
+	BRK
+sub:	NOP
+	BRK
+`
+
+func run(t *testing.T, options Options) []string {
+	assembled, err := asm.Assemble(program)
+	assert.Nil(t, err)
+	c := core.NewCPU()
+	c.LoadAndReset(assembled.Bytes)
+	c.WriteMemory(0x0012, 0x55)
+
+	var out bytes.Buffer
+	tracer := New(&out, options)
+	tracer.Attach(c)
+	assert.Nil(t, c.Run())
+	assert.Nil(t, tracer.Flush())
+
+	if out.Len() == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+}
+
+func TestFormat_Nintendulator(t *testing.T) {
+	lines := run(t, Options{})
+
+	assert.Equal(t, []string{
+		"8000  A2 02     LDX #$02                        A:00 X:00 Y:00 P:04 SP:FD PPU:  0,  0 CYC:0",
+		"8002  B5 10     LDA $10,X @ 12 = 55             A:00 X:02 Y:00 P:04 SP:FD PPU:  0,  6 CYC:2",
+		"8004  EE 00 03  INC $0300 = 00                  A:55 X:02 Y:00 P:04 SP:FD PPU:  0, 18 CYC:6",
+		"8007  20 0B 80  JSR $800B                       A:55 X:02 Y:00 P:04 SP:FD PPU:  0, 36 CYC:12",
+		"800B  EA        NOP                             A:55 X:02 Y:00 P:04 SP:FB PPU:  0, 54 CYC:18",
+		"800C  00        BRK                             A:55 X:02 Y:00 P:04 SP:FB PPU:  0, 60 CYC:20",
+	}, lines)
+}
+
+func TestFormat_Others(t *testing.T) {
+	fceux := run(t, Options{Format: FormatFCEUX})
+	assert.Equal(t, "$8002:B5 10     LDA $10,X                    A:00 X:02 Y:00 S:FD P:nvubdIzc", fceux[1])
+
+	mesen := run(t, Options{Format: FormatMesen})
+	assert.Equal(t, "8004  INC $0300                    A:55 X:02 Y:00 S:FD P:nvubdIzc Fr:0 Cycle:6", mesen[2])
+
+	lines := run(t, Options{Format: FormatJSON})
+	assert.Len(t, lines, 6)
+	var decoded jsonLine
+	assert.Nil(t, json.Unmarshal([]byte(lines[3]), &decoded))
+	assert.Equal(t, jsonLine{
+		PC: 0x8007, Bytes: "20 0B 80", Instruction: "JSR $800B", A: 0x55, X: 2, SP: 0xfd, P: 0x04, Cycles: 12,
+	}, decoded)
+}
+
+func TestAnnotate_PointerWrap(t *testing.T) {
+	testCases := []struct {
+		name     string
+		variant  core.Variant
+		program  []uint8
+		expected string
+	}{
+		{"Indirect X", core.VariantNES, []uint8{0xa1, 0xff}, "@ FF = 0300 = 42"},
+		{"Indirect Y", core.VariantNES, []uint8{0xb1, 0xff}, "= 0300 @ 0300 = 42"},
+		{"JMP indirect", core.VariantNES, []uint8{0x6c, 0xff, 0x04}, "= 1234"},
+		{"65C02 JMP indirect", core.Variant65C02, []uint8{0x6c, 0xff, 0x04}, "= 5634"},
+	}
+
+	for _, test := range testCases {
+		callback := func(t *testing.T) {
+			c := core.NewCPUVariant(test.variant)
+			c.LoadAndReset(test.program)
+			// A zero-page pointer to $0300 at $FF
+			c.WriteMemory(0x00ff, 0x00)
+			c.WriteMemory(0x0000, 0x03)
+			c.WriteMemory(0x0300, 0x42)
+			// A jump vector at $04FF, with the high byte at $0400 or $0500
+			c.WriteMemory(0x04ff, 0x34)
+			c.WriteMemory(0x0400, 0x12)
+			c.WriteMemory(0x0500, 0x56)
+
+			line := record{
+				Disassembly: c.Disassemble(core.ROM_SEGMENT_START),
+				Registers:   c.Registers(),
+				memory:      c,
+				variant:     c.Variant(),
+			}
+
+			assert.Equal(t, test.expected, annotate(line))
+		}
+		t.Run(test.name, callback)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		expected []uint16
+	}{
+		{"all", Options{}, []uint16{0x8000, 0x8002, 0x8004, 0x8007, 0x800b, 0x800c}},
+		{"range", Options{Ranges: []Range{{0x8002, 0x8004}, {0x800c, 0x800c}}}, []uint16{0x8002, 0x8004, 0x800c}},
+		{"mnemonics", Options{Mnemonics: []string{"jsr", "NOP"}}, []uint16{0x8007, 0x800b}},
+		{"start at pc", Options{Start: Trigger{TriggerPC, 0x8007}}, []uint16{0x8007, 0x800b, 0x800c}},
+		{"stop at pc", Options{Stop: Trigger{TriggerPC, 0x8007}}, []uint16{0x8000, 0x8002, 0x8004}},
+		{"cycles", Options{Start: Trigger{TriggerCycle, 2}, Stop: Trigger{TriggerCycle, 18}}, []uint16{0x8002, 0x8004, 0x8007}},
+		{"start never fires", Options{Start: Trigger{TriggerPC, 0x9000}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var addresses []uint16
+			test.options.Format = FormatJSON
+			for _, line := range run(t, test.options) {
+				var decoded jsonLine
+				assert.Nil(t, json.Unmarshal([]byte(line), &decoded))
+				addresses = append(addresses, decoded.PC)
+			}
+			assert.Equal(t, test.expected, addresses)
+		})
+	}
+}
+
+func TestParseTrigger(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Trigger
+		valid    bool
+	}{
+		{"", Trigger{}, true},
+		{"pc=$C000", Trigger{TriggerPC, 0xc000}, true},
+		{"frame=10", Trigger{TriggerFrame, 10}, true},
+		{"cycle=100000", Trigger{TriggerCycle, 100000}, true},
+		{"pc", Trigger{}, false},
+		{"line=3", Trigger{}, false},
+		{"pc=zz", Trigger{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			trigger, err := ParseTrigger(test.text)
+			assert.Equal(t, test.valid, err == nil)
+			assert.Equal(t, test.expected, trigger)
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Range
+		valid    bool
+	}{
+		{"$8000-$8FFF", Range{0x8000, 0x8fff}, true},
+		{"$C000", Range{0xc000, 0xc000}, true},
+		{"$9000-$8000", Range{}, false},
+		{"$8000-$10000", Range{}, false},
+		{"nowhere", Range{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			r, err := ParseRange(test.text)
+			assert.Equal(t, test.valid, err == nil)
+			assert.Equal(t, test.expected, r)
+		})
+	}
+}